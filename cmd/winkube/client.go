@@ -0,0 +1,333 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/winkube/service"
+	"github.com/winkube/webapp"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client for the monitor API and the cluster API of a WinKube instance.
+type client struct {
+	// e.g. http://localhost:8080
+	monitorUrl string
+	// e.g. https://localhost:9999
+	clusterUrl string
+	// the join token (<id>.<secret>) used to sign the cluster API calls
+	joinToken string
+	// the files containing the cluster CA and the client certificate used for the cluster API
+	tlsFiles tlsFiles
+	// the user account used for the monitor API
+	credentials credentials
+	http        *http.Client
+}
+
+type credentials struct {
+	user     string
+	password string
+}
+
+type tlsFiles struct {
+	ca   string
+	cert string
+	key  string
+}
+
+func createClient(host string, port int, clusterPort int, joinToken string, files tlsFiles, login credentials) *client {
+	return &client{
+		monitorUrl:  fmt.Sprintf("http://%v:%v", host, port),
+		clusterUrl:  fmt.Sprintf("https://%v:%v", host, clusterPort),
+		joinToken:   joinToken,
+		tlsFiles:    files,
+		credentials: login,
+		http:        &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// Authenticates a monitor API request with the user account, if configured.
+func (this *client) authenticate(req *http.Request) {
+	if this.credentials.user != "" {
+		req.SetBasicAuth(this.credentials.user, this.credentials.password)
+	}
+}
+
+// Calls the monitor API, the response is unmarshalled into result, if not nil.
+func (this *client) api(method string, path string, body io.Reader, result interface{}) error {
+	req, err := http.NewRequest(method, this.monitorUrl+service.API_ROOT+path, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	this.authenticate(req)
+	return this.do(req, result)
+}
+
+// Calls the cluster API, the request is signed with the join token.
+func (this *client) cluster(method string, path string, result interface{}) error {
+	if this.joinToken == "" {
+		return errors.New("A join token is required to call the cluster API, see -token.")
+	}
+	req, err := http.NewRequest(method, this.clusterUrl+path, nil)
+	if err != nil {
+		return err
+	}
+	err = service.SignRequest(req, this.joinToken)
+	if err != nil {
+		return err
+	}
+	clusterHttp, err := this.clusterHttp()
+	if err != nil {
+		return err
+	}
+	resp, err := clusterHttp.Do(req)
+	return this.read(resp, err, result)
+}
+
+// Creates the client for the cluster API, which trusts the cluster CA and authenticates with the
+// host certificate.
+func (this *client) clusterHttp() (*http.Client, error) {
+	caPEM, err := ioutil.ReadFile(this.tlsFiles.ca)
+	if err != nil {
+		return nil, errors.New("Cannot read the cluster CA, see -ca: " + err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("No certificate found in " + this.tlsFiles.ca)
+	}
+	cert, err := tls.LoadX509KeyPair(this.tlsFiles.cert, this.tlsFiles.key)
+	if err != nil {
+		return nil, errors.New("Cannot read the client certificate, see -cert and -key: " + err.Error())
+	}
+	return &http.Client{
+		Timeout: this.http.Timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				RootCAs:      pool,
+				Certificates: []tls.Certificate{cert},
+			},
+		},
+	}, nil
+}
+
+func (this *client) do(req *http.Request, result interface{}) error {
+	resp, err := this.http.Do(req)
+	return this.read(resp, err, result)
+}
+
+func (this *client) read(resp *http.Response, err error, result interface{}) error {
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		apiError := service.ApiError{}
+		if json.Unmarshal(data, &apiError) == nil && apiError.Error != "" {
+			return errors.New(apiError.Error)
+		}
+		problem := webapp.Problem{}
+		if json.Unmarshal(data, &problem) == nil && problem.Status != 0 {
+			return fmt.Errorf("%v (correlation id %v)", problem.Error(), problem.CorrelationId)
+		}
+		return fmt.Errorf("%v: %v", resp.Status, strings.TrimSpace(string(data)))
+	}
+	if result == nil {
+		return nil
+	}
+	if text, ok := result.(*string); ok {
+		*text = string(data)
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
+
+func (this *client) status() (service.ApiStatus, error) {
+	status := service.ApiStatus{}
+	return status, this.api(http.MethodGet, "/status", nil, &status)
+}
+
+func (this *client) info() (service.Info, error) {
+	info := service.Info{}
+	return info, this.api(http.MethodGet, "/info", nil, &info)
+}
+
+func (this *client) startNodes() (service.ApiAction, error) {
+	action := service.ApiAction{}
+	return action, this.api(http.MethodPost, "/nodes/start", nil, &action)
+}
+
+func (this *client) stopNodes() (service.ApiAction, error) {
+	action := service.ApiAction{}
+	return action, this.api(http.MethodPost, "/nodes/stop", nil, &action)
+}
+
+func (this *client) enterSetup() (service.ApiStatus, error) {
+	status := service.ApiStatus{}
+	return status, this.api(http.MethodPost, "/setup", nil, &status)
+}
+
+func (this *client) installConfig(config []byte) (service.ApiAction, error) {
+	action := service.ApiAction{}
+	return action, this.api(http.MethodPut, "/config", bytes.NewReader(config), &action)
+}
+
+func (this *client) runningActions() ([]service.ApiAction, error) {
+	var actions []service.ApiAction
+	return actions, this.api(http.MethodGet, "/actions", nil, &actions)
+}
+
+func (this *client) completedActions(query url.Values) (service.ApiActionPage, error) {
+	page := service.ApiActionPage{}
+	return page, this.api(http.MethodGet, "/actions/completed?"+query.Encode(), nil, &page)
+}
+
+func (this *client) action(id string) (service.ApiAction, error) {
+	action := service.ApiAction{}
+	return action, this.api(http.MethodGet, "/action?id="+url.QueryEscape(id), nil, &action)
+}
+
+func (this *client) cancelAction(id string) (service.ApiAction, error) {
+	action := service.ApiAction{}
+	return action, this.api(http.MethodPost, "/action/cancel?id="+url.QueryEscape(id), nil, &action)
+}
+
+// Follows the log of an action, writing it to out. Returns the final status of the action.
+func (this *client) tail(id string, out io.Writer) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, this.monitorUrl+"/actions/"+url.PathEscape(id)+"/stream", nil)
+	if err != nil {
+		return "", err
+	}
+	this.authenticate(req)
+	// the stream stays open as long as the action runs
+	resp, err := (&http.Client{}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("%v: %v", resp.Status, strings.TrimSpace(string(data)))
+	}
+	event := ""
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: ") && event == "complete":
+			return strings.TrimPrefix(line, "data: "), nil
+		case strings.HasPrefix(line, "data: "):
+			fmt.Fprintln(out, strings.TrimPrefix(line, "data: "))
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return "", err
+	}
+	// the action was already completed, so no complete event was sent
+	action, err := this.action(id)
+	return action.Status, err
+}
+
+// Returns the masters and workers known by the cluster controller.
+func (this *client) clusterNodes() (masters map[string]service.Node, workers map[string]service.Node, err error) {
+	err = this.cluster(http.MethodGet, "/cluster/masters", &masters)
+	if err == nil {
+		err = this.cluster(http.MethodGet, "/cluster/workers", &workers)
+	}
+	return masters, workers, err
+}
+
+// Returns the lease of the controller leading the cluster.
+func (this *client) clusterLease() (lease service.ControllerLease, err error) {
+	return lease, this.cluster(http.MethodGet, "/cluster/lease", &lease)
+}
+
+// Executes an operation on the local master or worker node of the instance. Operations are posted,
+// since some of them change the cluster.
+func (this *client) exec(nodeType string, operation string, params map[string]string) (result service.ExecResult, err error) {
+	query := url.Values{}
+	for name, value := range params {
+		query.Set(name, value)
+	}
+	query.Set(service.NODE_OPERATION_PARAM, operation)
+	return result, this.cluster(http.MethodPost, "/"+nodeType+"/exec?"+query.Encode(), &result)
+}
+
+// Returns the operations available for the node type given.
+func (this *client) nodeOperations(nodeType string) (operations []service.NodeOperation, err error) {
+	return operations, this.cluster(http.MethodGet, "/"+nodeType+"/operations", &operations)
+}
+
+func (this *client) tokens() ([]service.JoinToken, error) {
+	var tokens []service.JoinToken
+	return tokens, this.api(http.MethodGet, "/tokens", nil, &tokens)
+}
+
+func (this *client) issueToken(node string, ttl string, candidate bool) (service.ApiJoinToken, error) {
+	body, err := json.Marshal(map[string]interface{}{"node": node, "ttl": ttl, "candidate": candidate})
+	if err != nil {
+		return service.ApiJoinToken{}, err
+	}
+	token := service.ApiJoinToken{}
+	return token, this.api(http.MethodPost, "/tokens", bytes.NewReader(body), &token)
+}
+
+func (this *client) revokeToken(id string) error {
+	return this.api(http.MethodPost, "/token/revoke?id="+url.QueryEscape(id), nil, nil)
+}
+
+func (this *client) users() ([]service.User, error) {
+	var users []service.User
+	return users, this.api(http.MethodGet, "/users", nil, &users)
+}
+
+// Creates or updates a user, an empty password keeps the password of an existing user.
+func (this *client) saveUser(name string, password string, role string) error {
+	body, err := json.Marshal(map[string]string{"name": name, "password": password, "role": role})
+	if err != nil {
+		return err
+	}
+	return this.api(http.MethodPut, "/users", bytes.NewReader(body), nil)
+}
+
+func (this *client) removeUser(name string) error {
+	return this.api(http.MethodDelete, "/users?name="+url.QueryEscape(name), nil, nil)
+}
+
+func (this *client) audit(limit int) ([]service.AuditRecord, error) {
+	var records []service.AuditRecord
+	return records, this.api(http.MethodGet, "/audit?limit="+strconv.Itoa(limit), nil, &records)
+}
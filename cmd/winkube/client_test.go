@@ -0,0 +1,92 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/go-playground/assert.v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Creates a client calling the monitor API of the server given.
+func testClient(server *httptest.Server) *client {
+	return &client{
+		monitorUrl:  server.URL,
+		credentials: credentials{user: "operator", password: "secret"},
+		http:        server.Client(),
+	}
+}
+
+func TestTail_PrintsTheLogUntilTheCompleteEvent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		user, password, _ := req.BasicAuth()
+		assert.Equal(t, "operator:secret", user+":"+password)
+		assert.Equal(t, "/actions/a%201/stream", req.URL.EscapedPath())
+		writer.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(writer, "event: log\ndata: Starting nodes...\ndata: master up\n\n")
+		fmt.Fprint(writer, "event: log\ndata: worker up\n\n")
+		fmt.Fprint(writer, "event: complete\ndata: COMPLETED\n\n")
+		fmt.Fprint(writer, "event: log\ndata: ignored\n\n")
+	}))
+	defer server.Close()
+	out := bytes.Buffer{}
+	status, err := testClient(server).tail("a 1", &out)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "COMPLETED", status)
+	assert.Equal(t, "Starting nodes...\nmaster up\nworker up\n", out.String())
+}
+
+func TestTail_ReadsTheStatusIfTheStreamEndsWithoutCompleteEvent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/actions/a1/stream":
+			fmt.Fprint(writer, "event: log\ndata: done\n\n")
+		case "/api/v1/action":
+			assert.Equal(t, "a1", req.URL.Query().Get("id"))
+			fmt.Fprint(writer, `{"id":"a1","command":"Start Nodes","status":"FAILED"}`)
+		default:
+			http.NotFound(writer, req)
+		}
+	}))
+	defer server.Close()
+	out := bytes.Buffer{}
+	status, err := testClient(server).tail("a1", &out)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "FAILED", status)
+	assert.Equal(t, "done\n", out.String())
+}
+
+func TestTail_FailsForUnknownActions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		http.Error(writer, "No such action: a1", http.StatusNotFound)
+	}))
+	defer server.Close()
+	_, err := testClient(server).tail("a1", &bytes.Buffer{})
+	assert.Equal(t, "404 Not Found: No such action: a1", err.Error())
+}
+
+func TestRead_ReturnsTheApiError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.WriteHeader(http.StatusConflict)
+		fmt.Fprint(writer, `{"error":"Illegal state transition requested: SETUP -> IDLE"}`)
+	}))
+	defer server.Close()
+	_, err := testClient(server).status()
+	assert.Equal(t, true, strings.HasSuffix(err.Error(), "SETUP -> IDLE"))
+}
@@ -0,0 +1,467 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/**
+ * The winkube command line client, which drives a local or remote WinKube instance using its
+ * monitor and cluster APIs.
+ */
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/winkube/service"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const usage = `Usage: winkube [options] <command> [arguments]
+
+Commands:
+  status                      Shows the application state and the local nodes.
+  start [-wait]               Starts the local nodes.
+  stop [-wait]                Stops the local nodes.
+  setup [-from-file <file>]   Enters setup, or installs the given config file and starts.
+  actions list [-completed]   Lists the running or completed actions.
+  actions tail <id>           Follows the log of an action until it completes.
+  actions cancel <id>         Cancels a running action.
+  cluster nodes               Lists the nodes known by the cluster controller.
+  cluster leader              Shows the controller leading the cluster and the
+                              standby controllers.
+  tokens list                 Lists the join tokens issued by the controller.
+  tokens issue [-ttl <duration>] [-candidate] <node>
+                              Issues a join token for a node, -candidate for a
+                              standby controller.
+  tokens revoke <id>          Revokes a join token.
+  users list                  Lists the user accounts.
+  users set -role <role> [-new-password <password>] <name>
+                              Creates or updates a user account (viewer, operator or admin).
+  users remove <name>         Removes a user account.
+  audit [-limit <n>]          Shows the latest audit records.
+  node exec <master|worker> <operation> [<param>=<value>...]
+                              Executes an operation on a local node, e.g.
+                              node exec master drain node=worker-1 timeout=4m.
+  node operations <master|worker>
+                              Lists the operations of a node type and their
+                              parameters.
+
+Options:
+`
+
+type options struct {
+	host        string
+	port        int
+	clusterPort int
+	joinToken   string
+	tlsFiles    tlsFiles
+	credentials credentials
+}
+
+func main() {
+	opts := options{}
+	flags := flag.NewFlagSet("winkube", flag.ExitOnError)
+	flags.StringVar(&opts.host, "host", envOrDefault("WINKUBE_HOST", "localhost"), "The WinKube host.")
+	flags.IntVar(&opts.port, "port", 8080, "The port of the monitor API.")
+	flags.IntVar(&opts.clusterPort, "cluster-port", 9999, "The port of the cluster API.")
+	flags.StringVar(&opts.joinToken, "token", os.Getenv("WINKUBE_JOIN_TOKEN"), "The join token (<id>.<secret>), required for the cluster and node commands.")
+	flags.StringVar(&opts.tlsFiles.ca, "ca", service.WINKUBE_TRUSTED_CA_FILE, "The cluster CA certificate, on a controller use "+service.WINKUBE_CA_CERT_FILE+".")
+	flags.StringVar(&opts.tlsFiles.cert, "cert", service.WINKUBE_HOST_CERT_FILE, "The client certificate for the cluster API.")
+	flags.StringVar(&opts.tlsFiles.key, "key", service.WINKUBE_HOST_KEY_FILE, "The private key of the client certificate.")
+	flags.StringVar(&opts.credentials.user, "user", os.Getenv("WINKUBE_USER"), "The user for the monitor API.")
+	flags.StringVar(&opts.credentials.password, "password", os.Getenv("WINKUBE_PASSWORD"), "The password of the user, prefer WINKUBE_PASSWORD.")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	client := createClient(opts.host, opts.port, opts.clusterPort, opts.joinToken, opts.tlsFiles, opts.credentials)
+	err := run(client, flags.Arg(0), flags.Args()[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+		os.Exit(1)
+	}
+}
+
+func envOrDefault(name string, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func run(client *client, command string, args []string) error {
+	switch command {
+	case "status":
+		return statusCommand(client)
+	case "start":
+		return nodesCommand(client, args, client.startNodes)
+	case "stop":
+		return nodesCommand(client, args, client.stopNodes)
+	case "setup":
+		return setupCommand(client, args)
+	case "actions":
+		return actionsCommand(client, args)
+	case "cluster":
+		return clusterCommand(client, args)
+	case "node":
+		return nodeCommand(client, args)
+	case "tokens":
+		return tokensCommand(client, args)
+	case "users":
+		return usersCommand(client, args)
+	case "audit":
+		return auditCommand(client, args)
+	default:
+		return errors.New("Unknown command: " + command)
+	}
+}
+
+func statusCommand(client *client) error {
+	status, err := client.status()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("State:      %v (requested: %v)\n", status.Current, status.Requested)
+	if status.Current == service.APPSTATE_SETUP {
+		return nil
+	}
+	info, err := client.info()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Instance:   %v, %v\n", info.NodeInfo.InstanceName, info.NodeInfo.InstanceIp)
+	fmt.Printf("Cluster:    %v, controller %v\n", info.ClusterInfo.ClusterId, info.ClusterInfo.ClusterController)
+	fmt.Printf("            %v\n", info.ClusterInfo.ClusterState)
+	if info.ClusterInfo.CAFingerprint != "" {
+		fmt.Printf("Cluster CA: %v\n", info.ClusterInfo.CAFingerprint)
+	}
+	for _, node := range info.NodeInfo.Nodes {
+		fmt.Printf("Node:       %v (%v) %v, %v MB, %v CPU\n", node.NodeName, node.NodeType, node.NodeAddress, node.NodeMemory, node.NodeCPU)
+	}
+	return nil
+}
+
+func nodesCommand(client *client, args []string, operation func() (service.ApiAction, error)) error {
+	flags := flag.NewFlagSet("nodes", flag.ExitOnError)
+	wait := flags.Bool("wait", false, "Follows the log until the nodes are started/stopped.")
+	flags.Parse(args)
+	action, err := operation()
+	if err != nil {
+		return err
+	}
+	return followAction(client, action, *wait)
+}
+
+func setupCommand(client *client, args []string) error {
+	flags := flag.NewFlagSet("setup", flag.ExitOnError)
+	file := flags.String("from-file", "", "A config file, e.g. a winkube-config.json of another host.")
+	wait := flags.Bool("wait", false, "Follows the log until the config is installed.")
+	flags.Parse(args)
+	if *file == "" {
+		status, err := client.enterSetup()
+		if err == nil {
+			fmt.Printf("State: %v\n", status.Current)
+		}
+		return err
+	}
+	config, err := ioutil.ReadFile(*file)
+	if err != nil {
+		return err
+	}
+	action, err := client.installConfig(config)
+	if err != nil {
+		return err
+	}
+	return followAction(client, action, *wait)
+}
+
+// Prints the action started, or follows its log, if wait is set.
+func followAction(client *client, action service.ApiAction, wait bool) error {
+	if !wait {
+		fmt.Printf("Started %v (%v), follow it using: winkube actions tail %v\n", action.Command, action.Id, action.Id)
+		return nil
+	}
+	return tailCommand(client, action.Id)
+}
+
+func actionsCommand(client *client, args []string) error {
+	if len(args) == 0 {
+		return errors.New("actions: expected list, tail or cancel.")
+	}
+	switch args[0] {
+	case "list":
+		flags := flag.NewFlagSet("actions list", flag.ExitOnError)
+		completed := flags.Bool("completed", false, "Lists the completed instead of the running actions.")
+		status := flags.String("status", "", "Only completed actions with the given status.")
+		command := flags.String("command", "", "Only completed actions containing the given command.")
+		page := flags.Int("page", 0, "The page of completed actions.")
+		size := flags.Int("size", 20, "The page size for completed actions.")
+		flags.Parse(args[1:])
+		if !*completed {
+			actions, err := client.runningActions()
+			if err == nil {
+				printActions(actions)
+			}
+			return err
+		}
+		query := url.Values{}
+		query.Set("status", *status)
+		query.Set("command", *command)
+		query.Set("page", strconv.Itoa(*page))
+		query.Set("size", strconv.Itoa(*size))
+		result, err := client.completedActions(query)
+		if err == nil {
+			printActions(result.Actions)
+			fmt.Printf("Page %v of %v (%v actions)\n", result.Page+1, result.Pages, result.Total)
+		}
+		return err
+	case "tail":
+		if len(args) != 2 {
+			return errors.New("actions tail: expected an action id.")
+		}
+		return tailCommand(client, args[1])
+	case "cancel":
+		if len(args) != 2 {
+			return errors.New("actions cancel: expected an action id.")
+		}
+		action, err := client.cancelAction(args[1])
+		if err == nil {
+			fmt.Printf("%v (%v): %v\n", action.Command, action.Id, action.Status)
+		}
+		return err
+	default:
+		return errors.New("actions: unknown command " + args[0])
+	}
+}
+
+func printActions(actions []service.ApiAction) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tCOMMAND\tSTATUS\tPROGRESS\tSTARTED")
+	for _, a := range actions {
+		fmt.Fprintf(writer, "%v\t%v\t%v\t%v%%\t%v\n", a.Id, a.Command, a.RolledUpStatus, a.Progress, a.StartedAt.Format("2006-01-02 15:04:05"))
+	}
+	writer.Flush()
+}
+
+// Follows an action's log, fails if the action did not complete successfully.
+func tailCommand(client *client, id string) error {
+	status, err := client.tail(id, os.Stdout)
+	if err != nil {
+		return err
+	}
+	if status != "COMPLETED" {
+		return errors.New("Action " + id + " finished with status " + status)
+	}
+	return nil
+}
+
+func clusterCommand(client *client, args []string) error {
+	if len(args) == 1 && args[0] == "leader" {
+		lease, err := client.clusterLease()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Cluster:    %v\n", lease.ClusterId)
+		fmt.Printf("Leader:     %v (term %v)\n", lease.Leader, lease.Term)
+		fmt.Printf("Candidates: %v\n", strings.Join(lease.Candidates, ", "))
+		return nil
+	}
+	if len(args) != 1 || args[0] != "nodes" {
+		return errors.New("cluster: expected nodes or leader.")
+	}
+	masters, workers, err := client.clusterNodes()
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tTYPE\tHOST\tSTATE\tENDPOINT\tLAST SEEN")
+	for _, nodes := range []map[string]service.Node{masters, workers} {
+		var keys []string
+		for key := range nodes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			node := nodes[key]
+			fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\t%v\n", node.Name, node.NodeType, node.Host, node.State, node.Endpoint, node.Timestamp.Format("2006-01-02 15:04:05"))
+		}
+	}
+	return writer.Flush()
+}
+
+func nodeCommand(client *client, args []string) error {
+	if len(args) < 2 || (args[0] != "exec" && args[0] != "operations") {
+		return errors.New("node: expected exec <master|worker> <operation> or operations <master|worker>.")
+	}
+	nodeType := strings.ToLower(args[1])
+	if nodeType != "master" && nodeType != "worker" {
+		return errors.New("node " + args[0] + ": node type must be master or worker.")
+	}
+	if args[0] == "operations" {
+		operations, err := client.nodeOperations(nodeType)
+		if err != nil {
+			return err
+		}
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "OPERATION\tPARAMETERS\tDESCRIPTION")
+		for _, operation := range operations {
+			params := []string{}
+			for _, param := range operation.Params {
+				if param.Required {
+					params = append(params, param.Name)
+				} else {
+					params = append(params, "["+param.Name+"]")
+				}
+			}
+			fmt.Fprintf(writer, "%v\t%v\t%v\n", operation.Name, strings.Join(params, " "), operation.Description)
+		}
+		return writer.Flush()
+	}
+	if len(args) < 3 {
+		return errors.New("node exec: expected an operation, see node operations " + nodeType + ".")
+	}
+	params := make(map[string]string)
+	for _, arg := range args[3:] {
+		separator := strings.Index(arg, "=")
+		if separator <= 0 {
+			return errors.New("node exec: expected <param>=<value>, got " + arg + ".")
+		}
+		params[arg[:separator]] = arg[separator+1:]
+	}
+	result, err := client.exec(nodeType, args[2], params)
+	if err != nil {
+		return err
+	}
+	fmt.Print(result.Stdout)
+	fmt.Fprint(os.Stderr, result.Stderr)
+	if result.ExitCode != 0 {
+		return errors.New("Operation failed with exit code " + strconv.Itoa(result.ExitCode))
+	}
+	return nil
+}
+
+func tokensCommand(client *client, args []string) error {
+	if len(args) == 0 {
+		return errors.New("tokens: expected list, issue or revoke.")
+	}
+	switch args[0] {
+	case "list":
+		tokens, err := client.tokens()
+		if err != nil {
+			return err
+		}
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "ID\tNODE\tISSUED\tEXPIRES\tSTATE")
+		for _, token := range tokens {
+			expires := "never"
+			if token.ExpiresAt != nil {
+				expires = token.ExpiresAt.Format("2006-01-02 15:04:05")
+			}
+			state := "valid"
+			if token.Candidate {
+				state = "valid (candidate)"
+			}
+			if token.Revoked {
+				state = "revoked"
+			} else if token.Expired() {
+				state = "expired"
+			}
+			fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\n", token.Id, token.Node, token.IssuedAt.Format("2006-01-02 15:04:05"), expires, state)
+		}
+		return writer.Flush()
+	case "issue":
+		flags := flag.NewFlagSet("tokens issue", flag.ExitOnError)
+		ttl := flags.String("ttl", "", "The lifetime of the token, e.g. 720h, 0 never expires.")
+		candidate := flags.Bool("candidate", false, "Issues the token of a standby controller.")
+		flags.Parse(args[1:])
+		if flags.NArg() != 1 {
+			return errors.New("tokens issue: expected the node name.")
+		}
+		token, err := client.issueToken(flags.Arg(0), *ttl, *candidate)
+		if err != nil {
+			return err
+		}
+		fmt.Println(token.Token)
+		return nil
+	case "revoke":
+		if len(args) != 2 {
+			return errors.New("tokens revoke: expected the token id.")
+		}
+		return client.revokeToken(args[1])
+	default:
+		return errors.New("tokens: unknown command " + args[0])
+	}
+}
+
+func usersCommand(client *client, args []string) error {
+	if len(args) == 0 {
+		return errors.New("users: expected list, set or remove.")
+	}
+	switch args[0] {
+	case "list":
+		users, err := client.users()
+		if err != nil {
+			return err
+		}
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "NAME\tROLE")
+		for _, user := range users {
+			fmt.Fprintf(writer, "%v\t%v\n", user.Name, user.Role)
+		}
+		return writer.Flush()
+	case "set":
+		flags := flag.NewFlagSet("users set", flag.ExitOnError)
+		role := flags.String("role", string(service.ROLE_VIEWER), "The role of the user: viewer, operator or admin.")
+		password := flags.String("new-password", os.Getenv("WINKUBE_NEW_PASSWORD"), "The password of the user, required for new users.")
+		flags.Parse(args[1:])
+		if flags.NArg() != 1 {
+			return errors.New("users set: expected the user name.")
+		}
+		return client.saveUser(flags.Arg(0), *password, *role)
+	case "remove":
+		if len(args) != 2 {
+			return errors.New("users remove: expected the user name.")
+		}
+		return client.removeUser(args[1])
+	default:
+		return errors.New("users: unknown command " + args[0])
+	}
+}
+
+func auditCommand(client *client, args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	limit := flags.Int("limit", 50, "The number of records shown.")
+	flags.Parse(args)
+	records, err := client.audit(*limit)
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "TIME\tUSER\tROLE\tREMOTE\tREQUEST\tALLOWED\tMESSAGE")
+	for _, record := range records {
+		fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v %v\t%v\t%v\n", record.Time.Format("2006-01-02 15:04:05"), record.User,
+			record.Role, record.RemoteAddr, record.Method, record.Path, record.Allowed, record.Message)
+	}
+	return writer.Flush()
+}
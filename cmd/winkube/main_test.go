@@ -0,0 +1,90 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"gopkg.in/go-playground/assert.v1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A request received by the test server.
+type recordedRequest struct {
+	method string
+	uri    string
+	body   string
+}
+
+// Starts a server recording the requests, answering each one with the response given.
+func recordingServer(response string, requests *[]recordedRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		*requests = append(*requests, recordedRequest{method: req.Method, uri: req.URL.RequestURI(), body: string(body)})
+		writer.Write([]byte(response))
+	}))
+}
+
+func TestRun_RejectsInvalidArguments(t *testing.T) {
+	var requests []recordedRequest
+	server := recordingServer("{}", &requests)
+	defer server.Close()
+	client := testClient(server)
+	errors := map[string][]string{
+		"Unknown command: reboot":                                                        {"reboot"},
+		"actions: expected list, tail or cancel.":                                        {"actions"},
+		"actions tail: expected an action id.":                                           {"actions", "tail"},
+		"actions: unknown command purge":                                                 {"actions", "purge"},
+		"node exec: node type must be master or worker.":                                 {"node", "exec", "controller", "uptime"},
+		"node exec: expected an operation, see node operations worker.":                  {"node", "exec", "worker"},
+		"node exec: expected <param>=<value>, got node.":                                 {"node", "exec", "master", "drain", "node"},
+		"node exec: expected <param>=<value>, got =worker-1.":                            {"node", "exec", "master", "drain", "=worker-1"},
+		"tokens issue: expected the node name.":                                          {"tokens", "issue", "-ttl", "1h"},
+		"users set: expected the user name.":                                             {"users", "set", "-role", "admin"},
+		"cluster: expected nodes or leader.":                                             {"cluster", "masters"},
+		"node: expected exec <master|worker> <operation> or operations <master|worker>.": {"node", "ls"},
+	}
+	for message, args := range errors {
+		err := run(client, args[0], args[1:])
+		assert.Equal(t, message, err.Error())
+	}
+	assert.Equal(t, 0, len(requests))
+}
+
+func TestRun_PassesTheArgumentsToTheApi(t *testing.T) {
+	var requests []recordedRequest
+	server := recordingServer(`{"id":"a1","command":"Install configuration (API)","status":"RUNNING"}`, &requests)
+	defer server.Close()
+	client := testClient(server)
+	dir, err := ioutil.TempDir("", "winkube-cli-test")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "winkube-config.json")
+	assert.Equal(t, nil, ioutil.WriteFile(file, []byte(`{"version":1}`), 0600))
+
+	assert.Equal(t, nil, run(client, "setup", []string{"-from-file", file}))
+	assert.Equal(t, nil, run(client, "actions", []string{"cancel", "a 1"}))
+	assert.Equal(t, nil, run(client, "actions", []string{"list", "-completed", "-status", "FAILED", "-size", "5"}))
+	assert.Equal(t, nil, run(client, "tokens", []string{"issue", "-ttl", "1h", "-candidate", "worker-1"}))
+	assert.Equal(t, []recordedRequest{
+		{method: http.MethodPut, uri: "/api/v1/config", body: `{"version":1}`},
+		{method: http.MethodPost, uri: "/api/v1/action/cancel?id=a+1"},
+		{method: http.MethodGet, uri: "/api/v1/actions/completed?command=&page=0&size=5&status=FAILED"},
+		{method: http.MethodPost, uri: "/api/v1/tokens", body: `{"candidate":true,"node":"worker-1","ttl":"1h"}`},
+	}, requests)
+}
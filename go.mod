@@ -14,7 +14,7 @@
 
 module github.com/winkube
 
-go 1.13
+go 1.16
 
 require (
 	github.com/go-playground/locales v0.13.0 // indirect
@@ -27,9 +27,11 @@ require (
 	github.com/magiconair/properties v1.8.1
 	github.com/sirupsen/logrus v1.4.2
 	github.com/stretchr/testify v1.4.0
+	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550
 	golang.org/x/net v0.0.0-20191007182048-72f939374954 // indirect
 	golang.org/x/sys v0.0.0-20190904154756-749cb33beabd // indirect
 	golang.org/x/text v0.3.2
 	gopkg.in/go-playground/assert.v1 v1.2.1
 	gopkg.in/go-playground/validator.v9 v9.30.0
+	gopkg.in/yaml.v2 v2.2.2
 )
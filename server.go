@@ -19,107 +19,198 @@
 package main
 
 import (
+	"embed"
+	"errors"
+	"flag"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/winkube/service"
 	"github.com/winkube/service/assert"
+	"github.com/winkube/util"
+	"github.com/winkube/webapp"
 	"net/http"
+	"os"
 	"os/exec"
 	"strings"
-	"time"
 )
 
-func startup() {
+// Environment variable naming a directory with templates, translations or static files overriding
+// the ones embedded, e.g. templates/index.html.
+const WINKUBE_ASSETS_ENV = "WINKUBE_ASSETS"
+
+// The templates, translations and static files of the web UI and the Vagrantfile template. Files
+// starting with an underscore are not embedded with their directory.
+//
+//go:embed templates templates/_*.html i18n static
+var assetFiles embed.FS
+
+func startup(seedFile string) {
+	stateMachine := *service.Container().StateMachine
+	stateMachine.Handle(service.APPSTATE_SETUP, enterSetup)
+	stateMachine.Handle(service.APPSTATE_RUNNING, switchToRunning)
+	stateMachine.Handle(service.APPSTATE_IDLE, switchToIdle)
+	(*service.Container().LocalController).AddNodeListener(nodeChanged)
+	// an existing valid config is never overridden by the bootstrap
+	if !service.Container().Config.Ready() && service.BootstrapRequested(seedFile) {
+		log.Info("Bootstrapping configuration...")
+		err := service.Bootstrap(seedFile)
+		if err != nil {
+			log.Error("Bootstrap failed, entering setup: " + err.Error())
+		}
+	}
 	if !service.Container().Config.Ready() {
-		service.Container().RequiredAppStatus = service.APPSTATE_SETUP
+		stateMachine.RequestState(service.APPSTATE_SETUP)
+	} else {
+		stateMachine.RequestState(service.APPSTATE_RUNNING)
 	}
-	go manageState()
 	http.Handle("/", service.Container().Router)
 	http.ListenAndServe("0.0.0.0:8080", nil)
 }
 
-func manageState() {
-	for {
+func enterSetup(from service.AppStatus, action *service.Action) error {
+	if from == service.APPSTATE_RUNNING || from == service.APPSTATE_IDLE || from == service.APPSTATE_ERROR {
+		log.Info("Stopping service registry...")
+		action.LogActionLn("Stopping service registry...")
+		(*service.Container().ServiceRegistry).Stop()
+		action.LogActionLn("Service registry stopped.")
+	}
+	log.Info("Entering setup mode...")
+	return nil
+}
 
-		if service.Container().RequiredAppStatus != service.Container().CurrentStatus {
-			var actionManager service.ActionManager = *service.GetActionManager()
-			config := service.Container().Config
-			var action *service.Action
-			switch service.Container().RequiredAppStatus {
-			case service.APPSTATE_SETUP:
-				action = actionManager.StartAction("Trying to switch to SETUP Mode")
-				if service.Container().CurrentStatus == service.APPSTATE_RUNNING || service.Container().CurrentStatus == service.APPSTATE_ERROR {
-					log.Info("Stopping service registry...")
-					action.LogActionLn("Stopping service registry...")
-					(*service.Container().ServiceRegistry).Stop()
-					action.LogActionLn("Service registry stopped.")
-				}
-				log.Info("Entering setup mode...")
-				service.Container().CurrentStatus = service.APPSTATE_SETUP
-				action.CompleteWithMessage("New Mode applied: SETUP")
-			case service.APPSTATE_RUNNING:
-				switchToRunning(config)
-			case service.APPSTATE_IDLE:
-				if service.Container().CurrentStatus == service.APPSTATE_RUNNING {
-					action = actionManager.StartAction("Switch to IDLE Mode")
-					// TODO mark worker node as non deployable
-					// wait for Kubernetes to remove workload
-					log.Info("WinKube now idle.")
-					service.Container().CurrentStatus = service.APPSTATE_IDLE
-					action.CompleteWithMessage("New Mode applied: IDLE")
-				}
-			}
+// Marks the local worker and joining master as non deployable and waits for Kubernetes to remove
+// their workload. If a node cannot be cordoned or drained, the nodes cordoned so far are made
+// schedulable again, since the state machine does not uncordon them when leaving the error state.
+func switchToIdle(from service.AppStatus, action *service.Action) error {
+	config := service.Container().Config
+	controller := *service.Container().LocalController
+	nodes := config.IdleNodeNames()
+	cordoned := []string{}
+	for _, node := range nodes {
+		action.LogActionLn("Cordoning node " + node + "...")
+		err := controller.CordonNode(node)
+		if err != nil {
+			log.Error("Cordoning node " + node + " failed: " + err.Error())
+			uncordonNodes(controller, cordoned, action)
+			return err
+		}
+		cordoned = append(cordoned, node)
+	}
+	for i, node := range nodes {
+		action.LogActionLn(fmt.Sprintf("Draining node %v (%v/%v), timeout %v...", node, i+1, len(nodes), config.DrainTimeout()))
+		err := controller.DrainNode(node, config.DrainTimeout())
+		if err != nil {
+			log.Error("Draining node " + node + " failed: " + err.Error())
+			uncordonNodes(controller, cordoned, action)
+			return err
 		}
-		time.Sleep(10 * time.Second)
+		action.LogActionLn("Node " + node + " drained.")
 	}
+	log.Info("WinKube now idle.")
+	return nil
 }
 
-func switchToRunning(config *service.SystemConfiguration) {
-	actionManager := *service.GetActionManager()
-	action := actionManager.StartAction("Trying to switch to RUNNING Mode")
-	defer action.Complete()
-	oldStatus := service.Container().CurrentStatus
-	if config.Ready() {
-		service.Container().CurrentStatus = service.APPSTATE_STARTING
-		action.LogActionLn("Starting service registry...")
-		(*service.Container().ServiceRegistry).Start(config.NetConfig.NetMulticastEnabled, config.NetConfig.NetUPnPPort, strings.Split(config.NetConfig.MasterController, ","))
-		action.LogActionLn("Starting cluster controller...")
-		err := (*service.Container().LocalController).Start(config)
-		if action.OnErrorComplete(err) {
-			log.Error("Starting local controller failed: " + err.Error())
-			resetToSetupStatus(oldStatus)
-			return
+// Makes the nodes given schedulable again, logged as child of the action given.
+func uncordonNodes(controller service.LocalController, nodes []string, action *service.Action) {
+	if len(nodes) == 0 {
+		return
+	}
+	child := action.StartChild("Uncordon nodes cordoned for idle mode")
+	var failed error
+	for _, node := range nodes {
+		child.LogActionLn("Uncordoning node " + node + "...")
+		err := controller.UncordonNode(node)
+		if err != nil {
+			log.Error("Uncordoning node " + node + " failed: " + err.Error())
+			child.LogActionLn("Uncordoning node " + node + " failed: " + err.Error())
+			failed = err
 		}
-		action.LogActionLn("Configuring nodes...")
-		clusterConfig := (*service.Container().LocalController).GetClusterConfig()
-		assert.AssertNotNil(clusterConfig)
-		configAction := (*service.Container().NodeManager).ConfigureNodes(*config, clusterConfig, true)
-		if !action.OnErrorComplete(configAction.Error) {
-			log.Error("Failed to configure the nodes: ", configAction.Error)
-			log.Info("Starting nodes...")
-			action.LogActionLn("Starting nodes...")
-			startNodesAction := (*service.Container().NodeManager).StartNodes()
-			if action.OnErrorComplete(startNodesAction.Error) {
-				log.Error("Starting nodes failed: " + startNodesAction.Error.Error())
-				resetToSetupStatus(oldStatus)
+	}
+	if failed != nil {
+		child.CompleteWithError(failed)
+		return
+	}
+	child.CompleteWithMessage(fmt.Sprintf("%v nodes schedulable again.", len(nodes)))
+}
+
+// Evicts the workload of nodes lost by the controller, so Kubernetes reschedules it, and makes
+// them schedulable again, once they are back.
+func nodeChanged(event service.NodeEvent) {
+	node := strings.ToLower(event.Node.Name)
+	controller := *service.Container().LocalController
+	if event.Node.State == service.NodeLost && event.Previous != service.NodeLost {
+		go func() {
+			action := (*service.GetActionManager()).StartAction("Drain lost node " + node)
+			action.LogActionLn(event.String())
+			err := controller.CordonNode(node)
+			if err == nil {
+				err = controller.DrainNode(node, service.Container().Config.DrainTimeout())
+			}
+			if err != nil {
+				log.Error("Draining lost node " + node + " failed: " + err.Error())
+				action.CompleteWithError(err)
 				return
 			}
-			log.Info("Registering services...")
-			service.Container().CurrentStatus = service.APPSTATE_RUNNING
-		} else {
-			log.Error("Configure nodes failed: " + configAction.Error.Error())
-			resetToSetupStatus(oldStatus)
-			action.CompleteWithMessage("Cannot switch to a RUNNING state: config is not ready.")
-		}
-	} else {
-		action.CompleteWithMessage("Cannot switch to a RUNNING state: config is not ready.")
-		resetToSetupStatus(oldStatus)
+			action.CompleteWithMessage("Node " + node + " drained.")
+		}()
+	} else if event.Node.State == service.NodeAlive && event.Previous == service.NodeLost {
+		go func() {
+			action := (*service.GetActionManager()).StartAction("Uncordon recovered node " + node)
+			action.LogActionLn(event.String())
+			err := controller.UncordonNode(node)
+			if err != nil {
+				log.Error("Uncordoning node " + node + " failed: " + err.Error())
+				action.CompleteWithError(err)
+				return
+			}
+			action.CompleteWithMessage("Node " + node + " schedulable again.")
+		}()
 	}
 }
 
-func resetToSetupStatus(oldStatus service.AppStatus) {
-	service.Container().CurrentStatus = oldStatus
-	service.Container().RequiredAppStatus = service.APPSTATE_SETUP
+func switchToRunning(from service.AppStatus, action *service.Action) error {
+	if from == service.APPSTATE_IDLE {
+		controller := *service.Container().LocalController
+		for _, node := range service.Container().Config.IdleNodeNames() {
+			action.LogActionLn("Uncordoning node " + node + "...")
+			err := controller.UncordonNode(node)
+			if err != nil {
+				log.Error("Uncordoning node " + node + " failed: " + err.Error())
+				return err
+			}
+		}
+		log.Info("WinKube running again.")
+		return nil
+	}
+	config := service.Container().Config
+	if !config.Ready() {
+		return errors.New("Cannot switch to a RUNNING state: config is not ready.")
+	}
+	action.LogActionLn("Starting service registry...")
+	(*service.Container().ServiceRegistry).Start(config.NetConfig.NetMulticastEnabled, config.NetConfig.NetUPnPPort, strings.Split(config.NetConfig.MasterController, ","))
+	action.LogActionLn("Starting cluster controller...")
+	err := (*service.Container().LocalController).Start(config)
+	if err != nil {
+		log.Error("Starting local controller failed: " + err.Error())
+		return err
+	}
+	action.LogActionLn("Configuring nodes...")
+	clusterConfig := (*service.Container().LocalController).GetClusterConfig()
+	assert.AssertNotNil(clusterConfig)
+	configAction := (*service.Container().NodeManager).ConfigureNodes(action, *config, clusterConfig, true)
+	if err := configAction.Err(); err != nil {
+		log.Error("Configure nodes failed: " + err.Error())
+		return err
+	}
+	log.Info("Starting nodes...")
+	action.LogActionLn("Starting nodes...")
+	startNodesAction := (*service.Container().NodeManager).StartNodes(action)
+	if err := startNodesAction.Err(); err != nil {
+		log.Error("Starting nodes failed: " + err.Error())
+		return err
+	}
+	log.Info("Registering services...")
+	return nil
 }
 
 // Opens the local browser with the setup application
@@ -134,13 +225,20 @@ func explore(path string) {
 
 // Main that starts the server and all services
 func main() {
+	seedFile := flag.String("seed", os.Getenv(service.WINKUBE_SEED_ENV), "A YAML or JSON seed file used to create the config without the setup wizard.")
+	assetsDir := flag.String("assets", os.Getenv(WINKUBE_ASSETS_ENV), "A directory with templates, translations or static files overriding the embedded ones.")
+	flag.Parse()
+	util.UseAssets(assetFiles, *assetsDir)
 	fmt.Println("Starting management container...")
 	service.Start()
 	log.Info(service.Container().Stats())
 	router := service.Container().Router
+	router.PathPrefix("/static/").Handler(webapp.StaticHandler("/static/", "static"))
 	setupWebapp := service.SetupWebApplication(router)
 	router.PathPrefix("/setup").HandlerFunc(setupWebapp.HandleRequest)
+	apiWebapp := service.MonitorApiApplication()
+	router.PathPrefix(service.API_ROOT).HandlerFunc(apiWebapp.HandleRequest)
 	monitorWebapp := service.MonitorWebApplication(router)
 	router.PathPrefix("/").HandlerFunc(monitorWebapp.HandleRequest)
-	startup()
+	startup(*seedFile)
 }
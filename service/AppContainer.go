@@ -15,6 +15,7 @@
 package service
 
 import (
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
@@ -25,6 +26,7 @@ import (
 	"golang.org/x/text/message/catalog"
 	"gopkg.in/go-playground/validator.v9"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
@@ -47,6 +49,35 @@ const (
 	APPSTATE_ERROR
 )
 
+var appStatusNames = [...]string{"INITIALIZING", "INITIALIZED", "SETUP", "STARTING", "RUNNING", "IDLE", "ERROR"}
+
+func (this AppStatus) String() string {
+	return appStatusNames[this]
+}
+
+// AppStatus is serialized using its name.
+func (this AppStatus) MarshalText() ([]byte, error) {
+	return []byte(this.String()), nil
+}
+
+func (this *AppStatus) UnmarshalText(text []byte) error {
+	status, err := ParseAppStatus(string(text))
+	if err == nil {
+		*this = status
+	}
+	return err
+}
+
+// Parses the (case insensitive) name of an AppStatus.
+func ParseAppStatus(name string) (AppStatus, error) {
+	for i, n := range appStatusNames {
+		if strings.EqualFold(n, name) {
+			return AppStatus(i), nil
+		}
+	}
+	return APPSTATE_ERROR, errors.New("Invalid application state: " + name)
+}
+
 func Container() *AppContainer {
 	if container == nil {
 		Start()
@@ -59,20 +90,40 @@ func Log() *log.Logger {
 }
 
 func Start() {
+	instance = CreateActionManager(CreateFileActionStore(WINKUBE_ACTIONS_FILE, DefaultActionRetention))
 	appContainer := AppContainer{
-		Logger:            logger(),
-		Router:            router(),
-		Validator:         createValidator(),
-		CurrentStatus:     APPSTATE_INITIALIZING,
-		RequiredAppStatus: APPSTATE_RUNNING,
+		Logger:    logger(),
+		Router:    router(),
+		Validator: createValidator(),
 	}
 	container = &appContainer
+	secretStore, err := createDefaultSecretStore()
+	if err != nil {
+		appContainer.Logger.Error("Secret store not available, secrets cannot be read or written: " + err.Error())
+	}
+	appContainer.SecretStore = secretStore
+	appContainer.Tokens = CreateTokenManager(WINKUBE_TOKENS_FILE, secretStore)
+	appContainer.ClusterTLS = CreateClusterTLS()
+	appContainer.Sessions = createDefaultSessionStore(secretStore)
+	users, err := createDefaultUserStore()
+	if err != nil {
+		// do not fall back to an empty store, which would allow anybody to create an admin
+		appContainer.Logger.Panic("User accounts could not be loaded from " + WINKUBE_USERS_FILE + ": " + err.Error())
+	}
+	appContainer.Users = users
+	appContainer.Audit = CreateAuditLog(WINKUBE_AUDIT_FILE)
 	appContainer.Config = config()
 	appContainer.Router = router()
 	appContainer.ServiceRegistry = netutil.CreateServiceRegistry(WINKUBE_ADTYPE)
-	appContainer.LocalController = CreateLocalController(container.ServiceRegistry)
+	clusters, err := CreateFileClusterStore(WINKUBE_CLUSTERS_FILE)
+	if err != nil {
+		// an empty store would hand out IPs already used by nodes
+		appContainer.Logger.Panic("Cluster state could not be loaded from " + WINKUBE_CLUSTERS_FILE + ": " + err.Error())
+	}
+	appContainer.LocalController = CreateLocalController(container.ServiceRegistry, clusters)
 	appContainer.NodeManager = createNodeManager(appContainer.ServiceRegistry)
-	appContainer.CurrentStatus = APPSTATE_INITIALIZED
+	appContainer.StateMachine = CreateStateMachine(APPSTATE_INITIALIZED)
+	(*appContainer.StateMachine).Start()
 	appContainer.Logger.Info("WinKube is initialized, continue...")
 }
 
@@ -86,6 +137,7 @@ func createValidator() *validator.Validate {
 
 func vagrantConfig(sl validator.StructLevel) {
 	config := sl.Current().Interface().(VagrantConfig)
+	config.MasterToken = redact(config.MasterToken)
 	fmt.Printf("VagrantConfig: %+v", config)
 }
 
@@ -118,19 +170,32 @@ func clusterNodeConfigValidation(sl validator.StructLevel) {
 }
 
 type AppContainer struct {
-	Startup           time.Time
-	StartupDuration   time.Duration
-	Logger            *log.Logger
-	MessageCatalog    *catalog.Builder
-	Config            *SystemConfiguration
-	ServiceProvider   *netutil.ServiceProvider
-	Router            *mux.Router
-	ServiceRegistry   *netutil.ServiceRegistry
-	LocalController   *LocalController
-	NodeManager       *NodeManager
-	CurrentStatus     AppStatus
-	RequiredAppStatus AppStatus
-	Validator         *validator.Validate
+	Startup         time.Time
+	StartupDuration time.Duration
+	Logger          *log.Logger
+	MessageCatalog  *catalog.Builder
+	Config          *SystemConfiguration
+	ServiceProvider *netutil.ServiceProvider
+	Router          *mux.Router
+	ServiceRegistry *netutil.ServiceRegistry
+	LocalController *LocalController
+	NodeManager     *NodeManager
+	StateMachine    *StateMachine
+	Validator       *validator.Validate
+	SecretStore     *SecretStore
+	Tokens          *TokenManager
+	ClusterTLS      *ClusterTLS
+	Sessions        *SessionStore
+	Users           *UserStore
+	Audit           *AuditLog
+}
+
+// The current application state.
+func (this AppContainer) CurrentStatus() AppStatus {
+	if this.StateMachine == nil {
+		return APPSTATE_INITIALIZING
+	}
+	return (*this.StateMachine).Status()
 }
 
 func (this AppContainer) Stats() string {
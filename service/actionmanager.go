@@ -15,33 +15,128 @@
 package service
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
 type Action struct {
-	Id          string
+	Id string
+	// The id of the action that triggered this action, empty for top level actions.
+	ParentId    string
 	StartedAt   *time.Time
 	FinishedAt  *time.Time
 	Command     string
 	Description string
 	Error       error
-	log         *bytes.Buffer
+	// The number of steps of the action, if known, and the steps done so far.
+	TotalSteps     int
+	CompletedSteps int
+	// True, if the action has been cancelled.
+	Cancelled bool
+	log       *actionLog
+	ctx       context.Context
+	cancel    context.CancelFunc
+	// the manager which started the action
+	owner ActionManager
+}
+
+// Error an action is completed with, when cancelled.
+var ErrActionCancelled = errors.New("Action cancelled.")
+
+// The log of an action. Log output can be written and followed concurrently.
+type actionLog struct {
+	mutex     sync.RWMutex
+	buffer    strings.Builder
+	followers map[chan string]bool
+	closed    bool
+}
+
+func createActionLog(text string) *actionLog {
+	log := actionLog{
+		followers: make(map[chan string]bool),
+	}
+	log.buffer.WriteString(text)
+	return &log
+}
+
+func (this *actionLog) String() string {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.buffer.String()
+}
+
+func (this *actionLog) write(text string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.buffer.WriteString(text)
+	for follower := range this.followers {
+		select {
+		case follower <- text:
+		default:
+			// slow follower, drop it to not block the action
+			close(follower)
+			delete(this.followers, follower)
+		}
+	}
+}
+
+// Returns the current log and a channel receiving all further output. The channel is closed, when
+// the action completes or the follower cannot keep up. The returned function must be called to stop
+// following.
+func (this *actionLog) follow() (string, <-chan string, func()) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	follower := make(chan string, 100)
+	if this.closed {
+		close(follower)
+		return this.buffer.String(), follower, func() {}
+	}
+	this.followers[follower] = true
+	return this.buffer.String(), follower, func() {
+		this.mutex.Lock()
+		defer this.mutex.Unlock()
+		if this.followers[follower] {
+			close(follower)
+			delete(this.followers, follower)
+		}
+	}
+}
+
+func (this *actionLog) close() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.closed = true
+	for follower := range this.followers {
+		close(follower)
+	}
+	this.followers = make(map[chan string]bool)
 }
 
 var instance ActionManager
 
 func init() {
-	instance = CreateActionManager()
+	instance = CreateActionManager(CreateMemoryActionStore(DefaultActionRetention))
 }
 
 func GetActionManager() *ActionManager {
 	return &instance
 }
 
+// The manager owning the action. Actions loaded from the store of a previous run belong to the
+// default manager.
+func (this Action) manager() ActionManager {
+	if this.owner == nil {
+		return *GetActionManager()
+	}
+	return this.owner
+}
+
 func (this Action) Log() string {
 	return this.log.String()
 }
@@ -52,26 +147,105 @@ func (this Action) Status() string {
 	if this.FinishedAt == nil {
 		return "RUNNING"
 	}
+	if this.Cancelled {
+		return "CANCELLED"
+	}
 	if this.Error != nil {
 		return "ERROR"
 	}
 	return "COMPLETED"
 }
 
+// The status of the action including its children: ERROR if any of them failed, CANCELLED if any
+// of them was cancelled, RUNNING if any of them is still running, else COMPLETED.
+func (this Action) RolledUpStatus() string {
+	status := this.Status()
+	if status == "ERROR" || status == "CANCELLED" {
+		return status
+	}
+	for _, child := range this.Children() {
+		switch child.RolledUpStatus() {
+		case "ERROR":
+			return "ERROR"
+		case "CANCELLED":
+			status = "CANCELLED"
+		case "RUNNING":
+			if status != "CANCELLED" {
+				status = "RUNNING"
+			}
+		}
+	}
+	return status
+}
+
+// The error the action completed with. Actions are handed out as snapshots, so the error is read
+// from the manager, which also returns it for actions completed after the snapshot was taken.
+func (this Action) Err() error {
+	if current := this.manager().LookupAction(this.Id); current != nil {
+		return current.Error
+	}
+	return this.Error
+}
+
+// The context of the action, which is done when the action completes or is cancelled. Child
+// actions are cancelled together with their parent.
+func (this Action) Context() context.Context {
+	if this.ctx == nil {
+		return context.Background()
+	}
+	return this.ctx
+}
+
+// The progress in percent. If no steps are defined, the progress is evaluated from the children.
+func (this Action) Progress() int {
+	if this.Finished() {
+		return 100
+	}
+	if this.TotalSteps > 0 {
+		return this.CompletedSteps * 100 / this.TotalSteps
+	}
+	children := this.Children()
+	if len(children) == 0 {
+		return 0
+	}
+	progress := 0
+	for _, child := range children {
+		progress += child.Progress()
+	}
+	return progress / len(children)
+}
+
+// The actions started as part of this action, oldest first.
+func (this Action) Children() []*Action {
+	return this.manager().Children(this.Id)
+}
+
+func (this Action) StartChild(command string) *Action {
+	return this.manager().StartChildAction(this.Id, command)
+}
+
+func (this Action) SetSteps(total int) {
+	this.manager().SetSteps(this.Id, total)
+}
+
+func (this Action) Step(message string) {
+	this.manager().Step(this.Id, message)
+}
+
 func (this Action) Complete() {
-	(*GetActionManager()).Complete(this.Id)
+	this.manager().Complete(this.Id)
 }
 
 func (this Action) CompleteWithMessage(message string) {
-	(*GetActionManager()).CompleteWithMessage(this.Id, message)
+	this.manager().CompleteWithMessage(this.Id, message)
 }
 
 func (this Action) CompleteWithError(err error) {
-	(*GetActionManager()).CompleteWithError(this.Id, err)
+	this.manager().CompleteWithError(this.Id, err)
 }
 
 func (this Action) LogAction(message string) {
-	(*GetActionManager()).LogAction(this.Id, message)
+	this.manager().LogAction(this.Id, message)
 }
 
 func (this Action) LogActionLn(message string) {
@@ -90,108 +264,234 @@ type ActionManager interface {
 	LookupAction(id string) *Action
 	RunningActions() []*Action
 	CompletedActions() []*Action
+	QueryActions(query ActionQuery) ActionPage
 	StartAction(command string) *Action
+	StartChildAction(parentId string, command string) *Action
+	// Cancels a running action and its children.
+	Cancel(id string) error
+	Children(id string) []*Action
+	SetSteps(id string, total int) *Action
+	Step(id string, message string) *Action
 	LogAction(id string, log string) *Action
+	FollowLog(id string) (string, <-chan string, func(), error)
 	Complete(id string) *Action
 	CompleteWithMessage(id string, message string) *Action
 	CompleteWithError(id string, err error) *Action
 }
 
-func CreateActionManager() ActionManager {
+func CreateActionManager(store *ActionStore) ActionManager {
 	return &actionManager{
-		runningActions:   map[string]*Action{},
-		completedActions: []*Action{},
+		runningActions: map[string]*Action{},
+		store:          store,
 	}
 }
 
+// The action manager is safe for concurrent use. Running actions returned are snapshots taken
+// at the time of the call, completed actions do not change anymore. Only the manager changes the
+// actions it keeps, under its lock.
 type actionManager struct {
-	runningActions   map[string]*Action
-	completedActions []*Action
+	runningActions map[string]*Action
+	store          *ActionStore
+	mutex          sync.RWMutex
 }
 
 func (this *actionManager) LookupAction(id string) *Action {
-	action := this.runningActions[id]
-	if action == nil {
-		for _, a := range this.completedActions {
-			if a.Id == id {
-				return a
-			}
-		}
+	this.mutex.RLock()
+	action := snapshot(this.runningActions[id])
+	if action != nil {
+		this.mutex.RUnlock()
+		return action
 	}
-	return action
+	this.mutex.RUnlock()
+	return (*this.store).Lookup(id)
 }
 func (this *actionManager) RunningActions() []*Action {
+	this.mutex.RLock()
 	actions := []*Action{}
 	for _, v := range this.runningActions {
-		actions = append(actions, v)
+		actions = append(actions, snapshot(v))
 	}
+	this.mutex.RUnlock()
 	sort.Slice(actions, func(i, j int) bool {
-		return actions[i].StartedAt.Nanosecond() < actions[j].StartedAt.Nanosecond()
+		return actions[i].StartedAt.Before(*actions[j].StartedAt)
 	})
 	return actions
 }
 func (this *actionManager) CompletedActions() []*Action {
-	return this.completedActions
+	return (*this.store).Query(ActionQuery{}).Actions
+}
+func (this *actionManager) QueryActions(query ActionQuery) ActionPage {
+	return (*this.store).Query(query)
 }
 func (this *actionManager) StartAction(command string) *Action {
+	return this.StartChildAction("", command)
+}
+func (this *actionManager) StartChildAction(parentId string, command string) *Action {
 	var now = time.Now()
 	var uuid, _ = uuid.NewUUID()
 	a := Action{
 		Id:        uuid.String(),
+		ParentId:  parentId,
 		StartedAt: &now,
 		Command:   command,
-		log:       &bytes.Buffer{},
+		log:       createActionLog(""),
+		owner:     this,
 	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	parentCtx := context.Background()
+	if parent := this.runningActions[parentId]; parent != nil {
+		parentCtx = parent.ctx
+	}
+	a.ctx, a.cancel = context.WithCancel(parentCtx)
 	this.runningActions[uuid.String()] = &a
-	return &a
+	return snapshot(&a)
 }
-func (this *actionManager) LogAction(id string, log string) *Action {
+func (this *actionManager) Cancel(id string) error {
+	this.mutex.RLock()
 	a := this.runningActions[id]
-	if a != nil {
-		if a.Finished() {
-			fmt.Printf("Cannot log action " + a.Command + ": already finished.")
+	this.mutex.RUnlock()
+	if a == nil {
+		return fmt.Errorf("No running action: %v", id)
+	}
+	a.cancel()
+	for _, child := range this.Children(id) {
+		if !child.Finished() {
+			this.Cancel(child.Id)
 		}
-		a.log.WriteString(log)
 	}
-	return a
+	this.CompleteWithError(id, ErrActionCancelled)
+	return nil
 }
-func (this *actionManager) Complete(id string) *Action {
-	return this.CompleteWithMessage(id, "")
+func (this *actionManager) Children(id string) []*Action {
+	children := (*this.store).Query(ActionQuery{ParentId: id}).Actions
+	this.mutex.RLock()
+	for _, v := range this.runningActions {
+		if v.ParentId == id {
+			children = append(children, snapshot(v))
+		}
+	}
+	this.mutex.RUnlock()
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].StartedAt.Before(*children[j].StartedAt)
+	})
+	return children
 }
-func (this *actionManager) CompleteWithMessage(id string, message string) *Action {
-	now := time.Now()
-
+func (this *actionManager) SetSteps(id string, total int) *Action {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
 	a := this.runningActions[id]
+	if a != nil {
+		a.TotalSteps = total
+	}
+	return snapshot(a)
+}
 
+// Marks the next step of an action as done and logs the message given.
+func (this *actionManager) Step(id string, message string) *Action {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	a := this.runningActions[id]
 	if a != nil {
-		if a.Finished() {
-			if message != "" {
-				fmt.Printf("Logging a message to a already completed action: " + a.Command + " - " + message)
-			}
-			return a
-		}
+		a.CompletedSteps++
 		if message != "" {
-			a.log.WriteString(message + "\n")
+			a.log.write(fmt.Sprintf("[%v/%v] %v\n", a.CompletedSteps, a.TotalSteps, message))
 		}
-		delete(this.runningActions, id)
-		a.FinishedAt = &now
-		this.completedActions = append(this.completedActions, a)
 	}
-	return a
+	return snapshot(a)
+}
+func (this *actionManager) LogAction(id string, log string) *Action {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	a := this.runningActions[id]
+	if a != nil {
+		a.log.write(log)
+	}
+	return snapshot(a)
 }
+
+// Returns the current log of an action and a channel receiving any further log output until the
+// action completes. The returned function must be called when done.
+func (this *actionManager) FollowLog(id string) (string, <-chan string, func(), error) {
+	this.mutex.RLock()
+	a := this.runningActions[id]
+	this.mutex.RUnlock()
+	if a == nil {
+		a = (*this.store).Lookup(id)
+	}
+	if a == nil {
+		return "", nil, nil, fmt.Errorf("No such action: %v", id)
+	}
+	log, follower, cancel := a.log.follow()
+	return log, follower, cancel, nil
+}
+func (this *actionManager) Complete(id string) *Action {
+	return this.CompleteWithMessage(id, "")
+}
+func (this *actionManager) CompleteWithMessage(id string, message string) *Action {
+	this.mutex.Lock()
+	a := this.runningActions[id]
+	if a != nil && message != "" {
+		a.log.write(message + "\n")
+	}
+	return this.finish(a)
+}
+
+// Completes an action with the error given, a nil error completes it successfully.
 func (this *actionManager) CompleteWithError(id string, err error) *Action {
-	now := time.Now()
+	if err == nil {
+		return this.Complete(id)
+	}
+	this.mutex.Lock()
 	a := this.runningActions[id]
 	if a != nil {
-		if a.Finished() {
-			fmt.Printf("Completion with error %v, but action is already finished %v(%v)", err, a.Command, a.Id)
-			return a
-		}
-		a.log.WriteString(err.Error() + "\n")
-		delete(this.runningActions, id)
-		a.FinishedAt = &now
+		a.log.write(err.Error() + "\n")
 		a.Error = err
-		this.completedActions = append(this.completedActions, a)
 	}
-	return a
+	return this.finish(a)
+}
+
+// Moves a completed action from the running actions to the store, must be called with the lock
+// held, which it releases. The action is stored before it is removed from the running actions, and
+// its log is closed last, so followers woken by the closed log find it completed.
+func (this *actionManager) finish(a *Action) *Action {
+	if a == nil {
+		this.mutex.Unlock()
+		return nil
+	}
+	now := time.Now()
+	a.FinishedAt = &now
+	// the context is done before completion only, if the action or one of its parents was cancelled
+	a.Cancelled = a.ctx.Err() != nil
+	a.cancel()
+	completed := snapshot(a)
+	this.save(completed)
+	delete(this.runningActions, a.Id)
+	this.mutex.Unlock()
+	a.log.close()
+	return completed
+}
+
+func (this *actionManager) save(action *Action) {
+	err := (*this.store).Save(action)
+	if err != nil {
+		Log().Error("Failed to store action " + action.Command + "(" + action.Id + "): " + err.Error())
+	}
+}
+
+// Copies an action, so it can be handed out without exposing the action changed by the manager.
+func snapshot(action *Action) *Action {
+	if action == nil {
+		return nil
+	}
+	result := *action
+	return &result
+}
+
+// Starts a child action of the given parent, or a top level action if parent is nil.
+func startAction(parent *Action, command string) *Action {
+	if parent == nil {
+		return (*GetActionManager()).StartAction(command)
+	}
+	return parent.StartChild(command)
 }
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"errors"
+	"github.com/gorilla/mux"
+	"gopkg.in/go-playground/assert.v1"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestActionManager_ConcurrentLogging(t *testing.T) {
+	manager := CreateActionManager(CreateMemoryActionStore(ActionRetention{}))
+	action := manager.StartAction("Start Nodes")
+	current, follower, cancel, err := manager.FollowLog(action.Id)
+	defer cancel()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", current)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			manager.LogAction(action.Id, "line "+strconv.Itoa(i)+"\n")
+			manager.RunningActions()
+		}(i)
+	}
+	wg.Wait()
+	manager.CompleteWithMessage(action.Id, "done")
+
+	followed := ""
+	for chunk := range follower {
+		followed += chunk
+	}
+	assert.Equal(t, manager.LookupAction(action.Id).Log(), followed)
+	assert.Equal(t, "COMPLETED", manager.LookupAction(action.Id).Status())
+	assert.Equal(t, 0, len(manager.RunningActions()))
+}
+
+func TestActionManager_ChildActions(t *testing.T) {
+	manager := CreateActionManager(CreateMemoryActionStore(ActionRetention{}))
+	parent := manager.StartAction("Trying to switch to RUNNING Mode")
+	manager.SetSteps(parent.Id, 2)
+	manager.Step(parent.Id, "Entered STARTING Mode...")
+	assert.Equal(t, 50, manager.LookupAction(parent.Id).Progress())
+	assert.Equal(t, "[1/2] Entered STARTING Mode...\n", manager.LookupAction(parent.Id).Log())
+
+	configure := manager.StartChildAction(parent.Id, "Configure Nodes")
+	start := manager.StartChildAction(parent.Id, "Start Nodes")
+	manager.Complete(configure.Id)
+	children := manager.Children(parent.Id)
+	assert.Equal(t, 2, len(children))
+	assert.Equal(t, configure.Id, children[0].Id)
+	assert.Equal(t, "COMPLETED", children[0].Status())
+	assert.Equal(t, start.Id, children[1].Id)
+	assert.Equal(t, "RUNNING", children[1].Status())
+	assert.Equal(t, 0, len(manager.Children(start.Id)))
+}
+
+func TestActionManager_CancelCancelsChildren(t *testing.T) {
+	manager := CreateActionManager(CreateMemoryActionStore(ActionRetention{}))
+	parent := manager.StartAction("Trying to switch to RUNNING Mode")
+	child := manager.StartChildAction(parent.Id, "Start Nodes")
+
+	assert.Equal(t, nil, manager.Cancel(parent.Id))
+	assert.NotEqual(t, nil, child.Context().Err())
+	assert.Equal(t, "CANCELLED", manager.LookupAction(parent.Id).Status())
+	assert.Equal(t, "CANCELLED", manager.LookupAction(child.Id).Status())
+	assert.NotEqual(t, nil, manager.Cancel(parent.Id))
+
+	completed := manager.StartAction("Destroy Nodes")
+	manager.Complete(completed.Id)
+	assert.Equal(t, "COMPLETED", manager.LookupAction(completed.Id).Status())
+	assert.NotEqual(t, nil, completed.Context().Err())
+}
+
+// Blocks the first write until released, so the stream falls behind the action.
+type blockingStreamWriter struct {
+	*httptest.ResponseRecorder
+	blocked chan bool
+	release chan bool
+	once    sync.Once
+	mutex   sync.Mutex
+}
+
+func (this *blockingStreamWriter) Write(data []byte) (int, error) {
+	this.once.Do(func() {
+		close(this.blocked)
+		<-this.release
+	})
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.ResponseRecorder.Write(data)
+}
+
+func TestActionManager_HandsOutSnapshotsOfItsOwnActions(t *testing.T) {
+	manager := CreateActionManager(CreateMemoryActionStore(ActionRetention{}))
+	action := manager.StartAction("Configure Nodes")
+	child := action.StartChild("Write Vagrantfile")
+	assert.Equal(t, 1, len(manager.Children(action.Id)))
+	assert.Equal(t, nil, (*GetActionManager()).LookupAction(child.Id))
+
+	child.CompleteWithError(errors.New("disk full"))
+	// the snapshot does not change, the error is read from the manager
+	assert.Equal(t, nil, child.Error)
+	assert.Equal(t, false, child.Finished())
+	assert.Equal(t, "disk full", child.Err().Error())
+	assert.Equal(t, "ERROR", manager.LookupAction(child.Id).Status())
+
+	// completing with a nil error completes successfully
+	completed := manager.CompleteWithError(action.Id, nil)
+	assert.Equal(t, "COMPLETED", completed.Status())
+	assert.Equal(t, nil, action.Err())
+}
+
+func TestActionStreamHandler_ResyncsDroppedFollowers(t *testing.T) {
+	manager := *GetActionManager()
+	action := manager.StartAction("Stream Test")
+	manager.LogAction(action.Id, "first\n")
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/actions/"+action.Id+"/stream", nil), map[string]string{"id": action.Id})
+	writer := &blockingStreamWriter{ResponseRecorder: httptest.NewRecorder(), blocked: make(chan bool), release: make(chan bool)}
+	done := make(chan bool)
+	go func() {
+		ActionStreamHandler(writer, req)
+		close(done)
+	}()
+	// more output than the follower buffers, while the stream is blocked
+	<-writer.blocked
+	for i := 0; i < 150; i++ {
+		manager.LogAction(action.Id, "line "+strconv.Itoa(i)+"\n")
+	}
+	close(writer.release)
+	time.Sleep(50 * time.Millisecond)
+	writer.mutex.Lock()
+	assert.Equal(t, false, strings.Contains(writer.Body.String(), "event: complete"))
+	writer.mutex.Unlock()
+	manager.LogAction(action.Id, "last\n")
+	manager.CompleteWithMessage(action.Id, "done")
+	<-done
+	body := writer.Body.String()
+	assert.Equal(t, 1, strings.Count(body, "data: line 149\n"))
+	assert.Equal(t, 1, strings.Count(body, "data: line 0\n"))
+	assert.Equal(t, true, strings.Contains(body, "data: last\n"))
+	assert.Equal(t, true, strings.HasSuffix(body, "event: complete\ndata: COMPLETED\n\n"))
+}
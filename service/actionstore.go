@@ -0,0 +1,355 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/winkube/util"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const WINKUBE_ACTIONS_FILE = "winkube-actions.jsonl"
+
+// Default retention used for the completed actions.
+var DefaultActionRetention = ActionRetention{
+	MaxCount: 1000,
+	MaxAge:   30 * 24 * time.Hour,
+}
+
+// Defines how long completed actions are kept. Zero values disable the corresponding limit.
+type ActionRetention struct {
+	MaxCount int
+	MaxAge   time.Duration
+}
+
+// Filter and page definition for querying completed actions.
+type ActionQuery struct {
+	// The status, e.g. COMPLETED, ERROR or CANCELLED, empty matches all.
+	Status string
+	// A case insensitive part of the command, empty matches all.
+	Command string
+	// Only actions started at or after this time.
+	From *time.Time
+	// Only actions started before this time.
+	To *time.Time
+	// Only children of the action with this id, empty matches all.
+	ParentId string
+	// Only top level actions.
+	Roots bool
+	// The page to return, starting with 0.
+	Page     int
+	PageSize int
+}
+
+// A page of completed actions, newest first.
+type ActionPage struct {
+	Actions  []*Action
+	Page     int
+	PageSize int
+	Total    int
+}
+
+func (this ActionPage) Pages() int {
+	if this.PageSize <= 0 {
+		return 1
+	}
+	return (this.Total + this.PageSize - 1) / this.PageSize
+}
+func (this ActionPage) HasPrevious() bool {
+	return this.Page > 0
+}
+func (this ActionPage) HasNext() bool {
+	return this.Page+1 < this.Pages()
+}
+func (this ActionPage) PreviousPage() int {
+	return this.Page - 1
+}
+func (this ActionPage) NextPage() int {
+	return this.Page + 1
+}
+
+// An ActionStore keeps the completed actions.
+type ActionStore interface {
+	// Adds a completed action.
+	Save(action *Action) error
+	// Looks up a completed action, returns nil if not found.
+	Lookup(id string) *Action
+	// Returns all completed actions matching the query, newest first.
+	Query(query ActionQuery) ActionPage
+}
+
+// Creates a store keeping the actions in memory only.
+func CreateMemoryActionStore(retention ActionRetention) *ActionStore {
+	var store ActionStore = &actionStore{
+		retention: retention,
+	}
+	return &store
+}
+
+// Creates a store, which writes the actions as JSON lines to the given file. Existing
+// entries are read on creation.
+func CreateFileActionStore(file string, retention ActionRetention) *ActionStore {
+	store := actionStore{
+		file:      file,
+		retention: retention,
+	}
+	err := store.load()
+	if err != nil {
+		log.Error("Failed to load action history from " + file + ": " + err.Error())
+	}
+	var result ActionStore = &store
+	return &result
+}
+
+// The serialized form of an action.
+type actionRecord struct {
+	Id             string     `json:"id"`
+	ParentId       string     `json:"parentId,omitempty"`
+	StartedAt      *time.Time `json:"startedAt"`
+	FinishedAt     *time.Time `json:"finishedAt"`
+	Command        string     `json:"command"`
+	Description    string     `json:"description,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	TotalSteps     int        `json:"totalSteps,omitempty"`
+	CompletedSteps int        `json:"completedSteps,omitempty"`
+	Cancelled      bool       `json:"cancelled,omitempty"`
+	Log            string     `json:"log"`
+}
+
+func toActionRecord(action *Action) actionRecord {
+	record := actionRecord{
+		Id:             action.Id,
+		ParentId:       action.ParentId,
+		StartedAt:      action.StartedAt,
+		FinishedAt:     action.FinishedAt,
+		Command:        action.Command,
+		Description:    action.Description,
+		TotalSteps:     action.TotalSteps,
+		CompletedSteps: action.CompletedSteps,
+		Cancelled:      action.Cancelled,
+		Log:            action.Log(),
+	}
+	if action.Error != nil {
+		record.Error = action.Error.Error()
+	}
+	return record
+}
+
+func (this actionRecord) toAction() *Action {
+	action := Action{
+		Id:             this.Id,
+		ParentId:       this.ParentId,
+		StartedAt:      this.StartedAt,
+		FinishedAt:     this.FinishedAt,
+		Command:        this.Command,
+		Description:    this.Description,
+		TotalSteps:     this.TotalSteps,
+		CompletedSteps: this.CompletedSteps,
+		Cancelled:      this.Cancelled,
+		log:            createActionLog(this.Log),
+	}
+	if this.Error != "" {
+		action.Error = errors.New(this.Error)
+	}
+	// stored actions are completed, so following their log ends immediately
+	action.log.close()
+	return &action
+}
+
+type actionStore struct {
+	file      string
+	retention ActionRetention
+	actions   []*Action
+	// the number of purged actions still contained in the file
+	stale int
+	mutex sync.RWMutex
+}
+
+func (this *actionStore) Save(action *Action) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.actions = append(this.actions, action)
+	this.stale += this.purge()
+	if this.stale > len(this.actions)/10 {
+		return this.rewrite()
+	}
+	return this.append(action)
+}
+
+func (this *actionStore) Lookup(id string) *Action {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	for _, a := range this.actions {
+		if a.Id == id {
+			return a
+		}
+	}
+	return nil
+}
+
+func (this *actionStore) Query(query ActionQuery) ActionPage {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	var matching []*Action
+	for i := len(this.actions) - 1; i >= 0; i-- {
+		if query.matches(this.actions[i]) {
+			matching = append(matching, this.actions[i])
+		}
+	}
+	page := ActionPage{
+		Actions:  []*Action{},
+		Page:     query.Page,
+		PageSize: query.PageSize,
+		Total:    len(matching),
+	}
+	if query.PageSize <= 0 {
+		page.Actions = append(page.Actions, matching...)
+		return page
+	}
+	start := query.Page * query.PageSize
+	if start < 0 || start >= len(matching) {
+		return page
+	}
+	end := start + query.PageSize
+	if end > len(matching) {
+		end = len(matching)
+	}
+	page.Actions = append(page.Actions, matching[start:end]...)
+	return page
+}
+
+func (this ActionQuery) matches(action *Action) bool {
+	if this.Status != "" && !strings.EqualFold(this.Status, action.Status()) {
+		return false
+	}
+	if this.ParentId != "" && action.ParentId != this.ParentId {
+		return false
+	}
+	if this.Roots && action.ParentId != "" {
+		return false
+	}
+	if this.Command != "" && !strings.Contains(strings.ToLower(action.Command), strings.ToLower(this.Command)) {
+		return false
+	}
+	if this.From != nil && action.StartedAt.Before(*this.From) {
+		return false
+	}
+	if this.To != nil && !action.StartedAt.Before(*this.To) {
+		return false
+	}
+	return true
+}
+
+// Removes all actions exceeding the retention limits, returns the number of actions removed.
+func (this *actionStore) purge() int {
+	count := len(this.actions)
+	if this.retention.MaxAge > 0 {
+		limit := time.Now().Add(-this.retention.MaxAge)
+		var kept []*Action
+		for _, a := range this.actions {
+			if a.FinishedAt == nil || a.FinishedAt.After(limit) {
+				kept = append(kept, a)
+			}
+		}
+		this.actions = kept
+	}
+	if this.retention.MaxCount > 0 && len(this.actions) > this.retention.MaxCount {
+		this.actions = this.actions[len(this.actions)-this.retention.MaxCount:]
+	}
+	return count - len(this.actions)
+}
+
+func (this *actionStore) load() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	f, err := os.Open(this.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		record := actionRecord{}
+		if json.Unmarshal(scanner.Bytes(), &record) == nil && record.FinishedAt != nil {
+			this.actions = append(this.actions, record.toAction())
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	sort.SliceStable(this.actions, func(i, j int) bool {
+		return this.actions[i].FinishedAt.Before(*this.actions[j].FinishedAt)
+	})
+	if this.purge() > 0 {
+		return this.rewrite()
+	}
+	return nil
+}
+
+func (this *actionStore) append(action *Action) error {
+	if this.file == "" {
+		return nil
+	}
+	data, err := json.Marshal(toActionRecord(action))
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(this.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// Writes all actions to a temporary file, which then replaces the store file. The purged actions
+// are counted as stale until the rewrite succeeded, so a failed rewrite is retried.
+func (this *actionStore) rewrite() error {
+	if this.file == "" {
+		this.stale = 0
+		return nil
+	}
+	var buffer bytes.Buffer
+	for _, a := range this.actions {
+		data, err := json.Marshal(toActionRecord(a))
+		if err != nil {
+			return err
+		}
+		buffer.Write(data)
+		buffer.WriteByte('\n')
+	}
+	err := util.WriteFileAtomic(this.file, buffer.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	this.stale = 0
+	return nil
+}
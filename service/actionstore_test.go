@@ -0,0 +1,101 @@
+package service
+
+import (
+	"errors"
+	"gopkg.in/go-playground/assert.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func completedAction(id string, command string, startedAt time.Time, err error) *Action {
+	finishedAt := startedAt.Add(time.Second)
+	return &Action{
+		Id:         id,
+		Command:    command,
+		StartedAt:  &startedAt,
+		FinishedAt: &finishedAt,
+		Error:      err,
+		log:        createActionLog("log of " + id + "\n"),
+	}
+}
+
+func TestActionStore_QueryFiltersAndPages(t *testing.T) {
+	store := *CreateMemoryActionStore(ActionRetention{})
+	start := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		var err error
+		if i%2 == 1 {
+			err = errors.New("failed")
+		}
+		store.Save(completedAction(strconv.Itoa(i), "Start Nodes", start.AddDate(0, 0, i), err))
+	}
+	store.Save(completedAction("5", "Destroy Nodes", start.AddDate(0, 0, 5), nil))
+
+	page := store.Query(ActionQuery{PageSize: 4})
+	assert.Equal(t, 6, page.Total)
+	assert.Equal(t, 2, page.Pages())
+	assert.Equal(t, "5", page.Actions[0].Id)
+	assert.Equal(t, true, page.HasNext())
+	page = store.Query(ActionQuery{Page: 1, PageSize: 4})
+	assert.Equal(t, 2, len(page.Actions))
+	assert.Equal(t, "0", page.Actions[1].Id)
+
+	assert.Equal(t, 2, store.Query(ActionQuery{Status: "error"}).Total)
+	assert.Equal(t, 1, store.Query(ActionQuery{Command: "destroy"}).Total)
+	from := start.AddDate(0, 0, 1)
+	to := start.AddDate(0, 0, 3)
+	page = store.Query(ActionQuery{From: &from, To: &to})
+	assert.Equal(t, 2, page.Total)
+	assert.Equal(t, "2", page.Actions[0].Id)
+}
+
+func TestActionStore_FileIsReloadedWithRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "winkube-actions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, WINKUBE_ACTIONS_FILE)
+	retention := ActionRetention{MaxCount: 3, MaxAge: 24 * time.Hour}
+
+	store := *CreateFileActionStore(file, retention)
+	store.Save(completedAction("old", "Start Nodes", time.Now().AddDate(0, 0, -2), nil))
+	for i := 0; i < 4; i++ {
+		store.Save(completedAction(strconv.Itoa(i), "Start Nodes", time.Now(), errors.New("failed "+strconv.Itoa(i))))
+	}
+	assert.Equal(t, 3, store.Query(ActionQuery{}).Total)
+
+	reloaded := *CreateFileActionStore(file, retention)
+	page := reloaded.Query(ActionQuery{})
+	assert.Equal(t, 3, page.Total)
+	assert.Equal(t, "3", page.Actions[0].Id)
+	assert.Equal(t, "ERROR", page.Actions[0].Status())
+	assert.Equal(t, "failed 3", page.Actions[0].Error.Error())
+	assert.Equal(t, "log of 3\n", page.Actions[0].Log())
+	assert.Equal(t, (*Action)(nil), reloaded.Lookup("old"))
+}
+
+func TestActionStore_FailedRewriteKeepsTheStaleCount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "winkube-actions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := actionStore{
+		file:    filepath.Join(dir, "missing", WINKUBE_ACTIONS_FILE),
+		actions: []*Action{completedAction("1", "Start Nodes", time.Now(), nil)},
+		stale:   5,
+	}
+	assert.NotEqual(t, nil, store.rewrite())
+	assert.Equal(t, 5, store.stale)
+
+	store.file = filepath.Join(dir, WINKUBE_ACTIONS_FILE)
+	assert.Equal(t, nil, store.rewrite())
+	assert.Equal(t, 0, store.stale)
+	reloaded := *CreateFileActionStore(store.file, ActionRetention{})
+	assert.Equal(t, "1", reloaded.Lookup("1").Id)
+}
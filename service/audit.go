@@ -0,0 +1,121 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// The file the audit records are appended to.
+const WINKUBE_AUDIT_FILE = "winkube-audit.jsonl"
+
+// The number of audit records kept in memory.
+const AUDIT_MEMORY_SIZE = 1000
+
+// An audit record of a privileged action or a login.
+type AuditRecord struct {
+	Time       time.Time `json:"time"`
+	User       string    `json:"user"`
+	Role       Role      `json:"role,omitempty"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Allowed    bool      `json:"allowed"`
+	Message    string    `json:"message,omitempty"`
+}
+
+// The AuditLog records privileged actions and logins.
+type AuditLog interface {
+	Record(record AuditRecord) error
+	// The latest records, newest first. A limit <= 0 returns all records kept in memory.
+	Latest(limit int) []AuditRecord
+}
+
+// Creates an audit log appending to the file given, an empty file name keeps the records in memory
+// only. The latest records of an existing file are loaded.
+func CreateAuditLog(file string) *AuditLog {
+	auditLog := auditLog{file: file}
+	auditLog.load()
+	var result AuditLog = &auditLog
+	return &result
+}
+
+type auditLog struct {
+	file    string
+	records []AuditRecord
+	mutex   sync.Mutex
+}
+
+func (this *auditLog) Record(record AuditRecord) error {
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.remember(record)
+	if this.file == "" {
+		return nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(this.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+func (this *auditLog) Latest(limit int) []AuditRecord {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	result := []AuditRecord{}
+	for i := len(this.records) - 1; i >= 0 && (limit <= 0 || len(result) < limit); i-- {
+		result = append(result, this.records[i])
+	}
+	return result
+}
+
+func (this *auditLog) remember(record AuditRecord) {
+	this.records = append(this.records, record)
+	if len(this.records) > AUDIT_MEMORY_SIZE {
+		this.records = this.records[len(this.records)-AUDIT_MEMORY_SIZE:]
+	}
+}
+
+func (this *auditLog) load() {
+	if this.file == "" {
+		return
+	}
+	f, err := os.Open(this.file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		record := AuditRecord{}
+		if json.Unmarshal(scanner.Bytes(), &record) == nil {
+			this.remember(record)
+		}
+	}
+}
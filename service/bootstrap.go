@@ -0,0 +1,342 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/**
+ * Headless bootstrap, which creates the configuration from a seed file and/or WINKUBE_* environment
+ * variables instead of the setup wizard.
+ */
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/winkube/util"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The environment variable naming the seed file, if not passed on the command line.
+const WINKUBE_SEED_ENV = "WINKUBE_SEED"
+
+// Applies a value of an environment variable to the configuration.
+type envSetter func(config *SystemConfiguration, value string) error
+
+// The environment variables supported, they are applied after the seed file.
+var bootstrapEnv = map[string]envSetter{
+	"WINKUBE_HOST_INTERFACE": func(c *SystemConfiguration, v string) error { c.NetHostInterface = v; return nil },
+	"WINKUBE_HOSTNAME":       func(c *SystemConfiguration, v string) error { c.NetHostname = v; return nil },
+	"WINKUBE_HOST_IP":        func(c *SystemConfiguration, v string) error { c.NetHostIP = v; return nil },
+	"WINKUBE_MULTICAST": func(c *SystemConfiguration, v string) error {
+		c.NetMulticastEnabled = util.ParseBool(v)
+		return nil
+	},
+	"WINKUBE_UPNP_PORT":         func(c *SystemConfiguration, v string) error { return parseInt(v, &c.NetUPnPPort) },
+	"WINKUBE_MASTER_CONTROLLER": func(c *SystemConfiguration, v string) error { c.MasterController = v; return nil },
+	"WINKUBE_DRAIN_TIMEOUT":     func(c *SystemConfiguration, v string) error { return parseInt(v, &c.NodeDrainTimeout) },
+	// the host is the cluster controller
+	"WINKUBE_CONTROLLER": func(c *SystemConfiguration, v string) error {
+		if util.ParseBool(v) {
+			c.InitControllerConfig()
+			c.ClusterLogin = nil
+		}
+		return nil
+	},
+	// the host joins the cluster of the controller given
+	"WINKUBE_CONTROLLER_HOST": func(c *SystemConfiguration, v string) error {
+		initClusterLogin(c).ControllerHost = v
+		return nil
+	},
+	"WINKUBE_CLUSTER_ID": func(c *SystemConfiguration, v string) error {
+		if c.IsControllerNode() {
+			c.ControllerConfig.ClusterId = v
+		} else {
+			initClusterLogin(c).ClusterId = v
+		}
+		return nil
+	},
+	"WINKUBE_CLUSTER_CREDENTIALS": func(c *SystemConfiguration, v string) error {
+		if c.IsControllerNode() {
+			c.ControllerConfig.ClusterCredentials = v
+		} else {
+			initClusterLogin(c).ClusterCredentials = v
+		}
+		return nil
+	},
+	"WINKUBE_JOIN_TOKEN": func(c *SystemConfiguration, v string) error {
+		if _, _, err := ParseJoinToken(v); err != nil {
+			return err
+		}
+		initClusterLogin(c).JoinToken = v
+		return nil
+	},
+	"WINKUBE_CA_FINGERPRINT": func(c *SystemConfiguration, v string) error {
+		initClusterLogin(c).CAFingerprint = v
+		return nil
+	},
+	// the host is a standby controller of the cluster joined
+	"WINKUBE_CONTROLLER_CANDIDATE": func(c *SystemConfiguration, v string) error {
+		initClusterLogin(c).ControllerCandidate = util.ParseBool(v)
+		return nil
+	},
+	"WINKUBE_CLUSTER_POD_CIDR": clusterEnv(func(c *ClusterConfig, v string) error {
+		c.ClusterPodCIDR = v
+		return nil
+	}),
+	"WINKUBE_CLUSTER_NET_CIDR": clusterEnv(func(c *ClusterConfig, v string) error {
+		c.ClusterNetCIDR = v
+		return nil
+	}),
+	"WINKUBE_CLUSTER_SERVICE_DOMAIN": clusterEnv(func(c *ClusterConfig, v string) error {
+		c.ClusterServiceDomain = v
+		return nil
+	}),
+	"WINKUBE_CLUSTER_NODE_SUSPECT_TIMEOUT": clusterEnv(func(c *ClusterConfig, v string) error {
+		return parseInt(v, &c.NodeSuspectTimeout)
+	}),
+	"WINKUBE_CLUSTER_NODE_LOST_TIMEOUT": clusterEnv(func(c *ClusterConfig, v string) error {
+		return parseInt(v, &c.NodeLostTimeout)
+	}),
+	"WINKUBE_CLUSTER_NODE_RELEASE_GRACE_PERIOD": clusterEnv(func(c *ClusterConfig, v string) error {
+		return parseInt(v, &c.NodeReleaseGracePeriod)
+	}),
+	"WINKUBE_CLUSTER_VM_NET": clusterEnv(func(c *ClusterConfig, v string) (err error) {
+		c.ClusterVMNet, err = parseNetType(v)
+		return err
+	}),
+	// none, primary or joining
+	"WINKUBE_MASTER": func(c *SystemConfiguration, v string) error {
+		switch strings.ToLower(v) {
+		case "none", "false":
+			c.MasterNode = nil
+		case "primary":
+			c.InitMasterNode(true).IsJoiningNode = false
+		case "joining":
+			c.InitMasterNode(false).IsJoiningNode = true
+		default:
+			return fmt.Errorf("Invalid master mode: %v, expected none, primary or joining.", v)
+		}
+		return nil
+	},
+	"WINKUBE_MASTER_NAME":    nodeEnv("master", setNodeName),
+	"WINKUBE_MASTER_ADDRESS": nodeEnv("master", setNodeAddress),
+	"WINKUBE_MASTER_MEMORY":  nodeEnv("master", setNodeMemory),
+	"WINKUBE_MASTER_CPU":     nodeEnv("master", setNodeCPU),
+	"WINKUBE_WORKER": func(c *SystemConfiguration, v string) error {
+		if util.ParseBool(v) {
+			c.InitWorkerNode()
+		} else {
+			c.WorkerNode = nil
+		}
+		return nil
+	},
+	"WINKUBE_WORKER_NAME":    nodeEnv("worker", setNodeName),
+	"WINKUBE_WORKER_ADDRESS": nodeEnv("worker", setNodeAddress),
+	"WINKUBE_WORKER_MEMORY":  nodeEnv("worker", setNodeMemory),
+	"WINKUBE_WORKER_CPU":     nodeEnv("worker", setNodeCPU),
+}
+
+// Checks if a seed file or any of the bootstrap environment variables is present.
+func BootstrapRequested(seedFile string) bool {
+	if seedFile != "" {
+		return true
+	}
+	for name := range bootstrapEnv {
+		if _, found := os.LookupEnv(name); found {
+			return true
+		}
+	}
+	return false
+}
+
+// Populates the configuration from the seed file (YAML or JSON, using the config file format) and
+// the environment, validates and writes it. The application can then be switched to RUNNING.
+func Bootstrap(seedFile string) error {
+	config := Container().Config
+	action := (*GetActionManager()).StartAction("Bootstrap configuration")
+	if seedFile != "" {
+		action.LogActionLn("Reading seed file " + seedFile + "...")
+		data, err := ioutil.ReadFile(seedFile)
+		if err != nil {
+			return completeBootstrap(action, err)
+		}
+		if err = applySeed(config, data); err != nil {
+			return completeBootstrap(action, fmt.Errorf("Invalid seed file %v: %v", seedFile, err))
+		}
+	}
+	applied, err := applyEnvironment(config, os.LookupEnv)
+	if err != nil {
+		return completeBootstrap(action, err)
+	}
+	if len(applied) > 0 {
+		action.LogActionLn("Applied environment: " + strings.Join(applied, ", "))
+	}
+	if err = config.Validate(); err != nil {
+		return completeBootstrap(action, fmt.Errorf("Bootstrapped config is not valid: %v", err))
+	}
+	writeAction := config.WriteConfig(action)
+	if writeAction != nil && writeAction.Err() != nil {
+		return completeBootstrap(action, writeAction.Err())
+	}
+	action.CompleteWithMessage("Config bootstrapped.")
+	return nil
+}
+
+// Completes the bootstrap action with the error given, which is returned.
+func completeBootstrap(action *Action, err error) error {
+	Log().Error("Bootstrap failed: " + err.Error())
+	action.CompleteWithError(err)
+	return err
+}
+
+// Merges the seed into the configuration. Node and cluster configs in the seed are merged with
+// the defaults used by the setup wizard.
+func applySeed(config *SystemConfiguration, data []byte) error {
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	seed, ok := toJsonValue(raw).(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("expected a map of config values")
+	}
+	if master, found := seed["master"].(map[string]interface{}); found {
+		primary := true
+		if joining, found := master["IsJoiningNode"].(bool); found {
+			primary = !joining
+		}
+		config.InitMasterNode(primary)
+	}
+	if _, found := seed["worker"]; found {
+		config.InitWorkerNode()
+	}
+	if _, found := seed["cluster"]; found {
+		config.InitControllerConfig()
+	}
+	jsonData, err := json.Marshal(seed)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(jsonData, config)
+}
+
+// Converts the maps read by the YAML parser into maps with string keys usable for JSON.
+func toJsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{})
+		for key, item := range v {
+			result[fmt.Sprint(key)] = toJsonValue(item)
+		}
+		return result
+	case []interface{}:
+		for i, item := range v {
+			v[i] = toJsonValue(item)
+		}
+	}
+	return value
+}
+
+// Applies the bootstrap environment variables found, returns the names of the variables applied.
+func applyEnvironment(config *SystemConfiguration, lookup func(string) (string, bool)) ([]string, error) {
+	var applied []string
+	// the node and controller selection must be applied before the properties depending on them
+	ordered := []string{"WINKUBE_CONTROLLER", "WINKUBE_MASTER", "WINKUBE_WORKER"}
+	for name := range bootstrapEnv {
+		if name != ordered[0] && name != ordered[1] && name != ordered[2] {
+			ordered = append(ordered, name)
+		}
+	}
+	sort.Strings(ordered[3:])
+	for _, name := range ordered {
+		value, found := lookup(name)
+		if !found {
+			continue
+		}
+		if err := bootstrapEnv[name](config, value); err != nil {
+			return applied, fmt.Errorf("Invalid value for %v: %v", name, err)
+		}
+		applied = append(applied, name)
+	}
+	return applied, nil
+}
+
+func initClusterLogin(config *SystemConfiguration) *ClusterControllerConnection {
+	if config.ClusterLogin == nil {
+		config.ClusterLogin = &ClusterControllerConnection{}
+	}
+	return config.ClusterLogin
+}
+
+// Creates a setter for a property of the cluster, requires the host to be the controller.
+func clusterEnv(setter func(cluster *ClusterConfig, value string) error) envSetter {
+	return func(config *SystemConfiguration, value string) error {
+		if !config.IsControllerNode() {
+			return fmt.Errorf("cluster properties require WINKUBE_CONTROLLER")
+		}
+		return setter(config.ControllerConfig, value)
+	}
+}
+
+// Creates a setter for a property of the master or worker node, which must have been enabled before.
+func nodeEnv(nodeType string, setter func(node *ClusterNodeConfig, value string) error) envSetter {
+	return func(config *SystemConfiguration, value string) error {
+		node := config.WorkerNode
+		if nodeType == "master" {
+			node = config.MasterNode
+		}
+		if node == nil {
+			return fmt.Errorf("no %v node configured", nodeType)
+		}
+		return setter(node, value)
+	}
+}
+
+func setNodeName(node *ClusterNodeConfig, value string) error {
+	node.NodeName = value
+	return nil
+}
+
+func setNodeAddress(node *ClusterNodeConfig, value string) error {
+	node.NodeAddress = value
+	return nil
+}
+
+func setNodeMemory(node *ClusterNodeConfig, value string) error {
+	return parseInt(value, &node.NodeMemory)
+}
+
+func setNodeCPU(node *ClusterNodeConfig, value string) error {
+	return parseInt(value, &node.NodeCPU)
+}
+
+func parseInt(value string, target *int) error {
+	i, err := strconv.Atoi(value)
+	if err == nil {
+		*target = i
+	}
+	return err
+}
+
+func parseNetType(value string) (VMNetType, error) {
+	for _, netType := range NodeNetType_Values() {
+		if strings.EqualFold(netType.String(), value) {
+			return netType, nil
+		}
+	}
+	return UndefinedNetType, fmt.Errorf("invalid net type: %v, expected NAT or Bridged", value)
+}
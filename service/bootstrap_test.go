@@ -0,0 +1,73 @@
+package service
+
+import (
+	"gopkg.in/go-playground/assert.v1"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBootstrap_SeedIsMergedWithDefaults(t *testing.T) {
+	config := SystemConfiguration{Id: "host-1"}
+	seed := `
+NetHostname: lab-pc-01
+NetUPnPPort: 1900
+cluster:
+  ClusterId: lab
+  ClusterVMNet: 2
+master:
+  NodeName: Master-1
+worker:
+  NodeMemory: 4096
+`
+	assert.Equal(t, nil, applySeed(&config, []byte(seed)))
+	assert.Equal(t, "host-1", config.Id)
+	assert.Equal(t, "lab-pc-01", config.NetHostname)
+	assert.Equal(t, "lab", config.ControllerConfig.ClusterId)
+	assert.Equal(t, Bridged, config.ControllerConfig.ClusterVMNet)
+	assert.Equal(t, "172.16.0.0/16", config.ControllerConfig.ClusterPodCIDR)
+	assert.Equal(t, "Master-1", config.MasterNode.NodeName)
+	assert.Equal(t, true, config.IsPrimaryMaster())
+	assert.Equal(t, 4096, config.WorkerNode.NodeMemory)
+	assert.Equal(t, "Worker", config.WorkerNode.NodeName)
+}
+
+func TestBootstrap_EnvironmentIsApplied(t *testing.T) {
+	env := map[string]string{
+		"WINKUBE_CONTROLLER_HOST":     "controller.lab",
+		"WINKUBE_CLUSTER_ID":          "lab",
+		"WINKUBE_CLUSTER_CREDENTIALS": "secret",
+		"WINKUBE_MASTER":              "joining",
+		"WINKUBE_MASTER_MEMORY":       "3072",
+		"WINKUBE_WORKER":              "false",
+	}
+	config := SystemConfiguration{}
+	config.InitWorkerNode()
+	applied, err := applyEnvironment(&config, func(name string) (string, bool) {
+		value, found := env[name]
+		return value, found
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, len(env), len(applied))
+	assert.Equal(t, "controller.lab", config.ClusterLogin.ControllerHost)
+	assert.Equal(t, "lab", config.ClusterLogin.ClusterId)
+	assert.Equal(t, "secret", config.ClusterLogin.ClusterCredentials)
+	assert.Equal(t, true, config.IsJoiningMaster())
+	assert.Equal(t, 3072, config.MasterNode.NodeMemory)
+	assert.Equal(t, false, config.IsWorkerNode())
+
+	_, err = applyEnvironment(&config, func(name string) (string, bool) {
+		return "10.0.0.0/24", name == "WINKUBE_CLUSTER_NET_CIDR"
+	})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestSystemConfiguration_DrainTimeoutFitsTheDrainLimit(t *testing.T) {
+	assert.Equal(t, true, DEFAULT_DRAIN_TIMEOUT <= MAX_DRAIN_TIMEOUT)
+	assert.Equal(t, time.Duration(270)*time.Second, MAX_DRAIN_TIMEOUT)
+	assert.Equal(t, DEFAULT_DRAIN_TIMEOUT, SystemConfiguration{}.DrainTimeout())
+	assert.Equal(t, 2*time.Minute, SystemConfiguration{NodeDrainTimeout: 120}.DrainTimeout())
+	assert.Equal(t, MAX_DRAIN_TIMEOUT, SystemConfiguration{NodeDrainTimeout: 600}.DrainTimeout())
+	assert.Equal(t, false, strings.Contains(SystemConfiguration{NodeDrainTimeout: 270}.Validate().Error(), "NodeDrainTimeout"))
+	assert.Equal(t, true, strings.Contains(SystemConfiguration{NodeDrainTimeout: 271}.Validate().Error(), "NodeDrainTimeout"))
+}
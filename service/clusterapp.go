@@ -18,9 +18,7 @@
 package service
 
 import (
-	"encoding/json"
 	"github.com/gorilla/mux"
-	"github.com/winkube/util"
 	"github.com/winkube/webapp"
 	"golang.org/x/text/language"
 	"net/http"
@@ -44,30 +42,14 @@ func NodesAction(context *webapp.RequestContext, writer http.ResponseWriter) *we
 	if Container().Config.MasterNode != nil {
 		nodes = append(nodes, Container().Config.MasterNode)
 	}
-	if Container().Config.MasterNode != nil {
+	if Container().Config.WorkerNode != nil {
 		nodes = append(nodes, Container().Config.WorkerNode)
 	}
-	data, err := json.Marshal(nodes)
-	if err == nil {
-		writer.Write(data)
-		writer.WriteHeader(http.StatusOK)
-	} else {
-		writer.WriteHeader(http.StatusInternalServerError)
-	}
-	return &webapp.ActionResponse{
-		Complete: true,
-	}
+	return webapp.JsonResponse(http.StatusOK, nodes)
 }
 
 func ConfigAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
-	// Collect messages
-	config := Container().Config
-	data, err := json.Marshal(config)
-	util.CheckAndLogError("Cannot create Cluster Record", err)
-	writer.Write(data)
-	return &webapp.ActionResponse{
-		Complete: true,
-	}
+	return webapp.JsonResponse(http.StatusOK, Container().Config.Redacted())
 }
 
 //func GetUsedIPAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
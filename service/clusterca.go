@@ -0,0 +1,345 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/winkube/util"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// The files containing the certificate and the private key of the cluster CA on the controller.
+const WINKUBE_CA_CERT_FILE = "winkube-ca.crt"
+const WINKUBE_CA_KEY_FILE = "winkube-ca.key"
+
+// The organizational unit of the certificates the controllers issue for themselves. The hosts only
+// accept requests of the controller with a certificate of this unit.
+const CONTROLLER_CERT_UNIT = "WinKube Controller"
+
+// The lifetime of the cluster CA.
+const CA_VALIDITY = 10 * 365 * 24 * time.Hour
+
+// The lifetime of the host certificates issued by the cluster CA.
+const HOST_CERT_VALIDITY = 90 * 24 * time.Hour
+
+// Host certificates are renewed, when they expire within this period.
+const HOST_CERT_RENEWAL = 30 * 24 * time.Hour
+
+// The certificate authority of a cluster, which issues the certificates of the WinKube hosts
+// taking part in the cluster.
+type CertificateAuthority interface {
+	Certificate() *x509.Certificate
+	// The CA certificate PEM encoded.
+	CertificatePEM() []byte
+	// Signs the PEM encoded certificate request given. The certificate is issued for the common
+	// name given, the DNS names and IP addresses are taken from the request, which is refused, if
+	// it contains names not in allowed. The certificate is valid for server and client
+	// authentication, the result is PEM encoded.
+	Sign(csrPEM []byte, commonName string, allowed []string) ([]byte, error)
+	// Same as Sign, but the certificate identifies a cluster controller, see
+	// IsControllerCertificate. Only issued to the controllers themselves.
+	SignController(csrPEM []byte, commonName string, allowed []string) ([]byte, error)
+}
+
+// Loads the CA of the given cluster from the files given, the CA is created, if the files do not
+// exist yet. The private key is encrypted by the secret store, if given.
+func CreateCertificateAuthority(certFile string, keyFile string, clusterId string, secrets *SecretStore) (*CertificateAuthority, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if os.IsNotExist(err) {
+		return createCertificateAuthority(certFile, keyFile, clusterId, secrets)
+	}
+	if err != nil {
+		return nil, err
+	}
+	stored, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := readCAKey(keyFile, secrets)
+	if err != nil {
+		return nil, err
+	}
+	if secrets != nil && !strings.HasPrefix(string(stored), SECRET_PREFIX) {
+		// keys of older versions are stored in plain
+		if err = writeCAKey(keyFile, keyPEM, secrets); err != nil {
+			return nil, err
+		}
+	}
+	cert, err := parseCertificatePEM(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	var ca CertificateAuthority = &certificateAuthority{cert: cert, certPEM: certPEM, key: key}
+	return &ca, nil
+}
+
+func createCertificateAuthority(certFile string, keyFile string, clusterId string, secrets *SecretStore) (*CertificateAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "WinKube CA " + clusterId, Organization: []string{"WinKube"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(CA_VALIDITY),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := privateKeyPEM(key)
+	if err != nil {
+		return nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err = writeCAKey(keyFile, keyPEM, secrets); err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		return nil, err
+	}
+	var ca CertificateAuthority = &certificateAuthority{cert: cert, certPEM: certPEM, key: key}
+	return &ca, nil
+}
+
+// Reads the PEM encoded CA key, which is decrypted by the secret store, if given. Keys stored in
+// plain are returned as they are.
+func readCAKey(keyFile string, secrets *SecretStore) ([]byte, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil || secrets == nil {
+		return data, err
+	}
+	keyPEM, err := (*secrets).Decrypt(string(data))
+	return []byte(keyPEM), err
+}
+
+// Writes the PEM encoded CA key, which is encrypted by the secret store, if given.
+func writeCAKey(keyFile string, keyPEM []byte, secrets *SecretStore) error {
+	data := string(keyPEM)
+	if secrets != nil {
+		var err error
+		if data, err = (*secrets).Encrypt(data); err != nil {
+			return err
+		}
+	}
+	return util.WriteFileAtomic(keyFile, []byte(data), 0600)
+}
+
+type certificateAuthority struct {
+	cert    *x509.Certificate
+	certPEM []byte
+	key     crypto.Signer
+}
+
+func (this *certificateAuthority) Certificate() *x509.Certificate {
+	return this.cert
+}
+
+func (this *certificateAuthority) CertificatePEM() []byte {
+	return this.certPEM
+}
+
+func (this *certificateAuthority) Sign(csrPEM []byte, commonName string, allowed []string) ([]byte, error) {
+	return this.sign(csrPEM, pkix.Name{CommonName: commonName, Organization: []string{"WinKube"}}, allowed)
+}
+
+func (this *certificateAuthority) SignController(csrPEM []byte, commonName string, allowed []string) ([]byte, error) {
+	return this.sign(csrPEM, pkix.Name{CommonName: commonName, Organization: []string{"WinKube"},
+		OrganizationalUnit: []string{CONTROLLER_CERT_UNIT}}, allowed)
+}
+
+// Signs the request for the subject given, the subject of the request is ignored.
+func (this *certificateAuthority) sign(csrPEM []byte, subject pkix.Name, allowed []string) ([]byte, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("No PEM encoded certificate request found.")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err = csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	if err = checkSubjectNames(csr, allowed); err != nil {
+		return nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	notAfter := time.Now().Add(HOST_CERT_VALIDITY)
+	if notAfter.After(this.cert.NotAfter) {
+		notAfter = this.cert.NotAfter
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		DNSNames:     csr.DNSNames,
+		IPAddresses:  csr.IPAddresses,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, this.cert, csr.PublicKey, this.key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// Checks the certificate request names the allowed DNS names and IP addresses only, so a host
+// cannot get a certificate for another host.
+func checkSubjectNames(csr *x509.CertificateRequest, allowed []string) error {
+	if len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+		return errors.New("Certificate requests must not contain email addresses or URIs.")
+	}
+	for _, name := range csr.DNSNames {
+		if !containsName(allowed, name) {
+			return errors.New("Certificate request for " + name + " is not allowed.")
+		}
+	}
+	for _, ip := range csr.IPAddresses {
+		if !containsName(allowed, ip.String()) {
+			return errors.New("Certificate request for " + ip.String() + " is not allowed.")
+		}
+	}
+	return nil
+}
+
+func containsName(names []string, name string) bool {
+	ip := net.ParseIP(name)
+	for _, n := range names {
+		if ip != nil && ip.Equal(net.ParseIP(n)) || ip == nil && strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Creates a new private key and a certificate request for the host and addresses given, both are
+// returned PEM encoded.
+func createCertificateRequest(hostname string, addresses []string) (keyPEM []byte, csrPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: hostname},
+		DNSNames: []string{hostname, "localhost"},
+	}
+	for _, address := range addresses {
+		if ip := net.ParseIP(address); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if address != "" {
+			template.DNSNames = append(template.DNSNames, address)
+		}
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &template, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err = privateKeyPEM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keyPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// The SHA-256 fingerprint of a certificate, e.g. 3A:0F:...
+func CertificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// Checks if a certificate identifies a cluster controller. The hosts never get such a certificate
+// from the controller, the controllers issue it for themselves.
+func IsControllerCertificate(cert *x509.Certificate) bool {
+	for _, unit := range cert.Subject.OrganizationalUnit {
+		if unit == CONTROLLER_CERT_UNIT {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if a certificate has to be renewed, because it expires within HOST_CERT_RENEWAL.
+func needsRenewal(cert *x509.Certificate) bool {
+	return time.Now().Add(HOST_CERT_RENEWAL).After(cert.NotAfter)
+}
+
+func parseCertificatePEM(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("No PEM encoded certificate found.")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func parsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "EC PRIVATE KEY" {
+		return nil, errors.New("No PEM encoded EC private key found.")
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+func privateKeyPEM(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"crypto/x509"
+	"gopkg.in/go-playground/assert.v1"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCertificateAuthority_IssuesHostCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "winkube-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, WINKUBE_CA_CERT_FILE)
+	keyFile := filepath.Join(dir, WINKUBE_CA_KEY_FILE)
+
+	ca, err := CreateCertificateAuthority(certFile, keyFile, "MyCluster", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, (*ca).Certificate().IsCA)
+	reloaded, err := CreateCertificateAuthority(certFile, keyFile, "MyCluster", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, CertificateFingerprint((*ca).Certificate()), CertificateFingerprint((*reloaded).Certificate()))
+	assert.Equal(t, 95, len(CertificateFingerprint((*ca).Certificate())))
+
+	_, csr, err := createCertificateRequest("host-1", []string{"192.168.1.10", "host-1.local"})
+	assert.Equal(t, nil, err)
+	certPEM, err := (*reloaded).Sign(csr, "worker-1", []string{"host-1", "localhost", "host-1.local", "192.168.1.10"})
+	assert.Equal(t, nil, err)
+	cert, err := parseCertificatePEM(certPEM)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "worker-1", cert.Subject.CommonName)
+	assert.Equal(t, []string{"host-1", "localhost", "host-1.local"}, cert.DNSNames)
+	assert.Equal(t, true, cert.IPAddresses[0].Equal(net.ParseIP("192.168.1.10")))
+	assert.Equal(t, false, needsRenewal(cert))
+	assert.Equal(t, true, cert.NotAfter.Before(time.Now().Add(HOST_CERT_VALIDITY+time.Minute)))
+
+	roots := x509.NewCertPool()
+	roots.AddCert((*ca).Certificate())
+	for _, usage := range []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth} {
+		_, err = cert.Verify(x509.VerifyOptions{Roots: roots, DNSName: "host-1", KeyUsages: []x509.ExtKeyUsage{usage}})
+		assert.Equal(t, nil, err)
+	}
+
+	_, err = (*ca).Sign([]byte("no csr"), "worker-1", nil)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestCertificateAuthority_RefusesForeignNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "winkube-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, err := CreateCertificateAuthority(filepath.Join(dir, WINKUBE_CA_CERT_FILE), filepath.Join(dir, WINKUBE_CA_KEY_FILE), "MyCluster", nil)
+	assert.Equal(t, nil, err)
+	allowed := []string{"host-1", "localhost", "127.0.0.1", "192.168.1.10"}
+
+	_, csr, err := createCertificateRequest("controller-host", []string{"192.168.1.10"})
+	assert.Equal(t, nil, err)
+	_, err = (*ca).Sign(csr, "host-1", allowed)
+	assert.Equal(t, "Certificate request for controller-host is not allowed.", err.Error())
+
+	_, csr, err = createCertificateRequest("host-1", []string{"192.168.1.1"})
+	assert.Equal(t, nil, err)
+	_, err = (*ca).Sign(csr, "host-1", allowed)
+	assert.Equal(t, "Certificate request for 192.168.1.1 is not allowed.", err.Error())
+
+	_, csr, err = createCertificateRequest("HOST-1", []string{"127.0.0.1", "192.168.1.10"})
+	assert.Equal(t, nil, err)
+	_, err = (*ca).Sign(csr, "host-1", allowed)
+	assert.Equal(t, nil, err)
+}
+
+func TestCertificateAuthority_EncryptsTheKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "winkube-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, WINKUBE_CA_CERT_FILE)
+	keyFile := filepath.Join(dir, WINKUBE_CA_KEY_FILE)
+	secrets := mustSecretStore(t)(CreateKeyFileSecretStore(filepath.Join(dir, WINKUBE_MASTER_KEY_FILE)))
+
+	// a CA of an older version with the key stored in plain
+	ca, err := CreateCertificateAuthority(certFile, keyFile, "MyCluster", nil)
+	assert.Equal(t, nil, err)
+	plain, _ := ioutil.ReadFile(keyFile)
+	assert.Equal(t, true, strings.HasPrefix(string(plain), "-----BEGIN"))
+
+	reloaded, err := CreateCertificateAuthority(certFile, keyFile, "MyCluster", secrets)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, CertificateFingerprint((*ca).Certificate()), CertificateFingerprint((*reloaded).Certificate()))
+	stored, _ := ioutil.ReadFile(keyFile)
+	assert.Equal(t, true, strings.HasPrefix(string(stored), SECRET_PREFIX))
+	keyPEM, err := readCAKey(keyFile, secrets)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, string(plain), string(keyPEM))
+}
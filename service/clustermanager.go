@@ -16,20 +16,29 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/winkube/service/netutil"
 	"github.com/winkube/util"
 	"github.com/winkube/webapp"
 	"golang.org/x/text/language"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// The timeout of cluster API calls, and of the commands executed on the local nodes.
+const CLUSTER_API_TIMEOUT = 30 * time.Second
+const CLUSTER_EXEC_TIMEOUT = 5 * time.Minute
+
 type Endpoint int
 
 const (
@@ -46,6 +55,11 @@ type Node struct {
 	Host      string    `json:"host"`
 	Timestamp time.Time `json:"timestamp"`
 	Endpoint  string    `json:"endpoint"`
+	// The liveness evaluated by the controller from the heartbeats, the timestamp is the time of the
+	// last heartbeat.
+	State NodeState `json:"state,omitempty"`
+	// The IPs reserved for the node, released when the node is lost.
+	Addresses []string `json:"addresses,omitempty"`
 }
 
 type Cluster struct {
@@ -65,9 +79,12 @@ type ControllerDelegate interface {
 	Stop() error
 	GetClusterId() string
 	GetClusterConfig() ClusterConfig
-	Exec(command string) string
+	// Executes an operation on a node of the cluster, routed to the host running the node.
+	Exec(request OperationRequest) (ExecResult, error)
 	ReserveNodeIP(master bool) string
 	ReleaseNodeIP(string)
+	// Registers the heartbeat of a node.
+	Heartbeat(node Node) error
 }
 
 type LocalController interface {
@@ -79,18 +96,27 @@ type LocalController interface {
 	GetState() string
 	ReserveNodeIP(master bool) string
 	ReleaseNodeIP(string)
-	DrainNode(node Node)
-	CordonNode(node Node)
+	CordonNode(nodeName string) error
+	UncordonNode(nodeName string) error
+	DrainNode(nodeName string, timeout time.Duration) error
+	// Executes an operation on a node of the cluster, an empty node selects a master.
+	Exec(request OperationRequest) (ExecResult, error)
+	// The lease of the controller leading the cluster, nil if not running.
+	GetLease() *ControllerLease
+	// Registers a listener notified about the node events, while this host leads the cluster.
+	AddNodeListener(listener NodeListener)
 
 	GetKnownClusters() []Cluster
 	GetClusterById(clusterId string) *Cluster
 	UpdateCluster(clusterId string) *Cluster
 }
 
-func CreateLocalController(serviceRegistry *netutil.ServiceRegistry) *LocalController {
+// Creates the local controller, the clusters managed locally are restored from the store given.
+func CreateLocalController(serviceRegistry *netutil.ServiceRegistry, clusters *ClusterStore) *LocalController {
 	var cm = localController{
 		knownClusters:   make(map[string]*Cluster),
 		serviceRegistry: serviceRegistry,
+		clusters:        clusters,
 	}
 	var CM LocalController = &cm
 	return &CM
@@ -103,7 +129,7 @@ func createLocalControllerNode(clusterId string, nodeId string) *Node {
 		NodeType:  Controller,
 		Host:      hostname(),
 		Timestamp: time.Now(),
-		Endpoint:  "http://" + hostname() + ":9999/cluster",
+		Endpoint:  "https://" + hostname() + ":9999/cluster",
 	}
 	return &cn
 }
@@ -113,28 +139,55 @@ func createLocalControllerNode(clusterId string, nodeId string) *Node {
 // controllerConnection.
 func createClusterManagerWebApp(controller *localControllerDelegate) *webapp.WebApplication {
 	webapp := webapp.CreateWebApp("cluster", "", language.English)
-	webapp.AuthAction = controllerAuthAction
+	webapp.JSONErrors = true
+	instrumentWebApp(webapp)
+	webapp.Use(controllerAuthFilter)
 	webapp.GetAction("/cluster/id", controller.actionClusterId)
+	webapp.GetAction("/cluster/ca", actionClusterCA)
+	webapp.PostAction("/cluster/certificate", actionIssueCertificate)
 	webapp.GetAction("/cluster/known", actionKnownIds)
 	webapp.GetAction("/cluster", controller.actionServeClusterConfig)
 	webapp.GetAction("/cluster/ClusterState", actionClusterState)
 	webapp.GetAction("/cluster/nodeip", controller.actionReserveNodeIP)
-	webapp.DeleteAction("/cluster/nodeip", controller.actionReleaseNodeIP)
+	webapp.DeleteAction("/cluster/nodeip/{address}", controller.actionReleaseNodeIP)
 	webapp.PostAction("/cluster/node", controller.actionNodeStarted)
-	webapp.DeleteAction("/cluster/node", controller.actionNodeStopped)
+	webapp.DeleteAction("/cluster/node/{id}", controller.actionNodeStopped)
 	webapp.GetAction("/cluster/masters", controller.actionGetMasters)
+	webapp.GetAction("/cluster/masters/{id}", controller.actionGetMaster)
 	webapp.GetAction("/cluster/workers", controller.actionGetWorkers)
+	webapp.GetAction("/cluster/workers/{id}", controller.actionGetWorker)
+	webapp.GetAction("/cluster/lease", controller.actionLease)
+	webapp.GetAction("/cluster/replica", controller.actionReplica)
+	webapp.PostAction("/cluster/exec", controller.actionExec)
+	// query parameter based paths of older hosts
+	webapp.DeleteAction("/cluster/nodeip", controller.actionReleaseNodeIP)
+	webapp.DeleteAction("/cluster/node", controller.actionNodeStopped)
 	webapp.GetAction("/master", actionMasterState)
 	webapp.GetAction("/worker", actionWorkerState)
-	webapp.GetAction("/master/exec", controller.actionMasterExecCommand)
-	webapp.GetAction("/worker/exec", controller.actionWorkerExecCommand)
+	// read-only operations may be executed with GET, operations changing the cluster require POST
+	webapp.GetAction("/master/exec", actionMasterExecOperation)
+	webapp.PostAction("/master/exec", actionMasterExecOperation)
+	webapp.GetAction("/worker/exec", actionWorkerExecOperation)
+	webapp.PostAction("/worker/exec", actionWorkerExecOperation)
+	webapp.GetAction("/master/operations", actionMasterOperations)
+	webapp.GetAction("/worker/operations", actionWorkerOperations)
+	webapp.DefaultTimeout = CLUSTER_API_TIMEOUT
+	webapp.SetTimeout("GET", "/master/exec", CLUSTER_EXEC_TIMEOUT)
+	webapp.SetTimeout("POST", "/master/exec", CLUSTER_EXEC_TIMEOUT)
+	webapp.SetTimeout("GET", "/worker/exec", CLUSTER_EXEC_TIMEOUT)
+	webapp.SetTimeout("POST", "/worker/exec", CLUSTER_EXEC_TIMEOUT)
+	// the command is forwarded to the host running the node
+	webapp.SetTimeout("POST", "/cluster/exec", CLUSTER_EXEC_TIMEOUT+CLUSTER_API_TIMEOUT)
 	return webapp
 }
 
-func initHeaders(headers *http.Header) {
+// Signs a request to the controller API with the join token of this node.
+func signRequest(req *http.Request) error {
 	config := Container().Config
-	headers.Set("clusterid", config.ClusterId())
-	headers.Set("clustercredentials", config.ClusterCredentials())
+	if config.ClusterLogin == nil || config.ClusterLogin.JoinToken == "" {
+		return errors.New("No join token configured to call the cluster controller.")
+	}
+	return SignRequest(req, config.ClusterLogin.JoinToken)
 }
 
 // The cluster manager is the proxy management component which connects this machine with the overall
@@ -145,13 +198,21 @@ type localController struct {
 	controllerDelegate *ControllerDelegate      `validate:"required"`
 	clusterId          string                   `validate:"required"`
 	knownClusters      map[string]*Cluster
+	clusters           *ClusterStore
+	// replicates the leader, if this host is a standby controller
+	standby *controllerStandby
+	// sends the heartbeats of the local nodes
+	heartbeat     *nodeHeartbeat
+	nodeListeners []NodeListener
+	// serves the commands the controller executes on the local nodes, if another host leads
+	hostApi *http.Server
 }
 
 func (c *localController) Start(config *SystemConfiguration) error {
 	Log().Info("Starting local controller...")
 	var err error
 	if config.IsControllerNode() {
-		err = c.startLocal(config, config.Id)
+		err = c.startController(config)
 	} else {
 		err = c.startRemote(*config.ClusterLogin)
 	}
@@ -168,6 +229,13 @@ func (c *localController) Start(config *SystemConfiguration) error {
 	if !util.CheckAndLogError("Failed to configure local Nodes.", err) {
 		return err
 	}
+	c.heartbeat = &nodeHeartbeat{
+		nodes: localNodes(config),
+		send: func(node Node) error {
+			return (*c.controllerDelegate).Heartbeat(node)
+		},
+	}
+	c.heartbeat.Start()
 	var l netutil.ServiceListener = *c
 	(*c.serviceRegistry).Listen(&l)
 	return nil
@@ -231,24 +299,53 @@ func (c *localController) ensureRunning() {
 	}
 }
 
-func (c *localController) DrainNode(node Node) {
-	cluster := c.GetClusterById(node.ClusterId)
-	if cluster != nil {
-		controller := cluster.Controller
-		if controller != nil {
-			c.execRemote(controller, "kubectl drain node "+node.Name)
-		}
+// Evicts all workload from the given Kubernetes node, waiting at most for the given timeout, which
+// is limited to MAX_DRAIN_TIMEOUT.
+func (c *localController) DrainNode(nodeName string, timeout time.Duration) error {
+	if timeout > MAX_DRAIN_TIMEOUT {
+		Log().Warn(fmt.Sprintf("Drain timeout %v of node %v exceeds the limit, using %v.", timeout, nodeName, MAX_DRAIN_TIMEOUT))
+		timeout = MAX_DRAIN_TIMEOUT
 	}
+	_, err := c.masterOperation("drain", "node", nodeName, "timeout", strconv.Itoa(int(timeout.Seconds()))+"s")
+	return err
 }
 
-func (c *localController) CordonNode(node Node) {
-	cluster := c.GetClusterById(node.ClusterId)
-	if cluster != nil {
-		controller := cluster.Controller
-		if controller != nil {
-			c.execRemote(controller, "kubectl cordon node "+node.Name)
-		}
+// Marks the given Kubernetes node as unschedulable.
+func (c *localController) CordonNode(nodeName string) error {
+	_, err := c.masterOperation("cordon", "node", nodeName)
+	return err
+}
+
+// Marks the given Kubernetes node as schedulable again.
+func (c *localController) UncordonNode(nodeName string) error {
+	_, err := c.masterOperation("uncordon", "node", nodeName)
+	return err
+}
+
+// Executes an operation on a master, the parameters are passed as name value pairs. The output
+// is returned, an error if the operation failed.
+func (c *localController) masterOperation(operation string, params ...string) (string, error) {
+	request := OperationRequest{Operation: operation, Params: make(map[string]string)}
+	for i := 0; i+1 < len(params); i += 2 {
+		request.Params[params[i]] = params[i+1]
+	}
+	result, err := c.Exec(request)
+	if err != nil {
+		return "", err
+	}
+	return result.Stdout, result.Err()
+}
+
+// Executes an operation on the node requested. Operations for the nodes of this host, or for a
+// master if this host runs one, are executed locally, all others are routed by the controller.
+func (c *localController) Exec(request OperationRequest) (ExecResult, error) {
+	if localNodeConfig(Container().Config, request.Node) != nil {
+		return execOperation(request)
 	}
+	if c.controllerDelegate == nil {
+		return ExecResult{}, errors.New("Local controller is not running.")
+	}
+	return (*c.controllerDelegate).Exec(request)
 }
 
 func (c *localController) IsRunning() bool {
@@ -259,33 +356,91 @@ func (c *localController) GetState() string {
 	if c.controllerDelegate == nil {
 		return "Uninitialized controller."
 	}
-	return (*c.controllerDelegate).Exec("kubectl get Nodes")
+	nodes, err := c.masterOperation("get-nodes")
+	if err != nil {
+		return err.Error()
+	}
+	return nodes
 }
 
-func (this *localController) startLocal(config *SystemConfiguration, nodedId string) error {
-	Log().Info("Starting local cluster controller for cluster: " + config.ControllerConfig.ClusterId)
-	this.clusterId = config.ControllerConfig.ClusterId
-	clusterState := this.knownClusters[config.ControllerConfig.ClusterId]
+// Starts the controller configured on this host. If a standby controller has taken over while
+// this host was down, this host follows it instead of leading the cluster.
+func (this *localController) startController(config *SystemConfiguration) error {
+	clusterId := config.ControllerConfig.ClusterId
+	err := (*Container().ClusterTLS).InitController(clusterId)
+	if err != nil {
+		return err
+	}
+	if record := (*this.clusters).Lookup(clusterId); record != nil && len(record.Candidates) > 0 {
+		joinToken, err := controllerToken()
+		if err != nil {
+			return err
+		}
+		lease := winningLease(fetchLeases(otherHosts(record.Candidates), joinToken))
+		if lease != nil && lease.Leader != hostname() {
+			Log().Info(fmt.Sprintf("Controller %v has taken over cluster %v in term %v.", lease.Leader, clusterId, lease.Term))
+			return this.follow(*lease, joinToken)
+		}
+	}
+	return this.startLocal(config.ControllerConfig, config.Id)
+}
+
+func (this *localController) startLocal(clusterConfig *ClusterConfig, nodedId string) error {
+	Log().Info("Starting local cluster controller for cluster: " + clusterConfig.ClusterId)
+	this.clusterId = clusterConfig.ClusterId
+	clusterState := this.knownClusters[clusterConfig.ClusterId]
+	var reservedIPs []string
+	var candidates []string
+	var term int64
 	if clusterState == nil {
 		clusterState = &Cluster{
-			ClusterConfig: config.ControllerConfig,
-			Controller:    createLocalControllerNode(config.ControllerConfig.ClusterId, nodedId),
+			ClusterConfig: clusterConfig,
+			Controller:    createLocalControllerNode(clusterConfig.ClusterId, nodedId),
 			Masters:       make(map[string]Node),
 			Workers:       make(map[string]Node),
 		}
-		this.knownClusters[config.ControllerConfig.ClusterId] = clusterState
+		if record := (*this.clusters).Lookup(clusterConfig.ClusterId); record != nil {
+			Log().Info(fmt.Sprintf("Restored cluster %v: %v masters, %v workers, %v reserved IPs.",
+				record.ClusterId, len(record.Masters), len(record.Workers), len(record.ReservedIPs)))
+			clusterState.Masters = record.Masters
+			clusterState.Workers = record.Workers
+			reservedIPs = record.ReservedIPs
+			// the nodes could not reach this controller while it was down
+			for _, nodes := range []map[string]Node{clusterState.Masters, clusterState.Workers} {
+				for id, node := range nodes {
+					node.Timestamp = time.Now()
+					nodes[id] = node
+				}
+			}
+			candidates = record.Candidates
+			term = record.Term
+		}
+		this.knownClusters[clusterConfig.ClusterId] = clusterState
 	} else {
 		if clusterState.Controller.Host != hostname() {
-			panic(fmt.Sprint("Cluster is remotedly managed. Cannot start a local controllerConnection for &v", config.ClusterId))
+			panic(fmt.Sprintf("Cluster is remotedly managed. Cannot start a local controllerConnection for %v", clusterConfig.ClusterId))
 		}
 	}
+	joinToken, err := controllerToken()
+	if err != nil {
+		return err
+	}
 	clController := localControllerDelegate{
 		clusterState:   clusterState,
-		clusterNetCIDR: netutil.CreateCIDR(config.ControllerConfig.ClusterNetCIDR),
+		clusterNetCIDR: netutil.CreateCIDR(clusterConfig.ClusterNetCIDR),
+		reservedIPs:    reservedIPs,
+		store:          this.clusters,
+		mutex:          &sync.Mutex{},
+		// every start of a leader begins a new term
+		term:       term + 1,
+		candidates: candidates,
+		joinToken:  joinToken,
+		stepDown:   this.stepDown,
+		listener:   this.notifyNodeListeners,
 	}
 	var cctl ControllerDelegate = &clController
 	this.controllerDelegate = &cctl
-	err := Container().Validator.Struct(this)
+	err = Container().Validator.Struct(this)
 	if !util.CheckAndLogError("Failed to start local controllerConnection.", err) {
 		panic(err)
 	}
@@ -294,13 +449,15 @@ func (this *localController) startLocal(config *SystemConfiguration, nodedId str
 
 func (this *localController) startRemote(clusterConnection ClusterControllerConnection) error {
 	Log().Info("Connecting to remote cluster: " + clusterConnection.ClusterId + "...")
-	clusterConfig, err := loadRemoteConfig(clusterConnection)
-	if !util.CheckAndLogError("Failed to start local controllerConnection.", err) {
+	this.clusterId = clusterConnection.ClusterId
+	err := (*Container().ClusterTLS).InitHost(clusterConnection)
+	if !util.CheckAndLogError("Failed to initialize the cluster TLS credentials.", err) {
 		return err
 	}
-	clController := remoteControllerDelegate{
-		controllerConnection: clusterConnection,
-		config:               clusterConfig,
+	clController := createRemoteControllerDelegate(clusterConnection, this.clusters)
+	err = clController.Start()
+	if !util.CheckAndLogError("Failed to start local controllerConnection.", err) {
+		return err
 	}
 	var cctl ControllerDelegate = clController
 	this.controllerDelegate = &cctl
@@ -308,10 +465,116 @@ func (this *localController) startRemote(clusterConnection ClusterControllerConn
 	if !util.CheckAndLogError("Failed to start cluster manager.", err) {
 		panic(err)
 	}
-	return clController.Start()
+	this.startHostApi()
+	if clusterConnection.ControllerCandidate {
+		this.startStandby(clController)
+	}
+	return nil
+}
+
+// Follows the controller leading the cluster as standby controller.
+func (this *localController) follow(lease ControllerLease, joinToken string) error {
+	Log().Info("Following controller " + lease.Leader + " of cluster " + lease.ClusterId + "...")
+	this.clusterId = lease.ClusterId
+	clController := createRemoteControllerDelegate(ClusterControllerConnection{
+		ClusterId:           lease.ClusterId,
+		ControllerHost:      lease.Leader,
+		JoinToken:           joinToken,
+		ControllerCandidate: true,
+	}, this.clusters)
+	clController.candidates = lease.Candidates
+	err := clController.Start()
+	if err != nil {
+		return err
+	}
+	var cctl ControllerDelegate = clController
+	this.controllerDelegate = &cctl
+	this.startHostApi()
+	this.startStandby(clController)
+	return nil
+}
+
+// Starts replicating the leader the delegate given is connected to.
+func (this *localController) startStandby(leader *remoteControllerDelegate) {
+	standby := createControllerStandby(this.clusterId, leader.host(), leader.controllerConnection.JoinToken, this.clusters)
+	standby.takeover = this.takeover
+	standby.follow = leader.follow
+	this.standby = standby
+	standby.Start()
+}
+
+// Leads the cluster replicated by this standby controller.
+func (this *localController) takeover(replica *ControllerReplica) error {
+	if this.controllerDelegate != nil {
+		(*this.controllerDelegate).Stop()
+	}
+	this.standby = nil
+	// the cluster API is served on the same port
+	this.stopHostApi()
+	delete(this.knownClusters, replica.Lease.ClusterId)
+	config := replica.Config
+	err := (*Container().ClusterTLS).InitController(config.ClusterId)
+	if err == nil {
+		err = this.startLocal(&config, Container().Config.Id)
+	}
+	if err == nil {
+		Log().Info("Took over cluster " + config.ClusterId + ".")
+	}
+	return err
+}
+
+// Stops leading the cluster, since another controller has taken over, and follows it.
+func (this *localController) stepDown(lease ControllerLease) {
+	Log().Warn(fmt.Sprintf("Controller %v leads cluster %v in term %v, stepping down.", lease.Leader, lease.ClusterId, lease.Term))
+	if this.controllerDelegate != nil {
+		(*this.controllerDelegate).Stop()
+	}
+	delete(this.knownClusters, lease.ClusterId)
+	joinToken, err := controllerToken()
+	if err == nil {
+		err = this.follow(lease, joinToken)
+	}
+	util.CheckAndLogError("Failed to follow controller "+lease.Leader+".", err)
+}
+
+// The lease of the controller leading the cluster, as known by this host.
+func (this *localController) GetLease() *ControllerLease {
+	if this.controllerDelegate == nil {
+		return nil
+	}
+	switch delegate := (*this.controllerDelegate).(type) {
+	case *localControllerDelegate:
+		lease := delegate.Lease()
+		return &lease
+	case *remoteControllerDelegate:
+		lease := delegate.Lease()
+		return &lease
+	}
+	return nil
+}
+
+func (this *localController) AddNodeListener(listener NodeListener) {
+	this.nodeListeners = append(this.nodeListeners, listener)
+}
+
+// Passes a node event to all listeners.
+func (this *localController) notifyNodeListeners(event NodeEvent) {
+	for _, listener := range this.nodeListeners {
+		listener(event)
+	}
 }
 
 func (this *localController) Stop() error {
+	if this.heartbeat != nil {
+		this.heartbeat.Stop()
+		this.heartbeat = nil
+	}
+	this.stopHostApi()
+	(*Container().ClusterTLS).Stop()
+	if this.standby != nil {
+		this.standby.Stop()
+		this.standby = nil
+	}
 	if this.controllerDelegate != nil {
 		(*this.controllerDelegate).Stop()
 		this.controllerDelegate = nil
@@ -349,12 +612,26 @@ func (this *localController) GetCluster() *Cluster {
 
 func (this *localController) GetKnownClusters() []Cluster {
 	clusters := []Cluster{}
-	for _, v := range this.knownClusters {
+	for id, v := range this.knownClusters {
+		if delegate, local := this.localDelegate(); local && id == this.clusterId {
+			// the cluster led by this host is updated concurrently
+			clusters = append(clusters, delegate.snapshot())
+			continue
+		}
 		clusters = append(clusters, *v)
 	}
 	return clusters
 }
 
+// The delegate of the cluster, if led by this host.
+func (this *localController) localDelegate() (*localControllerDelegate, bool) {
+	if this.controllerDelegate == nil {
+		return nil, false
+	}
+	delegate, local := (*this.controllerDelegate).(*localControllerDelegate)
+	return delegate, local
+}
+
 func (this *localController) GetOrCreateClusterById(clusterId string) *Cluster {
 	cluster := this.knownClusters[clusterId]
 	if cluster == nil {
@@ -371,72 +648,168 @@ func (this *localController) UpdateAndGetClusterById(clusterName string) *Cluste
 	return this.GetClusterById(clusterName)
 }
 
-// Execute the given command on the (controller) node given.
-func (c *localController) execRemote(node *Node, command string) {
-	panic("execRemote not implemented!")
-}
-
 // A remote ClusterControlPane is an passive management component that delegates cluster management to the
 // current active cluster controllerConnection, which resideds on another host. It caches and regularly updates
-// current cloud configuration from its master controllerConnection.
+// current cloud configuration from its master controllerConnection. If the controller cannot be reached, the
+// calls fail over to the standby controller, which has taken over.
 type remoteControllerDelegate struct {
 	controllerConnection ClusterControllerConnection `validate:"required"`
 	config               *ClusterConfig              // will be loaded from the controllerConnection...
+	// the hosts able to lead the cluster, asked for the leader on failover
+	candidates []string
+	term       int64
+	mutex      sync.Mutex
 }
 
-func (r remoteControllerDelegate) Start() error {
-	config, err := loadRemoteConfig(r.controllerConnection)
-	if err == nil {
-		r.config = config
+// Creates the delegate for the controller given, the standby controllers are restored from the
+// store given, if known.
+func createRemoteControllerDelegate(connection ClusterControllerConnection, store *ClusterStore) *remoteControllerDelegate {
+	delegate := remoteControllerDelegate{
+		controllerConnection: connection,
 	}
-	return err
+	if record := (*store).Lookup(connection.ClusterId); record != nil {
+		delegate.candidates = record.Candidates
+		delegate.term = record.Term
+	}
+	return &delegate
 }
 
-func (r remoteControllerDelegate) Exec(command string) string {
-	data, err := performGet("http://" + r.controllerConnection.ControllerHost + ":9999/cluster/exec&cmd=" + command)
+func (r *remoteControllerDelegate) Start() error {
+	data, err := r.call(http.MethodGet, "/cluster")
 	if err != nil {
-		Log().Error("Exec", err)
-		return ""
+		return err
 	}
-	return string(data)
+	config := &ClusterConfig{}
+	if err = json.Unmarshal(data, config); err != nil {
+		return err
+	}
+	lease := ControllerLease{}
+	data, err = r.call(http.MethodGet, "/cluster/lease")
+	if err == nil {
+		err = json.Unmarshal(data, &lease)
+	}
+	if err != nil {
+		// controllers of older versions do not serve their lease
+		Log().Warn("The lease of controller " + r.host() + " is not available: " + err.Error())
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.config = config
+	if lease.Leader != "" {
+		r.candidates = lease.Candidates
+		r.term = lease.Term
+	}
+	return nil
+}
+
+// The host of the controller currently leading the cluster.
+func (r *remoteControllerDelegate) host() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.controllerConnection.ControllerHost
 }
 
-func (r remoteControllerDelegate) Stop() error {
+// The lease of the controller currently called.
+func (r *remoteControllerDelegate) Lease() ControllerLease {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return ControllerLease{
+		ClusterId:  r.controllerConnection.ClusterId,
+		Leader:     r.controllerConnection.ControllerHost,
+		Term:       r.term,
+		Candidates: append([]string{}, r.candidates...),
+	}
+}
+
+// Calls the cluster API of the controller. If it cannot be reached, the call is repeated with the
+// controller, which has taken over.
+func (r *remoteControllerDelegate) call(method string, path string) ([]byte, error) {
+	return r.send(method, path, nil)
+}
+
+// Same as call, but sends the body given.
+func (r *remoteControllerDelegate) send(method string, path string, body []byte) ([]byte, error) {
+	data, err := performRequest(method, "https://"+r.host()+":9999"+path, body, r.controllerConnection.JoinToken)
+	if _, unreachable := err.(*url.Error); !unreachable || !r.failover() {
+		return data, err
+	}
+	return performRequest(method, "https://"+r.host()+":9999"+path, body, r.controllerConnection.JoinToken)
+}
+
+// Asks the standby controllers for the controller leading the cluster. Returns true, if another
+// controller has taken over.
+func (r *remoteControllerDelegate) failover() bool {
+	current := r.host()
+	others := []string{}
+	for _, candidate := range otherHosts(r.Lease().Candidates) {
+		if candidate != current {
+			others = append(others, candidate)
+		}
+	}
+	lease := winningLease(fetchLeases(others, r.controllerConnection.JoinToken))
+	if lease == nil {
+		return false
+	}
+	r.follow(*lease)
+	return true
+}
+
+// Calls the controller of the lease given from now on. The controller host configured is updated,
+// so the controller is also used after a restart.
+func (r *remoteControllerDelegate) follow(lease ControllerLease) {
+	r.mutex.Lock()
+	previous := r.controllerConnection.ControllerHost
+	r.controllerConnection.ControllerHost = lease.Leader
+	r.candidates = lease.Candidates
+	r.term = lease.Term
+	r.mutex.Unlock()
+	if previous == lease.Leader {
+		return
+	}
+	Log().Info(fmt.Sprintf("Controller %v has taken over cluster %v from %v in term %v.", lease.Leader, lease.ClusterId, previous, lease.Term))
+	config := Container().Config
+	if config.ClusterLogin != nil && config.ClusterLogin.ClusterId == lease.ClusterId {
+		config.ClusterLogin.ControllerHost = lease.Leader
+		config.WriteConfig(nil)
+	}
+}
+
+func (r *remoteControllerDelegate) Stop() error {
 	// nothing to do
 	return nil
 }
 
-func (r remoteControllerDelegate) GetClusterId() string {
+func (r *remoteControllerDelegate) GetClusterId() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 	if r.config != nil {
 		return r.config.ClusterId
 	}
 	return ""
 }
 
-func (r remoteControllerDelegate) getConfig() ClusterConfig {
+func (r *remoteControllerDelegate) getConfig() ClusterConfig {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 	if r.config == nil {
 		// TODO load config from controllerConnection
 	}
 	return *r.config
 }
 
-func (r remoteControllerDelegate) GetClusterConfig() ClusterConfig {
+func (r *remoteControllerDelegate) GetClusterConfig() ClusterConfig {
 	return r.getConfig()
 }
 
-func (r remoteControllerDelegate) GetState() string {
-	return r.masterRemoteExec("kubectl get Nodes")
-}
-
-func (r remoteControllerDelegate) GetMasters() []Node {
+func (r *remoteControllerDelegate) GetMasters() []Node {
 	// Call controllerConnection to get master list
-	data, err := performGet("http://" + r.controllerConnection.ControllerHost + ":9999/cluster/masters")
+	data, err := r.call(http.MethodGet, "/cluster/masters")
 	if err != nil {
 		Log().Error("GetMasters", err)
 		return []Node{}
 	}
 	var nodes []Node
-	err = json.Unmarshal(data, nodes)
+	err = json.Unmarshal(data, &nodes)
 	if err != nil {
 		Log().Error("GetMasters", err)
 		return []Node{}
@@ -444,15 +817,15 @@ func (r remoteControllerDelegate) GetMasters() []Node {
 	return nodes
 }
 
-func (r remoteControllerDelegate) GetWorkers() []Node {
+func (r *remoteControllerDelegate) GetWorkers() []Node {
 	// Call controllerConnection to get worker list
-	data, err := performGet("http://" + r.controllerConnection.ControllerHost + ":9999/cluster/workers")
+	data, err := r.call(http.MethodGet, "/cluster/workers")
 	if err != nil {
 		Log().Error("GetWorkers", err)
 		return []Node{}
 	}
 	var nodes []Node
-	err = json.Unmarshal(data, nodes)
+	err = json.Unmarshal(data, &nodes)
 	if err != nil {
 		Log().Error("GetWorkers", err)
 		return []Node{}
@@ -460,9 +833,9 @@ func (r remoteControllerDelegate) GetWorkers() []Node {
 	return nodes
 }
 
-func (r remoteControllerDelegate) ReserveNodeIP(master bool) string {
+func (r *remoteControllerDelegate) ReserveNodeIP(master bool) string {
 	// Call controllerConnection to get ip
-	data, err := performGet("http://" + r.controllerConnection.ControllerHost + ":9999/cluster/nodeip")
+	data, err := r.call(http.MethodGet, "/cluster/nodeip")
 	if err != nil {
 		Log().Error("ReserveNodeIP", err)
 		return ""
@@ -470,30 +843,21 @@ func (r remoteControllerDelegate) ReserveNodeIP(master bool) string {
 	return string(data)
 }
 
-func (r remoteControllerDelegate) ReleaseNodeIP(ip string) {
+func (r *remoteControllerDelegate) ReleaseNodeIP(ip string) {
 	// Call controllerConnection to release ip
-	_, err := performDelete("http://" + r.controllerConnection.ControllerHost + ":9999/cluster/nodeip?ip=" + ip)
+	_, err := r.call(http.MethodDelete, "/cluster/nodeip/"+url.PathEscape(ip))
 	if err != nil {
 		Log().Error("ReleaseNodeIP", err)
 	}
 }
 
-func (r remoteControllerDelegate) DrainNode(node Node) {
-	r.masterRemoteExec("kubectl drain " + node.Name)
-}
-
-func (r remoteControllerDelegate) CordonNode(node Node) {
-	r.masterRemoteExec("kubectl cordon " + node.Name)
-}
-
-func (r remoteControllerDelegate) masterRemoteExec(command string) string {
-	// Call controllerConnection to get internal ip
-	data, err := performGet("http://" + r.controllerConnection.ControllerHost + ":9999/cluster/exec?cmd=" + command)
+func (r *remoteControllerDelegate) Heartbeat(node Node) error {
+	body, err := json.Marshal(node)
 	if err != nil {
-		Log().Error("masterRemoteExec", err)
-		return ""
+		return err
 	}
-	return string(data)
+	_, err = r.send(http.MethodPost, "/cluster/node", body)
+	return err
 }
 
 // A ClusterControlPane is an active management component that manages a cluster. It trackes the
@@ -504,30 +868,108 @@ type localControllerDelegate struct {
 	clusterState   *Cluster `validate:"required"`
 	clusterNetCIDR *netutil.CIDR
 	server         *http.Server
-}
-
-func (r *localControllerDelegate) GetState() string {
-	return r.Exec("kubectl get Nodes")
+	// the IPs reserved before the last restart
+	reservedIPs []string
+	store       *ClusterStore
+	// guards changes of the cluster state and their persistence
+	mutex *sync.Mutex
+	// the election term of this leader and the standby controllers registered
+	term       int64
+	candidates []string
+	// signs the calls to the standby controllers
+	joinToken string
+	// called, when another controller has taken over
+	stepDown func(lease ControllerLease)
+	// notified about the node events
+	listener NodeListener
+	stop     chan bool
 }
 
 func (c *localControllerDelegate) Start() error {
 	// initialize CIDR managers
 	c.clusterNetCIDR = netutil.CreateCIDR(c.clusterState.ClusterConfig.ClusterNetCIDR)
+	for _, ip := range c.reservedIPs {
+		(*c.clusterNetCIDR).MarkIpUsed(ip)
+	}
 	// start the cloud server
 	Log().Info("Initializing controllerConnection api...")
 	router := mux.NewRouter()
 	clusterApiApp := createClusterManagerWebApp(c)
 	router.PathPrefix("/").HandlerFunc(clusterApiApp.HandleRequest)
-	c.server = &http.Server{Addr: "0.0.0.0:9999", Handler: router}
-	go c.listenHttp()
+	c.server = &http.Server{
+		Addr:      "0.0.0.0:9999",
+		Handler:   router,
+		TLSConfig: (*Container().ClusterTLS).ServerConfig(),
+	}
+	c.mutex.Lock()
+	c.persist()
+	c.stop = make(chan bool)
+	go c.watchCandidates(c.stop)
+	go c.watchNodes(c.stop)
+	c.mutex.Unlock()
+	Log().Info(fmt.Sprintf("Leading cluster %v in term %v.", c.GetClusterId(), c.term))
+	go c.listenHttps()
 	return nil
 }
 
-func (c *localControllerDelegate) listenHttp() {
-	c.server.ListenAndServe()
+// Regularly asks the standby controllers, if one of them leads the cluster, e.g. since it took
+// over while this host was unreachable. If its lease wins, this controller steps down.
+func (c *localControllerDelegate) watchCandidates(stop chan bool) {
+	ticker := time.NewTicker(ControllerLeaseInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			own := c.Lease()
+			lease := winningLease(append(fetchLeases(otherHosts(c.candidateHosts()), c.joinToken), own))
+			if lease.Leader != own.Leader && c.stepDown != nil {
+				// stepping down stops this delegate
+				go c.stepDown(*lease)
+				return
+			}
+		}
+	}
+}
+
+// The hosts of the standby controllers.
+func (c *localControllerDelegate) candidateHosts() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string{}, c.candidates...)
+}
+
+// The lease of this controller, the leader is the first candidate.
+func (c *localControllerDelegate) Lease() ControllerLease {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	candidates := []string{hostname()}
+	for _, candidate := range c.candidates {
+		candidates = addCandidate(candidates, candidate)
+	}
+	return ControllerLease{
+		ClusterId:  c.clusterState.ClusterConfig.ClusterId,
+		Leader:     hostname(),
+		Term:       c.term,
+		Candidates: candidates,
+	}
+}
+
+func (c *localControllerDelegate) listenHttps() {
+	err := c.server.ListenAndServeTLS("", "")
+	if err != nil && err != http.ErrServerClosed {
+		Log().Error("Cluster API server failed: " + err.Error())
+	}
 }
 
 func (c *localControllerDelegate) Stop() error {
+	c.mutex.Lock()
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+	c.mutex.Unlock()
 	if c.server != nil {
 		return c.server.Close()
 	}
@@ -542,9 +984,19 @@ func (c *localControllerDelegate) GetClusterConfig() ClusterConfig {
 	return *c.clusterState.ClusterConfig
 }
 
+// A copy of the cluster state, which can be read without holding the lock.
+func (c *localControllerDelegate) snapshot() Cluster {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	cluster := *c.clusterState
+	cluster.Masters = copyNodes(c.clusterState.Masters)
+	cluster.Workers = copyNodes(c.clusterState.Workers)
+	return cluster
+}
+
 func (c *localControllerDelegate) GetMasters() []Node {
 	result := []Node{}
-	for _, v := range c.clusterState.Masters {
+	for _, v := range c.snapshot().Masters {
 		result = append(result, v)
 	}
 	return result
@@ -552,7 +1004,7 @@ func (c *localControllerDelegate) GetMasters() []Node {
 
 func (c *localControllerDelegate) GetWorkers() []Node {
 	result := []Node{}
-	for _, v := range c.clusterState.Workers {
+	for _, v := range c.snapshot().Workers {
 		result = append(result, v)
 	}
 	return result
@@ -562,28 +1014,46 @@ func (c *localControllerDelegate) ReserveNodeIP(master bool) string {
 	if c.clusterNetCIDR == nil {
 		return ""
 	}
-	return (*c.clusterNetCIDR).GetFreeIp()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ip := (*c.clusterNetCIDR).GetFreeIp()
+	if ip != "" {
+		c.persist()
+	}
+	return ip
 }
 
 func (c *localControllerDelegate) ReleaseNodeIP(ip string) {
 	if c.clusterNetCIDR == nil {
 		return
 	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	(*c.clusterNetCIDR).MarkIpUnused(ip)
+	c.persist()
 }
 
-func (c *localControllerDelegate) DrainNode(node Node) {
-	c.Exec("kubectl drain " + node.Name)
-}
-
-func (c *localControllerDelegate) CordonNode(node Node) {
-	c.Exec("kubectl cordon " + node.Name)
-}
-
-func (c *localControllerDelegate) Exec(command string) string {
-	// TODO implement remote master exec...
-	fmt.Println("TODO implement remote master exec: " + command)
-	return "Not implemented: " + command
+// Stores the nodes and the reserved IPs of the cluster, so they survive restarts. The caller must
+// hold the lock.
+func (c *localControllerDelegate) persist() {
+	if c.store == nil {
+		return
+	}
+	record := ClusterRecord{
+		ClusterId:  c.clusterState.ClusterConfig.ClusterId,
+		Masters:    c.clusterState.Masters,
+		Workers:    c.clusterState.Workers,
+		Leader:     hostname(),
+		Term:       c.term,
+		Candidates: c.candidates,
+	}
+	if c.clusterNetCIDR != nil {
+		record.ReservedIPs = (*c.clusterNetCIDR).UsedIps()
+	}
+	err := (*c.store).Save(record)
+	if err != nil {
+		Log().Error("Failed to store the state of cluster " + record.ClusterId + ": " + err.Error())
+	}
 }
 
 // Evaluates the cluster id as the right part of the WinKube service identifier:
@@ -663,261 +1133,254 @@ func hostname() string {
 
 // Web application actions...
 
-func controllerAuthAction(context *webapp.RequestContext, writer http.ResponseWriter) bool {
-	if strings.Contains(context.Request.RequestURI, "/cluster/id") {
-		// no security here...
+// Controller endpoints that can be called without a join token.
+var publicControllerPaths = map[string]bool{
+	"/cluster/id": true,
+	"/cluster/ca": true,
+}
+
+// Controller endpoints that can be called without a client certificate, e.g. to request the first
+// host certificate.
+var enrollmentControllerPaths = map[string]bool{
+	"/cluster/certificate": true,
+}
+
+// Request attribute containing the verified join token.
+const JOIN_TOKEN_ATTRIBUTE = "joinToken"
+
+// Protects all controller endpoints, except the public ones: requests must be signed with a valid
+// join token issued by this controller and, except for enrollment, be sent with a client
+// certificate issued by the cluster CA.
+func controllerAuthFilter(context *webapp.RequestContext, writer http.ResponseWriter) bool {
+	if publicControllerPaths[context.Request.URL.Path] {
 		return true
 	}
-	if Container().CurrentStatus != APPSTATE_RUNNING {
-		writer.Header().Set("Content-Type", "text/plain")
-		writer.Write([]byte("Not in running state."))
-		writer.WriteHeader(http.StatusInternalServerError)
+	if Container().CurrentStatus() != APPSTATE_RUNNING {
+		context.WriteResponse(writer, webapp.ErrorResponse(http.StatusServiceUnavailable, "Not in running state."))
 		return false
 	}
-	clusterId := context.GetParameter("clusterid")
-	clusterCredentials := context.GetParameter("clustercredentials")
-	if config().ClusterId() != clusterId {
-		writer.Header().Set("Content-Type", "text/plain")
-		writer.Write([]byte("Unauthorized."))
-		writer.WriteHeader(http.StatusUnauthorized)
+	if !enrollmentControllerPaths[context.Request.URL.Path] &&
+		(context.Request.TLS == nil || len(context.Request.TLS.VerifiedChains) == 0) {
+		Log().Warn("Rejected " + context.Request.Method + " " + context.Request.URL.Path + " from " +
+			context.Request.RemoteAddr + ": no client certificate.")
+		context.WriteResponse(writer, webapp.ErrorResponse(http.StatusUnauthorized, "Client certificate required."))
 		return false
 	}
-	if config().ClusterCredentials() != clusterCredentials {
-		writer.Header().Set("Content-Type", "text/plain")
-		writer.Write([]byte("Unauthorized."))
-		writer.WriteHeader(http.StatusUnauthorized)
+	token, err := (*Container().Tokens).Verify(context.Request)
+	if err != nil {
+		Log().Warn("Rejected " + context.Request.Method + " " + context.Request.URL.Path + " from " +
+			context.Request.RemoteAddr + ": " + err.Error())
+		context.WriteResponse(writer, webapp.ErrorResponse(http.StatusUnauthorized, "Invalid join token."))
 		return false
 	}
+	context.Attributes[JOIN_TOKEN_ATTRIBUTE] = token
 	return true
 }
 
-func (this localControllerDelegate) actionClusterId(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
-	writer.Write([]byte(this.clusterState.ClusterConfig.ClusterId))
-	writer.Header().Set("Content-Type", "text/plain")
-	writer.WriteHeader(http.StatusOK)
-	return nil
+func (this *localControllerDelegate) actionClusterId(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	return webapp.TextResponse(http.StatusOK, this.clusterState.ClusterConfig.ClusterId)
+}
+
+// Serves the cluster CA, which joining hosts trust on first use.
+func actionClusterCA(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	ca := (*Container().ClusterTLS).Authority()
+	if ca == nil {
+		return webapp.ErrorResponse(http.StatusNotFound, "No cluster CA available.")
+	}
+	return webapp.ContentResponse(http.StatusOK, "application/x-pem-file", (*ca).CertificatePEM())
 }
 
-func (this localControllerDelegate) actionServeClusterConfig(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
-	data, err := json.MarshalIndent(this.clusterState.ClusterConfig, "", "  ")
+// Issues a host certificate for the PEM encoded certificate request passed as body. The
+// certificate is issued for the node of the join token used, see certificateNames.
+func actionIssueCertificate(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	ca := (*Container().ClusterTLS).Authority()
+	if ca == nil {
+		return webapp.ErrorResponse(http.StatusNotFound, "No cluster CA available.")
+	}
+	csr, err := ioutil.ReadAll(io.LimitReader(context.Request.Body, 64*1024))
 	if err != nil {
-		writer.Write([]byte("Failed to serialize config to JSON: " + err.Error()))
-		writer.WriteHeader(http.StatusInternalServerError)
-	} else {
-		writer.Write(data)
-		writer.Header().Set("Content-Type", "application/json")
+		return webapp.ErrorResponse(http.StatusBadRequest, "No body: "+err.Error())
 	}
-	return nil
+	token := context.Attributes[JOIN_TOKEN_ATTRIBUTE].(JoinToken)
+	cert, err := (*ca).Sign(csr, token.Node, certificateNames(token, context.Request))
+	if err != nil {
+		Log().Warn("Refused host certificate for node " + token.Node + ": " + err.Error())
+		return webapp.ErrorResponse(http.StatusBadRequest, "Invalid certificate request: "+err.Error())
+	}
+	Log().Info("Issued host certificate for node " + token.Node + ".")
+	return webapp.ContentResponse(http.StatusOK, "application/x-pem-file", cert)
 }
 
-func (this localControllerDelegate) actionReserveNodeIP(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+// The names a host certificate may be issued for: the host named by the join token, the address
+// the request was sent from and the loopback names. Join tokens must therefore be issued for the
+// host names of the hosts.
+func certificateNames(token JoinToken, req *http.Request) []string {
+	names := []string{strings.TrimPrefix(token.Node, CONTROLLER_TOKEN_NODE_PREFIX), "localhost", "127.0.0.1", "::1"}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		names = append(names, host)
+	}
+	return names
+}
+
+func (this *localControllerDelegate) actionServeClusterConfig(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	return webapp.JsonResponse(http.StatusOK, this.clusterState.ClusterConfig)
+}
+
+func (this *localControllerDelegate) actionReserveNodeIP(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
 	master := util.ParseBool(context.GetQueryParameter("master"))
 	ip := this.ReserveNodeIP(master)
 	if ip == "" {
-		writer.WriteHeader(http.StatusNotFound)
-		return nil
+		return webapp.ErrorResponse(http.StatusNotFound, "No free node IP available.")
 	}
-	writer.Write([]byte(ip))
-	writer.Header().Set("Content-Type", "text/plain")
-	return nil
+	return webapp.TextResponse(http.StatusOK, ip)
 }
 
-func (this localControllerDelegate) actionReleaseNodeIP(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
-	address := context.GetQueryParameter("address")
+func (this *localControllerDelegate) actionReleaseNodeIP(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	address := context.PathParam("address")
 	if address == "" {
-		writer.Write([]byte("Parameter 'address' missing."))
-		writer.WriteHeader(http.StatusBadRequest)
-		return nil
+		address = context.GetQueryParameterWithDefault("address", context.GetQueryParameter("ip"))
+	}
+	if address == "" {
+		return webapp.ErrorResponse(http.StatusBadRequest, "Parameter 'address' missing.")
 	}
 	this.ReleaseNodeIP(address)
-	return nil
+	return webapp.StatusResponse(http.StatusOK)
 }
-func (this localControllerDelegate) actionNodeStarted(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+func (this *localControllerDelegate) actionNodeStarted(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
 	node := Node{}
+	// the body size is limited by the application's MaxBodySize
 	bodyBytes, err := ioutil.ReadAll(context.Request.Body)
 	if err != nil {
-		writer.Write([]byte("No body: " + err.Error()))
-		writer.WriteHeader(http.StatusBadRequest)
-		return nil
+		return webapp.ErrorResponse(http.StatusBadRequest, "No body: "+err.Error())
+	}
+	if err = json.Unmarshal(bodyBytes, &node); err != nil {
+		return webapp.ErrorResponse(http.StatusBadRequest, "Invalid node: "+err.Error())
 	}
-	err = json.Unmarshal(bodyBytes, node)
 	switch node.NodeType {
-	case Master:
-		this.clusterState.Masters[node.Id] = node
-	case Worker:
-		this.clusterState.Workers[node.Id] = node
+	case Master, Worker:
+		// also the heartbeat of the node
+		this.Heartbeat(node)
 	case Controller:
 		// nothing todo
 	case UndefinedNode:
 		fallthrough
 	default:
-		writer.Write([]byte("Unknown node type: " + err.Error()))
-		writer.WriteHeader(http.StatusBadRequest)
-		return nil
+		return webapp.ErrorResponse(http.StatusBadRequest, "Unknown node type: "+node.NodeType.String())
 	}
-	writer.WriteHeader(http.StatusOK)
-	return nil
+	return webapp.StatusResponse(http.StatusOK)
 }
-func (this localControllerDelegate) actionNodeStopped(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
-	nodeId := context.GetQueryParameter("id")
+func (this *localControllerDelegate) actionNodeStopped(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	nodeId := context.PathParam("id")
+	if nodeId == "" {
+		nodeId = context.GetQueryParameter("id")
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
 	node := this.clusterState.getNode(nodeId)
 	if node == nil {
-		writer.WriteHeader(http.StatusNotFound)
-		return nil
+		return webapp.ErrorResponse(http.StatusNotFound, "No such node: "+nodeId)
 	}
 	this.clusterState.removeNode(node)
-	return nil
+	this.persist()
+	return webapp.StatusResponse(http.StatusOK)
+}
+
+// The nodes are copied under the lock, since the liveness checks update them concurrently.
+func (this *localControllerDelegate) actionGetMasters(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	return webapp.JsonResponse(http.StatusOK, this.snapshot().Masters)
 }
-func (this localControllerDelegate) actionGetMasters(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
-	data, err := json.MarshalIndent(this.clusterState.Masters, "", "  ")
+
+func (this *localControllerDelegate) actionGetWorkers(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	return webapp.JsonResponse(http.StatusOK, this.snapshot().Workers)
+}
+
+func (this *localControllerDelegate) actionGetMaster(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	return nodeResponse(this.snapshot().Masters, context.PathParam("id"))
+}
+
+func (this *localControllerDelegate) actionGetWorker(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	return nodeResponse(this.snapshot().Workers, context.PathParam("id"))
+}
+
+// Serves the lease of this controller, which hosts use to find the leader on failover.
+func (this *localControllerDelegate) actionLease(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	return webapp.JsonResponse(http.StatusOK, this.Lease())
+}
+
+// Serves the replica of this controller to a standby controller, which is registered as candidate
+// with the host passed. Only hosts with a candidate token may replicate the controller.
+func (this *localControllerDelegate) actionReplica(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	token := context.Attributes[JOIN_TOKEN_ATTRIBUTE].(JoinToken)
+	if !token.Candidate {
+		return webapp.ErrorResponse(http.StatusForbidden, "Node "+token.Node+" is no controller candidate.")
+	}
+	host := context.GetQueryParameter("host")
+	if host == "" {
+		return webapp.ErrorResponse(http.StatusBadRequest, "Parameter 'host' missing.")
+	}
+	caCert, err := ioutil.ReadFile(WINKUBE_CA_CERT_FILE)
 	if err != nil {
-		writer.Write([]byte("Failed to mashal masters: " + err.Error()))
-		writer.WriteHeader(http.StatusInternalServerError)
+		return webapp.ErrorResponse(http.StatusInternalServerError, "Cluster CA not readable: "+err.Error())
 	}
-	writer.Write(data)
-	writer.Header().Set("Content-Type", "application/json")
-	return nil
-}
-func (this localControllerDelegate) actionGetWorkers(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
-	data, err := json.MarshalIndent(this.clusterState.Workers, "", "  ")
+	caKey, err := readCAKey(WINKUBE_CA_KEY_FILE, Container().SecretStore)
 	if err != nil {
-		writer.Write([]byte("Failed to mashal workers: " + err.Error()))
-		writer.WriteHeader(http.StatusInternalServerError)
+		return webapp.ErrorResponse(http.StatusInternalServerError, "Cluster CA not readable: "+err.Error())
 	}
-	writer.Write(data)
-	writer.Header().Set("Content-Type", "application/json")
-	return nil
-}
-
-func (this localControllerDelegate) actionMasterInfo(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
-	if !Container().Config.IsMasterNode() {
-		writer.Write([]byte("No master running."))
-		writer.WriteHeader(http.StatusNotFound)
+	this.mutex.Lock()
+	if registered := addCandidate(this.candidates, host); len(registered) != len(this.candidates) {
+		Log().Info("Registered standby controller " + host + " of node " + token.Node + ".")
+		this.candidates = registered
+		this.persist()
 	}
-	result, returnCode := this.execCommand("vagrant", "status "+Container().Config.WorkerNode.NodeName, *Container().Config.WorkerNode)
-	if returnCode == http.StatusOK {
-		writer.Write(result)
-		writer.Header().Set("Content-Type", "application/json")
-	} else {
-		writer.Write(result)
-		writer.WriteHeader(returnCode)
+	replica := ControllerReplica{
+		Config: *this.clusterState.ClusterConfig,
+		Record: ClusterRecord{
+			ClusterId: this.clusterState.ClusterConfig.ClusterId,
+			Masters:   copyNodes(this.clusterState.Masters),
+			Workers:   copyNodes(this.clusterState.Workers),
+		},
+		CACert:  caCert,
+		CAKey:   caKey,
+		Created: time.Now(),
 	}
-	return nil
+	if this.clusterNetCIDR != nil {
+		replica.Record.ReservedIPs = (*this.clusterNetCIDR).UsedIps()
+	}
+	this.mutex.Unlock()
+	replica.Lease = this.Lease()
+	replica.Tokens = (*Container().Tokens).Export()
+	return webapp.JsonResponse(http.StatusOK, replica)
 }
 
-func (this localControllerDelegate) actionWorkerInfo(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
-	if !Container().Config.IsWorkerNode() {
-		writer.Write([]byte("No worker running."))
-		writer.WriteHeader(http.StatusNotFound)
+// Returns the node with the id given as JSON, or 404 if not found.
+func nodeResponse(nodes map[string]Node, id string) *webapp.ActionResponse {
+	node, found := nodes[id]
+	if !found {
+		return webapp.ErrorResponse(http.StatusNotFound, "No such node: "+id)
 	}
-	result, returnCode := this.execCommand("vagrant", "status "+Container().Config.WorkerNode.NodeName, *Container().Config.WorkerNode)
-	if returnCode == http.StatusOK {
-		writer.Write(result)
-		writer.Header().Set("Content-Type", "application/json")
-	} else {
-		writer.Write(result)
-		writer.WriteHeader(returnCode)
-	}
-	return nil
+	return webapp.JsonResponse(http.StatusOK, node)
 }
 
-func (this localControllerDelegate) actionMasterExecCommand(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
-	command := context.GetParameter("cmd")
-	if command == "" {
-		writer.Write([]byte("No command passed."))
-		writer.WriteHeader(http.StatusBadRequest)
-	}
-	if Container().Config.IsMasterNode() {
-		result, returnCode := this.execCommand("vagrant", "ssh -c "+command, *Container().Config.WorkerNode)
-		if returnCode == http.StatusOK {
-			writer.Write(result)
-			writer.Header().Set("Content-Type", "application/json")
-		} else {
-			writer.Write(result)
-			writer.WriteHeader(returnCode)
-		}
-		return nil
-	} else {
-		result := make(map[string]string)
-		result["result"] = "No master configured"
-		result["command"] = command
-		result["exitCode"] = "-1"
-		json, _ := json.MarshalIndent(result, "", "  ")
-		writer.Write(json)
-		writer.Header().Set("Content-Type", "application/json")
-		return nil
-	}
+// Executes an operation of the registry on the local master, e.g. POST /master/exec?op=cordon&node=w-1.
+func actionMasterExecOperation(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	return actionNodeOperation(Master, context)
 }
 
-func (this localControllerDelegate) actionWorkerExecCommand(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
-	command := context.GetParameter("cmd")
-	if command == "" {
-		writer.Write([]byte("No command passed."))
-		writer.WriteHeader(http.StatusBadRequest)
-	}
-	if Container().Config.IsWorkerNode() {
-		result, returnCode := this.execCommand("vagrant", "ssh -c "+command, *Container().Config.WorkerNode)
-		if returnCode == http.StatusOK {
-			writer.Write(result)
-			writer.Header().Set("Content-Type", "application/json")
-		} else {
-			writer.Write(result)
-			writer.WriteHeader(returnCode)
-		}
-		return nil
-	} else {
-		result := make(map[string]string)
-		result["result"] = "No worker configured"
-		result["command"] = command
-		result["exitCode"] = "-1"
-		json, _ := json.MarshalIndent(result, "", "  ")
-		writer.Write(json)
-		writer.Header().Set("Content-Type", "application/json")
-		return nil
-	}
+// Executes an operation of the registry on the local worker, e.g. GET /worker/exec?op=uptime.
+func actionWorkerExecOperation(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	return actionNodeOperation(Worker, context)
 }
 
-func (this localControllerDelegate) execCommand(command string, args string, node ClusterNodeConfig) ([]byte, int) {
-	if command == "" {
-		return []byte("ERROR: No command passed."), http.StatusBadRequest
-	}
-	output, exitCode := this.execVagrantCommand("vagrant ssh -c \""+command+"\" "+node.NodeName, node)
-	if exitCode != 0 {
-		return []byte(output), http.StatusInternalServerError
-	}
-	result := make(map[string]string)
-	result["result"] = output
-	result["command"] = command
-	result["node"] = node.NodeName
-	result["address"] = node.NodeAddress
-	result["exitCode"] = strconv.Itoa(exitCode)
-	json, _ := json.MarshalIndent(result, "", "  ")
-	return json, http.StatusOK
+func actionMasterOperations(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	return actionNodeOperations(Master)
 }
 
-func (this localControllerDelegate) execVagrantCommand(command string, node ClusterNodeConfig) (string, int) {
-	cmd, cmdReader, err := util.RunCommand("Execute remote command", "vagrant", "ssh", "-c", "\""+command+"\" ", node.NodeName)
-	if err != nil {
-		return "ERROR: '" + command + "' failed: " + err.Error(), -1
-	}
-	var buff bytes.Buffer
-	scanner := bufio.NewScanner(cmdReader)
-	for scanner.Scan() {
-		buff.WriteString(scanner.Text())
-	}
-	return string(buff.Bytes()), cmd.ProcessState.ExitCode()
+func actionWorkerOperations(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	return actionNodeOperations(Worker)
 }
 
 func actionKnownIds(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
-	data, err := json.MarshalIndent((*Container().LocalController).GetKnownClusters(), "", "  ")
-	if err != nil {
-		writer.Write([]byte("Failed to serialize known cluster ids to JSON: " + err.Error()))
-		writer.WriteHeader(http.StatusInternalServerError)
-	} else {
-		writer.Write(data)
-		writer.Header().Set("Content-Type", "application/json")
-	}
-	return nil
+	return webapp.JsonResponse(http.StatusOK, (*Container().LocalController).GetKnownClusters())
 }
 
 func actionClusterState(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
@@ -925,50 +1388,35 @@ func actionClusterState(context *webapp.RequestContext, writer http.ResponseWrit
 	result["cluster"] = Container().Config.ClusterId()
 	result["timestamp"] = time.Now().String()
 	result["ClusterState"] = (*Container().LocalController).GetState()
-	json, _ := json.MarshalIndent(result, "", "  ")
-	writer.Write(json)
-	writer.Header().Set("Content-Type", "application/json")
-	return nil
+	return webapp.JsonResponse(http.StatusOK, result)
 }
 
 func actionMasterState(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
-	if Container().Config.IsMasterNode() {
-		_, cmdReader, err := util.RunCommand("Get master status.", "vagrant", "status", Container().Config.MasterNode.NodeName)
-		if err != nil {
-			writer.Write([]byte("ERROR: vagrant status " + Container().Config.MasterNode.NodeName + "' failed: " + err.Error()))
-			writer.WriteHeader(http.StatusInternalServerError)
-		}
-		var buff bytes.Buffer
-		scanner := bufio.NewScanner(cmdReader)
-		for scanner.Scan() {
-			buff.WriteString(scanner.Text())
-		}
-		writer.Write(buff.Bytes())
-	} else {
-		writer.Write([]byte("ERROR: no master present on this node."))
-		writer.WriteHeader(http.StatusNotFound)
+	if !Container().Config.IsMasterNode() {
+		return webapp.ErrorResponse(http.StatusNotFound, "No master present on this node.")
 	}
-	return nil
+	return vagrantStatus(Container().Config.MasterNode.NodeName)
 }
 
 func actionWorkerState(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
-	if Container().Config.IsWorkerNode() {
-		_, cmdReader, err := util.RunCommand("Get worker status.", "vagrant", "status", Container().Config.WorkerNode.NodeName)
-		if err != nil {
-			writer.Write([]byte("ERROR: vagrant status " + Container().Config.WorkerNode.NodeName + "' failed: " + err.Error()))
-			writer.WriteHeader(http.StatusInternalServerError)
-		}
-		var buff bytes.Buffer
-		scanner := bufio.NewScanner(cmdReader)
-		for scanner.Scan() {
-			buff.WriteString(scanner.Text())
-		}
-		writer.Write(buff.Bytes())
-	} else {
-		writer.Write([]byte("ERROR: no worker present on this node."))
-		writer.WriteHeader(http.StatusNotFound)
+	if !Container().Config.IsWorkerNode() {
+		return webapp.ErrorResponse(http.StatusNotFound, "No worker present on this node.")
 	}
-	return nil
+	return vagrantStatus(Container().Config.WorkerNode.NodeName)
+}
+
+// Returns the vagrant status of the box given as text.
+func vagrantStatus(box string) *webapp.ActionResponse {
+	_, cmdReader, err := util.RunCommand("Get status of "+box+".", "vagrant", "status", box)
+	if err != nil {
+		return webapp.ErrorResponse(http.StatusInternalServerError, "vagrant status '"+box+"' failed: "+err.Error())
+	}
+	var buff bytes.Buffer
+	scanner := bufio.NewScanner(cmdReader)
+	for scanner.Scan() {
+		buff.WriteString(scanner.Text())
+	}
+	return webapp.TextResponse(http.StatusOK, buff.String())
 }
 
 func remove(items []Node, i int) []Node {
@@ -990,40 +1438,49 @@ func nodeFromService(s netutil.Service) *Node {
 	}
 }
 
+// Calls the URI given signed with the join token of this host, an error is returned for error
+// status codes.
 func performGet(uri string) ([]byte, error) {
-	resp, err := http.Get(uri)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	data, readErr := ioutil.ReadAll(resp.Body)
-	if readErr != nil {
-		return nil, readErr
+	config := Container().Config
+	if config.ClusterLogin == nil || config.ClusterLogin.JoinToken == "" {
+		return nil, errors.New("No join token configured to call the cluster controller.")
 	}
-	return data, nil
+	return performRequest(http.MethodGet, uri, nil, config.ClusterLogin.JoinToken)
 }
 
-func performDelete(uri string) ([]byte, error) {
-	req, err := http.NewRequest("DELETE", uri, nil)
-	if util.CheckAndLogError("Failed to create delkete request", err) {
-		resp, qerr := http.DefaultClient.Do(req)
-		if qerr != nil {
-			return nil, qerr
-		}
-		return ioutil.ReadAll(resp.Body)
+// Calls the URI given with the method and the body given, the request is signed with the join
+// token given. An error is returned for error status codes, transport errors are returned as
+// *url.Error.
+func performRequest(method string, uri string, body []byte, joinToken string) ([]byte, error) {
+	req, err := http.NewRequest(method, uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
 	}
-	return nil, err
-}
-
-func loadRemoteConfig(connection ClusterControllerConnection) (*ClusterConfig, error) {
-	data, err := performGet("http://" + connection.ControllerHost + ":9999/cluster/config")
+	if err = SignRequest(req, joinToken); err != nil {
+		return nil, err
+	}
+	resp, err := (*Container().ClusterTLS).Client().Do(req)
 	if err != nil {
 		return nil, err
 	}
-	config := &ClusterConfig{}
-	err = json.Unmarshal(data, config)
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
-	return config, nil
+	if resp.StatusCode >= http.StatusBadRequest {
+		return data, errors.New(method + " " + uri + " failed: " + resp.Status + " " + string(data))
+	}
+	return data, nil
+}
+
+// The hosts given without this host.
+func otherHosts(hosts []string) []string {
+	result := []string{}
+	for _, host := range hosts {
+		if host != hostname() {
+			result = append(result, host)
+		}
+	}
+	return result
 }
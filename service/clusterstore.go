@@ -0,0 +1,154 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"github.com/winkube/util"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The file containing the state of the clusters managed by the local controller.
+const WINKUBE_CLUSTERS_FILE = "winkube-clusters.json"
+
+// The state of a cluster kept across restarts of its controller. The cluster config is not part of
+// it, since it contains secrets and is kept by the configuration of the controller.
+type ClusterRecord struct {
+	ClusterId string          `json:"clusterId"`
+	Masters   map[string]Node `json:"masters"`
+	Workers   map[string]Node `json:"workers"`
+	// The node IPs reserved in the cluster net.
+	ReservedIPs []string `json:"reservedIps"`
+	// The host leading the cluster, its election term and the hosts of the standby controllers.
+	Leader     string    `json:"leader,omitempty"`
+	Term       int64     `json:"term,omitempty"`
+	Candidates []string  `json:"candidates,omitempty"`
+	Updated    time.Time `json:"updated"`
+}
+
+// A ClusterStore keeps the nodes and IP reservations of the clusters managed by the local
+// controller.
+type ClusterStore interface {
+	// Returns the stored state of a cluster, nil if not found.
+	Lookup(clusterId string) *ClusterRecord
+	// Stores the state of a cluster, replacing its previous state.
+	Save(record ClusterRecord) error
+}
+
+// Creates a store keeping the clusters in memory only.
+func CreateMemoryClusterStore() *ClusterStore {
+	var store ClusterStore = &clusterStore{
+		records: make(map[string]ClusterRecord),
+	}
+	return &store
+}
+
+// Creates a store, which writes the clusters to the given file. Existing clusters are read on
+// creation.
+func CreateFileClusterStore(file string) (*ClusterStore, error) {
+	store := clusterStore{
+		file:    file,
+		records: make(map[string]ClusterRecord),
+	}
+	err := store.load()
+	if err != nil {
+		return nil, err
+	}
+	var result ClusterStore = &store
+	return &result, nil
+}
+
+type clusterStore struct {
+	file    string
+	records map[string]ClusterRecord
+	mutex   sync.Mutex
+}
+
+func (this *clusterStore) Lookup(clusterId string) *ClusterRecord {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	record, found := this.records[clusterId]
+	if !found {
+		return nil
+	}
+	record.Masters = copyNodes(record.Masters)
+	record.Workers = copyNodes(record.Workers)
+	return &record
+}
+
+func (this *clusterStore) Save(record ClusterRecord) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	record.Masters = copyNodes(record.Masters)
+	record.Workers = copyNodes(record.Workers)
+	record.ReservedIPs = append([]string{}, record.ReservedIPs...)
+	sort.Strings(record.ReservedIPs)
+	record.Candidates = append([]string{}, record.Candidates...)
+	record.Updated = time.Now()
+	this.records[record.ClusterId] = record
+	return this.save()
+}
+
+func (this *clusterStore) load() error {
+	data, err := ioutil.ReadFile(this.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var records []ClusterRecord
+	err = json.Unmarshal(data, &records)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		this.records[record.ClusterId] = record
+	}
+	return nil
+}
+
+// Writes all clusters to a temporary file, which then replaces the store file, so a crash never
+// leaves a partially written file. The caller must hold the lock.
+func (this *clusterStore) save() error {
+	if this.file == "" {
+		return nil
+	}
+	records := []ClusterRecord{}
+	for _, record := range this.records {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ClusterId < records[j].ClusterId
+	})
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(this.file, data, 0600)
+}
+
+// Copies the nodes given, a nil map results in an empty map.
+func copyNodes(nodes map[string]Node) map[string]Node {
+	result := make(map[string]Node)
+	for id, node := range nodes {
+		result[id] = node
+	}
+	return result
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"gopkg.in/go-playground/assert.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClusterStore_RestoresNodesAndReservedIPs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "winkube-clusters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, WINKUBE_CLUSTERS_FILE)
+
+	store, err := CreateFileClusterStore(file)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, (*store).Lookup("cluster-1") == nil)
+	masters := map[string]Node{"m-1": {Id: "m-1", ClusterId: "cluster-1", NodeType: Master, Host: "host-1"}}
+	err = (*store).Save(ClusterRecord{
+		ClusterId:   "cluster-1",
+		Masters:     masters,
+		ReservedIPs: []string{"192.168.99.12", "192.168.99.11"},
+	})
+	assert.Equal(t, nil, err)
+	// the store keeps a copy
+	delete(masters, "m-1")
+
+	reloaded, err := CreateFileClusterStore(file)
+	assert.Equal(t, nil, err)
+	record := (*reloaded).Lookup("cluster-1")
+	assert.Equal(t, "host-1", record.Masters["m-1"].Host)
+	assert.Equal(t, Master, record.Masters["m-1"].NodeType)
+	assert.Equal(t, 0, len(record.Workers))
+	assert.Equal(t, []string{"192.168.99.11", "192.168.99.12"}, record.ReservedIPs)
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, 1, len(files))
+}
+
+func TestClusterStore_RejectsCorruptFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "winkube-clusters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, WINKUBE_CLUSTERS_FILE)
+	ioutil.WriteFile(file, []byte("{"), 0600)
+	_, err = CreateFileClusterStore(file)
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,380 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The file containing the CA certificate of the cluster this host has joined.
+const WINKUBE_TRUSTED_CA_FILE = "winkube-cluster-ca.crt"
+
+// The files containing the certificate and the private key of this host.
+const WINKUBE_HOST_CERT_FILE = "winkube-host.crt"
+const WINKUBE_HOST_KEY_FILE = "winkube-host.key"
+
+// How often the host certificate is checked for renewal.
+var CertificateCheckInterval = time.Hour
+
+// ClusterTLS manages the TLS credentials of this host: the trusted cluster CA and the host
+// certificate, which is used by the cluster API server and for the calls to other hosts.
+type ClusterTLS interface {
+	// Initializes the credentials of a controller: the cluster CA is loaded or created and the
+	// host certificate is issued locally.
+	InitController(clusterId string) error
+	// Initializes the credentials of a host joining the cluster managed by the controller given.
+	// The controller CA is trusted on first use, if its fingerprint matches the fingerprint
+	// confirmed in the connection. The host certificate is requested from the controller using
+	// the join token.
+	InitHost(connection ClusterControllerConnection) error
+	// The fingerprint of the trusted cluster CA, empty if not initialized.
+	CAFingerprint() string
+	// The cluster CA, nil if this host is not a controller.
+	Authority() *CertificateAuthority
+	// The TLS config of the cluster API server, client certificates are verified if given.
+	ServerConfig() *tls.Config
+	// The client used to call the cluster API of other hosts.
+	Client() *http.Client
+	// Stops the certificate rotation.
+	Stop()
+}
+
+func CreateClusterTLS() *ClusterTLS {
+	var result ClusterTLS = &clusterTLS{}
+	return &result
+}
+
+type clusterTLS struct {
+	ca        *x509.Certificate
+	pool      *x509.CertPool
+	authority *CertificateAuthority
+	hostCert  *tls.Certificate
+	client    *http.Client
+	// creates a new host certificate, returns the certificate and the key PEM encoded
+	issue func() ([]byte, []byte, error)
+	stop  chan bool
+	mutex sync.RWMutex
+}
+
+func (this *clusterTLS) InitController(clusterId string) error {
+	Log().Info("Initializing certificate authority for cluster " + clusterId + "...")
+	ca, err := CreateCertificateAuthority(WINKUBE_CA_CERT_FILE, WINKUBE_CA_KEY_FILE, clusterId, Container().SecretStore)
+	if err != nil {
+		return err
+	}
+	this.mutex.Lock()
+	this.authority = ca
+	this.mutex.Unlock()
+	this.trust((*ca).Certificate())
+	return this.start(func() ([]byte, []byte, error) {
+		keyPEM, csrPEM, err := createCertificateRequest(hostname(), hostAddresses())
+		if err != nil {
+			return nil, nil, err
+		}
+		// the controller's own addresses need no further checks
+		certPEM, err := (*ca).SignController(csrPEM, hostname(), append([]string{hostname(), "localhost"}, hostAddresses()...))
+		return certPEM, keyPEM, err
+	}, true)
+}
+
+func (this *clusterTLS) InitHost(connection ClusterControllerConnection) error {
+	if connection.CAFingerprint == "" {
+		return errors.New("The CA fingerprint of controller " + connection.ControllerHost + " has not been confirmed.")
+	}
+	ca, err := loadTrustedCA()
+	if err != nil || !strings.EqualFold(CertificateFingerprint(ca), connection.CAFingerprint) {
+		Log().Info("Fetching CA of controller " + connection.ControllerHost + "...")
+		ca, err = FetchControllerCA(connection.ControllerHost)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(CertificateFingerprint(ca), connection.CAFingerprint) {
+			return errors.New("The CA of controller " + connection.ControllerHost + " has the fingerprint " +
+				CertificateFingerprint(ca) + ", expected " + connection.CAFingerprint + ".")
+		}
+		err = ioutil.WriteFile(WINKUBE_TRUSTED_CA_FILE, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	this.trust(ca)
+	return this.start(func() ([]byte, []byte, error) {
+		keyPEM, csrPEM, err := createCertificateRequest(hostname(), hostAddresses())
+		if err != nil {
+			return nil, nil, err
+		}
+		certPEM, err := this.enroll(connection.ControllerHost, csrPEM)
+		return certPEM, keyPEM, err
+	}, false)
+}
+
+func (this *clusterTLS) CAFingerprint() string {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	if this.ca == nil {
+		return ""
+	}
+	return CertificateFingerprint(this.ca)
+}
+
+func (this *clusterTLS) Authority() *CertificateAuthority {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.authority
+}
+
+func (this *clusterTLS) ServerConfig() *tls.Config {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  this.pool,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return this.certificate()
+		},
+	}
+}
+
+func (this *clusterTLS) Client() *http.Client {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	if this.client == nil {
+		return http.DefaultClient
+	}
+	return this.client
+}
+
+func (this *clusterTLS) Stop() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.stop != nil {
+		close(this.stop)
+		this.stop = nil
+	}
+}
+
+// Trusts the CA given, replacing the CA trusted before.
+func (this *clusterTLS) trust(ca *x509.Certificate) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.ca = ca
+	this.pool = x509.NewCertPool()
+	this.pool.AddCert(ca)
+	this.client = &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			RootCAs:    this.pool,
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				cert, err := this.certificate()
+				if err != nil {
+					// no certificate yet, e.g. when enrolling
+					return &tls.Certificate{}, nil
+				}
+				return cert, nil
+			},
+		},
+	}}
+}
+
+// Loads or issues the host certificate and starts its rotation. A certificate loaded is only used,
+// if it identifies a controller exactly if controller is set, e.g. a standby taking over needs a
+// new certificate.
+func (this *clusterTLS) start(issue func() ([]byte, []byte, error), controller bool) error {
+	this.Stop()
+	this.mutex.Lock()
+	this.issue = issue
+	this.hostCert = nil
+	this.mutex.Unlock()
+	cert, err := tls.LoadX509KeyPair(WINKUBE_HOST_CERT_FILE, WINKUBE_HOST_KEY_FILE)
+	if err == nil {
+		err = this.verify(&cert)
+	}
+	if err == nil && IsControllerCertificate(cert.Leaf) != controller {
+		err = errors.New("the certificate does not match the role of the host")
+	}
+	if err == nil {
+		this.mutex.Lock()
+		this.hostCert = &cert
+		this.mutex.Unlock()
+	} else if !os.IsNotExist(err) {
+		Log().Warn("Host certificate is not usable, requesting a new one: " + err.Error())
+	}
+	err = this.renewIfRequired()
+	if err != nil {
+		return err
+	}
+	stop := make(chan bool)
+	this.mutex.Lock()
+	this.stop = stop
+	this.mutex.Unlock()
+	go this.rotate(stop)
+	return nil
+}
+
+func (this *clusterTLS) rotate(stop chan bool) {
+	ticker := time.NewTicker(CertificateCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := this.renewIfRequired()
+			if err != nil {
+				Log().Error("Renewing the host certificate failed: " + err.Error())
+			}
+		}
+	}
+}
+
+// Issues a new host certificate, if there is none or the current one expires soon.
+func (this *clusterTLS) renewIfRequired() error {
+	cert, err := this.certificate()
+	if err == nil && !needsRenewal(cert.Leaf) {
+		return nil
+	}
+	Log().Info("Requesting a new host certificate...")
+	this.mutex.RLock()
+	issue := this.issue
+	this.mutex.RUnlock()
+	certPEM, keyPEM, err := issue()
+	if err != nil {
+		return err
+	}
+	renewed, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	if err = this.verify(&renewed); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(WINKUBE_HOST_KEY_FILE, keyPEM, 0600); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(WINKUBE_HOST_CERT_FILE, certPEM, 0644); err != nil {
+		return err
+	}
+	this.mutex.Lock()
+	this.hostCert = &renewed
+	this.mutex.Unlock()
+	Log().Info("New host certificate valid until " + renewed.Leaf.NotAfter.String() + ".")
+	return nil
+}
+
+// Checks the host certificate was issued by the trusted CA, the parsed certificate is set as leaf.
+func (this *clusterTLS) verify(cert *tls.Certificate) error {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	this.mutex.RLock()
+	pool := this.pool
+	this.mutex.RUnlock()
+	_, err = leaf.Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+	return nil
+}
+
+func (this *clusterTLS) certificate() (*tls.Certificate, error) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	if this.hostCert == nil {
+		return nil, errors.New("No host certificate available.")
+	}
+	return this.hostCert, nil
+}
+
+// Requests a host certificate from the controller, the request is signed with the join token.
+func (this *clusterTLS) enroll(controllerHost string, csrPEM []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", "https://"+controllerHost+":9999/cluster/certificate", bytes.NewReader(csrPEM))
+	if err != nil {
+		return nil, err
+	}
+	if err = signRequest(req); err != nil {
+		return nil, err
+	}
+	resp, err := this.Client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Controller " + controllerHost + " refused to issue a certificate: " + resp.Status + " " + string(data))
+	}
+	return data, nil
+}
+
+// Reads the CA of the controller given without verifying it. The CA returned must only be trusted
+// after its fingerprint has been confirmed.
+func FetchControllerCA(controllerHost string) (*x509.Certificate, error) {
+	client := http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	resp, err := client.Get("https://" + controllerHost + ":9999/cluster/ca")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Failed to read the CA of controller " + controllerHost + ": " + resp.Status)
+	}
+	return parseCertificatePEM(data)
+}
+
+func loadTrustedCA() (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(WINKUBE_TRUSTED_CA_FILE)
+	if err != nil {
+		return nil, err
+	}
+	return parseCertificatePEM(data)
+}
+
+// The addresses this host is reachable at, added to the host certificate.
+func hostAddresses() []string {
+	config := Container().Config
+	addresses := []string{"127.0.0.1"}
+	if config.NetHostIP != "" {
+		addresses = append(addresses, config.NetHostIP)
+	}
+	if config.NetHostname != "" && config.NetHostname != hostname() {
+		addresses = append(addresses, config.NetHostname)
+	}
+	return addresses
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// The current schema version of the config file. Increase it, when adding a migration.
+const CONFIG_SCHEMA_VERSION = 2
+
+// The backup of the previous config file, created when the config is written.
+const WINKUBE_CONFIG_BACKUP_FILE = WINKUBE_CONFIG_FILE + ".bak"
+
+// A migration upgrading the raw config file content from one schema version to the next.
+type ConfigMigration struct {
+	From        int
+	Description string
+	Migrate     func(config map[string]interface{}) error
+}
+
+// The migrations, indexed by the schema version they upgrade from.
+var configMigrations = map[int]ConfigMigration{}
+
+func init() {
+	RegisterConfigMigration(ConfigMigration{
+		From:        0,
+		Description: "Renamed the node id key 'Id' to 'id'.",
+		Migrate: func(config map[string]interface{}) error {
+			renameConfigKey(config, "Id", "id")
+			return nil
+		},
+	})
+	RegisterConfigMigration(ConfigMigration{
+		From:        1,
+		Description: "Cluster credentials and tokens are stored encrypted.",
+		Migrate: func(config map[string]interface{}) error {
+			// plaintext secrets are still readable, they are encrypted when the config is written
+			return nil
+		},
+	})
+}
+
+// Registers a migration, only one migration per schema version is allowed.
+func RegisterConfigMigration(migration ConfigMigration) {
+	if _, found := configMigrations[migration.From]; found {
+		panic(fmt.Sprintf("Duplicate config migration from schema version %v", migration.From))
+	}
+	configMigrations[migration.From] = migration
+}
+
+// Upgrades the config file content to the current schema version. Returns the upgraded content and
+// the descriptions of the migrations applied, which are empty if the config is up to date.
+func migrateConfig(data []byte) ([]byte, []string, error) {
+	var config map[string]interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, nil, err
+	}
+	version := 0
+	if v, found := config["schemaVersion"].(float64); found {
+		version = int(v)
+	}
+	if version > CONFIG_SCHEMA_VERSION {
+		return nil, nil, fmt.Errorf("Config schema version %v is newer than the supported version %v.", version, CONFIG_SCHEMA_VERSION)
+	}
+	if version == CONFIG_SCHEMA_VERSION {
+		return data, nil, nil
+	}
+	var applied []string
+	for ; version < CONFIG_SCHEMA_VERSION; version++ {
+		migration, found := configMigrations[version]
+		if !found {
+			return nil, applied, fmt.Errorf("No config migration from schema version %v.", version)
+		}
+		if err := migration.Migrate(config); err != nil {
+			return nil, applied, fmt.Errorf("Config migration from schema version %v failed: %v", version, err)
+		}
+		applied = append(applied, fmt.Sprintf("%v -> %v: %v", version, version+1, migration.Description))
+	}
+	config["schemaVersion"] = CONFIG_SCHEMA_VERSION
+	data, err := json.Marshal(config)
+	return data, applied, err
+}
+
+func renameConfigKey(config map[string]interface{}, from string, to string) {
+	if value, found := config[from]; found {
+		if _, exists := config[to]; !exists {
+			config[to] = value
+		}
+		delete(config, from)
+	}
+}
@@ -0,0 +1,59 @@
+package service
+
+import (
+	"encoding/json"
+	"gopkg.in/go-playground/assert.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigMigration_UpgradesUnversionedConfig(t *testing.T) {
+	data, applied, err := migrateConfig([]byte(`{"Id":"host-1","NetHostname":"lab-pc-01"}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, CONFIG_SCHEMA_VERSION, len(applied))
+	var config map[string]interface{}
+	assert.Equal(t, nil, json.Unmarshal(data, &config))
+	assert.Equal(t, "host-1", config["id"])
+	assert.Equal(t, nil, config["Id"])
+	assert.Equal(t, float64(CONFIG_SCHEMA_VERSION), config["schemaVersion"])
+	assert.Equal(t, "lab-pc-01", config["NetHostname"])
+}
+
+func TestConfigMigration_CurrentAndNewerVersions(t *testing.T) {
+	current := []byte(`{"schemaVersion":2,"id":"host-1"}`)
+	data, applied, err := migrateConfig(current)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(applied))
+	assert.Equal(t, string(current), string(data))
+
+	_, _, err = migrateConfig([]byte(`{"schemaVersion":99}`))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestConfigMigration_UnknownKeysAreReported(t *testing.T) {
+	assert.Equal(t, "Foo, bar", unknownConfigKeys([]byte(`{"id":"x","bar":1,"NetHostname":"y","Foo":2}`)))
+}
+
+func TestWriteConfig_KeepsThePreviousConfigAsBackup(t *testing.T) {
+	// the container migrates an existing config file when started
+	Container()
+	defer os.Remove(WINKUBE_CONFIG_FILE)
+	defer os.Remove(WINKUBE_CONFIG_BACKUP_FILE)
+	assert.Equal(t, nil, ioutil.WriteFile(WINKUBE_CONFIG_FILE, []byte(`{"id":"previous"}`), 0600))
+	config := SystemConfiguration{Id: "current"}
+	action := config.WriteConfig(nil)
+	assert.Equal(t, nil, action.Error)
+	backup, err := ioutil.ReadFile(WINKUBE_CONFIG_BACKUP_FILE)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"id":"previous"}`, string(backup))
+	var written map[string]interface{}
+	data, err := ioutil.ReadFile(WINKUBE_CONFIG_FILE)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, json.Unmarshal(data, &written))
+	assert.Equal(t, "current", written["id"])
+	// no temporary files are left
+	files, _ := filepath.Glob(WINKUBE_CONFIG_FILE + ".tmp*")
+	assert.Equal(t, 0, len(files))
+}
@@ -17,15 +17,27 @@ package service
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/winkube/service/netutil"
 	util2 "github.com/winkube/util"
+	"io/ioutil"
 	"net"
 	"os"
+	"sort"
+	"strings"
+	"time"
 )
 
 const WINKUBE_CONFIG_FILE = "winkube-config.json"
+const DEFAULT_DRAIN_TIMEOUT = 4 * time.Minute
+
+// The defaults of the time without heartbeat, after which the controller suspects a node or
+// considers it lost, and of the time after which the IPs of a lost node are released.
+const DEFAULT_NODE_SUSPECT_TIMEOUT = 30 * time.Second
+const DEFAULT_NODE_LOST_TIMEOUT = 2 * time.Minute
+const DEFAULT_NODE_RELEASE_GRACE_PERIOD = 10 * time.Minute
 
 type NodeType int
 
@@ -83,6 +95,13 @@ type ClusterControllerConnection struct {
 	ClusterId          string `validate:"required"`
 	ClusterCredentials string
 	ControllerHost     string `validate:"required"`
+	// The join token (<id>.<secret>) issued by the controller, used to sign the controller API calls.
+	JoinToken string
+	// The confirmed SHA-256 fingerprint of the controller CA, which is trusted on first use.
+	CAFingerprint string
+	// Candidates replicate the controller as standby and take over, if the controller fails. They
+	// require a candidate join token.
+	ControllerCandidate bool
 }
 
 type ClusterConfig struct {
@@ -100,6 +119,11 @@ type ClusterConfig struct {
 	ClusterAllWorkers    []ClusterNodeConfig
 	ClusterAllMasters    []ClusterNodeConfig
 	ClusterToken         string
+	// The seconds without heartbeat, after which a node is suspected or lost, and the seconds a
+	// node must be lost, before its IPs are released. 0 uses the defaults.
+	NodeSuspectTimeout     int `validate:"gte=0"`
+	NodeLostTimeout        int `validate:"gte=0"`
+	NodeReleaseGracePeriod int `validate:"gte=0"`
 }
 
 // The primary master, if existing.
@@ -110,6 +134,28 @@ func (this ClusterConfig) PrimaryMaster() *ClusterNodeConfig {
 	return nil
 }
 
+// The time without heartbeat, after which a node is suspected, defaults to 30 seconds.
+func (this ClusterConfig) SuspectTimeout() time.Duration {
+	return secondsOrDefault(this.NodeSuspectTimeout, DEFAULT_NODE_SUSPECT_TIMEOUT)
+}
+
+// The time without heartbeat, after which a node is lost, defaults to 2 minutes.
+func (this ClusterConfig) LostTimeout() time.Duration {
+	return secondsOrDefault(this.NodeLostTimeout, DEFAULT_NODE_LOST_TIMEOUT)
+}
+
+// The time a node must be lost, before its IPs are released, defaults to 10 minutes.
+func (this ClusterConfig) ReleaseGracePeriod() time.Duration {
+	return secondsOrDefault(this.NodeReleaseGracePeriod, DEFAULT_NODE_RELEASE_GRACE_PERIOD)
+}
+
+func secondsOrDefault(seconds int, defaultValue time.Duration) time.Duration {
+	if seconds <= 0 {
+		return defaultValue
+	}
+	return time.Duration(seconds) * time.Second
+}
+
 // All configured masters.
 func (this ClusterConfig) AllMasters() []ClusterNodeConfig {
 	return this.ClusterAllMasters
@@ -134,13 +180,18 @@ type ClusterNodeConfig struct {
 }
 
 type SystemConfiguration struct {
-	Id string `validate:"required", json:"id"`
+	// The schema version of the config file, see CONFIG_SCHEMA_VERSION.
+	SchemaVersion int    `json:"schemaVersion"`
+	Id            string `validate:"required" json:"id"`
 	LocalHostConfig
 	NetConfig
 	ClusterLogin     *ClusterControllerConnection `json:"clusterLogin"`
 	ControllerConfig *ClusterConfig               `json:"cluster"`
 	MasterNode       *ClusterNodeConfig           `json:"master"`
 	WorkerNode       *ClusterNodeConfig           `json:"worker"`
+	// The maximal time in seconds to wait for the workload to be evicted when going idle, at most
+	// MAX_DRAIN_TIMEOUT.
+	NodeDrainTimeout int `json:"drainTimeout" validate:"gte=0,lte=270"`
 }
 
 func (this SystemConfiguration) IsWorkerNode() bool {
@@ -162,6 +213,29 @@ func (this SystemConfiguration) UndefinedNode() bool {
 	return !this.IsMasterNode() && !this.IsControllerNode() && !this.IsWorkerNode()
 }
 
+// The Kubernetes names of the local nodes, which are cordoned and drained when going idle. The
+// primary master is not included, since it hosts the control plane.
+func (this SystemConfiguration) IdleNodeNames() []string {
+	var result []string
+	if this.IsWorkerNode() {
+		result = append(result, strings.ToLower(this.WorkerNode.NodeName))
+	}
+	if this.IsJoiningMaster() {
+		result = append(result, strings.ToLower(this.MasterNode.NodeName))
+	}
+	return result
+}
+
+// The maximal time to wait for the workload to be evicted when going idle, defaults to 4 minutes
+// and is limited to MAX_DRAIN_TIMEOUT.
+func (this SystemConfiguration) DrainTimeout() time.Duration {
+	timeout := secondsOrDefault(this.NodeDrainTimeout, DEFAULT_DRAIN_TIMEOUT)
+	if timeout > MAX_DRAIN_TIMEOUT {
+		return MAX_DRAIN_TIMEOUT
+	}
+	return timeout
+}
+
 func (conf SystemConfiguration) Validate() error {
 	return Container().Validator.Struct(conf)
 }
@@ -185,7 +259,7 @@ func InitConfig() *SystemConfiguration {
 			NetUPnPPort:         1900,
 		},
 	}
-	appConfig.ReadConfig()
+	appConfig.ReadConfig(nil)
 	return &appConfig
 }
 
@@ -240,9 +314,10 @@ func (config *SystemConfiguration) InitControllerConfig() *ClusterConfig {
 	return config.ControllerConfig
 }
 
-func (config *SystemConfiguration) ReadConfig() *Action {
+// Reads the config file, the action created is a child of the parent given, if not nil.
+func (config *SystemConfiguration) ReadConfig(parent *Action) *Action {
 	actionManager := *GetActionManager()
-	action := actionManager.StartAction("Read config from " + WINKUBE_CONFIG_FILE)
+	action := startAction(parent, "Read config from "+WINKUBE_CONFIG_FILE)
 	defer action.Complete()
 	f, err := os.Open(WINKUBE_CONFIG_FILE)
 	if err != nil {
@@ -257,40 +332,154 @@ func (config *SystemConfiguration) ReadConfig() *Action {
 		actionManager.LogAction(action.Id, "Could not read config: "+WINKUBE_CONFIG_FILE)
 		return actionManager.CompleteWithError(action.Id, err)
 	}
-	jsonerr := json.Unmarshal(b.Bytes(), &config)
-	if jsonerr != nil {
-		actionManager.LogAction(action.Id, "Could not unmarshal JSON from config: "+WINKUBE_CONFIG_FILE)
+	data, migrations, err := migrateConfig(b.Bytes())
+	if err != nil {
+		actionManager.LogAction(action.Id, "Could not migrate config: "+WINKUBE_CONFIG_FILE+"\n")
+		return actionManager.CompleteWithError(action.Id, err)
+	}
+	for _, migration := range migrations {
+		action.LogActionLn("Migrated config schema " + migration)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if decodeErr := decoder.Decode(config); decodeErr != nil {
+		// report unknown keys, but read the known ones
+		jsonerr := json.Unmarshal(data, config)
+		if jsonerr != nil {
+			actionManager.LogAction(action.Id, "Could not unmarshal JSON from config: "+WINKUBE_CONFIG_FILE+"\n")
+			return actionManager.CompleteWithError(action.Id, jsonerr)
+		}
+		unknown := unknownConfigKeys(data)
+		if unknown == "" {
+			unknown = decodeErr.Error()
+		}
+		action.LogActionLn("Warning: config contains unknown keys, which are ignored: " + unknown)
+	}
+	err = config.decryptSecrets()
+	if err != nil {
+		actionManager.LogAction(action.Id, "Could not decrypt secrets of config: "+WINKUBE_CONFIG_FILE+"\n")
 		return actionManager.CompleteWithError(action.Id, err)
 	}
+	if len(migrations) > 0 {
+		config.WriteConfig(action)
+	}
 	err = Container().Validator.Struct(config)
 	if err != nil {
 		action.LogActionLn("Loaded config is not valid, will trigger setup...")
 		action.CompleteWithError(err)
 	}
-	return actionManager.LogAction(action.Id, "Config successfully read: \n\n"+fmt.Sprintf("Id: %v\nNet:%+v\nHost:%+v\nCluster:%+v\nMaster:%+v\nWorker:%+v\nNodes:%+v\n",
-		config.Id,
-		config.LocalHostConfig,
-		config.NetConfig,
-		config.ControllerConfig,
-		config.MasterNode,
-		config.WorkerNode))
+	redacted := config.Redacted()
+	return actionManager.LogAction(action.Id, "Config successfully read: \n\n"+fmt.Sprintf("Id: %v\nNet:%+v\nHost:%+v\nLogin:%+v\nCluster:%+v\nMaster:%+v\nWorker:%+v\n",
+		redacted.Id,
+		redacted.LocalHostConfig,
+		redacted.NetConfig,
+		redacted.ClusterLogin,
+		redacted.ControllerConfig,
+		redacted.MasterNode,
+		redacted.WorkerNode))
 }
 
-func (config *SystemConfiguration) WriteConfig() *Action {
+// Writes the config file, the action created is a child of the parent given, if not nil. An
+// existing config file is kept as backup.
+func (config *SystemConfiguration) WriteConfig(parent *Action) *Action {
 	actionManager := *GetActionManager()
-	action := actionManager.StartAction("Write config to " + WINKUBE_CONFIG_FILE)
-	f, err := os.Create(WINKUBE_CONFIG_FILE)
+	action := startAction(parent, "Write config to "+WINKUBE_CONFIG_FILE)
+	config.SchemaVersion = CONFIG_SCHEMA_VERSION
+	if Container().SecretStore == nil {
+		return actionManager.CompleteWithError(action.Id, errors.New("No secret store available to encrypt the secrets."))
+	}
+	encrypted, err := config.mapSecrets((*Container().SecretStore).Encrypt)
 	if err != nil {
-		actionManager.LogAction(action.Id, "Could not open/create file: "+WINKUBE_CONFIG_FILE)
 		return actionManager.CompleteWithError(action.Id, err)
 	}
-	defer f.Close()
 	// generate config file
-	b, err := json.MarshalIndent(&config, "", "\t")
-	f.Write(b)
+	b, err := json.MarshalIndent(&encrypted, "", "\t")
+	if err != nil {
+		return actionManager.CompleteWithError(action.Id, err)
+	}
+	// the config is replaced atomically, so a failed write never loses the current config
+	if util2.FileExists(WINKUBE_CONFIG_FILE) {
+		previous, err := ioutil.ReadFile(WINKUBE_CONFIG_FILE)
+		if err == nil {
+			err = util2.WriteFileAtomic(WINKUBE_CONFIG_BACKUP_FILE, previous, 0600)
+		}
+		if err != nil {
+			actionManager.LogAction(action.Id, "Could not backup config to: "+WINKUBE_CONFIG_BACKUP_FILE+"\n")
+			return actionManager.CompleteWithError(action.Id, err)
+		}
+		actionManager.LogAction(action.Id, "Previous config saved as "+WINKUBE_CONFIG_BACKUP_FILE+"\n")
+	}
+	err = util2.WriteFileAtomic(WINKUBE_CONFIG_FILE, b, 0600)
+	if err != nil {
+		actionManager.LogAction(action.Id, "Could not write file: "+WINKUBE_CONFIG_FILE+"\n")
+		return actionManager.CompleteWithError(action.Id, err)
+	}
 	return actionManager.Complete(action.Id)
 }
 
+// Returns a copy of the config with all secrets replaced by REDACTED_SECRET, e.g. for logging.
+func (config SystemConfiguration) Redacted() SystemConfiguration {
+	redacted, _ := config.mapSecrets(func(secret string) (string, error) {
+		return redact(secret), nil
+	})
+	return redacted
+}
+
+func (config *SystemConfiguration) decryptSecrets() error {
+	if Container().SecretStore == nil {
+		return errors.New("No secret store available to decrypt the secrets.")
+	}
+	decrypted, err := config.mapSecrets((*Container().SecretStore).Decrypt)
+	if err == nil {
+		*config = decrypted
+	}
+	return err
+}
+
+// Returns a copy of the config with all secrets (cluster credentials and tokens) mapped by the
+// function given. The original config is not changed.
+func (config SystemConfiguration) mapSecrets(mapping func(secret string) (string, error)) (SystemConfiguration, error) {
+	var err error
+	if config.ClusterLogin != nil {
+		login := *config.ClusterLogin
+		if login.ClusterCredentials, err = mapping(login.ClusterCredentials); err != nil {
+			return config, err
+		}
+		if login.JoinToken, err = mapping(login.JoinToken); err != nil {
+			return config, err
+		}
+		config.ClusterLogin = &login
+	}
+	if config.ControllerConfig != nil {
+		cluster := *config.ControllerConfig
+		if cluster.ClusterCredentials, err = mapping(cluster.ClusterCredentials); err != nil {
+			return config, err
+		}
+		if cluster.ClusterToken, err = mapping(cluster.ClusterToken); err != nil {
+			return config, err
+		}
+		config.ControllerConfig = &cluster
+	}
+	return config, nil
+}
+
+// Evaluates the top level keys of the config file content, which are not known.
+func unknownConfigKeys(data []byte) string {
+	var raw map[string]interface{}
+	json.Unmarshal(data, &raw)
+	known, _ := json.Marshal(SystemConfiguration{})
+	var knownKeys map[string]interface{}
+	json.Unmarshal(known, &knownKeys)
+	var unknown []string
+	for key := range raw {
+		if _, found := knownKeys[key]; !found {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return strings.Join(unknown, ", ")
+}
+
 func (conf SystemConfiguration) GetHostIp() string {
 	interfaces, err := net.Interfaces()
 	if util2.CheckAndLogError("Failed to evaluate interfaces", err) {
@@ -0,0 +1,378 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The file containing the join tokens issued by the controller.
+const WINKUBE_TOKENS_FILE = "winkube-tokens.json"
+
+// Headers of a signed controller API request.
+const (
+	AUTH_HEADER_TOKEN     = "X-WinKube-Token"
+	AUTH_HEADER_TIMESTAMP = "X-WinKube-Timestamp"
+	AUTH_HEADER_NONCE     = "X-WinKube-Nonce"
+	AUTH_HEADER_SIGNATURE = "X-WinKube-Signature"
+)
+
+// The lifetime of join tokens, if not specified otherwise.
+const DEFAULT_TOKEN_TTL = 30 * 24 * time.Hour
+
+// The maximal difference between the timestamp of a signed request and the local clock. Nonces
+// are remembered for twice this duration.
+var MaxRequestSkew = 5 * time.Minute
+
+// A join token allows a node to call the controller API. The controller issues one token per
+// node, a node signs its requests with the token secret.
+type JoinToken struct {
+	Id        string     `json:"id"`
+	Node      string     `json:"node"`
+	Secret    string     `json:"secret,omitempty"`
+	IssuedAt  time.Time  `json:"issuedAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Revoked   bool       `json:"revoked,omitempty"`
+	// Candidate tokens are issued to the standby controllers, they may replicate the controller.
+	Candidate bool `json:"candidate,omitempty"`
+}
+
+func (this JoinToken) Expired() bool {
+	return this.ExpiresAt != nil && time.Now().After(*this.ExpiresAt)
+}
+
+func (this JoinToken) Valid() bool {
+	return !this.Revoked && !this.Expired()
+}
+
+// The token as configured on a node: <id>.<secret>
+func (this JoinToken) String() string {
+	return this.Id + "." + this.Secret
+}
+
+// Splits a token of the form <id>.<secret>.
+func ParseJoinToken(token string) (id string, secret string, err error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New("Invalid join token, expected <id>.<secret>.")
+	}
+	return parts[0], parts[1], nil
+}
+
+// The TokenManager issues, revokes and verifies the join tokens of a controller.
+type TokenManager interface {
+	// Issues a new token for the node given, revoking the tokens issued for the node before. A ttl
+	// of 0 creates a token that never expires.
+	Issue(node string, ttl time.Duration) (JoinToken, error)
+	// Issues a token like Issue, which allows the node to act as standby controller.
+	IssueCandidate(node string, ttl time.Duration) (JoinToken, error)
+	// Revokes the token with the given id.
+	Revoke(id string) error
+	// All tokens issued, without their secrets.
+	Tokens() []JoinToken
+	// Verifies the signature, the timestamp and the nonce of a request signed with SignRequest.
+	// The valid token used for signing is returned.
+	Verify(req *http.Request) (JoinToken, error)
+	// All tokens including their secrets, used to replicate the tokens to the standby controllers.
+	Export() []JoinToken
+	// Replaces all tokens with the tokens given, e.g. when a standby controller takes over.
+	Import(tokens []JoinToken) error
+}
+
+// Creates a token manager keeping its tokens in the file given, an empty file name keeps the tokens
+// in memory only. The token secrets are encrypted with the secret store given, if not nil.
+func CreateTokenManager(file string, secrets *SecretStore) *TokenManager {
+	manager := tokenManager{
+		file:    file,
+		secrets: secrets,
+		tokens:  make(map[string]*JoinToken),
+		nonces:  make(map[string]time.Time),
+	}
+	err := manager.load()
+	if err != nil {
+		Log().Error("Failed to load join tokens from " + file + ": " + err.Error())
+	}
+	var result TokenManager = &manager
+	return &result
+}
+
+type tokenManager struct {
+	file    string
+	secrets *SecretStore
+	tokens  map[string]*JoinToken
+	// the nonces seen, with the time they can be forgotten
+	nonces map[string]time.Time
+	mutex  sync.Mutex
+}
+
+func (this *tokenManager) Issue(node string, ttl time.Duration) (JoinToken, error) {
+	return this.issue(node, ttl, false)
+}
+
+func (this *tokenManager) IssueCandidate(node string, ttl time.Duration) (JoinToken, error) {
+	return this.issue(node, ttl, true)
+}
+
+func (this *tokenManager) issue(node string, ttl time.Duration, candidate bool) (JoinToken, error) {
+	if node == "" {
+		return JoinToken{}, errors.New("A node name is required to issue a join token.")
+	}
+	id, err := randomBytes(6)
+	if err != nil {
+		return JoinToken{}, err
+	}
+	secret, err := randomBytes(24)
+	if err != nil {
+		return JoinToken{}, err
+	}
+	token := JoinToken{
+		Id:        hex.EncodeToString(id),
+		Node:      node,
+		Secret:    base64.RawURLEncoding.EncodeToString(secret),
+		IssuedAt:  time.Now(),
+		Candidate: candidate,
+	}
+	if ttl > 0 {
+		expiresAt := token.IssuedAt.Add(ttl)
+		token.ExpiresAt = &expiresAt
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, t := range this.tokens {
+		if t.Node == node {
+			t.Revoked = true
+		}
+	}
+	this.tokens[token.Id] = &token
+	return token, this.save()
+}
+
+func (this *tokenManager) Revoke(id string) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	token := this.tokens[id]
+	if token == nil {
+		return errors.New("No such token: " + id)
+	}
+	token.Revoked = true
+	return this.save()
+}
+
+func (this *tokenManager) Tokens() []JoinToken {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	result := []JoinToken{}
+	for _, t := range this.tokens {
+		token := *t
+		token.Secret = ""
+		result = append(result, token)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].IssuedAt.Before(result[j].IssuedAt)
+	})
+	return result
+}
+
+func (this *tokenManager) Export() []JoinToken {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	result := []JoinToken{}
+	for _, t := range this.tokens {
+		result = append(result, *t)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].IssuedAt.Before(result[j].IssuedAt)
+	})
+	return result
+}
+
+func (this *tokenManager) Import(tokens []JoinToken) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.tokens = make(map[string]*JoinToken)
+	for i := range tokens {
+		token := tokens[i]
+		this.tokens[token.Id] = &token
+	}
+	return this.save()
+}
+
+func (this *tokenManager) Verify(req *http.Request) (JoinToken, error) {
+	id := req.Header.Get(AUTH_HEADER_TOKEN)
+	timestamp := req.Header.Get(AUTH_HEADER_TIMESTAMP)
+	nonce := req.Header.Get(AUTH_HEADER_NONCE)
+	signature := req.Header.Get(AUTH_HEADER_SIGNATURE)
+	if id == "" || timestamp == "" || nonce == "" || signature == "" {
+		return JoinToken{}, errors.New("Request is not signed.")
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return JoinToken{}, errors.New("Invalid request timestamp: " + timestamp)
+	}
+	sent := time.Unix(seconds, 0)
+	if sent.Before(time.Now().Add(-MaxRequestSkew)) || sent.After(time.Now().Add(MaxRequestSkew)) {
+		return JoinToken{}, errors.New("Request timestamp outside of the allowed window: " + sent.String())
+	}
+	body, err := readBody(req)
+	if err != nil {
+		return JoinToken{}, err
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	token := this.tokens[id]
+	if token == nil {
+		return JoinToken{}, errors.New("Unknown token: " + id)
+	}
+	if !token.Valid() {
+		return JoinToken{}, errors.New("Token " + id + " of node " + token.Node + " is expired or revoked.")
+	}
+	expected := requestSignature(token.Secret, req, timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return JoinToken{}, errors.New("Invalid signature for token " + id + " of node " + token.Node + ".")
+	}
+	now := time.Now()
+	for n, forget := range this.nonces {
+		if now.After(forget) {
+			delete(this.nonces, n)
+		}
+	}
+	if _, seen := this.nonces[id+":"+nonce]; seen {
+		return JoinToken{}, errors.New("Replayed request of node " + token.Node + ".")
+	}
+	this.nonces[id+":"+nonce] = sent.Add(2 * MaxRequestSkew)
+	result := *token
+	result.Secret = ""
+	return result, nil
+}
+
+// Signs a request with the join token given (<id>.<secret>), adding the token id, a timestamp, a
+// nonce and the HMAC-SHA256 signature of the request as headers.
+func SignRequest(req *http.Request, token string) error {
+	id, secret, err := ParseJoinToken(token)
+	if err != nil {
+		return err
+	}
+	nonce, err := randomBytes(16)
+	if err != nil {
+		return err
+	}
+	body, err := readBody(req)
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(AUTH_HEADER_TOKEN, id)
+	req.Header.Set(AUTH_HEADER_TIMESTAMP, timestamp)
+	req.Header.Set(AUTH_HEADER_NONCE, hex.EncodeToString(nonce))
+	req.Header.Set(AUTH_HEADER_SIGNATURE, requestSignature(secret, req, timestamp, hex.EncodeToString(nonce), body))
+	return nil
+}
+
+// Signs the method, the URI, the timestamp, the nonce and the body hash of a request.
+func requestSignature(secret string, req *http.Request, timestamp string, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{
+		strings.ToUpper(req.Method),
+		req.URL.RequestURI(),
+		timestamp,
+		nonce,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Reads the body of a request and replaces it, so it can be read again.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return []byte{}, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+func (this *tokenManager) load() error {
+	if this.file == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(this.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var tokens []JoinToken
+	err = json.Unmarshal(data, &tokens)
+	if err != nil {
+		return err
+	}
+	for i := range tokens {
+		if this.secrets != nil {
+			tokens[i].Secret, err = (*this.secrets).Decrypt(tokens[i].Secret)
+			if err != nil {
+				return err
+			}
+		}
+		this.tokens[tokens[i].Id] = &tokens[i]
+	}
+	return nil
+}
+
+// Writes all tokens, the caller must hold the lock.
+func (this *tokenManager) save() error {
+	if this.file == "" {
+		return nil
+	}
+	tokens := []JoinToken{}
+	for _, t := range this.tokens {
+		token := *t
+		if this.secrets != nil {
+			secret, err := (*this.secrets).Encrypt(token.Secret)
+			if err != nil {
+				return err
+			}
+			token.Secret = secret
+		}
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].IssuedAt.Before(tokens[j].IssuedAt)
+	})
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(this.file, data, 0600)
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"bytes"
+	"gopkg.in/go-playground/assert.v1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func signedRequest(t *testing.T, method string, uri string, body string, token string) *http.Request {
+	req, err := http.NewRequest(method, uri, bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, nil, SignRequest(req, token))
+	// the server reads the request from the wire
+	server := httptest.NewRequest(method, uri, req.Body)
+	server.Header = req.Header
+	return server
+}
+
+func TestTokenManager_VerifiesSignedRequestsOnce(t *testing.T) {
+	tokens := *CreateTokenManager("", nil)
+	token, err := tokens.Issue("worker-1", time.Hour)
+	assert.Equal(t, nil, err)
+
+	req := signedRequest(t, "POST", "http://controller:9999/cluster/node?id=1", `{"Id":"1"}`, token.String())
+	verified, err := tokens.Verify(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "worker-1", verified.Node)
+	assert.Equal(t, "", verified.Secret)
+	body, _ := ioutil.ReadAll(req.Body)
+	assert.Equal(t, `{"Id":"1"}`, string(body))
+
+	replayed := httptest.NewRequest("POST", "http://controller:9999/cluster/node?id=1", bytes.NewReader(body))
+	replayed.Header = req.Header
+	_, err = tokens.Verify(replayed)
+	assert.NotEqual(t, nil, err)
+
+	tampered := signedRequest(t, "GET", "http://controller:9999/cluster/masters", "", token.String())
+	tampered.URL.Path = "/cluster/workers"
+	_, err = tokens.Verify(tampered)
+	assert.NotEqual(t, nil, err)
+
+	old := signedRequest(t, "GET", "http://controller:9999/cluster/masters", "", token.String())
+	old.Header.Set(AUTH_HEADER_TIMESTAMP, strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+	_, err = tokens.Verify(old)
+	assert.NotEqual(t, nil, err)
+
+	_, err = tokens.Verify(httptest.NewRequest("GET", "http://controller:9999/cluster/masters", nil))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestTokenManager_RevokedAndExpiredTokensAreRejected(t *testing.T) {
+	tokens := *CreateTokenManager("", nil)
+	first, _ := tokens.Issue("worker-1", 0)
+	second, _ := tokens.Issue("worker-1", 0)
+	_, err := tokens.Verify(signedRequest(t, "GET", "http://controller:9999/cluster", "", first.String()))
+	assert.NotEqual(t, nil, err)
+	_, err = tokens.Verify(signedRequest(t, "GET", "http://controller:9999/cluster", "", second.String()))
+	assert.Equal(t, nil, err)
+
+	assert.Equal(t, nil, tokens.Revoke(second.Id))
+	_, err = tokens.Verify(signedRequest(t, "GET", "http://controller:9999/cluster", "", second.String()))
+	assert.NotEqual(t, nil, err)
+	assert.NotEqual(t, nil, tokens.Revoke("unknown"))
+
+	expired, _ := tokens.Issue("worker-2", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	_, err = tokens.Verify(signedRequest(t, "GET", "http://controller:9999/cluster", "", expired.String()))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestTokenManager_TokensArePersistedEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "winkube-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secrets, err := CreateKeyFileSecretStore(filepath.Join(dir, WINKUBE_MASTER_KEY_FILE))
+	assert.Equal(t, nil, err)
+	file := filepath.Join(dir, WINKUBE_TOKENS_FILE)
+
+	token, err := (*CreateTokenManager(file, secrets)).Issue("master-1", 0)
+	assert.Equal(t, nil, err)
+	data, _ := ioutil.ReadFile(file)
+	assert.Equal(t, false, bytes.Contains(data, []byte(token.Secret)))
+
+	reloaded := *CreateTokenManager(file, secrets)
+	assert.Equal(t, 1, len(reloaded.Tokens()))
+	_, err = reloaded.Verify(signedRequest(t, "DELETE", "http://controller:9999/cluster/nodeip?address=10.0.0.1", "", token.String()))
+	assert.Equal(t, nil, err)
+}
+
+func TestTokenManager_ImportsExportedCandidateTokens(t *testing.T) {
+	leader := *CreateTokenManager("", nil)
+	candidate, err := leader.IssueCandidate("master-2", 0)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, candidate.Candidate)
+	_, err = leader.Issue("worker-1", time.Hour)
+	assert.Equal(t, nil, err)
+
+	standby := *CreateTokenManager("", nil)
+	assert.Equal(t, nil, standby.Import(leader.Export()))
+	assert.Equal(t, 2, len(standby.Tokens()))
+	verified, err := standby.Verify(signedRequest(t, "GET", "http://standby:9999/cluster/lease", "", candidate.String()))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, verified.Candidate)
+}
@@ -0,0 +1,355 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/winkube/util"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How often the standby controllers replicate the leader, and how long the leader may be
+// unreachable, before the first standby takes over. Each further standby waits another timeout,
+// so the standby controllers do not take over at the same time.
+var ControllerLeaseInterval = 5 * time.Second
+var ControllerLeaseTimeout = 15 * time.Second
+
+// The node name of the candidate token a configured controller signs its calls to the other
+// controllers with, followed by its host name.
+const CONTROLLER_TOKEN_NODE_PREFIX = "controller:"
+
+// The lease of the controller leading a cluster. Leases with a higher term win, so a controller
+// coming back after a failover follows the controller, which has taken over.
+type ControllerLease struct {
+	ClusterId string `json:"clusterId"`
+	Leader    string `json:"leader"`
+	Term      int64  `json:"term"`
+	// All hosts able to lead the cluster, the leader included.
+	Candidates []string `json:"candidates"`
+}
+
+// Everything a standby controller requires to take over: the cluster config, the nodes and IP
+// reservations, the join tokens and the cluster CA.
+type ControllerReplica struct {
+	Lease   ControllerLease `json:"lease"`
+	Config  ClusterConfig   `json:"config"`
+	Record  ClusterRecord   `json:"record"`
+	Tokens  []JoinToken     `json:"tokens"`
+	CACert  []byte          `json:"caCert"`
+	CAKey   []byte          `json:"caKey"`
+	Created time.Time       `json:"created"`
+}
+
+// The position of a host in the takeover order: the candidates take over in the order they
+// registered with the leader, the leader itself is skipped. Hosts not registered come last.
+func standbyRank(candidates []string, leader string, host string) int {
+	rank := 0
+	for _, candidate := range candidates {
+		if candidate == leader {
+			continue
+		}
+		if candidate == host {
+			return rank
+		}
+		rank++
+	}
+	return rank
+}
+
+// Returns the lease winning an election: the lease with the highest term, on equal terms the one
+// whose leader sorts first. Nil is returned for no leases.
+func winningLease(leases []ControllerLease) *ControllerLease {
+	if len(leases) == 0 {
+		return nil
+	}
+	sorted := append([]ControllerLease{}, leases...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Term != sorted[j].Term {
+			return sorted[i].Term > sorted[j].Term
+		}
+		return sorted[i].Leader < sorted[j].Leader
+	})
+	return &sorted[0]
+}
+
+// Adds a host to the candidates given, if not yet contained.
+func addCandidate(candidates []string, host string) []string {
+	for _, candidate := range candidates {
+		if candidate == host {
+			return candidates
+		}
+	}
+	return append(candidates, host)
+}
+
+// Asks the hosts given for their lease, only the hosts currently leading answer. Hosts not
+// answering are skipped, as are answers of hosts claiming another host to lead.
+func fetchLeases(hosts []string, joinToken string) []ControllerLease {
+	leases := []ControllerLease{}
+	for _, host := range hosts {
+		var lease ControllerLease
+		if err := callController(host, "/cluster/lease", joinToken, &lease); err != nil {
+			Log().Debug("No lease from controller " + host + ": " + err.Error())
+			continue
+		}
+		if lease.Leader == host {
+			leases = append(leases, lease)
+		}
+	}
+	return leases
+}
+
+// Calls the cluster API of a controller, waiting at most ControllerLeaseInterval. The JSON
+// result is read into the result given.
+func callController(host string, path string, joinToken string, result interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ControllerLeaseInterval)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, "https://"+host+":9999"+path, nil)
+	if err != nil {
+		return err
+	}
+	if err = SignRequest(req, joinToken); err != nil {
+		return err
+	}
+	resp, err := (*Container().ClusterTLS).Client().Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("Controller " + host + " answered " + resp.Status + ": " + string(data))
+	}
+	return json.Unmarshal(data, result)
+}
+
+// The join token this host signs its calls to the other controllers with: the configured join
+// token of a candidate, or a candidate token a configured controller issues for itself.
+func controllerToken() (string, error) {
+	config := Container().Config
+	if config.ClusterLogin != nil && config.ClusterLogin.JoinToken != "" {
+		return config.ClusterLogin.JoinToken, nil
+	}
+	node := CONTROLLER_TOKEN_NODE_PREFIX + hostname()
+	for _, token := range (*Container().Tokens).Export() {
+		if token.Node == node && token.Candidate && token.Valid() {
+			return token.String(), nil
+		}
+	}
+	token, err := (*Container().Tokens).IssueCandidate(node, 0)
+	if err != nil {
+		return "", err
+	}
+	return token.String(), nil
+}
+
+// A standby controller replicates the leader of a cluster. If the leader cannot be reached for
+// longer than its lease timeout, the standby takes over, unless another controller has done so.
+type controllerStandby struct {
+	clusterId string
+	joinToken string
+	store     *ClusterStore
+	// called to lead the cluster with the replica given
+	takeover func(replica *ControllerReplica) error
+	// called when another controller has taken over
+	follow      func(lease ControllerLease)
+	leader      string
+	term        int64
+	candidates  []string
+	replica     *ControllerReplica
+	lastContact time.Time
+	stop        chan bool
+	mutex       sync.Mutex
+}
+
+// Creates a standby following the leader given.
+func createControllerStandby(clusterId string, leader string, joinToken string, store *ClusterStore) *controllerStandby {
+	standby := controllerStandby{
+		clusterId:   clusterId,
+		joinToken:   joinToken,
+		store:       store,
+		leader:      leader,
+		lastContact: time.Now(),
+	}
+	if record := (*store).Lookup(clusterId); record != nil {
+		standby.term = record.Term
+		standby.candidates = record.Candidates
+	}
+	return &standby
+}
+
+// Starts replicating the leader.
+func (this *controllerStandby) Start() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.stop != nil {
+		return
+	}
+	this.stop = make(chan bool)
+	go this.run(this.stop)
+}
+
+// Stops replicating, e.g. when this host has taken over.
+func (this *controllerStandby) Stop() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.stop != nil {
+		close(this.stop)
+		this.stop = nil
+	}
+}
+
+// The lease of the leader currently followed.
+func (this *controllerStandby) Lease() ControllerLease {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return ControllerLease{
+		ClusterId:  this.clusterId,
+		Leader:     this.leader,
+		Term:       this.term,
+		Candidates: append([]string{}, this.candidates...),
+	}
+}
+
+func (this *controllerStandby) run(stop chan bool) {
+	ticker := time.NewTicker(ControllerLeaseInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := this.replicate()
+			if err == nil {
+				continue
+			}
+			Log().Debug("Replicating controller " + this.leader + " failed: " + err.Error())
+			if this.elect() {
+				this.Stop()
+				return
+			}
+		}
+	}
+}
+
+// Reads the replica of the leader and stores it locally.
+func (this *controllerStandby) replicate() error {
+	this.mutex.Lock()
+	leader := this.leader
+	this.mutex.Unlock()
+	var replica ControllerReplica
+	err := callController(leader, "/cluster/replica?host="+url.QueryEscape(hostname()), this.joinToken, &replica)
+	if err != nil {
+		return err
+	}
+	if replica.Lease.ClusterId != this.clusterId {
+		return errors.New("Controller " + leader + " leads cluster " + replica.Lease.ClusterId + ", expected " + this.clusterId + ".")
+	}
+	if err = applyReplica(&replica, this.store); err != nil {
+		return err
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.term = replica.Lease.Term
+	this.candidates = replica.Lease.Candidates
+	this.replica = &replica
+	this.lastContact = time.Now()
+	return nil
+}
+
+// Checks if the lease of the leader has timed out, and if so, follows the controller, which has
+// taken over, or takes over itself. Returns true, if this host has taken over.
+func (this *controllerStandby) elect() bool {
+	this.mutex.Lock()
+	leader := this.leader
+	term := this.term
+	candidates := append([]string{}, this.candidates...)
+	replica := this.replica
+	timeout := ControllerLeaseTimeout * time.Duration(1+standbyRank(candidates, leader, hostname()))
+	expired := time.Since(this.lastContact) > timeout
+	this.mutex.Unlock()
+	if !expired {
+		return false
+	}
+	if lease := winningLease(fetchLeases(otherHosts(candidates), this.joinToken)); lease != nil &&
+		(lease.Term > term || lease.Leader == leader) {
+		Log().Info("Controller " + lease.Leader + " leads cluster " + this.clusterId + ", following it.")
+		this.mutex.Lock()
+		this.leader = lease.Leader
+		this.term = lease.Term
+		this.lastContact = time.Now()
+		this.mutex.Unlock()
+		if this.follow != nil {
+			this.follow(*lease)
+		}
+		return false
+	}
+	if replica == nil {
+		Log().Warn("Controller " + leader + " is unreachable, but cannot take over without a replica of it.")
+		return false
+	}
+	Log().Warn("Controller " + leader + " is unreachable, taking over cluster " + this.clusterId + "...")
+	err := this.takeover(replica)
+	if err != nil {
+		Log().Error("Taking over cluster " + this.clusterId + " failed: " + err.Error())
+		return false
+	}
+	return true
+}
+
+// Stores the replica of a leader: the cluster record, the join tokens and the cluster CA.
+func applyReplica(replica *ControllerReplica, store *ClusterStore) error {
+	record := replica.Record
+	record.Leader = replica.Lease.Leader
+	record.Term = replica.Lease.Term
+	record.Candidates = replica.Lease.Candidates
+	if err := (*store).Save(record); err != nil {
+		return err
+	}
+	if err := (*Container().Tokens).Import(replica.Tokens); err != nil {
+		return err
+	}
+	if len(replica.CACert) > 0 && len(replica.CAKey) > 0 {
+		return replicateCA(replica.CACert, replica.CAKey, Container().SecretStore)
+	}
+	return nil
+}
+
+// Stores the CA of the leader, unless it is stored already. The key is encrypted like the other
+// secrets of the host.
+func replicateCA(certPEM []byte, keyPEM []byte, secrets *SecretStore) error {
+	storedCert, err := ioutil.ReadFile(WINKUBE_CA_CERT_FILE)
+	if err == nil && bytes.Equal(storedCert, certPEM) {
+		storedKey, err := readCAKey(WINKUBE_CA_KEY_FILE, secrets)
+		if err == nil && bytes.Equal(storedKey, keyPEM) {
+			return nil
+		}
+	}
+	if err = writeCAKey(WINKUBE_CA_KEY_FILE, keyPEM, secrets); err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(WINKUBE_CA_CERT_FILE, certPEM, 0644)
+}
@@ -0,0 +1,39 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Runs the tests in a temporary working directory: the container started by the tests creates
+// its key, session and action files relative to it, they must not end up in the package.
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "winkube-service-test")
+	if err != nil {
+		fmt.Println("Cannot create test directory: " + err.Error())
+		os.Exit(1)
+	}
+	if err = os.Chdir(dir); err != nil {
+		fmt.Println("Cannot change to test directory: " + err.Error())
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
@@ -0,0 +1,410 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/**
+ * JSON API of the monitor application registered under /api/v1.
+ */
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/winkube/webapp"
+	"golang.org/x/text/language"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const API_ROOT = "/api/v1"
+
+// The timeout of API calls, and of the calls entering setup.
+const API_TIMEOUT = 30 * time.Second
+const API_SETUP_TIMEOUT = 10 * time.Minute
+
+func MonitorApiApplication() *webapp.WebApplication {
+	Log().Info("Initializing monitor API...")
+	apiWebapp := webapp.CreateWebApp("WinKube-API", API_ROOT, language.English)
+	apiWebapp.JSONErrors = true
+	instrumentWebApp(apiWebapp)
+	useConfiguredCORS(apiWebapp)
+	apiWebapp.GetAction("/info", ApiInfoAction)
+	apiWebapp.GetAction("/status", ApiStatusAction)
+	apiWebapp.PutAction("/status", ApiRequestStatusAction)
+	apiWebapp.PostAction("/setup", ApiEnterSetupAction)
+	apiWebapp.PutAction("/config", ApiInstallConfigAction)
+	apiWebapp.PostAction("/nodes/start", ApiStartNodesAction)
+	apiWebapp.PostAction("/nodes/stop", ApiStopNodesAction)
+	apiWebapp.GetAction("/actions", ApiRunningActionsAction)
+	apiWebapp.GetAction("/actions/completed", ApiCompletedActionsAction)
+	apiWebapp.GetAction("/action", ApiActionAction)
+	apiWebapp.GetAction("/action/log", ApiActionLogAction)
+	apiWebapp.PostAction("/action/cancel", ApiCancelActionAction)
+	apiWebapp.GetAction("/tokens", ApiTokensAction)
+	apiWebapp.PostAction("/tokens", ApiIssueTokenAction)
+	apiWebapp.PostAction("/token/revoke", ApiRevokeTokenAction)
+	apiWebapp.GetAction("/users", ApiUsersAction)
+	apiWebapp.PutAction("/users", ApiSaveUserAction)
+	apiWebapp.DeleteAction("/users", ApiRemoveUserAction)
+	apiWebapp.GetAction("/audit", ApiAuditAction)
+	apiWebapp.GetAction("/metrics", ApiMetricsAction)
+	// Roles, reading requires a viewer
+	secureWebApp(apiWebapp, ROLE_VIEWER, true)
+	apiWebapp.RequireRole("PUT", "/status", string(ROLE_OPERATOR))
+	apiWebapp.RequireRole("POST", "/nodes/start", string(ROLE_OPERATOR))
+	apiWebapp.RequireRole("POST", "/nodes/stop", string(ROLE_OPERATOR))
+	apiWebapp.RequireRole("POST", "/action/cancel", string(ROLE_OPERATOR))
+	apiWebapp.RequireRole("POST", "/setup", string(ROLE_ADMIN))
+	apiWebapp.RequireRole("PUT", "/config", string(ROLE_ADMIN))
+	apiWebapp.RequireRole("GET", "/tokens", string(ROLE_ADMIN))
+	apiWebapp.RequireRole("POST", "/tokens", string(ROLE_ADMIN))
+	apiWebapp.RequireRole("POST", "/token/revoke", string(ROLE_ADMIN))
+	apiWebapp.RequireRole("GET", "/users", string(ROLE_ADMIN))
+	apiWebapp.RequireRole("PUT", "/users", string(ROLE_ADMIN))
+	apiWebapp.RequireRole("DELETE", "/users", string(ROLE_ADMIN))
+	apiWebapp.RequireRole("GET", "/audit", string(ROLE_ADMIN))
+	// Timeouts, entering setup waits for the nodes to be stopped
+	apiWebapp.DefaultTimeout = API_TIMEOUT
+	apiWebapp.SetTimeout("POST", "/setup", API_SETUP_TIMEOUT)
+	apiWebapp.SetTimeout("PUT", "/config", API_SETUP_TIMEOUT)
+	return apiWebapp
+}
+
+// The JSON representation of an action.
+type ApiAction struct {
+	Id             string     `json:"id"`
+	ParentId       string     `json:"parentId,omitempty"`
+	Command        string     `json:"command"`
+	Description    string     `json:"description,omitempty"`
+	Status         string     `json:"status"`
+	RolledUpStatus string     `json:"rolledUpStatus"`
+	Progress       int        `json:"progress"`
+	TotalSteps     int        `json:"totalSteps,omitempty"`
+	CompletedSteps int        `json:"completedSteps,omitempty"`
+	StartedAt      *time.Time `json:"startedAt"`
+	FinishedAt     *time.Time `json:"finishedAt,omitempty"`
+	Error          string     `json:"error,omitempty"`
+}
+
+// The JSON representation of a page of completed actions.
+type ApiActionPage struct {
+	Actions  []ApiAction `json:"actions"`
+	Page     int         `json:"page"`
+	PageSize int         `json:"pageSize"`
+	Pages    int         `json:"pages"`
+	Total    int         `json:"total"`
+}
+
+// The current and the requested application state.
+type ApiStatus struct {
+	Current   AppStatus `json:"current"`
+	Requested AppStatus `json:"requested"`
+}
+
+// A join token issued by the controller. The token (<id>.<secret>) is only returned when issued.
+type ApiJoinToken struct {
+	JoinToken
+	Token string `json:"token,omitempty"`
+}
+
+type ApiError struct {
+	Error string `json:"error"`
+}
+
+func toApiAction(action *Action) ApiAction {
+	result := ApiAction{
+		Id:             action.Id,
+		ParentId:       action.ParentId,
+		Command:        action.Command,
+		Description:    action.Description,
+		Status:         action.Status(),
+		RolledUpStatus: action.RolledUpStatus(),
+		Progress:       action.Progress(),
+		TotalSteps:     action.TotalSteps,
+		CompletedSteps: action.CompletedSteps,
+		StartedAt:      action.StartedAt,
+		FinishedAt:     action.FinishedAt,
+	}
+	if action.Error != nil {
+		result.Error = action.Error.Error()
+	}
+	return result
+}
+
+func toApiActions(actions []*Action) []ApiAction {
+	result := []ApiAction{}
+	for _, a := range actions {
+		result = append(result, toApiAction(a))
+	}
+	return result
+}
+
+func currentApiStatus() ApiStatus {
+	stateMachine := *Container().StateMachine
+	return ApiStatus{
+		Current:   stateMachine.Status(),
+		Requested: stateMachine.Requested(),
+	}
+}
+
+// Creates a JSON response with the error message given.
+func jsonError(status int, message string) *webapp.ActionResponse {
+	return webapp.JsonResponse(status, ApiError{Error: message})
+}
+
+// Returns the status code for a failed state request.
+func stateErrorStatus(err error) int {
+	switch err.(type) {
+	case IllegalTransitionError, UnexpectedStateError:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func ApiInfoAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	return webapp.JsonResponse(http.StatusOK, currentInfo(Container().Config))
+}
+
+func ApiStatusAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	return webapp.JsonResponse(http.StatusOK, currentApiStatus())
+}
+
+// Requests a new application state, expects a body like {"requested": "IDLE"}.
+func ApiRequestStatusAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	var request struct {
+		Requested *AppStatus `json:"requested"`
+	}
+	err := json.NewDecoder(context.Request.Body).Decode(&request)
+	if err != nil {
+		return jsonError(http.StatusBadRequest, "Invalid status request: "+err.Error())
+	}
+	if request.Requested == nil {
+		return jsonError(http.StatusBadRequest, "Invalid status request: requested state missing.")
+	}
+	err = (*Container().StateMachine).RequestState(*request.Requested)
+	if err != nil {
+		return jsonError(stateErrorStatus(err), err.Error())
+	}
+	return webapp.JsonResponse(http.StatusAccepted, currentApiStatus())
+}
+
+func ApiEnterSetupAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	err := (*Container().StateMachine).RequestStateAndWait(APPSTATE_SETUP)
+	if err != nil {
+		return jsonError(stateErrorStatus(err), err.Error())
+	}
+	return webapp.JsonResponse(http.StatusOK, currentApiStatus())
+}
+
+// Installs the configuration passed as JSON body, which has the format of the config file. The
+// application enters SETUP and then, after the nodes have been reset, switches to RUNNING.
+func ApiInstallConfigAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	var config SystemConfiguration
+	err := json.NewDecoder(context.Request.Body).Decode(&config)
+	if err != nil {
+		return jsonError(http.StatusBadRequest, "Invalid config: "+err.Error())
+	}
+	err = Container().Validator.Struct(config)
+	if err != nil {
+		return jsonError(http.StatusBadRequest, "Validation failed: "+err.Error())
+	}
+	err = (*Container().StateMachine).RequestStateAndWait(APPSTATE_SETUP)
+	if err != nil {
+		return jsonError(stateErrorStatus(err), err.Error())
+	}
+	err = applyConfig(config)
+	if err != nil {
+		return jsonError(stateErrorStatus(err), err.Error())
+	}
+	action := (*GetActionManager()).StartAction("Install configuration (API)")
+	go func() {
+		action.OnErrorComplete(installConfig(Container().Config, action))
+		action.Complete()
+	}()
+	return webapp.JsonResponse(http.StatusAccepted, toApiAction(action))
+}
+
+func ApiStartNodesAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	return apiNodesAction("Start Nodes (API)", (*Container().NodeManager).StartNodes)
+}
+
+func ApiStopNodesAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	return apiNodesAction("Stop Nodes (API)", (*Container().NodeManager).StopNodes)
+}
+
+// Starts the node operation given as action. The nodes are configured in RUNNING and IDLE only,
+// a failing operation completes the action instead of stopping the process.
+func apiNodesAction(command string, operation func(parent *Action) *Action) *webapp.ActionResponse {
+	if status := Container().CurrentStatus(); status != APPSTATE_RUNNING && status != APPSTATE_IDLE {
+		err := UnexpectedStateError{Status: status, Expected: APPSTATE_RUNNING}
+		return jsonError(stateErrorStatus(err), err.Error())
+	}
+	action := (*GetActionManager()).StartAction(command)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				Log().Error(fmt.Sprintf("%v failed: %v", command, r))
+				action.CompleteWithError(fmt.Errorf("%v failed: %v", command, r))
+			}
+		}()
+		result := operation(action)
+		action.OnErrorComplete(result.Error)
+		action.Complete()
+	}()
+	return webapp.JsonResponse(http.StatusAccepted, toApiAction(action))
+}
+
+func ApiRunningActionsAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	return webapp.JsonResponse(http.StatusOK, toApiActions((*GetActionManager()).RunningActions()))
+}
+
+// Returns the completed actions, supports the same parameters as the actions-completed page.
+func ApiCompletedActionsAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	page := (*GetActionManager()).QueryActions(readActionQuery(context))
+	return webapp.JsonResponse(http.StatusOK, ApiActionPage{
+		Actions:  toApiActions(page.Actions),
+		Page:     page.Page,
+		PageSize: page.PageSize,
+		Pages:    page.Pages(),
+		Total:    page.Total,
+	})
+}
+
+func ApiActionAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	action := (*GetActionManager()).LookupAction(context.GetQueryParameter("id"))
+	if action == nil {
+		return jsonError(http.StatusNotFound, "No such action.")
+	}
+	return webapp.JsonResponse(http.StatusOK, toApiAction(action))
+}
+
+// Returns the log of an action as plain text.
+func ApiActionLogAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	action := (*GetActionManager()).LookupAction(context.GetQueryParameter("id"))
+	if action == nil {
+		return jsonError(http.StatusNotFound, "No such action.")
+	}
+	return webapp.TextResponse(http.StatusOK, action.Log())
+}
+
+func ApiCancelActionAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	err := (*GetActionManager()).Cancel(context.GetQueryParameter("id"))
+	if err != nil {
+		return jsonError(http.StatusNotFound, err.Error())
+	}
+	return webapp.JsonResponse(http.StatusOK, toApiAction((*GetActionManager()).LookupAction(context.GetQueryParameter("id"))))
+}
+
+func ApiTokensAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	return webapp.JsonResponse(http.StatusOK, (*Container().Tokens).Tokens())
+}
+
+// Issues a join token for a node, expects a body like {"node": "worker-1", "ttl": "720h"}. The ttl
+// is optional, "0" creates a token that never expires. Tokens of standby controllers are issued
+// with "candidate": true.
+func ApiIssueTokenAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	var request struct {
+		Node      string `json:"node"`
+		Ttl       string `json:"ttl"`
+		Candidate bool   `json:"candidate"`
+	}
+	err := json.NewDecoder(context.Request.Body).Decode(&request)
+	if err != nil {
+		return jsonError(http.StatusBadRequest, "Invalid token request: "+err.Error())
+	}
+	ttl := DEFAULT_TOKEN_TTL
+	if request.Ttl != "" {
+		ttl, err = time.ParseDuration(request.Ttl)
+		if err != nil {
+			return jsonError(http.StatusBadRequest, "Invalid ttl: "+err.Error())
+		}
+	}
+	var token JoinToken
+	if request.Candidate {
+		token, err = (*Container().Tokens).IssueCandidate(request.Node, ttl)
+	} else {
+		token, err = (*Container().Tokens).Issue(request.Node, ttl)
+	}
+	if err != nil {
+		return jsonError(http.StatusBadRequest, err.Error())
+	}
+	Log().Info("Issued join token " + token.Id + " for node " + token.Node + ".")
+	result := ApiJoinToken{JoinToken: token, Token: token.String()}
+	result.Secret = ""
+	return webapp.JsonResponse(http.StatusCreated, result)
+}
+
+func ApiRevokeTokenAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	id := context.GetQueryParameter("id")
+	err := (*Container().Tokens).Revoke(id)
+	if err != nil {
+		return jsonError(http.StatusNotFound, err.Error())
+	}
+	Log().Info("Revoked join token " + id + ".")
+	for _, token := range (*Container().Tokens).Tokens() {
+		if token.Id == id {
+			return webapp.JsonResponse(http.StatusOK, token)
+		}
+	}
+	return nil
+}
+
+func ApiUsersAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	return webapp.JsonResponse(http.StatusOK, (*Container().Users).Users())
+}
+
+// Creates or updates a user, expects a body like {"name": "jane", "password": "...", "role": "operator"}.
+// The password is optional when updating a user.
+func ApiSaveUserAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	var request struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+		Role     Role   `json:"role"`
+	}
+	err := json.NewDecoder(context.Request.Body).Decode(&request)
+	if err != nil {
+		return jsonError(http.StatusBadRequest, "Invalid user: "+err.Error())
+	}
+	err = (*Container().Users).Save(request.Name, request.Password, request.Role)
+	if err != nil {
+		return jsonError(http.StatusBadRequest, err.Error())
+	}
+	Log().Info("Saved user " + request.Name + " with role " + string(request.Role) + ".")
+	return webapp.JsonResponse(http.StatusOK, User{Name: request.Name, Role: request.Role})
+}
+
+func ApiRemoveUserAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	name := context.GetQueryParameter("name")
+	err := (*Container().Users).Remove(name)
+	if err != nil {
+		return jsonError(http.StatusBadRequest, err.Error())
+	}
+	Log().Info("Removed user " + name + ".")
+	return webapp.StatusResponse(http.StatusNoContent)
+}
+
+// Returns the latest audit records, newest first. The number of records can be limited by the
+// limit parameter, which defaults to 100.
+func ApiAuditAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	limit, err := strconv.Atoi(context.GetQueryParameterWithDefault("limit", "100"))
+	if err != nil {
+		return jsonError(http.StatusBadRequest, "Invalid limit: "+err.Error())
+	}
+	return webapp.JsonResponse(http.StatusOK, (*Container().Audit).Latest(limit))
+}
+
+// Returns the request metrics of the web applications, keyed by application name.
+func ApiMetricsAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	return webapp.JsonResponse(http.StatusOK, requestMetrics.Snapshot())
+}
@@ -0,0 +1,68 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"github.com/winkube/webapp"
+	"gopkg.in/go-playground/assert.v1"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestApiNodesAction_RequiresConfiguredNodes(t *testing.T) {
+	stateMachine := Container().StateMachine
+	defer func() { Container().StateMachine = stateMachine }()
+	Container().StateMachine = CreateStateMachine(APPSTATE_SETUP)
+	called := false
+	response := apiNodesAction("Start Nodes (Test)", func(parent *Action) *Action {
+		called = true
+		return parent
+	})
+	assert.Equal(t, http.StatusConflict, response.Status)
+	assert.Equal(t, false, called)
+}
+
+func TestApiNodesAction_CompletesPanickingOperations(t *testing.T) {
+	stateMachine := Container().StateMachine
+	defer func() { Container().StateMachine = stateMachine }()
+	Container().StateMachine = CreateStateMachine(APPSTATE_RUNNING)
+	response := apiNodesAction("Start Nodes (Test)", func(parent *Action) *Action {
+		panic("no node config")
+	})
+	assert.Equal(t, http.StatusAccepted, response.Status)
+	id := response.Body.(ApiAction).Id
+	var action *Action
+	for i := 0; i < 100; i++ {
+		if action = (*GetActionManager()).LookupAction(id); action != nil && action.Finished() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "Start Nodes (Test) failed: no node config", action.Error.Error())
+}
+
+func TestCancelActionAction_RedirectsToLocalPagesOnly(t *testing.T) {
+	cancel := func(backAction string) string {
+		req := httptest.NewRequest(http.MethodPost, "/cancel?actionId=unknown&backAction="+url.QueryEscape(backAction), nil)
+		return CancelActionAction(&webapp.RequestContext{Request: req}, httptest.NewRecorder()).Redirect
+	}
+	assert.Equal(t, "/actions", cancel("actions"))
+	assert.Equal(t, "/actions-completed", cancel("/actions-completed"))
+	assert.Equal(t, "/", cancel("//evil.example"))
+	assert.Equal(t, "/", cancel("/\\evil.example"))
+}
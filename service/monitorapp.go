@@ -19,18 +19,22 @@ package service
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 	"github.com/winkube/webapp"
 	"golang.org/x/text/language"
 	"net/http"
 	"os/exec"
+	"strconv"
+	"strings"
 	"time"
 )
 
 func MonitorWebApplication(router *mux.Router) *webapp.WebApplication {
 	log.Info("Initializing root application (monitor)...")
 	monitorWebapp := webapp.CreateWebApp("WinKube-Setup", "/", language.English)
+	instrumentWebApp(monitorWebapp)
 	// Pages
 	monitorWebapp.AddPage(&webapp.Page{
 		Name:     "index",
@@ -47,16 +51,30 @@ func MonitorWebApplication(router *mux.Router) *webapp.WebApplication {
 	})
 	// Actions
 	monitorWebapp.GetAction("/", MainIndexAction)
-	monitorWebapp.GetAction("/start", StartAction)
-	monitorWebapp.GetAction("/stop", StopAction)
+	monitorWebapp.PostAction("/start", StartAction)
+	monitorWebapp.PostAction("/stop", StopAction)
 	monitorWebapp.GetAction("/actions", ActionsAction)
 	monitorWebapp.GetAction("/actionlog", ActionLogAction)
+	monitorWebapp.PostAction("/cancel", CancelActionAction)
 	monitorWebapp.GetAction("/actions-completed", ActionsCompletedAction)
 	monitorWebapp.GetAction("/status", LogNodeStatusAction)
-	monitorWebapp.GetAction("/enter-setup", EnterSetupAction)
+	monitorWebapp.PostAction("/enter-setup", EnterSetupAction)
+	monitorWebapp.PostAction("/idle", IdleAction)
+	monitorWebapp.PostAction("/resume", ResumeAction)
 	monitorWebapp.GetAction("/console", NodeConsoleAction)
 	//monitorWebapp.GetAction("/cordon", &NodeCordonAction{})
 	//monitorWebapp.GetAction("/drain", &NodeDrainAction{})
+	registerLoginActions(monitorWebapp)
+	// Roles, all other pages require a viewer
+	secureWebApp(monitorWebapp, ROLE_VIEWER, false)
+	monitorWebapp.RequireRole("POST", "/start", string(ROLE_OPERATOR))
+	monitorWebapp.RequireRole("POST", "/stop", string(ROLE_OPERATOR))
+	monitorWebapp.RequireRole("POST", "/cancel", string(ROLE_OPERATOR))
+	monitorWebapp.RequireRole("POST", "/idle", string(ROLE_OPERATOR))
+	monitorWebapp.RequireRole("POST", "/resume", string(ROLE_OPERATOR))
+	monitorWebapp.RequireRole("GET", "/console", string(ROLE_OPERATOR))
+	monitorWebapp.RequireRole("POST", "/enter-setup", string(ROLE_ADMIN))
+	router.HandleFunc("/actions/{id}/stream", requireRole(ROLE_VIEWER, ActionStreamHandler)).Methods("GET")
 	return monitorWebapp
 }
 
@@ -71,6 +89,8 @@ type ClusterInfo struct {
 	ClusterId         string
 	ClusterController string
 	ClusterState      string
+	// The fingerprint of the cluster CA, to be confirmed when joining hosts.
+	CAFingerprint string
 }
 
 type Info struct {
@@ -80,22 +100,88 @@ type Info struct {
 
 func ActionsAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
 	data := make(map[string]interface{})
-	data["actions"] = (*GetActionManager()).RunningActions()
+	data["actions"] = runningRootActions()
 	return &webapp.ActionResponse{
 		NextPage: "actions",
 		Model:    data,
 	}
 }
 
+// Returns the running actions, which are not part of another running action. The others are
+// shown as their children.
+func runningRootActions() []*Action {
+	running := (*GetActionManager()).RunningActions()
+	ids := make(map[string]bool)
+	for _, a := range running {
+		ids[a.Id] = true
+	}
+	roots := []*Action{}
+	for _, a := range running {
+		if !ids[a.ParentId] {
+			roots = append(roots, a)
+		}
+	}
+	return roots
+}
+
 func ActionsCompletedAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
 	data := make(map[string]interface{})
-	data["actions"] = (*GetActionManager()).CompletedActions()
+	query := readActionQuery(context)
+	page := (*GetActionManager()).QueryActions(query)
+	data["actions"] = page.Actions
+	data["page"] = page
+	data["filter"] = map[string]string{
+		"status":  query.Status,
+		"command": query.Command,
+		"from":    context.GetQueryParameter("from"),
+		"to":      context.GetQueryParameter("to"),
+	}
 	return &webapp.ActionResponse{
 		NextPage: "actions-completed",
 		Model:    data,
 	}
 }
 
+// Reads the filter and paging parameters for querying the completed actions. Dates are
+// expected as yyyy-MM-dd, the to date is inclusive. Unless searching for a command, only top
+// level actions are returned.
+func readActionQuery(context *webapp.RequestContext) ActionQuery {
+	query := ActionQuery{
+		Status:   context.GetQueryParameter("status"),
+		Command:  context.GetQueryParameter("command"),
+		PageSize: 20,
+	}
+	query.Roots = query.Command == ""
+	if page, err := strconv.Atoi(context.GetQueryParameter("page")); err == nil && page >= 0 {
+		query.Page = page
+	}
+	if size, err := strconv.Atoi(context.GetQueryParameter("size")); err == nil && size > 0 {
+		query.PageSize = size
+	}
+	if from, err := time.ParseInLocation("2006-01-02", context.GetQueryParameter("from"), time.Local); err == nil {
+		query.From = &from
+	}
+	if to, err := time.ParseInLocation("2006-01-02", context.GetQueryParameter("to"), time.Local); err == nil {
+		to = to.AddDate(0, 0, 1)
+		query.To = &to
+	}
+	return query
+}
+
+// Web action cancelling a running action, redirects back to the page given.
+func CancelActionAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	actionId := context.GetParameter("actionId")
+	err := (*GetActionManager()).Cancel(actionId)
+	if err != nil {
+		Log().Warn("Cancel failed: " + err.Error())
+	}
+	backAction := context.GetParameterOrDefault("backAction", "actions")
+	if !strings.HasPrefix(backAction, "/") {
+		backAction = "/" + backAction
+	}
+	return webapp.RedirectResponse(http.StatusSeeOther, redirectTarget(backAction))
+}
+
 func ActionLogAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
 	data := make(map[string]interface{})
 	actionId := context.GetQueryParameter("actionId")
@@ -109,15 +195,99 @@ func ActionLogAction(context *webapp.RequestContext, writer http.ResponseWriter)
 	}
 }
 
+// Streams the log of an action as Server-Sent Events. The current log is sent first, followed by
+// the further output as "log" events. A final "complete" event carries the action's status, once
+// the action has completed. If this stream cannot keep up with the action, its follower is dropped,
+// and the stream resyncs from the log buffer.
+func ActionStreamHandler(writer http.ResponseWriter, req *http.Request) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		http.Error(writer, "Streaming not supported.", http.StatusInternalServerError)
+		return
+	}
+	actionId := mux.Vars(req)["id"]
+	current, follower, cancel, err := (*GetActionManager()).FollowLog(actionId)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer func() { cancel() }()
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+	writeEvent(writer, "log", current)
+	flusher.Flush()
+	sent := len(current)
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case chunk, open := <-follower:
+			if open {
+				writeEvent(writer, "log", chunk)
+				flusher.Flush()
+				sent += len(chunk)
+				continue
+			}
+			// an action is finished before its log is closed, so a running action means this
+			// follower has been dropped
+			action := (*GetActionManager()).LookupAction(actionId)
+			if action != nil && !action.Finished() {
+				cancel()
+				current, follower, cancel, err = (*GetActionManager()).FollowLog(actionId)
+				if err != nil {
+					return
+				}
+				writeEvent(writer, "log", remainder(current, sent))
+				flusher.Flush()
+				sent = len(current)
+				continue
+			}
+			status := "UNKNOWN"
+			if action != nil {
+				writeEvent(writer, "log", remainder(action.Log(), sent))
+				status = action.Status()
+			}
+			writeEvent(writer, "complete", status)
+			flusher.Flush()
+			return
+		}
+	}
+}
+
+// The part of a log not sent yet.
+func remainder(log string, sent int) string {
+	if sent >= len(log) {
+		return ""
+	}
+	return log[sent:]
+}
+
+func writeEvent(writer http.ResponseWriter, event string, data string) {
+	if data == "" {
+		return
+	}
+	fmt.Fprintf(writer, "event: %v\n", event)
+	for _, line := range strings.Split(strings.TrimSuffix(data, "\n"), "\n") {
+		fmt.Fprintf(writer, "data: %v\n", line)
+	}
+	fmt.Fprint(writer, "\n")
+}
+
 // Web action starting the setup process
 func MainIndexAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
 	config := Container().Config
 	if !config.Ready() {
-		return &webapp.ActionResponse{
-			NextPage: "_redirect",
-			Model:    "/setup",
-		}
+		return webapp.RedirectResponse(http.StatusSeeOther, "/setup")
+	}
+	return &webapp.ActionResponse{
+		NextPage: "index",
+		Model:    currentInfo(config),
 	}
+}
+
+// Evaluates the node and cluster info shown on the index page.
+func currentInfo(config *SystemConfiguration) Info {
 	var nodes []ClusterNodeConfig
 	if config.IsMasterNode() {
 		nodes = append(nodes, *config.MasterNode)
@@ -137,71 +307,71 @@ func MainIndexAction(context *webapp.RequestContext, writer http.ResponseWriter)
 	} else {
 		clusterState = "Not initialized."
 	}
-	return &webapp.ActionResponse{
-		NextPage: "index",
-		Model: Info{
-			NodeInfo: NodeInfo{
-				InstanceName: config.NetHostname,
-				InstanceIp:   config.NetHostIP + " (" + config.NetHostInterface + ")",
-				StartedSince: "N/A",
-				Nodes:        nodes,
-			},
-			ClusterInfo: ClusterInfo{
-				ClusterController: controller,
-				ClusterId:         config.ClusterId(),
-				ClusterState:      clusterState,
-			},
+	return Info{
+		NodeInfo: NodeInfo{
+			InstanceName: config.NetHostname,
+			InstanceIp:   config.NetHostIP + " (" + config.NetHostInterface + ")",
+			StartedSince: "N/A",
+			Nodes:        nodes,
+		},
+		ClusterInfo: ClusterInfo{
+			ClusterController: controller,
+			ClusterId:         config.ClusterId(),
+			ClusterState:      clusterState,
+			CAFingerprint:     (*Container().ClusterTLS).CAFingerprint(),
 		},
 	}
 }
 
 func StartAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
-	(*Container().NodeManager).StartNodes()
-	return &webapp.ActionResponse{
-		NextPage: "index",
-		Model: Info{
-			NodeInfo:    NodeInfo{},
-			ClusterInfo: ClusterInfo{},
-		},
-	}
+	(*Container().NodeManager).StartNodes(nil)
+	return webapp.RedirectResponse(http.StatusSeeOther, "/actions")
 }
 
 func StopAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
-	(*Container().NodeManager).StopNodes()
-	return &webapp.ActionResponse{
-		NextPage: "index",
-		Model: Info{
-			NodeInfo:    NodeInfo{},
-			ClusterInfo: ClusterInfo{},
-		},
-	}
+	(*Container().NodeManager).StopNodes(nil)
+	return webapp.RedirectResponse(http.StatusSeeOther, "/actions")
 }
 
 func NodeConsoleAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
 	nodeName := context.GetParameter("name")
 	if nodeName == "" {
-		writer.Write([]byte("Require an instance name."))
-		writer.WriteHeader(http.StatusBadRequest)
-		return nil
+		return webapp.ErrorResponse(http.StatusBadRequest, "Require an instance name.")
 	}
 	cmd := exec.Command("cmd", "/C", "start", "vagrant", "ssh", nodeName)
 	err := cmd.Run()
 	if err != nil {
 		log.Panic("Cannopt open console...", err)
 	}
-	return &webapp.ActionResponse{
-		NextPage: "_redirect",
-		Model:    "/",
-	}
+	return webapp.RedirectResponse(http.StatusSeeOther, "/")
 }
 
 func EnterSetupAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
-	Container().RequiredAppStatus = APPSTATE_SETUP
-	time.Sleep(10 * time.Second)
-	return &webapp.ActionResponse{
-		NextPage: "_redirect",
-		Model:    "/setup",
+	err := (*Container().StateMachine).RequestStateAndWait(APPSTATE_SETUP)
+	if err != nil {
+		log.Error("Cannot enter setup: " + err.Error())
+		return webapp.RedirectResponse(http.StatusSeeOther, "/")
 	}
+	return webapp.RedirectResponse(http.StatusSeeOther, "/setup")
+}
+
+// Web action cordoning and draining the local nodes, so the host's resources are handed back.
+func IdleAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	return requestStateAction(APPSTATE_IDLE)
+}
+
+// Web action making the local nodes schedulable again after being idle.
+func ResumeAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	return requestStateAction(APPSTATE_RUNNING)
+}
+
+func requestStateAction(status AppStatus) *webapp.ActionResponse {
+	err := (*Container().StateMachine).RequestState(status)
+	if err != nil {
+		log.Error("Cannot switch to " + status.String() + ": " + err.Error())
+		return webapp.RedirectResponse(http.StatusSeeOther, "/")
+	}
+	return webapp.RedirectResponse(http.StatusSeeOther, "/actions")
 }
 
 func LogNodeStatusAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
@@ -212,9 +382,5 @@ func LogNodeStatusAction(context *webapp.RequestContext, writer http.ResponseWri
 	}
 	var buff = bytes.Buffer{}
 	buff.ReadFrom(reader)
-	writer.Write([]byte("Status:\n"))
-	writer.Write(buff.Bytes())
-	return &webapp.ActionResponse{
-		Complete: true,
-	}
+	return webapp.TextResponse(http.StatusOK, "Status:\n"+buff.String())
 }
@@ -298,10 +298,10 @@ func (this *serviceRegistry) keepAliveLoop() {
 		}
 		if len(usedAdvertisers) < len(this.advertizers) {
 			log.Info("Some services have been removed, sending bye message...")
-			unusedAdvertisers := map[string]ssdp.Advertiser{}
+			unusedAdvertisers := map[string]*ssdp.Advertiser{}
 			for key, adv := range this.advertizers {
 				if !util2.Exists(usedAdvertisers, key) {
-					unusedAdvertisers[key] = *adv
+					unusedAdvertisers[key] = adv
 				}
 			}
 			for key, adv := range unusedAdvertisers {
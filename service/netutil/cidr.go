@@ -61,10 +61,12 @@ func (this *cidr) Cidr() string {
 	return this.cidr
 }
 func (this *cidr) GetFreeIp() string {
-	this.mutex.RLock()
-	defer this.mutex.RUnlock()
-	freeIps := this.FreeIps()
-	for _, ip := range freeIps {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, ip := range this.AllIps() {
+		if _, used := this.usedIps[ip]; used {
+			continue
+		}
 		if !Ping(ip) {
 			t := time.Now()
 			this.usedIps[ip] = &t
@@ -220,7 +222,7 @@ func AddressCount(network *net.IPNet) uint64 {
 	return 1 << (uint64(bits) - uint64(prefixLen))
 }
 
-func (this cidr) hosts() ([]string, error) {
+func (this *cidr) hosts() ([]string, error) {
 	var ips []string
 	var currentIp string
 	for ip := this.ip.Mask(this.net.Mask); this.net.Contains(ip); ip = Inc(ip) {
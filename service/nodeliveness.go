@@ -0,0 +1,286 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the hosts send the heartbeats of their nodes to the controller, and how often the
+// controller checks the heartbeats received.
+var NodeHeartbeatInterval = 10 * time.Second
+var NodeLivenessCheckInterval = 5 * time.Second
+
+// The liveness of a node as seen by the controller.
+type NodeState int
+
+const (
+	// The node has sent a heartbeat recently.
+	NodeAlive NodeState = iota + 1
+	// The node has not sent a heartbeat for the suspect timeout.
+	NodeSuspect
+	// The node has not sent a heartbeat for the lost timeout.
+	NodeLost
+)
+
+var nodeStateNames = [...]string{"", "Alive", "Suspect", "Lost"}
+
+func (this NodeState) String() string {
+	if this < 0 || int(this) >= len(nodeStateNames) {
+		return ""
+	}
+	return nodeStateNames[this]
+}
+
+// NodeState is serialized using its name.
+func (this NodeState) MarshalText() ([]byte, error) {
+	return []byte(this.String()), nil
+}
+
+func (this *NodeState) UnmarshalText(text []byte) error {
+	for i, name := range nodeStateNames {
+		if strings.EqualFold(name, string(text)) {
+			*this = NodeState(i)
+			return nil
+		}
+	}
+	return errors.New("Invalid node state: " + string(text))
+}
+
+// Event sent when the controller changes the state of a node, or releases the IPs of a lost node.
+type NodeEvent struct {
+	Node     Node      `json:"node"`
+	Previous NodeState `json:"previous,omitempty"`
+	// The IPs released, since the node has been lost for longer than the grace period.
+	ReleasedIPs []string  `json:"releasedIps,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+func (this NodeEvent) String() string {
+	if len(this.ReleasedIPs) > 0 {
+		return fmt.Sprintf("Released IPs %v of lost node %v on %v.", strings.Join(this.ReleasedIPs, ", "), this.Node.Name, this.Node.Host)
+	}
+	if this.Previous == 0 {
+		return fmt.Sprintf("Node %v on %v registered.", this.Node.Name, this.Node.Host)
+	}
+	return fmt.Sprintf("Node %v on %v changed from %v to %v.", this.Node.Name, this.Node.Host, this.Previous, this.Node.State)
+}
+
+// Listener notified about the node events of the cluster led by this host.
+type NodeListener func(event NodeEvent)
+
+// Evaluates the state of a node at the time given from its last heartbeat.
+func nodeLiveness(node Node, now time.Time, config ClusterConfig) NodeState {
+	silent := now.Sub(node.Timestamp)
+	switch {
+	case silent >= config.LostTimeout():
+		return NodeLost
+	case silent >= config.SuspectTimeout():
+		return NodeSuspect
+	default:
+		return NodeAlive
+	}
+}
+
+// Checks if the IPs of a node have to be released, since it has been lost for longer than the
+// grace period.
+func nodeExpired(node Node, now time.Time, config ClusterConfig) bool {
+	return node.State == NodeLost && len(node.Addresses) > 0 &&
+		now.Sub(node.Timestamp) >= config.LostTimeout()+config.ReleaseGracePeriod()
+}
+
+// The nodes running on this host, as sent with the heartbeats.
+func localNodes(config *SystemConfiguration) []Node {
+	nodes := []Node{}
+	if config.IsMasterNode() {
+		nodes = append(nodes, localNode(config, Master, "-M", config.MasterNode))
+	}
+	if config.IsWorkerNode() {
+		nodes = append(nodes, localNode(config, Worker, "-W", config.WorkerNode))
+	}
+	return nodes
+}
+
+func localNode(config *SystemConfiguration, nodeType NodeType, suffix string, nodeConfig *ClusterNodeConfig) Node {
+	node := Node{
+		Id:        config.Id + suffix,
+		ClusterId: config.ClusterId(),
+		NodeType:  nodeType,
+		Name:      nodeConfig.NodeName,
+		Host:      hostname(),
+		Endpoint:  "https://" + hostname() + ":9999/" + strings.ToLower(nodeType.String()),
+	}
+	for _, address := range []string{nodeConfig.NodeAddress, nodeConfig.NodeAddressInternal} {
+		if address != "" && (len(node.Addresses) == 0 || node.Addresses[0] != address) {
+			node.Addresses = append(node.Addresses, address)
+		}
+	}
+	return node
+}
+
+// Regularly sends the heartbeats of the local nodes.
+type nodeHeartbeat struct {
+	nodes []Node
+	send  func(node Node) error
+	stop  chan bool
+	mutex sync.Mutex
+}
+
+func (this *nodeHeartbeat) Start() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.stop != nil || len(this.nodes) == 0 {
+		return
+	}
+	this.stop = make(chan bool)
+	go this.run(this.stop)
+}
+
+func (this *nodeHeartbeat) Stop() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.stop != nil {
+		close(this.stop)
+		this.stop = nil
+	}
+}
+
+func (this *nodeHeartbeat) run(stop chan bool) {
+	ticker := time.NewTicker(NodeHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		this.beat()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (this *nodeHeartbeat) beat() {
+	for _, node := range this.nodes {
+		if err := this.send(node); err != nil {
+			Log().Warn("Heartbeat of node " + node.Name + " failed: " + err.Error())
+		}
+	}
+}
+
+// Registers the heartbeat of a node: the node is alive and its addresses are reserved. Returns
+// the event to be sent, nil if the node was alive before. The caller must hold the lock.
+func (c *localControllerDelegate) registerNode(node Node) *NodeEvent {
+	previous := c.clusterState.getNode(node.Id)
+	node.Timestamp = time.Now()
+	node.State = NodeAlive
+	switch node.NodeType {
+	case Master:
+		c.clusterState.Masters[node.Id] = node
+	case Worker:
+		c.clusterState.Workers[node.Id] = node
+	}
+	if c.clusterNetCIDR != nil {
+		for _, address := range node.Addresses {
+			(*c.clusterNetCIDR).MarkIpUsed(address)
+		}
+	}
+	if previous != nil && previous.State == NodeAlive {
+		return nil
+	}
+	event := NodeEvent{Node: node, Time: node.Timestamp}
+	if previous != nil {
+		event.Previous = previous.State
+	}
+	return &event
+}
+
+func (c *localControllerDelegate) Heartbeat(node Node) error {
+	if node.NodeType != Master && node.NodeType != Worker {
+		return errors.New("Unknown node type: " + node.NodeType.String())
+	}
+	c.mutex.Lock()
+	event := c.registerNode(node)
+	c.persist()
+	c.mutex.Unlock()
+	c.notify(event)
+	return nil
+}
+
+// Regularly updates the state of the nodes from their heartbeats.
+func (c *localControllerDelegate) watchNodes(stop chan bool) {
+	ticker := time.NewTicker(NodeLivenessCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, event := range c.checkNodes(time.Now()) {
+				c.notify(&event)
+			}
+		}
+	}
+}
+
+// Updates the state of all nodes at the time given and releases the IPs of the nodes lost for
+// longer than the grace period. The events of the changes are returned.
+func (c *localControllerDelegate) checkNodes(now time.Time) []NodeEvent {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	config := *c.clusterState.ClusterConfig
+	events := []NodeEvent{}
+	for _, nodes := range []map[string]Node{c.clusterState.Masters, c.clusterState.Workers} {
+		for id, node := range nodes {
+			previous := node.State
+			if state := nodeLiveness(node, now, config); state != previous {
+				node.State = state
+				nodes[id] = node
+				events = append(events, NodeEvent{Node: node, Previous: previous, Time: now})
+			}
+			if nodeExpired(node, now, config) {
+				if c.clusterNetCIDR != nil {
+					for _, address := range node.Addresses {
+						(*c.clusterNetCIDR).MarkIpUnused(address)
+					}
+				}
+				events = append(events, NodeEvent{Node: node, Previous: NodeLost, ReleasedIPs: node.Addresses, Time: now})
+				node.Addresses = nil
+				nodes[id] = node
+			}
+		}
+	}
+	if len(events) > 0 {
+		c.persist()
+	}
+	return events
+}
+
+// Logs the event given and passes it to the listener, nil events are ignored.
+func (c *localControllerDelegate) notify(event *NodeEvent) {
+	if event == nil {
+		return
+	}
+	if event.Node.State == NodeAlive {
+		Log().Info(event.String())
+	} else {
+		Log().Warn(event.String())
+	}
+	if c.listener != nil {
+		c.listener(*event)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"github.com/winkube/service/netutil"
+	"gopkg.in/go-playground/assert.v1"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNodeLiveness_UsesTheConfiguredTimeouts(t *testing.T) {
+	config := ClusterConfig{NodeSuspectTimeout: 10, NodeLostTimeout: 60}
+	now := time.Now()
+	node := Node{Timestamp: now.Add(-5 * time.Second)}
+	assert.Equal(t, NodeAlive, nodeLiveness(node, now, config))
+	node.Timestamp = now.Add(-10 * time.Second)
+	assert.Equal(t, NodeSuspect, nodeLiveness(node, now, config))
+	node.Timestamp = now.Add(-time.Minute)
+	assert.Equal(t, NodeLost, nodeLiveness(node, now, config))
+	assert.Equal(t, NodeAlive, nodeLiveness(Node{Timestamp: now.Add(-29 * time.Second)}, now, ClusterConfig{}))
+}
+
+func TestNodeState_IsSerializedByName(t *testing.T) {
+	data, err := json.Marshal(Node{Id: "m-1", State: NodeSuspect})
+	assert.Equal(t, nil, err)
+	var node Node
+	assert.Equal(t, nil, json.Unmarshal(data, &node))
+	assert.Equal(t, NodeSuspect, node.State)
+}
+
+func TestCheckNodes_MarksSilentNodesAndReleasesTheirIPs(t *testing.T) {
+	config := ClusterConfig{ClusterNetCIDR: "192.168.99.0/24", NodeSuspectTimeout: 10, NodeLostTimeout: 60, NodeReleaseGracePeriod: 60}
+	delegate := localControllerDelegate{
+		clusterState: &Cluster{
+			ClusterConfig: &config,
+			Masters:       make(map[string]Node),
+			Workers:       make(map[string]Node),
+		},
+		clusterNetCIDR: netutil.CreateCIDR(config.ClusterNetCIDR),
+		mutex:          &sync.Mutex{},
+	}
+	events := []NodeEvent{}
+	delegate.listener = func(event NodeEvent) {
+		events = append(events, event)
+	}
+	assert.Equal(t, nil, delegate.Heartbeat(Node{Id: "w-1", Name: "worker-1", NodeType: Worker, Addresses: []string{"192.168.99.11"}}))
+	assert.Equal(t, nil, delegate.Heartbeat(Node{Id: "w-1", Name: "worker-1", NodeType: Worker, Addresses: []string{"192.168.99.11"}}))
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, []string{"192.168.99.11"}, (*delegate.clusterNetCIDR).UsedIps())
+
+	now := time.Now()
+	assert.Equal(t, 0, len(delegate.checkNodes(now)))
+	suspect := delegate.checkNodes(now.Add(30 * time.Second))
+	assert.Equal(t, 1, len(suspect))
+	assert.Equal(t, NodeAlive, suspect[0].Previous)
+	assert.Equal(t, NodeSuspect, suspect[0].Node.State)
+	lost := delegate.checkNodes(now.Add(90 * time.Second))
+	assert.Equal(t, NodeLost, lost[0].Node.State)
+	assert.Equal(t, 1, len((*delegate.clusterNetCIDR).UsedIps()))
+
+	released := delegate.checkNodes(now.Add(150 * time.Second))
+	assert.Equal(t, 1, len(released))
+	assert.Equal(t, []string{"192.168.99.11"}, released[0].ReleasedIPs)
+	assert.Equal(t, 0, len((*delegate.clusterNetCIDR).UsedIps()))
+	assert.Equal(t, 0, len(delegate.checkNodes(now.Add(200*time.Second))))
+
+	assert.Equal(t, nil, delegate.Heartbeat(Node{Id: "w-1", Name: "worker-1", NodeType: Worker, Addresses: []string{"192.168.99.11"}}))
+	assert.Equal(t, NodeLost, events[len(events)-1].Previous)
+	assert.Equal(t, NodeAlive, delegate.clusterState.Workers["w-1"].State)
+	assert.Equal(t, []string{"192.168.99.11"}, (*delegate.clusterNetCIDR).UsedIps())
+}
+
+func TestSnapshot_CopiesTheNodesUpdatedByHeartbeats(t *testing.T) {
+	config := ClusterConfig{ClusterNetCIDR: "192.168.99.0/24"}
+	delegate := localControllerDelegate{
+		clusterState: &Cluster{
+			ClusterConfig: &config,
+			Masters:       make(map[string]Node),
+			Workers:       make(map[string]Node),
+		},
+		mutex: &sync.Mutex{},
+	}
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 200; i++ {
+			delegate.Heartbeat(Node{Id: "w-" + strconv.Itoa(i), NodeType: Worker})
+		}
+		close(done)
+	}()
+	for i := 0; i < 200; i++ {
+		_, err := json.Marshal(delegate.snapshot().Workers)
+		assert.Equal(t, nil, err)
+	}
+	<-done
+	workers := delegate.snapshot().Workers
+	delete(workers, "w-0")
+	assert.Equal(t, 200, len(delegate.snapshot().Workers))
+}
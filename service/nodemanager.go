@@ -57,11 +57,13 @@ type VagrantConfig struct {
 type NodeManager interface {
 	IsReady() bool
 	ValidateConfig() error
-	ConfigureNodes(systemConfig SystemConfiguration, clusterConfig ClusterConfig, override bool) *Action
-	StartNodes() *Action
-	StopNodes() *Action
-	DestroyNodes() *Action
-	DestroyNode(name string) *Action
+	// The node operations run as child actions of the parent action given, or as top level
+	// actions, if the parent is nil.
+	ConfigureNodes(parent *Action, systemConfig SystemConfiguration, clusterConfig ClusterConfig, override bool) *Action
+	StartNodes(parent *Action) *Action
+	StopNodes(parent *Action) *Action
+	DestroyNodes(parent *Action) *Action
+	DestroyNode(parent *Action, name string) *Action
 	GetServices() []netutil.Service
 }
 
@@ -135,13 +137,13 @@ func (this *nodeManager) GetServices() []netutil.Service {
 	return result
 }
 
-func (this *nodeManager) DestroyNodes() *Action {
+func (this *nodeManager) DestroyNodes(parent *Action) *Action {
 	Log().Info("Destroy Nodes...")
 	actionManager := *GetActionManager()
-	action := actionManager.StartAction("Destroy Nodes")
+	action := startAction(parent, "Destroy Nodes")
 	defer actionManager.Complete(action.Id)
 	if util.FileExists("Vagrantfile") {
-		_, cmdReader, err := util.RunCommand("Stopping any running instances...", "vagrant", "destroy", "-f")
+		_, cmdReader, err := util.RunCommandContext(action.Context(), "Stopping any running instances...", "vagrant", "destroy", "-f")
 		if util.CheckAndLogError("Destroy Node: vagrant failed", err) {
 			fmt.Println("vagrant destroy -f ")
 			actionManager.LogAction(action.Id, "vagrant destroy -f\n")
@@ -161,11 +163,11 @@ func (this *nodeManager) DestroyNodes() *Action {
 	return action
 }
 
-func (this *nodeManager) ConfigureNodes(systemConfig SystemConfiguration, clusterConfig ClusterConfig, override bool) *Action {
+func (this *nodeManager) ConfigureNodes(parent *Action, systemConfig SystemConfiguration, clusterConfig ClusterConfig, override bool) *Action {
 	assert.AssertNotNil(systemConfig)
 	assert.AssertNotNil(clusterConfig)
 	actionManager := (*GetActionManager())
-	action := actionManager.StartAction("Configure Nodes")
+	action := startAction(parent, "Configure Nodes")
 	defer this.releaseIPsOnError(action, systemConfig)
 	this.config = &systemConfig
 	if !this.config.IsMasterNode() && !this.config.IsWorkerNode() {
@@ -195,8 +197,8 @@ func (this *nodeManager) ConfigureNodes(systemConfig SystemConfiguration, cluste
 }
 
 func (this *nodeManager) releaseIPsOnError(action *Action, configuration SystemConfiguration) {
-	if action.Error != nil {
-		Log().Info("Releasing internal/public node IPs due to error: " + action.Error.Error())
+	if err := action.Err(); err != nil {
+		Log().Info("Releasing internal/public node IPs due to error: " + err.Error())
 		if configuration.IsMasterNode() {
 			if configuration.MasterNode.NodeNetType == Bridged {
 				(*Container().LocalController).ReleaseNodeIP(configuration.MasterNode.NodeAddress)
@@ -236,10 +238,10 @@ func createVagrantConfig(systemConfiguration SystemConfiguration, clusterConfig
 	return config
 }
 
-func (this *nodeManager) StartNodes() *Action {
+func (this *nodeManager) StartNodes(parent *Action) *Action {
 	assert.AssertNotNil(this.config)
 	actionManager := (*GetActionManager())
-	action := actionManager.StartAction("Start Nodes")
+	action := startAction(parent, "Start Nodes")
 	defer actionManager.Complete(action.Id)
 	if !this.config.IsWorkerNode() && !this.config.IsWorkerNode() {
 		// nothing to start
@@ -247,7 +249,7 @@ func (this *nodeManager) StartNodes() *Action {
 		return action
 	}
 	if util.FileExists("Vagrantfile") {
-		_, cmdReader, err := util.RunCommand("start Nodes...", "vagrant", "up")
+		_, cmdReader, err := util.RunCommandContext(action.Context(), "start Nodes...", "vagrant", "up")
 		if util.CheckAndLogError("start Nodes: Starting vagrant failed", err) {
 			fmt.Println("vagrant up")
 			actionManager.LogAction(action.Id, "vagrant up\n")
@@ -262,6 +264,10 @@ func (this *nodeManager) StartNodes() *Action {
 	} else {
 		actionManager.LogAction(action.Id, "start Nodes failed: not configured.\n")
 	}
+	if action.Context().Err() != nil {
+		Log().Info("Start Nodes cancelled.")
+		return action
+	}
 	go this.publishServices()
 	return action
 }
@@ -277,14 +283,14 @@ func (this *nodeManager) publishServices() {
 	Log().Info("Service publish loop stopped.")
 }
 
-func (this *nodeManager) StopNodes() *Action {
+func (this *nodeManager) StopNodes(parent *Action) *Action {
 	actionManager := (*GetActionManager())
-	action := actionManager.StartAction("Stop Nodes...")
+	action := startAction(parent, "Stop Nodes...")
 	this.running = false
 	Log().Debug("Cleaning service registry...")
 	(*this.serviceRegistry).RemoveServices("NodeManager")
 	if util.FileExists("Vagrantfile") {
-		_, cmdReader, err := util.RunCommand("Stopping any running instances...", "vagrant", "-f", "halt")
+		_, cmdReader, err := util.RunCommandContext(action.Context(), "Stopping any running instances...", "vagrant", "-f", "halt")
 		if util.CheckAndLogError("Stop Nodes: Starting vagrant failed", err) {
 			fmt.Println("vagrant halt")
 			actionManager.LogAction(action.Id, "vagrant halt\n")
@@ -303,13 +309,13 @@ func (this *nodeManager) StopNodes() *Action {
 	return action
 }
 
-func (this *nodeManager) DestroyNode(name string) *Action {
+func (this *nodeManager) DestroyNode(parent *Action, name string) *Action {
 	Log().Info("Destroy node: " + name + "...")
 	actionManager := *GetActionManager()
-	action := actionManager.StartAction("Destroy node: " + name)
+	action := startAction(parent, "Destroy node: "+name)
 	go func() {
 		if util.FileExists("Vagrantfile") {
-			_, cmdReader, err := util.RunCommand("Stopping node: "+name+"...", "vagrant", "-f", "destroy", name)
+			_, cmdReader, err := util.RunCommandContext(action.Context(), "Stopping node: "+name+"...", "vagrant", "-f", "destroy", name)
 			if util.CheckAndLogError("Destroy Node: vagrant error occurred.", err) {
 				fmt.Println("vagrant -f destroy " + name)
 				actionManager.LogAction(action.Id, "vagrant -f destroy "+name+"\n")
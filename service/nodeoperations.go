@@ -0,0 +1,402 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"github.com/winkube/webapp"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The query parameter selecting the operation executed on a node.
+const NODE_OPERATION_PARAM = "op"
+
+// The longest time a node can be drained, the drain command has to complete within the time a
+// command may run.
+const MAX_DRAIN_TIMEOUT = CLUSTER_EXEC_TIMEOUT - CLUSTER_API_TIMEOUT
+
+// A parameter of a node operation. Values are checked, before the operation is executed.
+type OperationParam struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Required    bool   `json:"required,omitempty"`
+	// used if the parameter is not passed
+	Default  string `json:"default,omitempty"`
+	validate func(value string) error
+}
+
+// An operation, which can be executed on the master or worker node of a host. Operations are
+// translated into allow-listed commands with validated arguments, so no shell input is passed
+// to the nodes.
+type NodeOperation struct {
+	Name        string           `json:"name"`
+	Description string           `json:"description"`
+	NodeTypes   []NodeType       `json:"nodeTypes"`
+	Params      []OperationParam `json:"params,omitempty"`
+	// operations changing the cluster are only executed for POST requests
+	Mutating bool `json:"mutating,omitempty"`
+	// builds the command from the validated parameters
+	command func(params map[string]string) ExecRequest
+}
+
+var (
+	// Kubernetes resource names (DNS-1123 subdomains) and namespaces (DNS-1123 labels)
+	resourceNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+	labelPattern        = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+	durationPattern     = regexp.MustCompile(`^[0-9]+[smh]$`)
+)
+
+var nodeOperations = map[string]NodeOperation{}
+
+func init() {
+	registerNodeOperation(NodeOperation{
+		Name:        "get-nodes",
+		Description: "Lists the Kubernetes nodes.",
+		NodeTypes:   []NodeType{Master},
+		command: func(params map[string]string) ExecRequest {
+			return kubectlRequest("get", "nodes", "-o", "wide")
+		},
+	})
+	registerNodeOperation(NodeOperation{
+		Name:        "get-pods",
+		Description: "Lists the pods of a namespace, or of all namespaces.",
+		NodeTypes:   []NodeType{Master},
+		Params:      []OperationParam{namespaceParam("")},
+		command: func(params map[string]string) ExecRequest {
+			if params["namespace"] == "" {
+				return kubectlRequest("get", "pods", "--all-namespaces", "-o", "wide")
+			}
+			return kubectlRequest("get", "pods", "-n", params["namespace"], "-o", "wide")
+		},
+	})
+	registerNodeOperation(NodeOperation{
+		Name:        "describe-node",
+		Description: "Describes a Kubernetes node.",
+		NodeTypes:   []NodeType{Master},
+		Params:      []OperationParam{nodeParam()},
+		command: func(params map[string]string) ExecRequest {
+			return kubectlRequest("describe", "node", params["node"])
+		},
+	})
+	registerNodeOperation(NodeOperation{
+		Name:        "cordon",
+		Description: "Marks a Kubernetes node as unschedulable.",
+		NodeTypes:   []NodeType{Master},
+		Mutating:    true,
+		Params:      []OperationParam{nodeParam()},
+		command: func(params map[string]string) ExecRequest {
+			return kubectlRequest("cordon", params["node"])
+		},
+	})
+	registerNodeOperation(NodeOperation{
+		Name:        "uncordon",
+		Description: "Marks a Kubernetes node as schedulable again.",
+		NodeTypes:   []NodeType{Master},
+		Mutating:    true,
+		Params:      []OperationParam{nodeParam()},
+		command: func(params map[string]string) ExecRequest {
+			return kubectlRequest("uncordon", params["node"])
+		},
+	})
+	registerNodeOperation(NodeOperation{
+		Name:        "drain",
+		Description: "Evicts all workload from a Kubernetes node.",
+		NodeTypes:   []NodeType{Master},
+		Mutating:    true,
+		Params: []OperationParam{nodeParam(), {
+			Name:        "timeout",
+			Description: "The time to wait for the evictions, e.g. 2m, at most " + MAX_DRAIN_TIMEOUT.String() + ".",
+			Default:     "2m",
+			validate:    durationUpTo(MAX_DRAIN_TIMEOUT),
+		}},
+		command: func(params map[string]string) ExecRequest {
+			timeout, _ := time.ParseDuration(params["timeout"])
+			request := kubectlRequest("drain", params["node"], "--ignore-daemonsets", "--delete-local-data",
+				"--timeout="+params["timeout"])
+			request.Timeout = int((timeout + CLUSTER_API_TIMEOUT).Seconds())
+			return request
+		},
+	})
+	registerNodeOperation(NodeOperation{
+		Name:        "logs",
+		Description: "Shows the latest log lines of a pod.",
+		NodeTypes:   []NodeType{Master},
+		Params: []OperationParam{{
+			Name:        "pod",
+			Description: "The name of the pod.",
+			Required:    true,
+			validate:    matches(resourceNamePattern, "a pod name"),
+		}, namespaceParam("default"), {
+			Name:        "container",
+			Description: "The container of the pod, required for pods with several containers.",
+			validate:    matches(labelPattern, "a container name"),
+		}, linesParam()},
+		command: func(params map[string]string) ExecRequest {
+			request := kubectlRequest("logs", params["pod"], "-n", params["namespace"], "--tail="+params["lines"])
+			if params["container"] != "" {
+				request.Args = append(request.Args, "-c", params["container"])
+			}
+			return request
+		},
+	})
+	registerNodeOperation(NodeOperation{
+		Name:        "token-create",
+		Description: "Creates a bootstrap token and prints the command joining a node.",
+		NodeTypes:   []NodeType{Master},
+		Mutating:    true,
+		Params: []OperationParam{{
+			Name:        "ttl",
+			Description: "The time the token is valid, e.g. 1h, at most 24h.",
+			Default:     "1h",
+			validate:    durationUpTo(24 * time.Hour),
+		}},
+		command: func(params map[string]string) ExecRequest {
+			return ExecRequest{Command: "kubeadm", Args: []string{"token", "create", "--ttl", params["ttl"], "--print-join-command"}}
+		},
+	})
+	registerNodeOperation(NodeOperation{
+		Name:        "token-list",
+		Description: "Lists the bootstrap tokens.",
+		NodeTypes:   []NodeType{Master},
+		command: func(params map[string]string) ExecRequest {
+			return ExecRequest{Command: "kubeadm", Args: []string{"token", "list"}}
+		},
+	})
+	registerNodeOperation(NodeOperation{
+		Name:        "kubelet-status",
+		Description: "Shows the status of the kubelet service.",
+		NodeTypes:   []NodeType{Master, Worker},
+		command: func(params map[string]string) ExecRequest {
+			return ExecRequest{Command: "systemctl", Args: []string{"status", "kubelet", "--no-pager"}}
+		},
+	})
+	registerNodeOperation(NodeOperation{
+		Name:        "kubelet-logs",
+		Description: "Shows the latest log lines of the kubelet service.",
+		NodeTypes:   []NodeType{Master, Worker},
+		Params:      []OperationParam{linesParam()},
+		command: func(params map[string]string) ExecRequest {
+			return ExecRequest{Command: "journalctl", Args: []string{"-u", "kubelet", "-n", params["lines"], "--no-pager"}}
+		},
+	})
+	registerNodeOperation(NodeOperation{
+		Name:        "uptime",
+		Description: "Shows how long the node is running and its load.",
+		NodeTypes:   []NodeType{Master, Worker},
+		command: func(params map[string]string) ExecRequest {
+			return ExecRequest{Command: "uptime"}
+		},
+	})
+	registerNodeOperation(NodeOperation{
+		Name:        "disk-usage",
+		Description: "Shows the disk usage of the node.",
+		NodeTypes:   []NodeType{Master, Worker},
+		command: func(params map[string]string) ExecRequest {
+			return ExecRequest{Command: "df", Args: []string{"-h"}}
+		},
+	})
+}
+
+func registerNodeOperation(operation NodeOperation) {
+	nodeOperations[operation.Name] = operation
+}
+
+// The operations available for the node type given, sorted by name.
+func NodeOperations(nodeType NodeType) []NodeOperation {
+	operations := []NodeOperation{}
+	for _, operation := range nodeOperations {
+		if operation.supports(nodeType) {
+			operations = append(operations, operation)
+		}
+	}
+	sort.Slice(operations, func(i, j int) bool {
+		return operations[i].Name < operations[j].Name
+	})
+	return operations
+}
+
+func nodeOperationNames(nodeType NodeType) string {
+	names := []string{}
+	for _, operation := range NodeOperations(nodeType) {
+		names = append(names, operation.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func (this NodeOperation) supports(nodeType NodeType) bool {
+	for _, t := range this.NodeTypes {
+		if t == nodeType {
+			return true
+		}
+	}
+	return false
+}
+
+// Looks up the operation with the name given for the node type given, and builds its command
+// from the parameters given. Unknown operations and parameters, missing and invalid values are
+// rejected.
+func nodeOperationRequest(nodeType NodeType, name string, params map[string]string) (ExecRequest, error) {
+	operation, found := nodeOperations[name]
+	if !found || !operation.supports(nodeType) {
+		if name == "" {
+			return ExecRequest{}, errors.New("No operation passed, available for " + strings.ToLower(nodeType.String()) +
+				" nodes are: " + nodeOperationNames(nodeType))
+		}
+		return ExecRequest{}, errors.New("Unknown operation for " + strings.ToLower(nodeType.String()) + " nodes: " +
+			name + ", available are: " + nodeOperationNames(nodeType))
+	}
+	values := make(map[string]string)
+	for _, param := range operation.Params {
+		value, passed := params[param.Name]
+		if !passed || value == "" {
+			if param.Required {
+				return ExecRequest{}, errors.New("Operation " + name + " requires the parameter " + param.Name + ": " + param.Description)
+			}
+			value = param.Default
+		}
+		if value != "" && param.validate != nil {
+			if err := param.validate(value); err != nil {
+				return ExecRequest{}, fmt.Errorf("Invalid parameter %v of operation %v: %v", param.Name, name, err)
+			}
+		}
+		values[param.Name] = value
+	}
+	for key := range params {
+		if _, known := values[key]; !known {
+			return ExecRequest{}, errors.New("Unknown parameter of operation " + name + ": " + key)
+		}
+	}
+	request := operation.command(values)
+	return request, request.Validate()
+}
+
+func kubectlRequest(args ...string) ExecRequest {
+	return ExecRequest{Command: "kubectl", Args: args}
+}
+
+func nodeParam() OperationParam {
+	return OperationParam{
+		Name:        "node",
+		Description: "The name of the Kubernetes node.",
+		Required:    true,
+		validate:    matches(resourceNamePattern, "a node name"),
+	}
+}
+
+func namespaceParam(defaultValue string) OperationParam {
+	return OperationParam{
+		Name:        "namespace",
+		Description: "The Kubernetes namespace.",
+		Default:     defaultValue,
+		validate:    matches(labelPattern, "a namespace"),
+	}
+}
+
+func linesParam() OperationParam {
+	return OperationParam{
+		Name:        "lines",
+		Description: "The number of log lines shown, at most 10000.",
+		Default:     "100",
+		validate:    intBetween(1, 10000),
+	}
+}
+
+func matches(pattern *regexp.Regexp, description string) func(value string) error {
+	return func(value string) error {
+		if len(value) > 253 || !pattern.MatchString(value) {
+			return fmt.Errorf("%q is not %v", value, description)
+		}
+		return nil
+	}
+}
+
+func durationUpTo(max time.Duration) func(value string) error {
+	return func(value string) error {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 || duration > max || !durationPattern.MatchString(value) {
+			return fmt.Errorf("%q is no duration between 1s and %v, e.g. 90s, 5m or 1h", value, max)
+		}
+		return nil
+	}
+}
+
+func intBetween(min int, max int) func(value string) error {
+	return func(value string) error {
+		number, err := strconv.Atoi(value)
+		if err != nil || number < min || number > max || strconv.Itoa(number) != value {
+			return fmt.Errorf("%q is no number between %v and %v", value, min, max)
+		}
+		return nil
+	}
+}
+
+// Executes an operation on the local node of the type given. The operation is selected by the
+// op query parameter, all other query parameters are passed to the operation.
+func actionNodeOperation(nodeType NodeType, context *webapp.RequestContext) *webapp.ActionResponse {
+	var node *ClusterNodeConfig
+	switch nodeType {
+	case Master:
+		if Container().Config.IsMasterNode() {
+			node = Container().Config.MasterNode
+		}
+	case Worker:
+		if Container().Config.IsWorkerNode() {
+			node = Container().Config.WorkerNode
+		}
+	}
+	if node == nil {
+		return webapp.ErrorResponse(http.StatusNotFound, "No "+strings.ToLower(nodeType.String())+" present on this node.")
+	}
+	query := context.Request.URL.Query()
+	if query.Get("cmd") != "" {
+		return webapp.ErrorResponse(http.StatusBadRequest, "Commands are not accepted, pass an operation as "+
+			NODE_OPERATION_PARAM+" parameter instead: "+nodeOperationNames(nodeType))
+	}
+	params := make(map[string]string)
+	for key, values := range query {
+		if key != NODE_OPERATION_PARAM && len(values) > 0 {
+			params[key] = values[0]
+		}
+	}
+	request := OperationRequest{Node: node.NodeName, Operation: query.Get(NODE_OPERATION_PARAM), Params: params}
+	if _, err := nodeOperationRequest(nodeType, request.Operation, params); err != nil {
+		return webapp.ErrorResponse(http.StatusBadRequest, err.Error())
+	}
+	if !operationMethodAllowed(context.Request.Method, request.Operation) {
+		return webapp.ErrorResponse(http.StatusMethodNotAllowed, "Operation "+request.Operation+" changes the cluster, use POST.")
+	}
+	result, err := execOperation(request)
+	if err != nil {
+		return webapp.ErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return webapp.JsonResponse(http.StatusOK, result)
+}
+
+// Checks if an operation may be executed for a request with the method given, operations changing
+// the cluster require POST requests.
+func operationMethodAllowed(method string, name string) bool {
+	return method == http.MethodPost || !nodeOperations[name].Mutating
+}
+
+// Lists the operations available for the node type given.
+func actionNodeOperations(nodeType NodeType) *webapp.ActionResponse {
+	return webapp.JsonResponse(http.StatusOK, NodeOperations(nodeType))
+}
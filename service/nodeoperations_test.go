@@ -0,0 +1,91 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"gopkg.in/go-playground/assert.v1"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNodeOperationRequest_BuildsTheCommandFromTheParameters(t *testing.T) {
+	request, err := nodeOperationRequest(Master, "drain", map[string]string{"node": "worker-1", "timeout": "4m"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "kubectl", request.Command)
+	assert.Equal(t, []string{"drain", "worker-1", "--ignore-daemonsets", "--delete-local-data", "--timeout=4m"}, request.Args)
+	assert.Equal(t, 270, request.Timeout)
+
+	request, err = nodeOperationRequest(Master, "logs", map[string]string{"pod": "coredns-5c98db65d4-x2x7z", "container": "coredns"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"logs", "coredns-5c98db65d4-x2x7z", "-n", "default", "--tail=100", "-c", "coredns"}, request.Args)
+
+	request, err = nodeOperationRequest(Worker, "kubelet-logs", map[string]string{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "journalctl", request.Command)
+	assert.Equal(t, []string{"-u", "kubelet", "-n", "100", "--no-pager"}, request.Args)
+}
+
+func TestNodeOperationRequest_RejectsUnknownOperations(t *testing.T) {
+	_, err := nodeOperationRequest(Master, "rm -rf /", nil)
+	assert.Equal(t, true, strings.Contains(err.Error(), "Unknown operation for master nodes: rm -rf /"))
+	_, err = nodeOperationRequest(Worker, "drain", map[string]string{"node": "worker-1"})
+	assert.Equal(t, true, strings.Contains(err.Error(), "Unknown operation for worker nodes: drain"))
+	_, err = nodeOperationRequest(Worker, "", nil)
+	assert.Equal(t, true, strings.Contains(err.Error(), "disk-usage, kubelet-logs, kubelet-status, uptime"))
+}
+
+func TestNodeOperationRequest_RejectsInvalidParameters(t *testing.T) {
+	_, err := nodeOperationRequest(Master, "cordon", map[string]string{})
+	assert.Equal(t, true, strings.Contains(err.Error(), "requires the parameter node"))
+	_, err = nodeOperationRequest(Master, "cordon", map[string]string{"node": "worker-1; reboot"})
+	assert.Equal(t, true, strings.Contains(err.Error(), "Invalid parameter node"))
+	_, err = nodeOperationRequest(Master, "cordon", map[string]string{"node": "worker-1", "force": "true"})
+	assert.Equal(t, true, strings.Contains(err.Error(), "Unknown parameter of operation cordon: force"))
+	_, err = nodeOperationRequest(Master, "drain", map[string]string{"node": "worker-1", "timeout": "1h"})
+	assert.Equal(t, true, strings.Contains(err.Error(), "Invalid parameter timeout"))
+	_, err = nodeOperationRequest(Master, "drain", map[string]string{"node": "worker-1", "timeout": "1m30s"})
+	assert.NotEqual(t, nil, err)
+	_, err = nodeOperationRequest(Master, "logs", map[string]string{"pod": "web", "lines": "-5"})
+	assert.Equal(t, true, strings.Contains(err.Error(), "Invalid parameter lines"))
+	_, err = nodeOperationRequest(Master, "get-pods", map[string]string{"namespace": "Kube_System"})
+	assert.Equal(t, true, strings.Contains(err.Error(), "Invalid parameter namespace"))
+}
+
+func TestNodeOperations_AreAllowedCommands(t *testing.T) {
+	for _, nodeType := range []NodeType{Master, Worker} {
+		for _, operation := range NodeOperations(nodeType) {
+			params := make(map[string]string)
+			for _, param := range operation.Params {
+				if param.Required {
+					params[param.Name] = "node-1"
+				}
+			}
+			_, err := nodeOperationRequest(nodeType, operation.Name, params)
+			assert.Equal(t, nil, err)
+		}
+	}
+}
+
+func TestOperationMethodAllowed_RequiresPostForChanges(t *testing.T) {
+	for _, name := range []string{"cordon", "uncordon", "drain", "token-create"} {
+		assert.Equal(t, false, operationMethodAllowed(http.MethodGet, name))
+		assert.Equal(t, true, operationMethodAllowed(http.MethodPost, name))
+	}
+	for _, name := range []string{"get-nodes", "token-list", "uptime"} {
+		assert.Equal(t, true, operationMethodAllowed(http.MethodGet, name))
+		assert.Equal(t, true, operationMethodAllowed(http.MethodPost, name))
+	}
+}
@@ -0,0 +1,427 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/winkube/util"
+	"github.com/winkube/webapp"
+	"golang.org/x/text/language"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The time a command executed on a node may run, if not requested otherwise.
+const EXEC_DEFAULT_TIMEOUT = time.Minute
+
+// The commands, which may be executed on the nodes, with the sub commands allowed as first
+// argument. Commands without sub commands accept any arguments. The commands are built by the
+// node operations only, this list guards against operations executing anything else.
+var execAllowList = map[string][]string{
+	"kubectl":    {"get", "describe", "logs", "cordon", "uncordon", "drain"},
+	"kubeadm":    {"token"},
+	"systemctl":  {"status"},
+	"journalctl": nil,
+	"uptime":     nil,
+	"df":         nil,
+}
+
+// An operation to be executed on a node of the cluster. The controller routes it to the host
+// running the node, which builds the command from the registry of node operations. Commands are
+// never passed between hosts.
+type OperationRequest struct {
+	// The name or id of the node, empty for a master of the cluster.
+	Node      string            `json:"node,omitempty"`
+	Operation string            `json:"operation"`
+	Params    map[string]string `json:"params,omitempty"`
+}
+
+// A command executed on a node of this host, built by a node operation.
+type ExecRequest struct {
+	// The name or id of the node, empty for a master of the cluster.
+	Node    string   `json:"node,omitempty"`
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	// The seconds the command may run, at most CLUSTER_EXEC_TIMEOUT. 0 uses EXEC_DEFAULT_TIMEOUT.
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// The result of a command executed on a node.
+type ExecResult struct {
+	Node     string   `json:"node"`
+	Host     string   `json:"host"`
+	Command  string   `json:"command"`
+	Args     []string `json:"args,omitempty"`
+	ExitCode int      `json:"exitCode"`
+	Stdout   string   `json:"stdout"`
+	Stderr   string   `json:"stderr"`
+}
+
+// Returns an error, if the command failed.
+func (this ExecResult) Err() error {
+	if this.ExitCode == 0 {
+		return nil
+	}
+	return fmt.Errorf("'%v' failed on node %v with exit code %v: %v", this.commandLine(), this.Node, this.ExitCode, strings.TrimSpace(this.Stderr))
+}
+
+func (this ExecResult) commandLine() string {
+	return ExecRequest{Command: this.Command, Args: this.Args}.commandLine()
+}
+
+// Checks the command is on the allow list, and the arguments can be passed safely.
+func (this ExecRequest) Validate() error {
+	subCommands, allowed := execAllowList[this.Command]
+	if !allowed {
+		return errors.New("Command not allowed: " + this.Command)
+	}
+	if subCommands != nil {
+		if len(this.Args) == 0 || !containsString(subCommands, this.Args[0]) {
+			return errors.New("Command not allowed: " + this.commandLine() + ", allowed are " +
+				this.Command + " " + strings.Join(subCommands, ", "))
+		}
+	}
+	for _, arg := range this.Args {
+		if strings.ContainsAny(arg, "\x00\n\r") {
+			return fmt.Errorf("Invalid argument of %v: %q", this.Command, arg)
+		}
+	}
+	if this.Timeout < 0 || time.Duration(this.Timeout)*time.Second > CLUSTER_EXEC_TIMEOUT {
+		return fmt.Errorf("Invalid timeout %vs, at most %v allowed.", this.Timeout, CLUSTER_EXEC_TIMEOUT)
+	}
+	return nil
+}
+
+// The time the command may run.
+func (this ExecRequest) timeout() time.Duration {
+	if this.Timeout <= 0 {
+		return EXEC_DEFAULT_TIMEOUT
+	}
+	return time.Duration(this.Timeout) * time.Second
+}
+
+// The command line executed by the shell of the node, all arguments are quoted.
+func (this ExecRequest) commandLine() string {
+	parts := []string{this.Command}
+	for _, arg := range this.Args {
+		parts = append(parts, shellQuote(arg))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Quotes an argument for a POSIX shell, so it is passed literally.
+func shellQuote(arg string) string {
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Executes a command on a node running on this host, an empty node selects the local master.
+func execLocal(request ExecRequest) (ExecResult, error) {
+	if err := request.Validate(); err != nil {
+		return ExecResult{}, err
+	}
+	node := localNodeConfig(Container().Config, request.Node)
+	if node == nil {
+		return ExecResult{}, errors.New("No node " + request.Node + " running on " + hostname() + ".")
+	}
+	if !util.FileExists("Vagrantfile") {
+		return ExecResult{}, errors.New("Cannot execute " + request.Command + " on " + node.NodeName + ": nodes are not configured.")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), request.timeout())
+	defer cancel()
+	Log().Info("Executing '" + request.commandLine() + "' on " + node.NodeName + "...")
+	stdout, stderr, err := util.RunCommandOutput(ctx, "vagrant", "ssh", node.NodeName, "-c", request.commandLine())
+	result := ExecResult{
+		Node:    node.NodeName,
+		Host:    hostname(),
+		Command: request.Command,
+		Args:    request.Args,
+		Stdout:  string(stdout),
+		Stderr:  string(stderr),
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return result, errors.New("'" + request.commandLine() + "' on " + node.NodeName + " timed out after " + request.timeout().String() + ".")
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		result.ExitCode = exitErr.ExitCode()
+	} else if err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// The config of the local node with the name or id given, an empty name selects the master.
+func localNodeConfig(config *SystemConfiguration, name string) *ClusterNodeConfig {
+	for _, node := range localNodes(config) {
+		if name != "" && !strings.EqualFold(node.Name, name) && node.Id != name {
+			continue
+		}
+		switch {
+		case node.NodeType == Master:
+			return config.MasterNode
+		case node.NodeType == Worker && name != "":
+			return config.WorkerNode
+		}
+	}
+	return nil
+}
+
+// Finds the node with the name or id given, an empty name selects a master, alive masters first.
+// The caller must hold the lock.
+func (c *localControllerDelegate) targetNode(name string) *Node {
+	if name != "" {
+		for _, nodes := range []map[string]Node{c.clusterState.Masters, c.clusterState.Workers} {
+			for _, node := range nodes {
+				if node.Id == name || strings.EqualFold(node.Name, name) {
+					return &node
+				}
+			}
+		}
+		return nil
+	}
+	masters := []Node{}
+	for _, node := range c.clusterState.Masters {
+		masters = append(masters, node)
+	}
+	sort.Slice(masters, func(i, j int) bool {
+		if (masters[i].State == NodeAlive) != (masters[j].State == NodeAlive) {
+			return masters[i].State == NodeAlive
+		}
+		return masters[i].Name < masters[j].Name
+	})
+	if len(masters) == 0 {
+		return nil
+	}
+	return &masters[0]
+}
+
+// Executes the operation on the node requested, either locally or on the host running the node.
+// The operation is validated here already, so invalid requests are not forwarded.
+func (c *localControllerDelegate) Exec(request OperationRequest) (ExecResult, error) {
+	c.mutex.Lock()
+	node := c.targetNode(request.Node)
+	c.mutex.Unlock()
+	if node == nil {
+		if request.Node == "" {
+			return ExecResult{}, errors.New("No master registered in cluster " + c.GetClusterId() + ".")
+		}
+		return ExecResult{}, errors.New("No such node: " + request.Node)
+	}
+	command, err := nodeOperationRequest(node.NodeType, request.Operation, request.Params)
+	if err != nil {
+		return ExecResult{}, err
+	}
+	request.Node = node.Name
+	if node.Host == hostname() {
+		return execOperation(request)
+	}
+	return forwardOperation(node.Host, request, command.timeout())
+}
+
+// Executes an operation on a node of this host, the command is built by the operation registry.
+func execOperation(request OperationRequest) (ExecResult, error) {
+	node := localNodeConfig(Container().Config, request.Node)
+	if node == nil {
+		return ExecResult{}, errors.New("No node " + request.Node + " running on " + hostname() + ".")
+	}
+	command, err := nodeOperationRequest(node.NodeType, request.Operation, request.Params)
+	if err != nil {
+		return ExecResult{}, err
+	}
+	command.Node = node.NodeName
+	return execLocal(command)
+}
+
+// Passes the operation to the host given, which executes it on its node, waiting at most the
+// time the command may run.
+func forwardOperation(host string, request OperationRequest, timeout time.Duration) (ExecResult, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return ExecResult{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout+CLUSTER_API_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, "https://"+host+":9999/node/exec", bytes.NewReader(body))
+	if err != nil {
+		return ExecResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := (*Container().ClusterTLS).Client().Do(req.WithContext(ctx))
+	if err != nil {
+		return ExecResult{}, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ExecResult{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return ExecResult{}, errors.New("Host " + host + " failed to execute " + request.Operation + ": " + resp.Status + " " + string(data))
+	}
+	var result ExecResult
+	return result, json.Unmarshal(data, &result)
+}
+
+func (r *remoteControllerDelegate) Exec(request OperationRequest) (ExecResult, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return ExecResult{}, err
+	}
+	data, err := r.send(http.MethodPost, "/cluster/exec", body)
+	if err != nil {
+		return ExecResult{}, err
+	}
+	var result ExecResult
+	return result, json.Unmarshal(data, &result)
+}
+
+// Reads the operation request of an action, returns an error response, if invalid.
+func readOperationRequest(context *webapp.RequestContext) (OperationRequest, *webapp.ActionResponse) {
+	var request OperationRequest
+	decoder := json.NewDecoder(context.Request.Body)
+	// e.g. commands and arguments of older hosts
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		return request, webapp.ErrorResponse(http.StatusBadRequest, "Invalid operation request: "+err.Error())
+	}
+	if request.Operation == "" {
+		return request, webapp.ErrorResponse(http.StatusBadRequest, "No operation passed.")
+	}
+	return request, nil
+}
+
+// Executes an operation on a node of the cluster, expects an OperationRequest as body. The
+// operation is routed to the host running the node.
+func (this *localControllerDelegate) actionExec(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	request, errorResponse := readOperationRequest(context)
+	if errorResponse != nil {
+		return errorResponse
+	}
+	result, err := this.Exec(request)
+	if err != nil {
+		return webapp.ErrorResponse(http.StatusBadGateway, err.Error())
+	}
+	return webapp.JsonResponse(http.StatusOK, result)
+}
+
+// Executes an operation routed by the controller on a node of this host.
+func actionNodeExec(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	request, errorResponse := readOperationRequest(context)
+	if errorResponse != nil {
+		return errorResponse
+	}
+	if localNodeConfig(Container().Config, request.Node) == nil {
+		return webapp.ErrorResponse(http.StatusNotFound, "No node "+request.Node+" running on "+hostname()+".")
+	}
+	result, err := execOperation(request)
+	if err != nil {
+		return webapp.ErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return webapp.JsonResponse(http.StatusOK, result)
+}
+
+// Creates the API of a host not leading the cluster, the controller executes commands on the
+// nodes of the host through it. The leader function returns the controller currently leading.
+func createHostWebApp(leader func() string) *webapp.WebApplication {
+	app := webapp.CreateWebApp("host", "", language.English)
+	app.JSONErrors = true
+	instrumentWebApp(app)
+	app.Use(func(context *webapp.RequestContext, writer http.ResponseWriter) bool {
+		return hostAuthFilter(context, writer, leader())
+	})
+	app.PostAction("/node/exec", actionNodeExec)
+	app.DefaultTimeout = CLUSTER_API_TIMEOUT
+	app.SetTimeout("POST", "/node/exec", CLUSTER_EXEC_TIMEOUT)
+	return app
+}
+
+// Only accepts requests of the leader given, see authorizeController.
+func hostAuthFilter(context *webapp.RequestContext, writer http.ResponseWriter, leader string) bool {
+	err := authorizeController(context.Request.TLS, leader)
+	if err != nil {
+		Log().Warn("Rejected " + context.Request.Method + " " + context.Request.URL.Path + " from " +
+			context.Request.RemoteAddr + ": " + err.Error())
+		context.WriteResponse(writer, webapp.ErrorResponse(http.StatusUnauthorized, "Only the cluster controller is allowed."))
+		return false
+	}
+	return true
+}
+
+// Checks the client of the connection is the leader given, identified by the controller
+// certificate it has issued for itself. The host names of certificates are requested by the hosts,
+// so they cannot identify the controller alone.
+func authorizeController(state *tls.ConnectionState, leader string) error {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return errors.New("no client certificate")
+	}
+	if leader == "" {
+		return errors.New("no controller leading the cluster")
+	}
+	cert := state.VerifiedChains[0][0]
+	if !IsControllerCertificate(cert) {
+		return errors.New("no controller certificate: " + cert.Subject.CommonName)
+	}
+	return cert.VerifyHostname(leader)
+}
+
+// Starts serving the host API, unless already running.
+func (this *localController) startHostApi() {
+	if this.hostApi != nil {
+		return
+	}
+	app := createHostWebApp(func() string {
+		if lease := this.GetLease(); lease != nil {
+			return lease.Leader
+		}
+		return ""
+	})
+	server := &http.Server{
+		Addr:      "0.0.0.0:9999",
+		Handler:   http.HandlerFunc(app.HandleRequest),
+		TLSConfig: (*Container().ClusterTLS).ServerConfig(),
+	}
+	this.hostApi = server
+	go func() {
+		err := server.ListenAndServeTLS("", "")
+		if err != nil && err != http.ErrServerClosed {
+			Log().Error("Host API server failed: " + err.Error())
+		}
+	}()
+}
+
+// Stops serving the host API, e.g. when this host takes over the cluster.
+func (this *localController) stopHostApi() {
+	if this.hostApi != nil {
+		this.hostApi.Close()
+		this.hostApi = nil
+	}
+}
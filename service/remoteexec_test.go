@@ -0,0 +1,140 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"github.com/winkube/webapp"
+	"gopkg.in/go-playground/assert.v1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestExecRequest_AcceptsAllowedCommandsOnly(t *testing.T) {
+	assert.Equal(t, nil, ExecRequest{Command: "kubectl", Args: []string{"get", "nodes"}}.Validate())
+	assert.Equal(t, nil, ExecRequest{Command: "uptime"}.Validate())
+	assert.Equal(t, nil, ExecRequest{Command: "journalctl", Args: []string{"-u", "kubelet"}, Timeout: 60}.Validate())
+	assert.NotEqual(t, nil, ExecRequest{Command: "rm", Args: []string{"-rf", "/"}}.Validate())
+	assert.NotEqual(t, nil, ExecRequest{Command: "kubectl", Args: []string{"delete", "node", "w-1"}}.Validate())
+	assert.NotEqual(t, nil, ExecRequest{Command: "kubectl"}.Validate())
+	assert.NotEqual(t, nil, ExecRequest{Command: "uptime; reboot"}.Validate())
+	assert.NotEqual(t, nil, ExecRequest{Command: "kubectl", Args: []string{"get", "nodes\nreboot"}}.Validate())
+	assert.NotEqual(t, nil, ExecRequest{Command: "uptime", Timeout: 3600}.Validate())
+	assert.NotEqual(t, nil, ExecRequest{Command: "uptime", Timeout: -1}.Validate())
+}
+
+func TestExecRequest_QuotesAllArguments(t *testing.T) {
+	request := ExecRequest{Command: "kubectl", Args: []string{"get", "nodes; reboot", "it's"}}
+	assert.Equal(t, `kubectl 'get' 'nodes; reboot' 'it'\''s'`, request.commandLine())
+	assert.Equal(t, "uptime", ExecRequest{Command: "uptime"}.commandLine())
+}
+
+func TestExecResult_FailsOnNonZeroExitCodes(t *testing.T) {
+	assert.Equal(t, nil, ExecResult{Command: "uptime"}.Err())
+	err := ExecResult{Node: "m-1", Command: "kubectl", Args: []string{"get", "pods"}, ExitCode: 1, Stderr: "forbidden\n"}.Err()
+	assert.Equal(t, "'kubectl 'get' 'pods'' failed on node m-1 with exit code 1: forbidden", err.Error())
+}
+
+func TestOperationRequest_IsSerializedAsJson(t *testing.T) {
+	data, err := json.Marshal(OperationRequest{Node: "w-1", Operation: "logs", Params: map[string]string{"pod": "web"}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"node":"w-1","operation":"logs","params":{"pod":"web"}}`, string(data))
+}
+
+func TestReadOperationRequest_RejectsCommands(t *testing.T) {
+	read := func(body string) *webapp.ActionResponse {
+		context := &webapp.RequestContext{Request: httptest.NewRequest(http.MethodPost, "/cluster/exec", strings.NewReader(body))}
+		_, response := readOperationRequest(context)
+		return response
+	}
+	assert.Equal(t, true, read(`{"node":"m-1","operation":"get-nodes"}`) == nil)
+	assert.Equal(t, http.StatusBadRequest, read(`{"command":"kubectl","args":["get","secrets","-A"]}`).Error.Status)
+	assert.Equal(t, http.StatusBadRequest, read(`{"operation":"get-nodes","args":["-o","yaml"]}`).Error.Status)
+	assert.Equal(t, http.StatusBadRequest, read(`{"node":"m-1"}`).Error.Status)
+}
+
+func TestDelegateExec_ValidatesTheOperationBeforeRouting(t *testing.T) {
+	delegate := localControllerDelegate{
+		clusterState: &Cluster{
+			Masters: map[string]Node{"a-M": {Id: "a-M", Name: "master-a", NodeType: Master, Host: "unreachable.invalid", State: NodeAlive}},
+			Workers: map[string]Node{"b-W": {Id: "b-W", Name: "worker-b", NodeType: Worker, Host: "unreachable.invalid", State: NodeAlive}},
+		},
+		mutex: &sync.Mutex{},
+	}
+	_, err := delegate.Exec(OperationRequest{Operation: "get-secrets"})
+	assert.Equal(t, true, strings.Contains(err.Error(), "Unknown operation for master nodes: get-secrets"))
+	_, err = delegate.Exec(OperationRequest{Node: "worker-b", Operation: "drain", Params: map[string]string{"node": "worker-b"}})
+	assert.Equal(t, true, strings.Contains(err.Error(), "Unknown operation for worker nodes: drain"))
+	_, err = delegate.Exec(OperationRequest{Operation: "drain", Params: map[string]string{"node": "worker-b", "force": "true"}})
+	assert.Equal(t, true, strings.Contains(err.Error(), "Unknown parameter of operation drain: force"))
+}
+
+func TestTargetNode_PrefersAliveMasters(t *testing.T) {
+	delegate := localControllerDelegate{
+		clusterState: &Cluster{
+			Masters: map[string]Node{
+				"a-M": {Id: "a-M", Name: "master-a", Host: "a", State: NodeLost},
+				"b-M": {Id: "b-M", Name: "master-b", Host: "b", State: NodeAlive},
+				"c-M": {Id: "c-M", Name: "master-c", Host: "c", State: NodeAlive},
+			},
+			Workers: map[string]Node{
+				"d-W": {Id: "d-W", Name: "worker-d", Host: "d", State: NodeAlive},
+			},
+		},
+	}
+	assert.Equal(t, "master-b", delegate.targetNode("").Name)
+	assert.Equal(t, "d", delegate.targetNode("worker-d").Host)
+	assert.Equal(t, "master-a", delegate.targetNode("a-M").Name)
+	assert.Equal(t, "master-c", delegate.targetNode("MASTER-C").Name)
+	assert.Equal(t, true, delegate.targetNode("unknown") == nil)
+	delegate.clusterState.Masters = map[string]Node{}
+	assert.Equal(t, true, delegate.targetNode("") == nil)
+}
+
+func TestAuthorizeController_AcceptsControllerCertificatesOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "winkube-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, err := CreateCertificateAuthority(filepath.Join(dir, WINKUBE_CA_CERT_FILE), filepath.Join(dir, WINKUBE_CA_KEY_FILE), "MyCluster", nil)
+	assert.Equal(t, nil, err)
+	_, csr, err := createCertificateRequest("leader-host", nil)
+	assert.Equal(t, nil, err)
+	allowed := []string{"leader-host", "localhost"}
+	hostPEM, err := (*ca).Sign(csr, "leader-host", allowed)
+	assert.Equal(t, nil, err)
+	controllerPEM, err := (*ca).SignController(csr, "leader-host", allowed)
+	assert.Equal(t, nil, err)
+	connection := func(certPEM []byte) *tls.ConnectionState {
+		cert, err := parseCertificatePEM(certPEM)
+		assert.Equal(t, nil, err)
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert, (*ca).Certificate()}}}
+	}
+
+	// a host may get a certificate naming the leader, it is still no controller
+	assert.Equal(t, "no controller certificate: leader-host", authorizeController(connection(hostPEM), "leader-host").Error())
+	assert.Equal(t, nil, authorizeController(connection(controllerPEM), "leader-host"))
+	assert.NotEqual(t, nil, authorizeController(connection(controllerPEM), "other-host"))
+	assert.NotEqual(t, nil, authorizeController(nil, "leader-host"))
+}
@@ -0,0 +1,164 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// The file containing the master key used to encrypt the secrets in the config file.
+const WINKUBE_MASTER_KEY_FILE = "winkube-master.key"
+
+// The file containing the salt used to derive the master key from a passphrase.
+const WINKUBE_SECRET_SALT_FILE = "winkube-secret.salt"
+
+// The environment variable containing the passphrase. If set, the master key is derived from it
+// instead of being read from the master key file.
+const WINKUBE_SECRET_PASSPHRASE_ENV = "WINKUBE_SECRET_PASSPHRASE"
+
+// Prefix of encrypted values.
+const SECRET_PREFIX = "enc:v1:"
+
+// Replacement shown instead of secrets in logs and UI.
+const REDACTED_SECRET = "********"
+
+// A SecretStore encrypts secrets, so they can be stored in files.
+type SecretStore interface {
+	// Encrypts a secret, the result starts with SECRET_PREFIX. Empty values are not encrypted.
+	Encrypt(plain string) (string, error)
+	// Decrypts a value encrypted by this store. Values not starting with SECRET_PREFIX are returned
+	// unchanged, so plaintext secrets of old config files can still be read.
+	Decrypt(value string) (string, error)
+}
+
+// Creates a store using the master key from the key file given. A new random key is created, if
+// the file does not exist.
+func CreateKeyFileSecretStore(keyFile string) (*SecretStore, error) {
+	key, err := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		key, err = randomBytes(32)
+		if err == nil {
+			err = ioutil.WriteFile(keyFile, key, 0600)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return createSecretStore(key)
+}
+
+// Creates a store using a master key derived from the passphrase given. The salt is read from, or
+// on first use created in, the salt file given.
+func CreatePassphraseSecretStore(passphrase string, saltFile string) (*SecretStore, error) {
+	if passphrase == "" {
+		return nil, errors.New("Empty passphrase.")
+	}
+	salt, err := ioutil.ReadFile(saltFile)
+	if os.IsNotExist(err) {
+		salt, err = randomBytes(16)
+		if err == nil {
+			err = ioutil.WriteFile(saltFile, salt, 0600)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	return createSecretStore(key)
+}
+
+// Creates the store configured, using the passphrase from the environment, if present, else the
+// master key file.
+func createDefaultSecretStore() (*SecretStore, error) {
+	if passphrase := os.Getenv(WINKUBE_SECRET_PASSPHRASE_ENV); passphrase != "" {
+		return CreatePassphraseSecretStore(passphrase, WINKUBE_SECRET_SALT_FILE)
+	}
+	return CreateKeyFileSecretStore(WINKUBE_MASTER_KEY_FILE)
+}
+
+func createSecretStore(key []byte) (*SecretStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	var store SecretStore = &aesSecretStore{gcm: gcm}
+	return &store, nil
+}
+
+// Encrypts using AES-GCM, the random nonce is stored in front of the cipher text.
+type aesSecretStore struct {
+	gcm cipher.AEAD
+}
+
+func (this *aesSecretStore) Encrypt(plain string) (string, error) {
+	if plain == "" || strings.HasPrefix(plain, SECRET_PREFIX) {
+		return plain, nil
+	}
+	nonce, err := randomBytes(this.gcm.NonceSize())
+	if err != nil {
+		return "", err
+	}
+	sealed := this.gcm.Seal(nonce, nonce, []byte(plain), nil)
+	return SECRET_PREFIX + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (this *aesSecretStore) Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, SECRET_PREFIX) {
+		return value, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, SECRET_PREFIX))
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < this.gcm.NonceSize() {
+		return "", errors.New("Invalid encrypted secret.")
+	}
+	nonce := sealed[:this.gcm.NonceSize()]
+	plain, err := this.gcm.Open(nil, nonce, sealed[this.gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("Cannot decrypt secret, the master key or passphrase does not match.")
+	}
+	return string(plain), nil
+}
+
+func randomBytes(size int) ([]byte, error) {
+	data := make([]byte, size)
+	_, err := io.ReadFull(rand.Reader, data)
+	return data, err
+}
+
+// Returns the secret itself, if empty, else REDACTED_SECRET.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return REDACTED_SECRET
+}
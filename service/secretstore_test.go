@@ -0,0 +1,55 @@
+package service
+
+import (
+	"gopkg.in/go-playground/assert.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecretStore_KeyFileRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "winkube-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, WINKUBE_MASTER_KEY_FILE)
+	store := *mustSecretStore(t)(CreateKeyFileSecretStore(keyFile))
+
+	encrypted, err := store.Encrypt("MyCluster")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, strings.HasPrefix(encrypted, SECRET_PREFIX))
+	assert.Equal(t, false, strings.Contains(encrypted, "MyCluster"))
+
+	reloaded := *mustSecretStore(t)(CreateKeyFileSecretStore(keyFile))
+	plain, err := reloaded.Decrypt(encrypted)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "MyCluster", plain)
+	plain, err = reloaded.Decrypt("legacy-plaintext")
+	assert.Equal(t, "legacy-plaintext", plain)
+	empty, _ := reloaded.Encrypt("")
+	assert.Equal(t, "", empty)
+
+	other := *mustSecretStore(t)(CreatePassphraseSecretStore("passphrase", filepath.Join(dir, WINKUBE_SECRET_SALT_FILE)))
+	_, err = other.Decrypt(encrypted)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestSecretStore_ConfigSecretsAreRedacted(t *testing.T) {
+	config := SystemConfiguration{ClusterLogin: &ClusterControllerConnection{ClusterId: "lab", ClusterCredentials: "secret"}}
+	redacted := config.Redacted()
+	assert.Equal(t, REDACTED_SECRET, redacted.ClusterLogin.ClusterCredentials)
+	assert.Equal(t, "lab", redacted.ClusterLogin.ClusterId)
+	assert.Equal(t, "secret", config.ClusterLogin.ClusterCredentials)
+}
+
+func mustSecretStore(t *testing.T) func(store *SecretStore, err error) *SecretStore {
+	return func(store *SecretStore, err error) *SecretStore {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+}
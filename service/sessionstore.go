@@ -0,0 +1,263 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gorilla/sessions"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// The file containing the session keys, the keys are encrypted with the SecretStore.
+const WINKUBE_SESSION_KEYS_FILE = "winkube-session-keys.json"
+
+// The interval, after which new session keys are created.
+const SESSION_KEY_ROTATION = 7 * 24 * time.Hour
+
+// The number of key pairs kept, sessions created with older keys become invalid.
+const SESSION_KEYS_KEPT = 2
+
+// The maximal age of a session in seconds.
+const SESSION_MAX_AGE = 30 * 60
+
+// A pair of keys signing and encrypting the session cookies.
+type SessionKey struct {
+	HashKey   string    `json:"hashKey"`
+	BlockKey  string    `json:"blockKey"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// A SessionStore keeps the web sessions in signed and encrypted cookies. The keys are rotated
+// regularly, sessions signed with the previous keys stay valid.
+type SessionStore interface {
+	sessions.Store
+	// Creates new keys, the current keys are kept for reading existing sessions.
+	Rotate() error
+}
+
+// Creates a store using the keys of the file given, which are created on first use. The keys are
+// encrypted with the secrets given. Without secrets, or an empty file name, the keys are kept in
+// memory only, so sessions do not survive a restart.
+func CreateSessionStore(file string, secrets *SecretStore) (*SessionStore, error) {
+	store := sessionStore{
+		file:    file,
+		secrets: secrets,
+	}
+	err := store.load()
+	if err != nil {
+		return nil, err
+	}
+	if store.rotationDue() {
+		err = store.rotate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var result SessionStore = &store
+	return &result, nil
+}
+
+// Creates the store of the web sessions. If the keys cannot be read, new keys are kept in
+// memory, which logs out all users on restart.
+func createDefaultSessionStore(secrets *SecretStore) *SessionStore {
+	if secrets == nil {
+		Log().Error("No secret store, session keys are not persisted.")
+	}
+	store, err := CreateSessionStore(WINKUBE_SESSION_KEYS_FILE, secrets)
+	if err != nil {
+		Log().Error("Cannot read the session keys, using temporary keys: " + err.Error())
+		store, _ = CreateSessionStore("", nil)
+	}
+	return store
+}
+
+type sessionStore struct {
+	file    string
+	secrets *SecretStore
+	// the keys, newest first
+	keys    []SessionKey
+	cookies *sessions.CookieStore
+	mutex   sync.RWMutex
+}
+
+func (this *sessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	this.rotateIfDue()
+	return this.current().Get(r, name)
+}
+
+func (this *sessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	return this.current().New(r, name)
+}
+
+func (this *sessionStore) Save(r *http.Request, w http.ResponseWriter, s *sessions.Session) error {
+	return this.current().Save(r, w, s)
+}
+
+func (this *sessionStore) Rotate() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.rotate()
+}
+
+// Creates new keys, the caller must hold the lock.
+func (this *sessionStore) rotate() error {
+	hashKey, err := randomBytes(64)
+	if err != nil {
+		return err
+	}
+	blockKey, err := randomBytes(32)
+	if err != nil {
+		return err
+	}
+	key := SessionKey{
+		HashKey:   base64.StdEncoding.EncodeToString(hashKey),
+		BlockKey:  base64.StdEncoding.EncodeToString(blockKey),
+		CreatedAt: time.Now(),
+	}
+	keys := append([]SessionKey{key}, this.keys...)
+	if len(keys) > SESSION_KEYS_KEPT {
+		keys = keys[:SESSION_KEYS_KEPT]
+	}
+	cookies, err := createCookieStore(keys)
+	if err != nil {
+		return err
+	}
+	err = this.save(keys)
+	if err != nil {
+		return err
+	}
+	this.keys = keys
+	this.cookies = cookies
+	return nil
+}
+
+// The cookie store of the current keys. Sessions keep the store they were read with, so a
+// rotation does not affect running requests.
+func (this *sessionStore) current() *sessions.CookieStore {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.cookies
+}
+
+func (this *sessionStore) rotateIfDue() {
+	this.mutex.RLock()
+	due := this.rotationDue()
+	this.mutex.RUnlock()
+	if !due {
+		return
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	// another request may have rotated meanwhile
+	if !this.rotationDue() {
+		return
+	}
+	err := this.rotate()
+	if err != nil {
+		Log().Error("Session key rotation failed: " + err.Error())
+	} else {
+		Log().Info("Session keys rotated.")
+	}
+}
+
+func (this *sessionStore) rotationDue() bool {
+	return len(this.keys) == 0 || time.Since(this.keys[0].CreatedAt) > SESSION_KEY_ROTATION
+}
+
+// Creates the cookie store, the first key pair is used to write sessions, all pairs to read them.
+func createCookieStore(keys []SessionKey) (*sessions.CookieStore, error) {
+	var pairs [][]byte
+	for _, key := range keys {
+		hashKey, err := base64.StdEncoding.DecodeString(key.HashKey)
+		if err != nil {
+			return nil, err
+		}
+		blockKey, err := base64.StdEncoding.DecodeString(key.BlockKey)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, hashKey, blockKey)
+	}
+	store := sessions.NewCookieStore(pairs...)
+	store.Options.HttpOnly = true
+	store.Options.SameSite = http.SameSiteLaxMode
+	store.MaxAge(SESSION_MAX_AGE)
+	return store, nil
+}
+
+func (this *sessionStore) load() error {
+	if this.file == "" || this.secrets == nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(this.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var keys []SessionKey
+	err = json.Unmarshal(data, &keys)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	for i := range keys {
+		if keys[i].HashKey, err = (*this.secrets).Decrypt(keys[i].HashKey); err != nil {
+			return err
+		}
+		if keys[i].BlockKey, err = (*this.secrets).Decrypt(keys[i].BlockKey); err != nil {
+			return err
+		}
+	}
+	cookies, err := createCookieStore(keys)
+	if err != nil {
+		return err
+	}
+	this.keys = keys
+	this.cookies = cookies
+	return nil
+}
+
+// Writes the keys given encrypted, the caller must hold the lock.
+func (this *sessionStore) save(keys []SessionKey) error {
+	if this.file == "" || this.secrets == nil {
+		return nil
+	}
+	encrypted := make([]SessionKey, len(keys))
+	for i, key := range keys {
+		hashKey, err := (*this.secrets).Encrypt(key.HashKey)
+		if err != nil {
+			return err
+		}
+		blockKey, err := (*this.secrets).Encrypt(key.BlockKey)
+		if err != nil {
+			return err
+		}
+		encrypted[i] = SessionKey{HashKey: hashKey, BlockKey: blockKey, CreatedAt: key.CreatedAt}
+	}
+	data, err := json.MarshalIndent(encrypted, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(this.file, data, 0600)
+}
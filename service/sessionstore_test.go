@@ -0,0 +1,58 @@
+package service
+
+import (
+	"gopkg.in/go-playground/assert.v1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSessionStore_ReadsSessionsAfterRotationAndRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "winkube-sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secrets, err := CreateKeyFileSecretStore(filepath.Join(dir, WINKUBE_MASTER_KEY_FILE))
+	assert.Equal(t, nil, err)
+	file := filepath.Join(dir, WINKUBE_SESSION_KEYS_FILE)
+	store, err := CreateSessionStore(file, secrets)
+	assert.Equal(t, nil, err)
+
+	cookie := saveSession(t, *store, "jane")
+	assert.Equal(t, "jane", readSession(t, *store, cookie))
+	assert.Equal(t, nil, (*store).Rotate())
+	assert.Equal(t, "jane", readSession(t, *store, cookie))
+
+	data, err := ioutil.ReadFile(file)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, len(data) > 0)
+	restarted, err := CreateSessionStore(file, secrets)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "jane", readSession(t, *restarted, cookie))
+
+	// only SESSION_KEYS_KEPT keys are kept
+	assert.Equal(t, nil, (*restarted).Rotate())
+	assert.Equal(t, "", readSession(t, *restarted, cookie))
+}
+
+func saveSession(t *testing.T, store SessionStore, user string) *http.Cookie {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	session, err := store.Get(req, WINKUBE_SESSION)
+	assert.Equal(t, nil, err)
+	session.Values[SESSION_USER] = user
+	recorder := httptest.NewRecorder()
+	assert.Equal(t, nil, session.Save(req, recorder))
+	return recorder.Result().Cookies()[0]
+}
+
+func readSession(t *testing.T, store SessionStore, cookie *http.Cookie) string {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookie)
+	session, _ := store.New(req, WINKUBE_SESSION)
+	user, _ := session.Values[SESSION_USER].(string)
+	return user
+}
@@ -18,6 +18,7 @@
 package service
 
 import (
+	"errors"
 	"github.com/gorilla/mux"
 	"github.com/winkube/util"
 	"github.com/winkube/webapp"
@@ -31,6 +32,7 @@ import (
 func SetupWebApplication(router *mux.Router) *webapp.WebApplication {
 	Log().Info("Initializing setup...")
 	setupWebapp := webapp.CreateWebApp("WinKube-Setup", "/setup", language.English)
+	instrumentWebApp(setupWebapp)
 	// Pages
 	setupWebapp.AddPage(&webapp.Page{
 		Name:     "index",
@@ -52,6 +54,8 @@ func SetupWebApplication(router *mux.Router) *webapp.WebApplication {
 	setupWebapp.PostAction("/step2", Step2Action)
 	setupWebapp.PostAction("/step3", Step3Action)
 	setupWebapp.PostAction("/install", InstallConfigAction)
+	// Changing the setup requires an admin
+	secureWebApp(setupWebapp, ROLE_ADMIN, false)
 	return setupWebapp
 }
 
@@ -61,9 +65,10 @@ type ConfigBean struct {
 	UseNATNetwork     bool
 }
 
-func readConfig(context *webapp.RequestContext) ConfigBean {
+// Applies the parameters of the request to the configuration edited in the session.
+func readConfig(context *webapp.RequestContext, writer http.ResponseWriter) ConfigBean {
 	context.Request.ParseMultipartForm(32000)
-	config := Container().Config
+	config := draftConfig(context, writer, false)
 	bean := ConfigBean{
 		Values: config,
 	}
@@ -103,10 +108,18 @@ func readClusterConnectionConfig(config *SystemConfiguration, context *webapp.Re
 		config.ClusterLogin.ClusterCredentials =
 			context.GetParameter("ClusterLogin-Credentials")
 	}
+	if context.GetParameter("ClusterLogin-JoinToken") != "" {
+		config.ClusterLogin.JoinToken =
+			context.GetParameter("ClusterLogin-JoinToken")
+	}
 	if context.GetParameter("ClusterLogin-Controller") != "" {
 		config.ClusterLogin.ControllerHost =
 			context.GetParameter("ClusterLogin-Controller")
 	}
+	if context.GetParameter("selectCandidate") != "" {
+		config.ClusterLogin.ControllerCandidate =
+			util.ParseBool(context.GetParameter("ClusterLogin-Candidate"))
+	}
 }
 
 func readNodeConfig(config *SystemConfiguration, context *webapp.RequestContext) {
@@ -207,7 +220,7 @@ func readClusterConfig(config *ClusterConfig, context *webapp.RequestContext) {
 	if context.GetParameter("Cluster-Credentials") != "" {
 		config.ClusterCredentials =
 			context.GetParameter("Cluster-Credentials")
-		Log().Debug("In: Cluster-Credentials = " + config.ClusterCredentials)
+		Log().Debug("In: Cluster-Credentials = " + redact(config.ClusterCredentials))
 	}
 	if context.GetParameter("Cluster-PodCIDR") != "" {
 		config.ClusterPodCIDR =
@@ -305,13 +318,13 @@ func nodeTypeFromString(nodeType string) NodeType {
 }
 
 func (this ConfigBean) WorkerNode() bool {
-	return Container().Config.WorkerNode != nil
+	return this.Values.WorkerNode != nil
 }
 func (this ConfigBean) MasterNode() bool {
-	return Container().Config.MasterNode != nil
+	return this.Values.MasterNode != nil
 }
 func (this ConfigBean) ControllerNode() bool {
-	return Container().Config.ControllerConfig != nil
+	return this.Values.ControllerConfig != nil
 }
 func (this ConfigBean) UndefinedNode() bool {
 	return !this.MasterNode() && !this.ControllerNode() && !this.WorkerNode()
@@ -320,23 +333,21 @@ func (this ConfigBean) UndefinedNode() bool {
 // Web action starting the setup process
 
 func IndexAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
-	if Container().CurrentStatus == APPSTATE_SETUP {
+	if Container().CurrentStatus() == APPSTATE_SETUP {
 		data := make(map[string]interface{})
-		data["Config"] = Container().Config
+		// the wizard starts with a copy of the active configuration
+		data["Config"] = draftConfig(context, writer, true)
 		return &webapp.ActionResponse{
 			NextPage: "index",
 			Model:    data,
 		}
 	}
-	return &webapp.ActionResponse{
-		NextPage: "_redirect",
-		Model:    "/",
-	}
+	return webapp.RedirectResponse(http.StatusSeeOther, "/")
 }
 func Step1Action(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
 	// Collect messages
 	data := make(map[string]interface{})
-	bean := readConfig(context)
+	bean := readConfig(context, writer)
 	data["Config"] = bean
 	return &webapp.ActionResponse{
 		NextPage: "step1",
@@ -345,7 +356,7 @@ func Step1Action(context *webapp.RequestContext, writer http.ResponseWriter) *we
 }
 func Step2Action(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
 	data := make(map[string]interface{})
-	bean := readConfig(context)
+	bean := readConfig(context, writer)
 	if bean.Values.MasterNode == nil && !bean.Values.IsControllerNode() && !bean.Values.IsWorkerNode() {
 		data["message"] = context.GetMessage("must-configure-anything.message")
 		return &webapp.ActionResponse{
@@ -366,8 +377,8 @@ func Step2Action(context *webapp.RequestContext, writer http.ResponseWriter) *we
 		bean.Values.InitMasterNode(true)
 	}
 	data["Config"] = bean
-	data["Clusters"] = clusterOptions(Container().LocalController)
-	data["Interfaces"] = interfaceOptions(Container().Config.NetHostInterface)
+	data["Clusters"] = clusterOptions(bean.Values)
+	data["Interfaces"] = interfaceOptions(bean.Values.NetHostInterface)
 	// Check if node type is set...
 	return &webapp.ActionResponse{
 		NextPage: "step2",
@@ -375,7 +386,7 @@ func Step2Action(context *webapp.RequestContext, writer http.ResponseWriter) *we
 	}
 }
 
-func clusterOptions(clusterManager *LocalController) webapp.Options {
+func clusterOptions(config *SystemConfiguration) webapp.Options {
 	clusterOptions := webapp.Options{}
 	// TODO fix this block
 	clusterIds := []string{"ClusterId-1", "ClusterId-2", "ClusterId-3"} // (*clusterManager).GetKnownClusters()
@@ -383,7 +394,7 @@ func clusterOptions(clusterManager *LocalController) webapp.Options {
 		option := webapp.Option{
 			Name:     id,
 			Value:    id,
-			Selected: Container().Config.ClusterId() == id,
+			Selected: config.ClusterId() == id,
 		}
 		clusterOptions.Entries = append(clusterOptions.Entries, option)
 	}
@@ -391,7 +402,7 @@ func clusterOptions(clusterManager *LocalController) webapp.Options {
 }
 
 func interfaceOptions(selected string) webapp.Options {
-	ifCurrent := Container().Config.NetHostInterface
+	ifCurrent := selected
 	if ifCurrent == "" {
 		ifCurrent = "Ethernet"
 	}
@@ -429,29 +440,45 @@ func getDisplayAddr(addresses []net.Addr, err error) string {
 
 // Web action continuing the setup process to step two
 func Step3Action(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
-	// Collect messages
-	data := make(map[string]interface{})
-	bean := readConfig(context)
-	data["Config"] = bean
 	return &webapp.ActionResponse{
 		NextPage: "step3",
-		Model:    data,
+		Model:    step3Model(readConfig(context, writer)),
+	}
+}
+
+// The model of the summary page. For joining hosts the fingerprint of the controller CA is read,
+// so it can be confirmed before the CA is trusted.
+func step3Model(bean ConfigBean) map[string]interface{} {
+	data := make(map[string]interface{})
+	data["Config"] = bean
+	login := bean.Values.ClusterLogin
+	if !bean.Values.IsControllerNode() && login != nil && login.ControllerHost != "" {
+		ca, err := FetchControllerCA(login.ControllerHost)
+		if err != nil {
+			data["ControllerCAError"] = err.Error()
+		} else {
+			data["ControllerCAFingerprint"] = CertificateFingerprint(ca)
+		}
 	}
+	return data
 }
 
 // Web action starting the node after the configuration has been completed
 func InstallConfigAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
-	// write config
-	config := Container().Config
-	nodeManager := *Container().NodeManager
+	bean := readConfig(context, writer)
+	config := bean.Values
 	action := (*GetActionManager()).StartAction("Validating configuration")
 	defer action.Complete()
-	err := nodeManager.ValidateConfig()
+	var err error
+	if !config.IsControllerNode() {
+		err = confirmControllerCA(config, context)
+	}
+	if err == nil {
+		err = Container().Validator.Struct(*config)
+	}
 	if err != nil {
 		action.CompleteWithError(err)
-		data := make(map[string]interface{})
-		bean := readConfig(context)
-		data["Config"] = bean
+		data := step3Model(bean)
 		data["error"] = "Validation failed: " + err.Error()
 		return &webapp.ActionResponse{
 			NextPage: "step3",
@@ -460,19 +487,58 @@ func InstallConfigAction(context *webapp.RequestContext, writer http.ResponseWri
 	} else {
 		action.LogActionLn("Successfully validated.")
 		Log().Info("Config validation successful.")
-		_ = config.WriteConfig()
-		action.LogActionLn("Resetting Nodes...")
-		resetAction := (*Container().NodeManager).DestroyNodes()
-		if action.OnErrorComplete(resetAction.Error) {
-			Log().Error("Destroy Nodes failed: " + resetAction.Error.Error())
-			action.LogActionLn("Destroy Nodes failed: " + resetAction.Error.Error())
-		} else {
-			action.LogActionLn("Nodes destroyed, set desired application state to RUNNING...")
-			Container().RequiredAppStatus = APPSTATE_RUNNING
+		// the draft becomes the active configuration
+		err = applyConfig(*config)
+		if err != nil {
+			action.CompleteWithError(err)
+			data := step3Model(bean)
+			data["error"] = "Configuration not applied: " + err.Error()
+			return &webapp.ActionResponse{
+				NextPage: "step3",
+				Model:    data,
+			}
 		}
+		discardDraftConfig(context, writer)
+		action.OnErrorComplete(installConfig(Container().Config, action))
 	}
-	return &webapp.ActionResponse{
-		NextPage: "_redirect",
-		Model:    "/actions",
+	return webapp.RedirectResponse(http.StatusSeeOther, "/actions")
+}
+
+// Takes over the controller CA fingerprint confirmed on the summary page.
+func confirmControllerCA(config *SystemConfiguration, context *webapp.RequestContext) error {
+	context.Request.ParseMultipartForm(32000)
+	fingerprint := context.GetParameter("TrustControllerCA")
+	if fingerprint != "" {
+		config.ClusterLogin.CAFingerprint = fingerprint
+	}
+	if config.ClusterLogin.CAFingerprint == "" {
+		return errors.New("The fingerprint of the controller CA must be confirmed.")
+	}
+	return nil
+}
+
+// Replaces the active configuration. The state machine swaps it while in SETUP, so no transition
+// reads a half written config.
+func applyConfig(config SystemConfiguration) error {
+	return (*Container().StateMachine).ApplyIn(APPSTATE_SETUP, func() error {
+		*Container().Config = config
+		return nil
+	})
+}
+
+// Writes the validated config, resets the nodes and requests the RUNNING state.
+func installConfig(config *SystemConfiguration, action *Action) error {
+	_ = config.WriteConfig(action)
+	action.LogActionLn("Resetting Nodes...")
+	resetAction := (*Container().NodeManager).DestroyNodes(action)
+	if err := resetAction.Err(); err != nil {
+		Log().Error("Destroy Nodes failed: " + err.Error())
+		return err
+	}
+	action.LogActionLn("Nodes destroyed, set desired application state to RUNNING...")
+	err := (*Container().StateMachine).RequestState(APPSTATE_RUNNING)
+	if err != nil {
+		Log().Error("Cannot switch to RUNNING: " + err.Error())
 	}
+	return err
 }
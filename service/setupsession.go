@@ -0,0 +1,96 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/winkube/webapp"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The session attribute containing the id of the configuration edited with the setup wizard.
+const SESSION_SETUP_DRAFT = "setup-draft"
+
+// Drafts not used within this period are discarded.
+const SETUP_DRAFT_TIMEOUT = SESSION_MAX_AGE * time.Second
+
+// A configuration edited with the setup wizard, it replaces the active configuration on install.
+type setupDraft struct {
+	config   *SystemConfiguration
+	lastUsed time.Time
+}
+
+// The drafts keyed by the id stored in the session. Session cookies are limited to 4KB, so the
+// drafts themselves are kept on the server.
+var setupDrafts = make(map[string]*setupDraft)
+var setupDraftsMutex sync.Mutex
+
+// The configuration edited in the session of the request. If the session has no draft yet, or
+// reset is set, a new draft copying the active configuration is started.
+func draftConfig(context *webapp.RequestContext, writer http.ResponseWriter, reset bool) *SystemConfiguration {
+	setupDraftsMutex.Lock()
+	defer setupDraftsMutex.Unlock()
+	expireSetupDrafts()
+	id, _ := context.GetSessionAttribute(SESSION_SETUP_DRAFT).(string)
+	draft := setupDrafts[id]
+	if draft == nil || reset {
+		delete(setupDrafts, id)
+		id = uuid.New().String()
+		draft = &setupDraft{config: copyConfig(Container().Config)}
+		setupDrafts[id] = draft
+		context.SetSessionAttribute(SESSION_SETUP_DRAFT, id)
+		err := context.SaveSession(writer)
+		if err != nil {
+			Log().Error("Cannot save the setup session: " + err.Error())
+		}
+	}
+	draft.lastUsed = time.Now()
+	return draft.config
+}
+
+// Discards the draft of the session, e.g. after it has been installed.
+func discardDraftConfig(context *webapp.RequestContext, writer http.ResponseWriter) {
+	setupDraftsMutex.Lock()
+	defer setupDraftsMutex.Unlock()
+	id, _ := context.GetSessionAttribute(SESSION_SETUP_DRAFT).(string)
+	delete(setupDrafts, id)
+	context.SetSessionAttribute(SESSION_SETUP_DRAFT, "")
+	context.SaveSession(writer)
+}
+
+// Removes the drafts not used recently, the caller must hold the lock.
+func expireSetupDrafts() {
+	for id, draft := range setupDrafts {
+		if time.Since(draft.lastUsed) > SETUP_DRAFT_TIMEOUT {
+			delete(setupDrafts, id)
+		}
+	}
+}
+
+// Creates a deep copy of a configuration.
+func copyConfig(config *SystemConfiguration) *SystemConfiguration {
+	result := SystemConfiguration{}
+	data, err := json.Marshal(config)
+	if err == nil {
+		err = json.Unmarshal(data, &result)
+	}
+	if err != nil {
+		Log().Panic("Cannot copy the configuration: " + err.Error())
+	}
+	return &result
+}
@@ -0,0 +1,286 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sync"
+)
+
+// The allowed transitions between the application states. Entering the error state is always
+// possible, once the application has been initialized.
+var appTransitions = map[AppStatus][]AppStatus{
+	APPSTATE_INITIALIZING: {APPSTATE_INITIALIZED, APPSTATE_ERROR},
+	APPSTATE_INITIALIZED:  {APPSTATE_SETUP, APPSTATE_STARTING, APPSTATE_ERROR},
+	APPSTATE_SETUP:        {APPSTATE_STARTING, APPSTATE_ERROR},
+	APPSTATE_STARTING:     {APPSTATE_RUNNING, APPSTATE_ERROR},
+	APPSTATE_RUNNING:      {APPSTATE_IDLE, APPSTATE_SETUP, APPSTATE_ERROR},
+	APPSTATE_IDLE:         {APPSTATE_RUNNING, APPSTATE_SETUP, APPSTATE_ERROR},
+	APPSTATE_ERROR:        {APPSTATE_SETUP, APPSTATE_STARTING},
+}
+
+// States that, if not directly reachable, are entered through an intermediate state,
+// e.g. RUNNING is entered through STARTING when coming from SETUP.
+var appEntryStates = map[AppStatus]AppStatus{
+	APPSTATE_RUNNING: APPSTATE_STARTING,
+}
+
+// Error returned if a transition is requested that is not allowed from the current state.
+type IllegalTransitionError struct {
+	From AppStatus
+	To   AppStatus
+}
+
+func (this IllegalTransitionError) Error() string {
+	return fmt.Sprintf("Illegal state transition requested: %v -> %v", this.From, this.To)
+}
+
+// Error returned if a change requires a state the application is not in (anymore).
+type UnexpectedStateError struct {
+	Status   AppStatus
+	Expected AppStatus
+}
+
+func (this UnexpectedStateError) Error() string {
+	return fmt.Sprintf("Application state is %v, but %v is required", this.Status, this.Expected)
+}
+
+// Function performing the work required to enter a target state. The action passed is owned by the
+// state machine and completed after the handler returns, operations performed should be started as
+// its children. Returning an error moves the machine into APPSTATE_ERROR.
+type TransitionHandler func(from AppStatus, action *Action) error
+
+// Listener notified after each state change.
+type StateListener func(from AppStatus, to AppStatus)
+
+// The StateMachine controls the application state. State changes are requested and queued, the
+// requests are processed one after the other by the machine's own goroutine.
+type StateMachine interface {
+	// The current state.
+	Status() AppStatus
+	// The state last requested, which may not have been reached (yet).
+	Requested() AppStatus
+	// Registers the handler called for entering the given state.
+	Handle(status AppStatus, handler TransitionHandler)
+	// Registers a listener called after each state change.
+	AddListener(listener StateListener)
+	// Queues a request to move to the given target state. An IllegalTransitionError is returned,
+	// if the target cannot be reached from the current state.
+	RequestState(target AppStatus) error
+	// Same as RequestState, but waits until the request has been processed.
+	RequestStateAndWait(target AppStatus) error
+	// Runs the change given between the transitions, if the machine is in the given state, e.g. to
+	// replace the configuration in SETUP. An UnexpectedStateError is returned in any other state.
+	ApplyIn(status AppStatus, change func() error) error
+	// Starts processing requests.
+	Start()
+	// Stops processing requests, pending requests are discarded.
+	Stop()
+}
+
+type stateRequest struct {
+	target AppStatus
+	// run in the target state instead of moving to it, if set
+	change func() error
+	done   chan error
+}
+
+type stateMachine struct {
+	status    AppStatus
+	requested AppStatus
+	handlers  map[AppStatus]TransitionHandler
+	listeners []StateListener
+	requests  chan stateRequest
+	stop      chan bool
+	mutex     sync.RWMutex
+}
+
+func CreateStateMachine(initial AppStatus) *StateMachine {
+	var sm StateMachine = &stateMachine{
+		status:    initial,
+		requested: initial,
+		handlers:  make(map[AppStatus]TransitionHandler),
+		requests:  make(chan stateRequest, 10),
+	}
+	return &sm
+}
+
+func (this *stateMachine) Status() AppStatus {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.status
+}
+
+func (this *stateMachine) Requested() AppStatus {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.requested
+}
+
+func (this *stateMachine) Handle(status AppStatus, handler TransitionHandler) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.handlers[status] = handler
+}
+
+func (this *stateMachine) AddListener(listener StateListener) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.listeners = append(this.listeners, listener)
+}
+
+func (this *stateMachine) RequestState(target AppStatus) error {
+	_, err := this.enqueue(target)
+	return err
+}
+
+func (this *stateMachine) RequestStateAndWait(target AppStatus) error {
+	done, err := this.enqueue(target)
+	if err != nil {
+		return err
+	}
+	return <-done
+}
+
+func (this *stateMachine) ApplyIn(status AppStatus, change func() error) error {
+	done := make(chan error, 1)
+	this.requests <- stateRequest{target: status, change: change, done: done}
+	return <-done
+}
+
+func (this *stateMachine) enqueue(target AppStatus) (chan error, error) {
+	if _, err := this.path(this.Status(), target); err != nil {
+		return nil, err
+	}
+	this.mutex.Lock()
+	this.requested = target
+	this.mutex.Unlock()
+	done := make(chan error, 1)
+	this.requests <- stateRequest{target: target, done: done}
+	return done, nil
+}
+
+func (this *stateMachine) Start() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.stop != nil {
+		return
+	}
+	this.stop = make(chan bool)
+	go this.run(this.stop)
+}
+
+func (this *stateMachine) Stop() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.stop != nil {
+		close(this.stop)
+		this.stop = nil
+	}
+}
+
+func (this *stateMachine) run(stop chan bool) {
+	for {
+		select {
+		case <-stop:
+			return
+		case request := <-this.requests:
+			if request.change != nil {
+				request.done <- this.apply(request.target, request.change)
+			} else {
+				request.done <- this.process(request.target)
+			}
+		}
+	}
+}
+
+// Evaluates the states to be passed to reach the target state.
+func (this *stateMachine) path(from AppStatus, to AppStatus) ([]AppStatus, error) {
+	if from == to {
+		return []AppStatus{}, nil
+	}
+	if isTransitionAllowed(from, to) {
+		return []AppStatus{to}, nil
+	}
+	if via, found := appEntryStates[to]; found && isTransitionAllowed(from, via) && isTransitionAllowed(via, to) {
+		return []AppStatus{via, to}, nil
+	}
+	return nil, IllegalTransitionError{From: from, To: to}
+}
+
+func (this *stateMachine) process(target AppStatus) error {
+	from := this.Status()
+	path, err := this.path(from, target)
+	if err != nil {
+		log.Warn("State transition rejected: " + err.Error())
+		return err
+	}
+	if len(path) == 0 {
+		return nil
+	}
+	action := (*GetActionManager()).StartAction("Trying to switch to " + target.String() + " Mode")
+	action.SetSteps(len(path))
+	for _, status := range path[:len(path)-1] {
+		this.setStatus(status)
+		action.Step("Entered " + status.String() + " Mode...")
+	}
+	this.mutex.RLock()
+	handler := this.handlers[target]
+	this.mutex.RUnlock()
+	if handler != nil {
+		err = handler(from, action)
+	}
+	if err == nil && action.Context().Err() != nil {
+		err = ErrActionCancelled
+	}
+	if err != nil {
+		log.Error("Switching to " + target.String() + " failed: " + err.Error())
+		this.setStatus(APPSTATE_ERROR)
+		action.CompleteWithError(err)
+		return err
+	}
+	this.setStatus(target)
+	action.CompleteWithMessage("New Mode applied: " + target.String())
+	return nil
+}
+
+func (this *stateMachine) apply(status AppStatus, change func() error) error {
+	if current := this.Status(); current != status {
+		return UnexpectedStateError{Status: current, Expected: status}
+	}
+	return change()
+}
+
+func (this *stateMachine) setStatus(status AppStatus) {
+	this.mutex.Lock()
+	from := this.status
+	this.status = status
+	listeners := this.listeners
+	this.mutex.Unlock()
+	log.Info("Application state changed: " + from.String() + " -> " + status.String())
+	for _, listener := range listeners {
+		listener(from, status)
+	}
+}
+
+func isTransitionAllowed(from AppStatus, to AppStatus) bool {
+	for _, status := range appTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
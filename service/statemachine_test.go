@@ -0,0 +1,91 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"gopkg.in/go-playground/assert.v1"
+	"testing"
+)
+
+func TestStateMachine_RunningIsEnteredThroughStarting(t *testing.T) {
+	sm := *CreateStateMachine(APPSTATE_SETUP)
+	var visited []AppStatus
+	sm.AddListener(func(from AppStatus, to AppStatus) {
+		visited = append(visited, to)
+	})
+	var handledFrom AppStatus
+	sm.Handle(APPSTATE_RUNNING, func(from AppStatus, action *Action) error {
+		handledFrom = from
+		assert.Equal(t, APPSTATE_STARTING, sm.Status())
+		return nil
+	})
+	sm.Start()
+	defer sm.Stop()
+	err := sm.RequestStateAndWait(APPSTATE_RUNNING)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, APPSTATE_RUNNING, sm.Status())
+	assert.Equal(t, APPSTATE_SETUP, handledFrom)
+	assert.Equal(t, []AppStatus{APPSTATE_STARTING, APPSTATE_RUNNING}, visited)
+}
+
+func TestStateMachine_IllegalTransitionIsRejected(t *testing.T) {
+	sm := *CreateStateMachine(APPSTATE_SETUP)
+	sm.Start()
+	defer sm.Stop()
+	err := sm.RequestState(APPSTATE_IDLE)
+	assert.Equal(t, IllegalTransitionError{From: APPSTATE_SETUP, To: APPSTATE_IDLE}, err)
+	assert.Equal(t, APPSTATE_SETUP, sm.Status())
+}
+
+func TestStateMachine_HandlerErrorEntersErrorState(t *testing.T) {
+	sm := *CreateStateMachine(APPSTATE_SETUP)
+	sm.Handle(APPSTATE_RUNNING, func(from AppStatus, action *Action) error {
+		return errors.New("nodes failed")
+	})
+	sm.Start()
+	defer sm.Stop()
+	err := sm.RequestStateAndWait(APPSTATE_RUNNING)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, APPSTATE_ERROR, sm.Status())
+	assert.Equal(t, nil, sm.RequestStateAndWait(APPSTATE_SETUP))
+	assert.Equal(t, APPSTATE_SETUP, sm.Status())
+}
+
+func TestStateMachine_SameStateIsNoop(t *testing.T) {
+	sm := *CreateStateMachine(APPSTATE_RUNNING)
+	called := false
+	sm.Handle(APPSTATE_RUNNING, func(from AppStatus, action *Action) error {
+		called = true
+		return nil
+	})
+	sm.Start()
+	defer sm.Stop()
+	assert.Equal(t, nil, sm.RequestStateAndWait(APPSTATE_RUNNING))
+	assert.Equal(t, false, called)
+}
+
+func TestStateMachine_ApplyInRunsTheChangeInTheStateGivenOnly(t *testing.T) {
+	sm := *CreateStateMachine(APPSTATE_SETUP)
+	sm.Start()
+	defer sm.Stop()
+	applied := 0
+	change := func() error {
+		applied++
+		return nil
+	}
+	assert.Equal(t, nil, sm.ApplyIn(APPSTATE_SETUP, change))
+	assert.Equal(t, nil, sm.RequestStateAndWait(APPSTATE_RUNNING))
+	err := sm.ApplyIn(APPSTATE_SETUP, change)
+	assert.Equal(t, UnexpectedStateError{Status: APPSTATE_RUNNING, Expected: APPSTATE_SETUP}, err)
+	assert.Equal(t, 1, applied)
+}
+
+func TestAppStatus_JsonUsesNames(t *testing.T) {
+	data, err := json.Marshal(ApiStatus{Current: APPSTATE_IDLE, Requested: APPSTATE_RUNNING})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"current":"IDLE","requested":"RUNNING"}`, string(data))
+	var status ApiStatus
+	assert.Equal(t, nil, json.Unmarshal([]byte(`{"current":"setup","requested":"RUNNING"}`), &status))
+	assert.Equal(t, APPSTATE_SETUP, status.Current)
+	assert.NotEqual(t, nil, json.Unmarshal([]byte(`{"current":"FOO"}`), &status))
+}
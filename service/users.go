@@ -0,0 +1,315 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// The file containing the user accounts of the web UI and the monitor API.
+const WINKUBE_USERS_FILE = "winkube-users.json"
+
+// Environment variables used to create the first admin account, if no accounts exist.
+const WINKUBE_ADMIN_USER_ENV = "WINKUBE_ADMIN_USER"
+const WINKUBE_ADMIN_PASSWORD_ENV = "WINKUBE_ADMIN_PASSWORD"
+
+// A hash compared for unknown users.
+const unknownUserHash = "$2a$10$xicRnbIkbydk/CrtDZa77O5CYFJheDvxIuUuP/AAq2H7lnvnbd5eu"
+
+// The minimal password length.
+const MIN_PASSWORD_LENGTH = 8
+
+// A role grants access to the web UI and API actions. Each role includes the roles before it:
+// viewers can only read, operators can start, stop and cancel, admins can change the setup.
+type Role string
+
+const (
+	ROLE_VIEWER   Role = "viewer"
+	ROLE_OPERATOR Role = "operator"
+	ROLE_ADMIN    Role = "admin"
+)
+
+var roleRanks = map[Role]int{
+	ROLE_VIEWER:   1,
+	ROLE_OPERATOR: 2,
+	ROLE_ADMIN:    3,
+}
+
+// Checks if the role grants everything the role given grants.
+func (this Role) Includes(other Role) bool {
+	return roleRanks[this] > 0 && roleRanks[this] >= roleRanks[other]
+}
+
+func (this Role) Valid() bool {
+	return roleRanks[this] > 0
+}
+
+// A user account, the password is stored as bcrypt hash only.
+type User struct {
+	Name         string `json:"name"`
+	PasswordHash string `json:"passwordHash,omitempty"`
+	Role         Role   `json:"role"`
+}
+
+// The UserStore keeps the user accounts.
+type UserStore interface {
+	// Returns the user, if the password matches, an error otherwise.
+	Authenticate(name string, password string) (*User, error)
+	// Looks up a user, returns nil if not found.
+	Lookup(name string) *User
+	// Creates or updates a user. An empty password keeps the password of an existing user.
+	Save(name string, password string, role Role) error
+	Remove(name string) error
+	// All users, without their password hashes.
+	Users() []User
+	// Checks if no user exists yet.
+	Empty() bool
+	// Creates the first admin, if no user exists yet and the setup secret logged at startup is passed.
+	CreateInitialAdmin(setupSecret string, name string, password string) error
+}
+
+// Creates a store keeping the users in the file given, an empty file name keeps them in memory.
+func CreateUserStore(file string) (*UserStore, error) {
+	store := userStore{
+		file:  file,
+		users: make(map[string]*User),
+	}
+	err := store.load()
+	if err != nil {
+		return nil, err
+	}
+	var result UserStore = &store
+	return &result, nil
+}
+
+// Creates the default user store. If no user exists, the first admin is created from the
+// environment, if configured, otherwise a setup secret is logged, which is required to create the
+// first admin on the login page.
+func createDefaultUserStore() (*UserStore, error) {
+	store, err := CreateUserStore(WINKUBE_USERS_FILE)
+	if err != nil {
+		return nil, err
+	}
+	if !(*store).Empty() {
+		return store, nil
+	}
+	password := os.Getenv(WINKUBE_ADMIN_PASSWORD_ENV)
+	if password != "" {
+		name := os.Getenv(WINKUBE_ADMIN_USER_ENV)
+		if name == "" {
+			name = "admin"
+		}
+		return store, (*store).Save(name, password, ROLE_ADMIN)
+	}
+	secret, err := (*store).(*userStore).newSetupSecret()
+	if err != nil {
+		return nil, err
+	}
+	Log().Warn("No user account exists yet. Log in with the setup secret " + secret + " to create the first admin, " +
+		"or set " + WINKUBE_ADMIN_USER_ENV + " and " + WINKUBE_ADMIN_PASSWORD_ENV + ".")
+	return store, nil
+}
+
+type userStore struct {
+	file  string
+	users map[string]*User
+	mutex sync.RWMutex
+	// required to create the first admin, valid once
+	setupSecret string
+	setupMutex  sync.Mutex
+}
+
+func (this *userStore) Authenticate(name string, password string) (*User, error) {
+	user := this.Lookup(name)
+	if user == nil {
+		// compare anyway, so unknown users cannot be detected by the response time
+		bcrypt.CompareHashAndPassword([]byte(unknownUserHash), []byte(password))
+		return nil, errors.New("Invalid user or password.")
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return nil, errors.New("Invalid user or password.")
+	}
+	return user, nil
+}
+
+func (this *userStore) Lookup(name string) *User {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	user := this.users[name]
+	if user == nil {
+		return nil
+	}
+	result := *user
+	return &result
+}
+
+func (this *userStore) Save(name string, password string, role Role) error {
+	if name == "" {
+		return errors.New("A user name is required.")
+	}
+	if !role.Valid() {
+		return errors.New("Invalid role: " + string(role))
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	previous := this.users[name]
+	user := &User{Name: name}
+	if previous != nil {
+		*user = *previous
+	} else if password == "" {
+		return errors.New("A password is required for new users.")
+	}
+	if password != "" {
+		if len(password) < MIN_PASSWORD_LENGTH {
+			return errors.New("The password is too short.")
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		user.PasswordHash = string(hash)
+	}
+	user.Role = role
+	this.users[name] = user
+	if !this.hasAdmin() {
+		if previous == nil {
+			delete(this.users, name)
+		} else {
+			this.users[name] = previous
+		}
+		return errors.New("At least one admin is required.")
+	}
+	return this.save()
+}
+
+func (this *userStore) Remove(name string) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	user := this.users[name]
+	if user == nil {
+		return errors.New("No such user: " + name)
+	}
+	delete(this.users, name)
+	if !this.hasAdmin() {
+		this.users[name] = user
+		return errors.New("At least one admin is required.")
+	}
+	return this.save()
+}
+
+func (this *userStore) Users() []User {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	result := []User{}
+	for _, u := range this.users {
+		result = append(result, User{Name: u.Name, Role: u.Role})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+func (this *userStore) Empty() bool {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return len(this.users) == 0
+}
+
+func (this *userStore) CreateInitialAdmin(setupSecret string, name string, password string) error {
+	this.setupMutex.Lock()
+	defer this.setupMutex.Unlock()
+	if !this.Empty() {
+		return errors.New("The first admin has been created already.")
+	}
+	if this.setupSecret == "" || subtle.ConstantTimeCompare([]byte(setupSecret), []byte(this.setupSecret)) != 1 {
+		return errors.New("Invalid setup secret, see the log of the WinKube service.")
+	}
+	err := this.Save(name, password, ROLE_ADMIN)
+	if err == nil {
+		this.setupSecret = ""
+	}
+	return err
+}
+
+// Creates a new setup secret, which replaces the previous one.
+func (this *userStore) newSetupSecret() (string, error) {
+	data, err := randomBytes(16)
+	if err != nil {
+		return "", err
+	}
+	this.setupMutex.Lock()
+	defer this.setupMutex.Unlock()
+	this.setupSecret = hex.EncodeToString(data)
+	return this.setupSecret, nil
+}
+
+func (this *userStore) hasAdmin() bool {
+	for _, u := range this.users {
+		if u.Role == ROLE_ADMIN {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *userStore) load() error {
+	if this.file == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(this.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var users []User
+	err = json.Unmarshal(data, &users)
+	if err != nil {
+		return err
+	}
+	for i := range users {
+		this.users[users[i].Name] = &users[i]
+	}
+	return nil
+}
+
+// Writes all users, the caller must hold the lock.
+func (this *userStore) save() error {
+	if this.file == "" {
+		return nil
+	}
+	users := []User{}
+	for _, u := range this.users {
+		users = append(users, *u)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(this.file, data, 0600)
+}
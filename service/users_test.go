@@ -0,0 +1,97 @@
+package service
+
+import (
+	"encoding/base64"
+	"gopkg.in/go-playground/assert.v1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUserStore_AuthenticatesPersistedUsers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "winkube-users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, WINKUBE_USERS_FILE)
+
+	store, err := CreateUserStore(file)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, (*store).Empty())
+	assert.NotEqual(t, nil, (*store).Save("viewer", "password1", ROLE_VIEWER))
+	assert.Equal(t, nil, (*store).Save("admin", "password1", ROLE_ADMIN))
+	assert.Equal(t, nil, (*store).Save("operator", "password2", ROLE_OPERATOR))
+	assert.NotEqual(t, nil, (*store).Save("short", "pw", ROLE_VIEWER))
+
+	reloaded, err := CreateUserStore(file)
+	assert.Equal(t, nil, err)
+	user, err := (*reloaded).Authenticate("operator", "password2")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ROLE_OPERATOR, user.Role)
+	_, err = (*reloaded).Authenticate("operator", "password1")
+	assert.NotEqual(t, nil, err)
+	_, err = (*reloaded).Authenticate("unknown", "password1")
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, "", (*reloaded).Users()[0].PasswordHash)
+
+	// the last admin cannot be removed or demoted
+	assert.NotEqual(t, nil, (*reloaded).Remove("admin"))
+	assert.NotEqual(t, nil, (*reloaded).Save("admin", "", ROLE_VIEWER))
+	assert.Equal(t, ROLE_ADMIN, (*reloaded).Lookup("admin").Role)
+	assert.Equal(t, nil, (*reloaded).Remove("operator"))
+	assert.Equal(t, 1, len((*reloaded).Users()))
+}
+
+func TestUserStore_CreatesTheInitialAdminWithTheSetupSecretOnly(t *testing.T) {
+	store, err := CreateUserStore("")
+	assert.Equal(t, nil, err)
+	// without a setup secret, no admin can be created on the login page
+	assert.NotEqual(t, nil, (*store).CreateInitialAdmin("", "admin", "password1"))
+	secret, err := (*store).(*userStore).newSetupSecret()
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, nil, (*store).CreateInitialAdmin("guessed", "admin", "password1"))
+	assert.Equal(t, true, (*store).Empty())
+
+	assert.Equal(t, nil, (*store).CreateInitialAdmin(secret, "admin", "password1"))
+	assert.Equal(t, ROLE_ADMIN, (*store).Lookup("admin").Role)
+	// the secret is valid once
+	assert.NotEqual(t, nil, (*store).CreateInitialAdmin(secret, "other", "password1"))
+	assert.Equal(t, nil, (*store).Lookup("other"))
+}
+
+func TestRole_Includes(t *testing.T) {
+	assert.Equal(t, true, ROLE_ADMIN.Includes(ROLE_OPERATOR))
+	assert.Equal(t, true, ROLE_OPERATOR.Includes(ROLE_OPERATOR))
+	assert.Equal(t, false, ROLE_VIEWER.Includes(ROLE_OPERATOR))
+	assert.Equal(t, false, Role("").Includes(ROLE_VIEWER))
+}
+
+func TestCsrfExempt_RequiresBasicAuthenticationOrNoSession(t *testing.T) {
+	request := func(authorization string, session bool) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/nodes/start", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		if session {
+			req.AddCookie(&http.Cookie{Name: WINKUBE_SESSION, Value: "session"})
+		}
+		return req
+	}
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:password1"))
+	assert.Equal(t, true, csrfExempt(request(basic, true)))
+	assert.Equal(t, true, csrfExempt(request("", false)))
+	assert.Equal(t, false, csrfExempt(request("", true)))
+	assert.Equal(t, false, csrfExempt(request("Bearer token", true)))
+	assert.Equal(t, false, csrfExempt(request("Basic invalid", true)))
+}
+
+func TestRedirectTarget_AcceptsLocalPathsOnly(t *testing.T) {
+	assert.Equal(t, "/actions?x=1", redirectTarget("/actions?x=1"))
+	assert.Equal(t, "/", redirectTarget("//evil.example.com"))
+	assert.Equal(t, "/", redirectTarget("https://evil.example.com"))
+	assert.Equal(t, "/", redirectTarget(""))
+}
@@ -0,0 +1,232 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"github.com/winkube/webapp"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The name of the session shared by the web applications.
+const WINKUBE_SESSION = "winkube-session"
+
+// The session attribute containing the name of the logged in user.
+const SESSION_USER = "user"
+
+// Enables the shared sessions and the role checks for a web application. Actions without an
+// explicit role require the default role given.
+func secureWebApp(app *webapp.WebApplication, defaultRole Role, api bool) {
+	app.UseSessions(*Container().Sessions, WINKUBE_SESSION)
+	app.DefaultRole = string(defaultRole)
+	if api {
+		app.CSRFExempt = csrfExempt
+		app.Use(apiAuthFilter)
+	} else {
+		app.Use(uiAuthFilter)
+	}
+}
+
+// API calls need no CSRF token, if they are not authenticated by the session cookie. Browsers do not
+// add basic authentication headers to cross site requests on their own. Other Authorization headers
+// are ignored by requestUser, which then falls back to the session cookie, so they are not exempt.
+func csrfExempt(req *http.Request) bool {
+	if _, _, ok := req.BasicAuth(); ok {
+		return true
+	}
+	_, err := req.Cookie(WINKUBE_SESSION)
+	return err != nil
+}
+
+// Redirects unauthenticated users to the login page.
+func uiAuthFilter(context *webapp.RequestContext, writer http.ResponseWriter) bool {
+	user, required := authorize(context.Request, Role(context.Application.RequiredRole(context.Request)))
+	if user == nil && required != "" {
+		context.WriteResponse(writer, webapp.RedirectResponse(http.StatusSeeOther, "/login?next="+url.QueryEscape(context.Request.URL.RequestURI())))
+		return false
+	}
+	if required != "" && !user.Role.Includes(required) {
+		context.WriteResponse(writer, webapp.ErrorResponse(http.StatusForbidden, "The role "+string(required)+" is required."))
+		return false
+	}
+	return true
+}
+
+// Rejects unauthenticated API calls, the API also accepts basic authentication.
+func apiAuthFilter(context *webapp.RequestContext, writer http.ResponseWriter) bool {
+	user, required := authorize(context.Request, Role(context.Application.RequiredRole(context.Request)))
+	if user == nil && required != "" {
+		writer.Header().Set("WWW-Authenticate", `Basic realm="WinKube"`)
+		context.WriteResponse(writer, jsonError(http.StatusUnauthorized, "Authentication required."))
+		return false
+	}
+	if required != "" && !user.Role.Includes(required) {
+		context.WriteResponse(writer, jsonError(http.StatusForbidden, "The role "+string(required)+" is required."))
+		return false
+	}
+	return true
+}
+
+// Wraps a handler registered directly on the router, so it requires the role given.
+func requireRole(role Role, handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		user, _ := authorize(req, role)
+		if user == nil {
+			http.Error(writer, "Authentication required.", http.StatusUnauthorized)
+			return
+		}
+		if !user.Role.Includes(role) {
+			http.Error(writer, "Forbidden: the role "+string(role)+" is required.", http.StatusForbidden)
+			return
+		}
+		handler(writer, req)
+	}
+}
+
+// Evaluates the user of a request, which requires the role given. Calls requiring operator or
+// admin rights are audited. An empty role allows anonymous access.
+func authorize(req *http.Request, required Role) (*User, Role) {
+	user := requestUser(req)
+	if required == "" || required == ROLE_VIEWER {
+		return user, required
+	}
+	record := AuditRecord{
+		RemoteAddr: req.RemoteAddr,
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		Allowed:    user != nil && user.Role.Includes(required),
+	}
+	if user != nil {
+		record.User = user.Name
+		record.Role = user.Role
+	}
+	if !record.Allowed {
+		record.Message = "Role " + string(required) + " required."
+	}
+	audit(record)
+	return user, required
+}
+
+// The user logged in with the session of the request, or authenticated by basic authentication.
+func requestUser(req *http.Request) *User {
+	users := *Container().Users
+	if name, password, ok := req.BasicAuth(); ok {
+		user, err := users.Authenticate(name, password)
+		if err != nil {
+			audit(AuditRecord{User: name, RemoteAddr: req.RemoteAddr, Method: req.Method, Path: req.URL.Path, Message: "Basic authentication failed."})
+			return nil
+		}
+		return user
+	}
+	session, _ := (*Container().Sessions).Get(req, WINKUBE_SESSION)
+	name, _ := session.Values[SESSION_USER].(string)
+	if name == "" {
+		return nil
+	}
+	return users.Lookup(name)
+}
+
+func audit(record AuditRecord) {
+	err := (*Container().Audit).Record(record)
+	if err != nil {
+		Log().Error("Failed to write audit record: " + err.Error())
+	}
+}
+
+// Registers the login and logout actions with the application given.
+func registerLoginActions(app *webapp.WebApplication) {
+	app.AddPage(&webapp.Page{
+		Name:     "login",
+		Template: "templates/login.html",
+	})
+	app.GetAction("/login", LoginPageAction)
+	app.PostAction("/login", LoginAction)
+	app.PostAction("/logout", LogoutAction)
+	app.RequireRole("GET", "/login", "")
+	app.RequireRole("POST", "/login", "")
+	app.RequireRole("POST", "/logout", "")
+}
+
+func LoginPageAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	return loginPage(context, "")
+}
+
+func loginPage(context *webapp.RequestContext, message string) *webapp.ActionResponse {
+	data := make(map[string]interface{})
+	data["Next"] = redirectTarget(context.GetParameter("next"))
+	// the first account is created as admin with the setup secret
+	data["FirstUser"] = (*Container().Users).Empty()
+	if message != "" {
+		data["error"] = message
+	}
+	return &webapp.ActionResponse{
+		NextPage: "login",
+		Model:    data,
+	}
+}
+
+// Logs a user in. If no user exists yet, the account entered is created as admin, if the setup
+// secret logged at startup is passed.
+func LoginAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	context.Request.ParseMultipartForm(32000)
+	users := *Container().Users
+	name := context.GetFormParameter("username")
+	password := context.GetFormParameter("password")
+	record := AuditRecord{User: name, RemoteAddr: context.Request.RemoteAddr, Method: "POST", Path: context.Request.URL.Path}
+	if users.Empty() {
+		err := users.CreateInitialAdmin(context.GetFormParameter("setupSecret"), name, password)
+		if err != nil {
+			record.Message = "Creating the initial admin account failed: " + err.Error()
+			audit(record)
+			return loginPage(context, err.Error())
+		}
+		record.Message = "Initial admin account created."
+		Log().Info("Created the initial admin account " + name + ".")
+	}
+	user, err := users.Authenticate(name, password)
+	if err != nil {
+		record.Message = "Login failed."
+		audit(record)
+		return loginPage(context, context.GetMessage("login.failed.message"))
+	}
+	record.Allowed = true
+	record.Role = user.Role
+	if record.Message == "" {
+		record.Message = "Logged in."
+	}
+	audit(record)
+	context.Session.Values[SESSION_USER] = user.Name
+	err = context.SaveSession(writer)
+	if err != nil {
+		return loginPage(context, err.Error())
+	}
+	return webapp.RedirectResponse(http.StatusSeeOther, redirectTarget(context.GetFormParameter("next")))
+}
+
+func LogoutAction(context *webapp.RequestContext, writer http.ResponseWriter) *webapp.ActionResponse {
+	delete(context.Session.Values, SESSION_USER)
+	context.Session.Options.MaxAge = -1
+	context.SaveSession(writer)
+	return webapp.RedirectResponse(http.StatusSeeOther, "/login")
+}
+
+// Only local paths are accepted as redirect targets after the login.
+func redirectTarget(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
@@ -0,0 +1,42 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"github.com/winkube/webapp"
+	"os"
+	"strings"
+)
+
+// Environment variable containing the origins allowed to call the monitor API from a browser,
+// separated by commas.
+const WINKUBE_CORS_ORIGINS_ENV = "WINKUBE_CORS_ORIGINS"
+
+// The request metrics of all web applications.
+var requestMetrics = webapp.CreateRequestMetrics()
+
+// Adds the middlewares used by all web applications: request logging and metrics.
+func instrumentWebApp(app *webapp.WebApplication) {
+	app.UseMiddleware(webapp.Logging())
+	app.UseMiddleware(webapp.Metrics(app.Name, requestMetrics))
+}
+
+// Allows browser calls from the configured origins, if any.
+func useConfiguredCORS(app *webapp.WebApplication) {
+	origins := os.Getenv(WINKUBE_CORS_ORIGINS_ENV)
+	if origins != "" {
+		app.UseMiddleware(webapp.CORS(strings.Split(origins, ",")...))
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// The files templates, translations and static files are read from, the working directory unless
+// the files embedded into the binary are used.
+var assets fs.FS = os.DirFS(".")
+
+// Reads templates, translations and static files from the files given. Files in the override
+// directory, if not empty, take precedence, so single files can be customized.
+func UseAssets(files fs.FS, overrideDir string) {
+	if overrideDir == "" {
+		assets = files
+		return
+	}
+	assets = overlayFS{override: os.DirFS(overrideDir), base: files}
+}
+
+// The files templates, translations and static files are read from.
+func Assets() fs.FS {
+	return assets
+}
+
+// Reads the asset with the slash separated path given, e.g. templates/index.html.
+func ReadAsset(name string) ([]byte, error) {
+	return fs.ReadFile(assets, name)
+}
+
+// Opens files from the override file system, if present, and from the base file system otherwise.
+type overlayFS struct {
+	override fs.FS
+	base     fs.FS
+}
+
+func (this overlayFS) Open(name string) (fs.File, error) {
+	file, err := this.override.Open(name)
+	if err == nil {
+		return file, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return this.base.Open(name)
+}
@@ -16,7 +16,6 @@ package util
 
 import (
 	log "github.com/sirupsen/logrus"
-	"io/ioutil"
 	"strings"
 	"text/template"
 )
@@ -51,7 +50,7 @@ func (tm TemplateManager) InitTemplates(templates map[string]string) {
 }
 
 func (tm TemplateManager) readTemplate(name string, file string) *template.Template {
-	dat, err := ioutil.ReadFile(file)
+	dat, err := ReadAsset(file)
 	if err != nil {
 		log.Error("Error reading template(" + file + "): " + err.Error())
 		return nil
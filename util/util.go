@@ -17,15 +17,19 @@ package util
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"strings"
+	"sync"
 )
 
 type EnumType interface {
@@ -86,6 +90,32 @@ func Keys(mymap map[interface{}]interface{}) []interface{} {
 	return keys
 }
 
+// Writes the file with the data given atomically: the data is written to a temporary file in the
+// same directory and synced, before the temporary file replaces the file. Readers see either the
+// previous or the new content, never a partially written file.
+func WriteFileAtomic(name string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
 // Exists reports whether the named file or directory exists.
 func FileExists(name string) bool {
 	if _, err := os.Stat(name); err != nil {
@@ -100,14 +130,80 @@ func FileExists(name string) bool {
  * Runs an OS command.
  */
 func RunCommand(description string, command string, args ...string) (*exec.Cmd, io.ReadCloser, error) {
-	fmt.Printf(description)
+	return RunCommandContext(context.Background(), description, command, args...)
+}
+
+/**
+ * Runs an OS command, which is killed including all its child processes when the context is done.
+ * The command is waited for, once its output has been read to the end.
+ */
+func RunCommandContext(ctx context.Context, description string, command string, args ...string) (*exec.Cmd, io.ReadCloser, error) {
+	fmt.Print(description)
 	cmd := exec.Command(command, args[:]...)
+	prepareProcessGroup(cmd)
 	cmdReader, err := cmd.StdoutPipe()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error creating StdoutPipe for Cmd: "+command, err)
 	}
 	err = cmd.Start()
-	return cmd, cmdReader, err
+	if err != nil {
+		return cmd, cmdReader, err
+	}
+	output := &commandOutput{ReadCloser: cmdReader, cmd: cmd, done: make(chan bool)}
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-output.done:
+		}
+	}()
+	return cmd, output, nil
+}
+
+// The output of a command, the command is waited for at the end of its output. So its process is
+// released, and not killed after it has exited.
+type commandOutput struct {
+	io.ReadCloser
+	cmd  *exec.Cmd
+	done chan bool
+	once sync.Once
+}
+
+func (this *commandOutput) Read(data []byte) (int, error) {
+	n, err := this.ReadCloser.Read(data)
+	if err != nil {
+		this.once.Do(func() {
+			this.cmd.Wait()
+			close(this.done)
+		})
+	}
+	return n, err
+}
+
+/**
+ * Runs an OS command and waits for it, returning its standard and error output separately. The
+ * command is killed including all its child processes when the context is done.
+ */
+func RunCommandOutput(ctx context.Context, command string, args ...string) (stdout []byte, stderr []byte, err error) {
+	cmd := exec.Command(command, args[:]...)
+	prepareProcessGroup(cmd)
+	var outBuffer, errBuffer bytes.Buffer
+	cmd.Stdout = &outBuffer
+	cmd.Stderr = &errBuffer
+	if err = cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-done:
+		}
+	}()
+	err = cmd.Wait()
+	return outBuffer.Bytes(), errBuffer.Bytes(), err
 }
 
 func FollowCommandWait(cmdReader io.ReadCloser, print bool) []byte {
@@ -208,7 +304,7 @@ func ReadProperties(filename string) (Properties, error) {
 func ParseURL(urlString string) *url.URL {
 	urlParsed, err := url.ParseRequestURI(urlString)
 	if err != nil {
-		fmt.Println("Failed to parse URL from  %v, error: %v", urlString, err)
+		fmt.Printf("Failed to parse URL from  %v, error: %v\n", urlString, err)
 	}
 	return urlParsed
 }
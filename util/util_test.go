@@ -0,0 +1,39 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"context"
+	"gopkg.in/go-playground/assert.v1"
+	"io/ioutil"
+	"runtime"
+	"testing"
+)
+
+func TestRunCommandContext_WaitsForTheCommandAtTheEndOfItsOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires sh")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cmd, output, err := RunCommandContext(ctx, "", "sh", "-c", "echo done")
+	assert.Equal(t, nil, err)
+	data, err := ioutil.ReadAll(output)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "done\n", string(data))
+	// waited for, so cancelling the context later on does not kill another process
+	assert.Equal(t, true, cmd.ProcessState != nil && cmd.ProcessState.Success())
+	<-output.(*commandOutput).done
+}
@@ -26,24 +26,48 @@ import (
 	"github.com/winkube/util"
 	"golang.org/x/text/language"
 	"net/http"
-	"net/url"
 	"strings"
+	"time"
 )
 
+// A filter is called for each request before its action is executed. Returning false stops the
+// request processing, the filter is then responsible for writing the response.
+type Filter func(req *RequestContext, writer http.ResponseWriter) bool
+
 type WebApplication struct {
 	Name            string
 	templateManager *util.TemplateManager
 	Pages           map[string]*Page
 	AuthAction      func(req *RequestContext, writer http.ResponseWriter) bool
-	GetActions      map[string]*func(req *RequestContext, writer http.ResponseWriter) *ActionResponse
-	PostActions     map[string]*func(req *RequestContext, writer http.ResponseWriter) *ActionResponse
-	PutActions      map[string]*func(req *RequestContext, writer http.ResponseWriter) *ActionResponse
-	DeleteActions   map[string]*func(req *RequestContext, writer http.ResponseWriter) *ActionResponse
-	sessionStore    *sessions.CookieStore
-	Translations    *Translations
-	rootContext     string
+	Filters         []Filter
+	Middlewares     []Middleware
+	// Errors are written as JSON problem documents instead of error pages.
+	JSONErrors    bool
+	GetActions    map[string]*func(req *RequestContext, writer http.ResponseWriter) *ActionResponse
+	PostActions   map[string]*func(req *RequestContext, writer http.ResponseWriter) *ActionResponse
+	PutActions    map[string]*func(req *RequestContext, writer http.ResponseWriter) *ActionResponse
+	DeleteActions map[string]*func(req *RequestContext, writer http.ResponseWriter) *ActionResponse
+	// The roles required by the actions, keyed by method and action name, e.g. "POST /cancel".
+	Roles map[string]string
+	// The role required by actions and pages without an explicit role.
+	DefaultRole  string
+	sessionStore sessions.Store
+	sessionName  string
+	// Requests for which no CSRF token is required, e.g. API calls not authenticated by a session.
+	CSRFExempt func(req *http.Request) bool
+	// The maximal size of request bodies in bytes, 0 means unlimited.
+	MaxBodySize int64
+	// The timeouts of the actions, keyed by method and action name like the roles.
+	Timeouts map[string]time.Duration
+	// The timeout of actions without an explicit timeout, 0 means no timeout.
+	DefaultTimeout time.Duration
+	Translations   *Translations
+	rootContext    string
 }
 
+// The default maximal size of request bodies.
+const DEFAULT_MAX_BODY_SIZE = 1 << 20
+
 func CreateWebApp(name string, rootContext string, defaulLanguage language.Tag) *WebApplication {
 	app := WebApplication{
 		Name:            name,
@@ -53,8 +77,11 @@ func CreateWebApp(name string, rootContext string, defaulLanguage language.Tag)
 		PostActions:     make(map[string]*func(req *RequestContext, writer http.ResponseWriter) *ActionResponse),
 		PutActions:      make(map[string]*func(req *RequestContext, writer http.ResponseWriter) *ActionResponse),
 		DeleteActions:   make(map[string]*func(req *RequestContext, writer http.ResponseWriter) *ActionResponse),
+		Roles:           make(map[string]string),
+		Timeouts:        make(map[string]time.Duration),
+		MaxBodySize:     DEFAULT_MAX_BODY_SIZE,
 		rootContext:     rootContext,
-		sessionStore:    sessions.NewCookieStore([]byte("WinKubeIsSoCool")),
+		sessionName:     "app-" + name,
 		Translations:    CreateTranslations(defaulLanguage),
 	}
 	app.AddPage(&Page{
@@ -62,19 +89,73 @@ func CreateWebApp(name string, rootContext string, defaulLanguage language.Tag)
 		Template:    "templates/_redirect.html",
 		Name:        "_redirect",
 	})
-	app.sessionStore.Options = &sessions.Options{
-		Path:     "/",
-		MaxAge:   1000 * 50 * 30, // 30 minutes
-		HttpOnly: true,
-	}
+	app.AddPage(&Page{
+		application: app,
+		Template:    "templates/_error.html",
+		Name:        "_error",
+	})
 	return &app
 }
 
+// Sets the store and the name of the sessions, applications sharing the store and name share their
+// sessions. Without a store no sessions are available.
+func (app *WebApplication) UseSessions(store sessions.Store, name string) *WebApplication {
+	app.sessionStore = store
+	app.sessionName = name
+	return app
+}
+
+// Registers the role required to call the action with the given method and name, an empty role
+// makes the action public.
+func (app *WebApplication) RequireRole(method string, name string, role string) *WebApplication {
+	app.Roles[strings.ToUpper(method)+" "+name] = role
+	return app
+}
+
+// The role required for the request given.
+func (app *WebApplication) RequiredRole(req *http.Request) string {
+	role, found := app.Roles[strings.ToUpper(req.Method)+" "+app.actionName(req)]
+	if found {
+		return role
+	}
+	return app.DefaultRole
+}
+
+// Sets the timeout of the action with the given method and name. The client receives a 503 response
+// when the action takes longer, so the action should stop when the request's context is done.
+func (app *WebApplication) SetTimeout(method string, name string, timeout time.Duration) *WebApplication {
+	app.Timeouts[strings.ToUpper(method)+" "+name] = timeout
+	return app
+}
+
+// The timeout for the request given.
+func (app *WebApplication) Timeout(req *http.Request) time.Duration {
+	timeout, found := app.Timeouts[strings.ToUpper(req.Method)+" "+app.actionName(req)]
+	if found {
+		return timeout
+	}
+	return app.DefaultTimeout
+}
+
 func (app *WebApplication) LoadTranslations(lang language.Tag) *WebApplication {
 	app.Translations.load(lang)
 	return app
 }
 
+// Adds a filter applied to all requests of this application, filters are called in the order added
+// after the AuthAction.
+func (app *WebApplication) Use(filter Filter) *WebApplication {
+	app.Filters = append(app.Filters, filter)
+	return app
+}
+
+// Adds a middleware wrapping all requests of this application, middlewares are called in the order
+// added.
+func (app *WebApplication) UseMiddleware(middleware Middleware) *WebApplication {
+	app.Middlewares = append(app.Middlewares, middleware)
+	return app
+}
+
 func (app *WebApplication) GetAction(name string, action func(req *RequestContext, writer http.ResponseWriter) *ActionResponse) *WebApplication {
 	app.GetActions[name] = &action
 	return app
@@ -92,27 +173,55 @@ func (app *WebApplication) DeleteAction(name string, action func(req *RequestCon
 	return app
 }
 
+// Handles a request, passing it through the recovery, the middlewares, the AuthAction and the
+// filters to the action.
 func (app *WebApplication) HandleRequest(writer http.ResponseWriter, req *http.Request) {
+	// recovered inside the middlewares too, so they see the 500 responses of failed actions
+	handler := app.recovery(http.HandlerFunc(app.handleLimitedRequest))
+	for i := len(app.Middlewares) - 1; i >= 0; i-- {
+		handler = app.Middlewares[i](handler)
+	}
+	app.recovery(handler).ServeHTTP(writer, req)
+}
+
+func (app *WebApplication) handleLimitedRequest(writer http.ResponseWriter, req *http.Request) {
+	if app.MaxBodySize > 0 && req.Body != nil {
+		req.Body = http.MaxBytesReader(writer, req.Body, app.MaxBodySize)
+	}
+	if timeout := app.Timeout(req); timeout > 0 {
+		http.TimeoutHandler(http.HandlerFunc(app.handleRequest), timeout, "Request timed out.").ServeHTTP(writer, req)
+		return
+	}
+	app.handleRequest(writer, req)
+}
+
+func (app *WebApplication) handleRequest(writer http.ResponseWriter, req *http.Request) {
 	// TODO Get language
 	langs := app.GetLanguages(req)
 	var language language.Tag = langs[0]
 	// get action...
-	// Get a session. Get() always returns a session, even if empty.
-	//session, err := app.sessionStore.Get(req, "app-"+app.Name)
-	//if err != nil {
-	//	http.Error(writer, err.Error(), http.StatusInternalServerError)
-	//	return
-	//}
-	// Save session at end
-	//defer session.Save(req, writer)
+	var session *sessions.Session
+	if app.sessionStore != nil {
+		// Get() always returns a session, an invalid or expired cookie results in a new session.
+		session, _ = app.sessionStore.Get(req, app.sessionName)
+	}
 	var renderModel *RenderModel = &RenderModel{
 		Messages: app.Translations.Properties(language),
 	}
+	match := app.matchAction(req)
 	renderModel.Context = &RequestContext{
 		Application: app,
 		Request:     req,
-		//Session:     session,
-		Language: language,
+		Attributes:  make(map[string]interface{}),
+		PathParams:  make(map[string]string),
+		Session:     session,
+		Language:    language,
+	}
+	if match != nil {
+		renderModel.Context.PathParams = match.params
+	}
+	if session != nil {
+		renderModel.CSRFToken = renderModel.Context.CSRFToken()
 	}
 
 	var actionResponse *ActionResponse
@@ -122,29 +231,69 @@ func (app *WebApplication) HandleRequest(writer http.ResponseWriter, req *http.R
 			return
 		}
 	}
-	var action = app.findAction(req)
-	if action != nil {
-		actionResponse = (*action)(renderModel.Context, writer)
+	for _, filter := range app.Filters {
+		if !filter(renderModel.Context, writer) {
+			return
+		}
+	}
+	if app.requiresCSRFToken(req) && !renderModel.Context.verifyCSRFToken() {
+		app.writeError(writer, req, Problem{Status: http.StatusForbidden, Detail: "Invalid or missing CSRF token."})
+		return
+	}
+	if match == nil {
+		if allowed := app.allowedMethods(req); len(allowed) > 0 {
+			writer.Header().Set("Allow", strings.Join(allowed, ", "))
+			app.writeError(writer, req, Problem{Status: http.StatusMethodNotAllowed})
+		} else {
+			app.writeError(writer, req, Problem{Status: http.StatusNotFound})
+		}
+		return
 	}
+	actionResponse = (*match.action)(renderModel.Context, writer)
 	if actionResponse == nil || actionResponse.Complete {
 		return
 	}
+	if actionResponse.Error != nil {
+		app.writeError(writer, req, *actionResponse.Error)
+		return
+	}
+	if session != nil && len(session.Values) > 0 {
+		// saving before the response is written also renews the session's expiry
+		err := renderModel.Context.SaveSession(writer)
+		if err != nil {
+			logrus.Error("Cannot save session: " + err.Error())
+		}
+	}
+	if app.writeResponse(writer, req, actionResponse) {
+		return
+	}
 	if actionResponse.NextPage != "" {
 		nextPage, found := app.Pages[actionResponse.NextPage]
 		if !found {
-			panic("Invalid page: " + actionResponse.NextPage)
+			app.writeError(writer, req, Problem{Detail: "Invalid page: " + actionResponse.NextPage})
+			return
 		}
 		renderModel.Page = nextPage
 	}
 	renderModel.Data = actionResponse.Model
-	// no action, try to find page...
+	// no page returned by the action, try to find the page requested...
 	if renderModel.Page == nil {
 		renderModel.Page = app.findPage(req)
 	}
+	status := actionResponse.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	// tools accepting JSON only get the model instead of the page
+	if renderModel.Data != nil && Negotiate(req, CONTENT_TYPE_HTML, CONTENT_TYPE_JSON) == CONTENT_TYPE_JSON {
+		app.writeBody(writer, req, status, CONTENT_TYPE_JSON, renderModel.Data)
+		return
+	}
 	if renderModel.Page != nil {
 		renderedPage := renderModel.Page.render(renderModel)
-		buf := bytes.NewBufferString(renderedPage)
-		writer.Write(buf.Bytes())
+		writer.Header().Set("Content-Type", CONTENT_TYPE_HTML)
+		writer.WriteHeader(status)
+		writer.Write(bytes.NewBufferString(renderedPage).Bytes())
 	}
 }
 
@@ -159,7 +308,7 @@ func (app *WebApplication) GetLanguages(req *http.Request) []language.Tag {
 		langs := strings.Split(v, ";")
 		tag, err := language.Parse(langs[0])
 		if err != nil {
-			logrus.Warn("Inpuarseable language tag in Accept-Language header or %s: %s", req, err)
+			logrus.Warnf("Inpuarseable language tag in Accept-Language header or %v: %s", req, err)
 		} else {
 			result = append(result, tag)
 		}
@@ -182,78 +331,39 @@ func (app *WebApplication) AddPage(page *Page) *WebApplication {
 	return app
 }
 
-func (app *WebApplication) findAction(req *http.Request) *func(req *RequestContext, writer http.ResponseWriter) *ActionResponse {
-	uri, _ := url.ParseRequestURI(req.RequestURI)
-	var action *func(req *RequestContext, writer http.ResponseWriter) *ActionResponse
-	actionName, found := uri.Query()["action"]
-	method := req.Method
-	if found {
-		action = app.lookupAction(method, actionName[0])
-	}
-	path := uri.Path
+// The path of the request relative to the root context.
+func (app *WebApplication) actionPath(req *http.Request) string {
+	path := req.URL.Path
 	if strings.Index(path, app.rootContext) == 0 {
 		path = strings.TrimPrefix(path, app.rootContext)
 	}
 	if !(strings.Index(path, "/") == 0) {
 		path = "/" + path
 	}
-	action = app.lookupAction(method, path)
-	if action == nil {
-		// check subsplits
-		parts := strings.SplitN(path, "/", 1)
-		for len(parts) > 1 {
-			action = app.lookupAction(method, parts[1])
-			if action != nil {
-				return action
-			}
-			parts = strings.SplitN(parts[1], "/", 1)
-		}
+	return path
+}
+
+// The name of the action of the request, which is the pattern matched, or the request's path if
+// no action matches.
+func (app *WebApplication) actionName(req *http.Request) string {
+	if match := app.matchAction(req); match != nil {
+		return match.name
 	}
-	return action
+	return app.actionPath(req)
 }
 
 func (app *WebApplication) lookupAction(method string, actionName string) *func(req *RequestContext, writer http.ResponseWriter) *ActionResponse {
-	switch strings.ToUpper(method) {
-	case "PUT":
-		return app.PutActions[actionName]
-	case "POST":
-		return app.PostActions[actionName]
-	case "DELETE":
-		return app.DeleteActions[actionName]
-	case "GET":
-		fallthrough
-	default:
-		return app.GetActions[actionName]
-	}
+	return app.actions(method)[actionName]
 }
 
+// Finds the page requested by the query parameter page, or by the path.
 func (app *WebApplication) findPage(req *http.Request) *Page {
-	uri, _ := url.ParseRequestURI(req.RequestURI)
-	var page *Page
-	pageName, found := uri.Query()["page"]
-	if found {
-		page = app.Pages[pageName[0]]
-	}
-	path := uri.Path
-	if strings.Index(path, app.rootContext) == 0 {
-		path = strings.TrimPrefix(path, app.rootContext)
-	}
-	if !(strings.Index(path, "/") == 0) {
-		path = "/" + path
-	}
-	page = app.Pages[path]
-	if page == nil {
-		// check subsplits
-		parts := strings.SplitN(path, "/", 1)
-		for len(parts) > 1 {
-			page = app.Pages[parts[1]]
-			if page != nil {
-				return page
-			}
-			parts = strings.SplitN(parts[1], "/", 1)
+	if names, found := req.URL.Query()["page"]; found {
+		if page := app.Pages[names[0]]; page != nil {
+			return page
 		}
 	}
-	return page
+	return app.Pages[app.actionPath(req)]
 }
 
 func (app *WebApplication) ExecuteTemplate(template string, model *RenderModel) string {
@@ -264,8 +374,15 @@ type RequestContext struct {
 	Application *WebApplication
 	Request     *http.Request
 	Attributes  map[string]interface{}
-	Session     *sessions.Session
-	Language    language.Tag
+	// The values of the parameters of the action's path pattern.
+	PathParams map[string]string
+	Session    *sessions.Session
+	Language   language.Tag
+}
+
+// Returns the value of a parameter of the action's path pattern, e.g. id for /cluster/node/{id}.
+func (this RequestContext) PathParam(name string) string {
+	return this.PathParams[name]
 }
 
 func (this RequestContext) GetHeaderParameter(key string) string {
@@ -325,11 +442,7 @@ func (this RequestContext) GetQueryParameter(key string) string {
 }
 
 func (this RequestContext) GetQueryParameterWithDefault(key string, defaultValue string) string {
-	uri, err := url.ParseRequestURI(this.Request.RequestURI)
-	if err != nil {
-		panic("Cannot read request URI: " + this.Request.RequestURI + ", err: " + err.Error())
-	}
-	params, found := uri.Query()[key]
+	params, found := this.Request.URL.Query()[key]
 	if found {
 		return params[0]
 	}
@@ -344,7 +457,7 @@ func (this RequestContext) GetSessionAttributeWithDefault(key string, defaultVal
 	if this.Session != nil {
 		v, found := this.Session.Values[key]
 		if found {
-			return v.(string)
+			return v
 		}
 	}
 	return defaultValue
@@ -359,6 +472,14 @@ func (this RequestContext) SetSessionAttribute(key string, value interface{}) in
 	return nil
 }
 
+// Saves the session, must be called before the response is written.
+func (this RequestContext) SaveSession(writer http.ResponseWriter) error {
+	if this.Session == nil {
+		return nil
+	}
+	return this.Session.Save(this.Request, writer)
+}
+
 func (this RequestContext) getRequestAttribute(key string) interface{} {
 	return this.getRequestAttributeWithDefault(key, nil)
 }
@@ -0,0 +1,80 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webapp
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"net/http"
+)
+
+// The form field containing the CSRF token, pages add it as hidden input to their forms.
+const CSRF_FIELD = "_csrf"
+
+// The header containing the CSRF token, used by scripts instead of the form field.
+const CSRF_HEADER = "X-CSRF-Token"
+
+// The session attribute keeping the CSRF token of a session.
+const csrfSessionAttribute = "_csrf"
+
+// Returns the CSRF token of the session, a new token is created on first use. Without a session no
+// token is available.
+func (this RequestContext) CSRFToken() string {
+	if this.Session == nil {
+		return ""
+	}
+	token, _ := this.Session.Values[csrfSessionAttribute].(string)
+	if token == "" {
+		data := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, data); err != nil {
+			panic("Cannot create CSRF token: " + err.Error())
+		}
+		token = base64.RawURLEncoding.EncodeToString(data)
+		this.Session.Values[csrfSessionAttribute] = token
+	}
+	return token
+}
+
+// Checks if the request needs a CSRF token: requests changing state of applications with sessions
+// need a token, unless exempted by the application.
+func (app *WebApplication) requiresCSRFToken(req *http.Request) bool {
+	if app.sessionStore == nil {
+		return false
+	}
+	switch req.Method {
+	case http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch:
+	default:
+		return false
+	}
+	return app.CSRFExempt == nil || !app.CSRFExempt(req)
+}
+
+// Verifies the token of the request against the token of its session.
+func (this RequestContext) verifyCSRFToken() bool {
+	if this.Session == nil {
+		return false
+	}
+	expected, _ := this.Session.Values[csrfSessionAttribute].(string)
+	if expected == "" {
+		return false
+	}
+	token := this.Request.Header.Get(CSRF_HEADER)
+	if token == "" {
+		token = this.Request.PostFormValue(CSRF_FIELD)
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
@@ -0,0 +1,78 @@
+package webapp
+
+import (
+	"github.com/gorilla/sessions"
+	"golang.org/x/text/language"
+	"gopkg.in/go-playground/assert.v1"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The translations are loaded relative to the project root.
+func TestMain(m *testing.M) {
+	if err := os.Chdir(".."); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestWebApplication_RequiresCSRFTokenForPosts(t *testing.T) {
+	app := CreateWebApp("test", "/", language.English)
+	app.UseSessions(sessions.NewCookieStore([]byte("test-key-test-key-test-key-12345")), "test")
+	var token string
+	app.GetAction("/form", func(context *RequestContext, writer http.ResponseWriter) *ActionResponse {
+		token = context.CSRFToken()
+		context.SaveSession(writer)
+		return nil
+	})
+	app.PostAction("/submit", func(context *RequestContext, writer http.ResponseWriter) *ActionResponse {
+		writer.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+	recorder := httptest.NewRecorder()
+	app.HandleRequest(recorder, httptest.NewRequest(http.MethodGet, "/form", nil))
+	cookie := recorder.Result().Cookies()[0]
+
+	post := func(form url.Values) int {
+		req := httptest.NewRequest(http.MethodPost, "/submit", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		recorder := httptest.NewRecorder()
+		app.HandleRequest(recorder, req)
+		return recorder.Code
+	}
+	assert.Equal(t, http.StatusForbidden, post(url.Values{}))
+	assert.Equal(t, http.StatusForbidden, post(url.Values{CSRF_FIELD: {"invalid"}}))
+	assert.Equal(t, http.StatusNoContent, post(url.Values{CSRF_FIELD: {token}}))
+}
+
+func TestWebApplication_LimitsBodiesAndTime(t *testing.T) {
+	app := CreateWebApp("test", "/", language.English)
+	app.MaxBodySize = 10
+	app.PostAction("/body", func(context *RequestContext, writer http.ResponseWriter) *ActionResponse {
+		if err := context.Request.ParseForm(); err != nil {
+			writer.WriteHeader(http.StatusRequestEntityTooLarge)
+		}
+		return nil
+	})
+	app.GetAction("/slow", func(context *RequestContext, writer http.ResponseWriter) *ActionResponse {
+		<-context.Request.Context().Done()
+		return nil
+	})
+	app.SetTimeout("GET", "/slow", 10*time.Millisecond)
+
+	req := httptest.NewRequest(http.MethodPost, "/body", strings.NewReader("value=0123456789"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	app.HandleRequest(recorder, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	app.HandleRequest(recorder, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+}
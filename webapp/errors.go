@@ -0,0 +1,97 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webapp
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+)
+
+// The header carrying the correlation id of an error, which is also logged.
+const CORRELATION_ID_HEADER = "X-Correlation-Id"
+
+// A problem document as defined by RFC 7807, the JSON representation of errors.
+type Problem struct {
+	Type          string `json:"type"`
+	Title         string `json:"title"`
+	Status        int    `json:"status"`
+	Detail        string `json:"detail,omitempty"`
+	Instance      string `json:"instance,omitempty"`
+	CorrelationId string `json:"correlationId"`
+}
+
+func (this Problem) Error() string {
+	if this.Detail == "" {
+		return this.Title
+	}
+	return this.Title + ": " + this.Detail
+}
+
+// Creates a response rendering an error page, or a problem document, with the status given.
+func ErrorResponse(status int, detail string) *ActionResponse {
+	return &ActionResponse{
+		Error: &Problem{
+			Type:   "about:blank",
+			Title:  http.StatusText(status),
+			Status: status,
+			Detail: detail,
+		},
+	}
+}
+
+// Writes the problem given as error page, or as problem document, if the application prefers
+// JSON or the client accepts JSON only. A correlation id is added, if missing.
+func (app *WebApplication) writeError(writer http.ResponseWriter, req *http.Request, problem Problem) {
+	if problem.CorrelationId == "" {
+		problem.CorrelationId = uuid.New().String()
+	}
+	if problem.Status == 0 {
+		problem.Status = http.StatusInternalServerError
+	}
+	if problem.Title == "" {
+		problem.Title = http.StatusText(problem.Status)
+	}
+	if problem.Type == "" {
+		problem.Type = "about:blank"
+	}
+	problem.Instance = req.URL.Path
+	message := app.Name + ": " + req.Method + " " + req.URL.Path + " failed with " + strconv.Itoa(problem.Status) +
+		" (correlation id " + problem.CorrelationId + "): " + problem.Error()
+	if problem.Status >= 500 {
+		logrus.Error(message)
+	} else {
+		logrus.Debug(message)
+	}
+	writer.Header().Set(CORRELATION_ID_HEADER, problem.CorrelationId)
+	if app.JSONErrors || Negotiate(req, CONTENT_TYPE_HTML, CONTENT_TYPE_JSON) == CONTENT_TYPE_JSON {
+		data, _ := json.MarshalIndent(problem, "", "  ")
+		writer.Header().Set("Content-Type", "application/problem+json")
+		writer.WriteHeader(problem.Status)
+		writer.Write(data)
+		return
+	}
+	writer.Header().Set("Content-Type", CONTENT_TYPE_HTML)
+	writer.WriteHeader(problem.Status)
+	page := app.Pages["_error"]
+	rendered := page.render(&RenderModel{
+		Messages: app.Translations.Properties(app.GetLanguages(req)[0]),
+		Data:     problem,
+	})
+	writer.Write(bytes.NewBufferString(rendered).Bytes())
+}
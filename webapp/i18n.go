@@ -17,6 +17,7 @@ package webapp
 import (
 	properties "github.com/magiconair/properties"
 	"github.com/sirupsen/logrus"
+	"github.com/winkube/util"
 	"golang.org/x/text/language"
 )
 
@@ -33,7 +34,7 @@ func CreateTranslations(defaultLanguage language.Tag, languages ...language.Tag)
 	t.load(defaultLanguage)
 	// Only write log, no panic for non default languages!
 	properties.ErrorHandler = func(err error) {
-		logrus.Error("Error loading language translations: %s", err.Error())
+		logrus.Errorf("Error loading language translations: %s", err.Error())
 	}
 	for _, lang := range languages {
 		t.load(lang)
@@ -44,12 +45,16 @@ func CreateTranslations(defaultLanguage language.Tag, languages ...language.Tag)
 func (this Translations) load(lang language.Tag) {
 	_, exists := this.properties[lang]
 	if !exists {
-		p, err := properties.LoadFile("i18n/translations-"+lang.String()+".properties", properties.UTF8)
+		data, err := util.ReadAsset("i18n/translations-" + lang.String() + ".properties")
+		var p *properties.Properties
+		if err == nil {
+			p, err = properties.Load(data, properties.UTF8)
+		}
 		if err == nil {
 			this.properties[lang] = p
 			return
 		}
-		logrus.Error("Error loading language translations for %s: %s", lang.String(), err.Error())
+		logrus.Errorf("Error loading language translations for %s: %s", lang.String(), err.Error())
 	}
 }
 
@@ -0,0 +1,206 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webapp
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A middleware wraps the request handling of an application, e.g. to log or measure requests.
+// Middlewares are called in the order added, before the AuthAction, the filters and the action.
+type Middleware func(next http.Handler) http.Handler
+
+// Records the status written, so middlewares can evaluate it after the request.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (this *statusWriter) WriteHeader(status int) {
+	if this.status == 0 {
+		this.status = status
+	}
+	this.ResponseWriter.WriteHeader(status)
+}
+
+func (this *statusWriter) Write(data []byte) (int, error) {
+	if this.status == 0 {
+		this.status = http.StatusOK
+	}
+	return this.ResponseWriter.Write(data)
+}
+
+// Streaming responses require the writer to be flushable.
+func (this *statusWriter) Flush() {
+	if flusher, ok := this.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// The status written, 200 if nothing was written.
+func (this *statusWriter) Status() int {
+	if this.status == 0 {
+		return http.StatusOK
+	}
+	return this.status
+}
+
+func statusWriterOf(writer http.ResponseWriter) *statusWriter {
+	if sw, ok := writer.(*statusWriter); ok {
+		return sw
+	}
+	return &statusWriter{ResponseWriter: writer}
+}
+
+// Turns panics into 500 responses. The correlation id of the response is logged with the panic
+// and its stack, so the failure can be found from the response.
+func (app *WebApplication) recovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		sw := statusWriterOf(writer)
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				if recovered == http.ErrAbortHandler {
+					panic(recovered)
+				}
+				id := uuid.New().String()
+				logrus.Errorf("%v: panic handling %v %v (correlation id %v): %v\n%s", app.Name, req.Method,
+					req.URL.Path, id, recovered, debug.Stack())
+				if sw.status != 0 {
+					// the response has already been started
+					return
+				}
+				app.writeError(sw, req, Problem{
+					Status:        http.StatusInternalServerError,
+					Detail:        "An unexpected error occurred.",
+					CorrelationId: id,
+				})
+			}
+		}()
+		next.ServeHTTP(sw, req)
+	})
+}
+
+// Logs each request with its status and duration.
+func Logging() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			sw := statusWriterOf(writer)
+			next.ServeHTTP(sw, req)
+			logrus.Debugf("%v %v -> %v (%v)", req.Method, req.URL.Path, sw.Status(), time.Since(start))
+		})
+	}
+}
+
+// Counts the requests of the applications and their durations.
+type RequestMetrics struct {
+	mutex sync.Mutex
+	apps  map[string]*AppMetrics
+}
+
+// The metrics of an application.
+type AppMetrics struct {
+	Requests int64 `json:"requests"`
+	// Requests answered with 4xx
+	ClientErrors int64 `json:"clientErrors"`
+	// Requests answered with 5xx
+	ServerErrors  int64         `json:"serverErrors"`
+	TotalDuration time.Duration `json:"totalDuration"`
+	MaxDuration   time.Duration `json:"maxDuration"`
+}
+
+func CreateRequestMetrics() *RequestMetrics {
+	return &RequestMetrics{apps: make(map[string]*AppMetrics)}
+}
+
+// A copy of the metrics, keyed by application name.
+func (this *RequestMetrics) Snapshot() map[string]AppMetrics {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	result := make(map[string]AppMetrics)
+	for name, metrics := range this.apps {
+		result[name] = *metrics
+	}
+	return result
+}
+
+func (this *RequestMetrics) record(app string, status int, duration time.Duration) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	metrics := this.apps[app]
+	if metrics == nil {
+		metrics = &AppMetrics{}
+		this.apps[app] = metrics
+	}
+	metrics.Requests++
+	if status >= 500 {
+		metrics.ServerErrors++
+	} else if status >= 400 {
+		metrics.ClientErrors++
+	}
+	metrics.TotalDuration += duration
+	if duration > metrics.MaxDuration {
+		metrics.MaxDuration = duration
+	}
+}
+
+// Records the requests of the application given in the metrics given.
+func Metrics(app string, metrics *RequestMetrics) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			sw := statusWriterOf(writer)
+			defer func() {
+				metrics.record(app, sw.Status(), time.Since(start))
+			}()
+			next.ServeHTTP(sw, req)
+		})
+	}
+}
+
+// Allows cross origin requests from the origins given, "*" allows all origins. Preflight requests
+// are answered directly.
+func CORS(origins ...string) Middleware {
+	allowed := make(map[string]bool)
+	for _, origin := range origins {
+		allowed[strings.TrimSuffix(strings.TrimSpace(origin), "/")] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+			origin := req.Header.Get("Origin")
+			if origin == "" || !(allowed["*"] || allowed[origin]) {
+				next.ServeHTTP(writer, req)
+				return
+			}
+			writer.Header().Set("Access-Control-Allow-Origin", origin)
+			writer.Header().Add("Vary", "Origin")
+			if req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != "" {
+				writer.Header().Set("Access-Control-Allow-Methods", strings.Join(append(routeMethods, http.MethodOptions), ", "))
+				writer.Header().Set("Access-Control-Allow-Headers", fmt.Sprintf("Authorization, Content-Type, %v", CSRF_HEADER))
+				writer.Header().Set("Access-Control-Max-Age", "600")
+				writer.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(writer, req)
+		})
+	}
+}
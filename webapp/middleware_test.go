@@ -0,0 +1,62 @@
+package webapp
+
+import (
+	"encoding/json"
+	"golang.org/x/text/language"
+	"gopkg.in/go-playground/assert.v1"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebApplication_RecoversFromPanics(t *testing.T) {
+	app := CreateWebApp("test", "/api", language.English)
+	app.JSONErrors = true
+	metrics := CreateRequestMetrics()
+	app.UseMiddleware(Metrics(app.Name, metrics))
+	app.GetAction("/fail", func(context *RequestContext, writer http.ResponseWriter) *ActionResponse {
+		panic("failed")
+	})
+	recorder := httptest.NewRecorder()
+	app.HandleRequest(recorder, httptest.NewRequest("GET", "/api/fail", nil))
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Equal(t, "application/problem+json", recorder.Header().Get("Content-Type"))
+	problem := Problem{}
+	assert.Equal(t, nil, json.Unmarshal(recorder.Body.Bytes(), &problem))
+	assert.Equal(t, recorder.Header().Get(CORRELATION_ID_HEADER), problem.CorrelationId)
+	assert.NotEqual(t, "", problem.CorrelationId)
+	assert.Equal(t, int64(1), metrics.Snapshot()["test"].ServerErrors)
+}
+
+func TestWebApplication_ErrorResponse(t *testing.T) {
+	app := CreateWebApp("test", "/api", language.English)
+	app.GetAction("/missing", func(context *RequestContext, writer http.ResponseWriter) *ActionResponse {
+		return ErrorResponse(http.StatusNotFound, "No such thing.")
+	})
+	req := httptest.NewRequest("GET", "/api/missing", nil)
+	req.Header.Set("Accept", "text/html")
+	recorder := httptest.NewRecorder()
+	app.HandleRequest(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "text/html; charset=utf-8", recorder.Header().Get("Content-Type"))
+	assert.NotEqual(t, "", recorder.Header().Get(CORRELATION_ID_HEADER))
+}
+
+func TestCORS_AnswersPreflightRequests(t *testing.T) {
+	app := CreateWebApp("test", "/api", language.English)
+	app.UseMiddleware(CORS("https://console.example.com"))
+	req := httptest.NewRequest("OPTIONS", "/api/status", nil)
+	req.Header.Set("Origin", "https://console.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	recorder := httptest.NewRecorder()
+	app.HandleRequest(recorder, req)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, "https://console.example.com", recorder.Header().Get("Access-Control-Allow-Origin"))
+
+	req = httptest.NewRequest("OPTIONS", "/api/status", nil)
+	req.Header.Set("Origin", "https://other.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	recorder = httptest.NewRecorder()
+	app.HandleRequest(recorder, req)
+	assert.Equal(t, "", recorder.Header().Get("Access-Control-Allow-Origin"))
+}
@@ -34,6 +34,8 @@ type RenderModel struct {
 	Context  *RequestContext
 	Messages map[string]string
 	Data     interface{}
+	// The CSRF token forms must post in the CSRF_FIELD, empty without sessions.
+	CSRFToken string
 }
 
 func (page *Page) render(model *RenderModel) string {
@@ -47,4 +49,14 @@ type ActionResponse struct {
 	Forward  string
 	Model    interface{}
 	Complete bool
+	// An error rendered as error page or problem document, see ErrorResponse.
+	Error *Problem
+	// The status written, 200 if not set.
+	Status int
+	// The content type of the body.
+	ContentType string
+	// The body written instead of a page: a byte slice, a string or a value serialized as JSON.
+	Body interface{}
+	// The location to redirect to.
+	Redirect string
 }
@@ -0,0 +1,196 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webapp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	CONTENT_TYPE_HTML = "text/html; charset=utf-8"
+	CONTENT_TYPE_JSON = "application/json"
+	CONTENT_TYPE_TEXT = "text/plain; charset=utf-8"
+)
+
+// Creates a response writing the value given as JSON.
+func JsonResponse(status int, value interface{}) *ActionResponse {
+	return &ActionResponse{Status: status, ContentType: CONTENT_TYPE_JSON, Body: value}
+}
+
+// Creates a response writing the text given as plain text.
+func TextResponse(status int, text string) *ActionResponse {
+	return &ActionResponse{Status: status, ContentType: CONTENT_TYPE_TEXT, Body: text}
+}
+
+// Creates a response writing the data given with the content type given.
+func ContentResponse(status int, contentType string, data []byte) *ActionResponse {
+	return &ActionResponse{Status: status, ContentType: contentType, Body: data}
+}
+
+// Creates a response redirecting to the location given, using 303 See Other if the status is 0.
+func RedirectResponse(status int, location string) *ActionResponse {
+	return &ActionResponse{Status: status, Redirect: location}
+}
+
+// Creates a response having the status given only.
+func StatusResponse(status int) *ActionResponse {
+	return &ActionResponse{Status: status}
+}
+
+// Writes a response outside of an action, e.g. from a filter.
+func (this *RequestContext) WriteResponse(writer http.ResponseWriter, response *ActionResponse) {
+	if response.Error != nil {
+		this.Application.writeError(writer, this.Request, *response.Error)
+		return
+	}
+	this.Application.writeResponse(writer, this.Request, response)
+}
+
+// Writes the redirect, body or status of a response. Returns false for responses rendering a page.
+func (app *WebApplication) writeResponse(writer http.ResponseWriter, req *http.Request, response *ActionResponse) bool {
+	status := response.Status
+	if response.Redirect != "" {
+		if status == 0 {
+			status = http.StatusSeeOther
+		}
+		http.Redirect(writer, req, response.Redirect, status)
+		return true
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if response.Body != nil {
+		app.writeBody(writer, req, status, response.ContentType, response.Body)
+		return true
+	}
+	if response.Status != 0 && response.NextPage == "" && response.Model == nil {
+		writer.WriteHeader(status)
+		return true
+	}
+	return false
+}
+
+// Writes a body. Byte slices are written as they are, other values are serialized as JSON for JSON
+// content types, or must be strings. The headers are written before the body.
+func (app *WebApplication) writeBody(writer http.ResponseWriter, req *http.Request, status int, contentType string, body interface{}) {
+	isJson := strings.Contains(contentType, "json")
+	var data []byte
+	if raw, ok := body.([]byte); ok {
+		data = raw
+	} else if text, ok := body.(string); ok && !isJson {
+		data = []byte(text)
+	} else if isJson {
+		var err error
+		data, err = json.MarshalIndent(body, "", "  ")
+		if err != nil {
+			app.writeError(writer, req, Problem{Detail: "Failed to serialize response: " + err.Error()})
+			return
+		}
+	} else {
+		app.writeError(writer, req, Problem{Detail: fmt.Sprintf("Cannot write %T as %v.", body, contentType)})
+		return
+	}
+	if contentType != "" {
+		writer.Header().Set("Content-Type", contentType)
+	}
+	writer.WriteHeader(status)
+	writer.Write(data)
+}
+
+// Selects the content type offered, which is most acceptable to the client by its Accept header.
+// Returns the first offer if the client accepts anything, and an empty string if no offer is
+// acceptable.
+func Negotiate(req *http.Request, offers ...string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	accept := req.Header.Get("Accept")
+	if accept == "" {
+		return offers[0]
+	}
+	ranges := parseAccept(accept)
+	best := ""
+	bestQuality := 0.0
+	for _, offer := range offers {
+		quality := acceptQuality(ranges, offer)
+		if quality > bestQuality {
+			best = offer
+			bestQuality = quality
+		}
+	}
+	return best
+}
+
+// A media range of an Accept header.
+type mediaRange struct {
+	mediaType string
+	subType   string
+	quality   float64
+}
+
+func parseAccept(accept string) []mediaRange {
+	var ranges []mediaRange
+	for _, entry := range strings.Split(accept, ",") {
+		parts := strings.Split(entry, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(parts[0]))
+		types := strings.SplitN(mediaType, "/", 2)
+		if len(types) != 2 {
+			continue
+		}
+		quality := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		ranges = append(ranges, mediaRange{mediaType: types[0], subType: types[1], quality: quality})
+	}
+	return ranges
+}
+
+// The quality of the most specific range matching the content type given, 0 if none matches.
+func acceptQuality(ranges []mediaRange, contentType string) float64 {
+	types := strings.SplitN(strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0])), "/", 2)
+	if len(types) != 2 {
+		return 0
+	}
+	quality := 0.0
+	specificity := -1
+	for _, r := range ranges {
+		var s int
+		switch {
+		case r.mediaType == types[0] && r.subType == types[1]:
+			s = 2
+		case r.mediaType == types[0] && r.subType == "*":
+			s = 1
+		case r.mediaType == "*" && r.subType == "*":
+			s = 0
+		default:
+			continue
+		}
+		if s > specificity {
+			specificity = s
+			quality = r.quality
+		}
+	}
+	return quality
+}
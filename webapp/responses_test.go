@@ -0,0 +1,58 @@
+package webapp
+
+import (
+	"golang.org/x/text/language"
+	"gopkg.in/go-playground/assert.v1"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	assert.Equal(t, CONTENT_TYPE_HTML, Negotiate(req, CONTENT_TYPE_HTML, CONTENT_TYPE_JSON))
+	req.Header.Set("Accept", "*/*")
+	assert.Equal(t, CONTENT_TYPE_HTML, Negotiate(req, CONTENT_TYPE_HTML, CONTENT_TYPE_JSON))
+	req.Header.Set("Accept", "application/json")
+	assert.Equal(t, CONTENT_TYPE_JSON, Negotiate(req, CONTENT_TYPE_HTML, CONTENT_TYPE_JSON))
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	assert.Equal(t, CONTENT_TYPE_HTML, Negotiate(req, CONTENT_TYPE_HTML, CONTENT_TYPE_JSON))
+	req.Header.Set("Accept", "text/html;q=0.5, application/*")
+	assert.Equal(t, CONTENT_TYPE_JSON, Negotiate(req, CONTENT_TYPE_HTML, CONTENT_TYPE_JSON))
+	req.Header.Set("Accept", "image/png")
+	assert.Equal(t, "", Negotiate(req, CONTENT_TYPE_HTML, CONTENT_TYPE_JSON))
+}
+
+func TestWebApplication_WritesResponses(t *testing.T) {
+	app := CreateWebApp("test", "", language.English)
+	app.GetAction("/json", func(context *RequestContext, writer http.ResponseWriter) *ActionResponse {
+		return JsonResponse(http.StatusCreated, map[string]string{"id": "n-1"})
+	})
+	app.GetAction("/redirect", func(context *RequestContext, writer http.ResponseWriter) *ActionResponse {
+		return RedirectResponse(0, "/json")
+	})
+	app.GetAction("/page", func(context *RequestContext, writer http.ResponseWriter) *ActionResponse {
+		return &ActionResponse{NextPage: "_redirect", Model: "/json"}
+	})
+	call := func(path string, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept", accept)
+		recorder := httptest.NewRecorder()
+		app.HandleRequest(recorder, req)
+		return recorder
+	}
+	recorder := call("/json", "")
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Equal(t, CONTENT_TYPE_JSON, recorder.Header().Get("Content-Type"))
+	assert.Equal(t, "{\n  \"id\": \"n-1\"\n}", recorder.Body.String())
+
+	recorder = call("/redirect", "")
+	assert.Equal(t, http.StatusSeeOther, recorder.Code)
+	assert.Equal(t, "/json", recorder.Header().Get("Location"))
+
+	recorder = call("/page", "text/html")
+	assert.Equal(t, CONTENT_TYPE_HTML, recorder.Header().Get("Content-Type"))
+	recorder = call("/page", "application/json")
+	assert.Equal(t, CONTENT_TYPE_JSON, recorder.Header().Get("Content-Type"))
+	assert.Equal(t, "\"/json\"", recorder.Body.String())
+}
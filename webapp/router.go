@@ -0,0 +1,148 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webapp
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Action names are path patterns: a segment {name} matches any single path segment, a final
+// segment {name...} matches the rest of the path, which may be empty. The values matched are
+// available by RequestContext.PathParam. If several patterns match, static segments win over
+// parameters and parameters over wildcards, e.g. /cluster/node/self wins over
+// /cluster/node/{id}.
+
+// The action found for a request.
+type routeMatch struct {
+	// the name of the action, i.e. the pattern matched
+	name   string
+	action *func(req *RequestContext, writer http.ResponseWriter) *ActionResponse
+	params map[string]string
+}
+
+// The methods checked for the Allow header of 405 responses.
+var routeMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete}
+
+// Finds the action of a request. An action named by the query parameter action is preferred over
+// the actions matching the path.
+func (app *WebApplication) matchAction(req *http.Request) *routeMatch {
+	if names, found := req.URL.Query()["action"]; found {
+		if action := app.lookupAction(req.Method, names[0]); action != nil {
+			return &routeMatch{name: names[0], action: action, params: make(map[string]string)}
+		}
+	}
+	return matchRoute(app.actions(req.Method), app.actionPath(req))
+}
+
+// The methods having an action for the path of the request, used for 405 responses.
+func (app *WebApplication) allowedMethods(req *http.Request) []string {
+	var methods []string
+	path := app.actionPath(req)
+	for _, method := range routeMethods {
+		if matchRoute(app.actions(method), path) != nil {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+func (app *WebApplication) actions(method string) map[string]*func(req *RequestContext, writer http.ResponseWriter) *ActionResponse {
+	switch strings.ToUpper(method) {
+	case "PUT":
+		return app.PutActions
+	case "POST":
+		return app.PostActions
+	case "DELETE":
+		return app.DeleteActions
+	case "GET":
+		fallthrough
+	default:
+		return app.GetActions
+	}
+}
+
+// Finds the most specific action matching the path given.
+func matchRoute(actions map[string]*func(req *RequestContext, writer http.ResponseWriter) *ActionResponse, path string) *routeMatch {
+	if action, found := actions[path]; found {
+		return &routeMatch{name: path, action: action, params: make(map[string]string)}
+	}
+	var patterns []string
+	for pattern := range actions {
+		if strings.Contains(pattern, "{") {
+			patterns = append(patterns, pattern)
+		}
+	}
+	// sorted, so equally specific patterns always resolve the same way
+	sort.Strings(patterns)
+	var best *routeMatch
+	var bestRank []int
+	for _, pattern := range patterns {
+		params, rank, ok := matchPattern(pattern, path)
+		if ok && (best == nil || moreSpecific(rank, bestRank)) {
+			best = &routeMatch{name: pattern, action: actions[pattern], params: params}
+			bestRank = rank
+		}
+	}
+	return best
+}
+
+// Matches a path against a pattern. The rank contains a value per segment: 2 for static segments,
+// 1 for parameters and 0 for wildcards.
+func matchPattern(pattern string, path string) (map[string]string, []int, bool) {
+	patternSegments := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	pathSegments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	params := make(map[string]string)
+	var rank []int
+	for i, segment := range patternSegments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "...}") && i == len(patternSegments)-1 {
+			params[segment[1:len(segment)-4]] = strings.Join(pathSegments[min(i, len(pathSegments)):], "/")
+			return params, append(rank, 0), true
+		}
+		if i >= len(pathSegments) {
+			return nil, nil, false
+		}
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if pathSegments[i] == "" {
+				return nil, nil, false
+			}
+			params[segment[1:len(segment)-1]] = pathSegments[i]
+			rank = append(rank, 1)
+		} else if segment == pathSegments[i] {
+			rank = append(rank, 2)
+		} else {
+			return nil, nil, false
+		}
+	}
+	return params, rank, len(patternSegments) == len(pathSegments)
+}
+
+func moreSpecific(rank []int, other []int) bool {
+	for i := 0; i < len(rank) && i < len(other); i++ {
+		if rank[i] != other[i] {
+			return rank[i] > other[i]
+		}
+	}
+	// a longer rank ends with a wildcard matching the empty rest
+	return len(rank) < len(other)
+}
+
+func min(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
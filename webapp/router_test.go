@@ -0,0 +1,55 @@
+package webapp
+
+import (
+	"golang.org/x/text/language"
+	"gopkg.in/go-playground/assert.v1"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatchPattern(t *testing.T) {
+	params, _, ok := matchPattern("/cluster/node/{id}", "/cluster/node/n-1")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "n-1", params["id"])
+	_, _, ok = matchPattern("/cluster/node/{id}", "/cluster/node/")
+	assert.Equal(t, false, ok)
+	_, _, ok = matchPattern("/cluster/node/{id}", "/cluster/node/n-1/ip")
+	assert.Equal(t, false, ok)
+	params, _, ok = matchPattern("/files/{path...}", "/files/a/b.txt")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "a/b.txt", params["path"])
+	params, _, ok = matchPattern("/files/{path...}", "/files")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "", params["path"])
+}
+
+func TestWebApplication_RoutesByPatternAndMethod(t *testing.T) {
+	app := CreateWebApp("test", "/api", language.English)
+	respond := func(body string) func(*RequestContext, http.ResponseWriter) *ActionResponse {
+		return func(context *RequestContext, writer http.ResponseWriter) *ActionResponse {
+			writer.Write([]byte(body + context.PathParam("id") + context.PathParam("rest")))
+			return nil
+		}
+	}
+	app.GetAction("/node/{id}", respond("param:"))
+	app.GetAction("/node/self", respond("static"))
+	app.GetAction("/node/{id}/{rest...}", respond("wildcard:"))
+	app.DeleteAction("/node/{id}", respond("deleted:"))
+	app.RequireRole("DELETE", "/node/{id}", "admin")
+
+	call := func(method string, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		app.HandleRequest(recorder, httptest.NewRequest(method, path, nil))
+		return recorder
+	}
+	assert.Equal(t, "param:n-1", call("GET", "/api/node/n-1").Body.String())
+	assert.Equal(t, "static", call("GET", "/api/node/self").Body.String())
+	assert.Equal(t, "wildcard:n-1a/b", call("GET", "/api/node/n-1/a/b").Body.String())
+	assert.Equal(t, "deleted:n-1", call("DELETE", "/api/node/n-1").Body.String())
+	assert.Equal(t, "admin", app.RequiredRole(httptest.NewRequest("DELETE", "/api/node/n-2", nil)))
+	recorder := call("PUT", "/api/node/n-1")
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+	assert.Equal(t, "GET, DELETE", recorder.Header().Get("Allow"))
+	assert.Equal(t, http.StatusNotFound, call("GET", "/api/unknown").Code)
+}
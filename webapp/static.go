@@ -0,0 +1,45 @@
+// Copyright 2019 Anatole Tresch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webapp
+
+import (
+	"github.com/winkube/util"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+// Serves the files of the asset directory given below the path prefix given, e.g. /static/ from
+// static. Directories are not listed.
+func StaticHandler(prefix string, dir string) http.Handler {
+	return http.StripPrefix(prefix, http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			writer.Header().Set("Allow", "GET, HEAD")
+			http.Error(writer, "Method not allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+		if req.URL.Path == "" || strings.HasSuffix(req.URL.Path, "/") {
+			http.NotFound(writer, req)
+			return
+		}
+		files, err := fs.Sub(util.Assets(), dir)
+		if err != nil {
+			http.NotFound(writer, req)
+			return
+		}
+		writer.Header().Set("Cache-Control", "public, max-age=3600")
+		http.FileServer(http.FS(files)).ServeHTTP(writer, req)
+	}))
+}
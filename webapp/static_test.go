@@ -0,0 +1,37 @@
+package webapp
+
+import (
+	"github.com/winkube/util"
+	"gopkg.in/go-playground/assert.v1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestStaticHandler_ServesOverriddenAssets(t *testing.T) {
+	defer util.UseAssets(os.DirFS("."), "")
+	override, err := ioutil.TempDir("", "winkube-assets")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(override)
+	os.MkdirAll(filepath.Join(override, "static", "css"), 0700)
+	ioutil.WriteFile(filepath.Join(override, "static", "css", "custom.css"), []byte("custom"), 0600)
+	util.UseAssets(fstest.MapFS{
+		"static/css/winkube.css": &fstest.MapFile{Data: []byte("embedded")},
+		"static/css/custom.css":  &fstest.MapFile{Data: []byte("replaced")},
+	}, override)
+
+	handler := StaticHandler("/static/", "static")
+	call := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		return recorder
+	}
+	assert.Equal(t, "embedded", call("/static/css/winkube.css").Body.String())
+	assert.Equal(t, "custom", call("/static/css/custom.css").Body.String())
+	assert.Equal(t, http.StatusNotFound, call("/static/css/").Code)
+	assert.Equal(t, http.StatusNotFound, call("/static/missing.js").Code)
+}